@@ -3,18 +3,33 @@ package aw
 import (
 	"github.com/renproject/aw/dht"
 	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/identity"
 	"github.com/renproject/aw/peer"
 	"github.com/renproject/aw/protocol"
+	"github.com/renproject/aw/pubsub"
 	"github.com/renproject/aw/tcp"
 )
 
 const (
 	V1        = protocol.V1
+	V2        = protocol.V2
 	Ping      = protocol.Ping
 	Pong      = protocol.Pong
 	Cast      = protocol.Cast
 	Multicast = protocol.Multicast
 	Broadcast = protocol.Broadcast
+	Stream    = protocol.Stream
+	Request   = protocol.Request
+	Response  = protocol.Response
+	Publish   = protocol.Publish
+	Gossip    = protocol.Gossip
+	IHave     = protocol.IHave
+	Graft     = protocol.Graft
+	Prune     = protocol.Prune
+	Reliable  = protocol.Reliable
+	Have      = protocol.Have
+	Want      = protocol.Want
+	Ack       = protocol.Ack
 )
 
 type (
@@ -28,12 +43,24 @@ type (
 	MessageSender    = protocol.MessageSender
 	MessageReceiver  = protocol.MessageReceiver
 
+	// Variants
+	VariantDefinition = protocol.VariantDefinition
+	VariantHandler    = peer.Handler
+	VariantNetwork    = peer.Network
+
+	// Publish/subscribe
+	Subscription    = pubsub.Subscription
+	PubSubMessage   = pubsub.Message
+	PubSubValidator = pubsub.Validator
+
 	// Events
-	Event                = protocol.Event
-	EventSender          = protocol.EventSender
-	EventReceiver        = protocol.EventReceiver
-	EventPeerChanged     = protocol.EventPeerChanged
-	EventMessageReceived = protocol.EventMessageReceived
+	Event                  = protocol.Event
+	EventSender            = protocol.EventSender
+	EventReceiver          = protocol.EventReceiver
+	EventPeerChanged       = protocol.EventPeerChanged
+	EventMessageReceived   = protocol.EventMessageReceived
+	EventStreamReceived    = protocol.EventStreamReceived
+	EventReliableDelivered = protocol.EventReliableDelivered
 
 	// Peers
 	Peer             = peer.Peer
@@ -44,6 +71,8 @@ type (
 	PeerAddress      = protocol.PeerAddress
 	PeerAddresses    = protocol.PeerAddresses
 	PeerAddressCodec = protocol.PeerAddressCodec
+	PeerIDCodec      = protocol.PeerIDCodec
+	TCPPeerAddress   = tcp.PeerAddress
 
 	// Network
 	DHT            = dht.DHT
@@ -51,8 +80,11 @@ type (
 	Server         = protocol.Server
 	Session        = protocol.Session
 	SessionManager = protocol.SessionManager
+	Capabilities   = protocol.Capabilities
+	Negotiation    = protocol.Negotiation
 	SignVerifier   = protocol.SignVerifier
 	Handshaker     = handshake.Handshaker
+	TicketStore    = handshake.TicketStore
 
 	// Options
 	TCPConnPoolOptions = tcp.ConnPoolOptions
@@ -62,6 +94,9 @@ type (
 // Default values
 var NilGroupID = protocol.NilGroupID
 
+// Variants
+var RegisterMessageVariant = protocol.RegisterMessageVariant
+
 // Constructors
 var (
 	NewMessage   = protocol.NewMessage
@@ -71,4 +106,12 @@ var (
 	NewConnPool  = tcp.NewConnPool
 	NewTCPClient = tcp.NewClient
 	NewTCPServer = tcp.NewServer
+
+	NewTCPServerWithConnPool = tcp.NewServerWithConnPool
+	NewTCPPeerAddress        = tcp.NewPeerAddress
+	NewTCPPeerAddressCodec   = tcp.NewPeerAddressCodec
+	NewSecp256k1SignVerifier = identity.NewSecp256k1SignVerifier
+	NewSecp256k1PeerIDCodec  = identity.NewSecp256k1PeerIDCodec
+	NewEd25519SignVerifier   = identity.NewEd25519SignVerifier
+	NewEd25519PeerIDCodec    = identity.NewEd25519PeerIDCodec
 )
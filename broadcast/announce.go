@@ -0,0 +1,212 @@
+package broadcast
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/id"
+)
+
+// Mode selects how a Broadcaster propagates a message to the peers selected by
+// its Strategy.
+type Mode string
+
+const (
+	// ModePush sends the whole message to the peers.
+	ModePush = Mode("push")
+
+	// ModeAnnounce sends the ID of the message to the peers in a Have message.
+	// Peers that have not seen the message pull it from one of the peers that
+	// announced it, using a Want message, and announce it in the same way.
+	// It sends much less data than ModePush when messages are large, but it
+	// takes an extra round trip for each hop.
+	ModeAnnounce = Mode("announce")
+)
+
+// pull is a message that has been announced, and is being pulled.
+type pull struct {
+	groupID    protocol.GroupID
+	announcers protocol.PeerIDs // Peers that it has not been pulled from yet
+	deadline   time.Time
+}
+
+// BroadcastWithMode broadcasts a message using the mode, instead of the mode
+// of the group.
+func (broadcaster *broadcaster) BroadcastWithMode(ctx context.Context, groupID protocol.GroupID, body protocol.MessageBody, mode Mode) error {
+	if err := validateMode(mode); err != nil {
+		return err
+	}
+	return broadcaster.broadcast(ctx, groupID, body, mode)
+}
+
+// SetMode sets the mode that is used to broadcast messages to the group.
+func (broadcaster *broadcaster) SetMode(groupID protocol.GroupID, mode Mode) error {
+	if err := validateMode(mode); err != nil {
+		return err
+	}
+
+	broadcaster.mu.Lock()
+	defer broadcaster.mu.Unlock()
+
+	broadcaster.modes[groupID] = mode
+	return nil
+}
+
+// mode returns the mode of the group.
+func (broadcaster *broadcaster) mode(groupID protocol.GroupID) Mode {
+	broadcaster.mu.Lock()
+	defer broadcaster.mu.Unlock()
+
+	if mode, ok := broadcaster.modes[groupID]; ok {
+		return mode
+	}
+	return broadcaster.defaultMode
+}
+
+// announced returns true if the message was announced to this peer, so that
+// it is announced to other peers in the same way. It forgets the pull of the
+// message.
+func (broadcaster *broadcaster) announced(messageID id.Hash) bool {
+	broadcaster.mu.Lock()
+	defer broadcaster.mu.Unlock()
+
+	_, ok := broadcaster.pulls[messageID]
+	delete(broadcaster.pulls, messageID)
+	return ok
+}
+
+// announce a message to the peers, and keep it so that they can pull it. It
+// returns the number of announcements that were sent, and sends their outcomes
+// to the results, if they are not nil.
+func (broadcaster *broadcaster) announce(ctx context.Context, messageID id.Hash, message protocol.Message, addrs protocol.PeerAddresses, results chan<- error) int {
+	broadcaster.mu.Lock()
+	broadcaster.history.insert(time.Now(), messageID, message)
+	broadcaster.mu.Unlock()
+
+	have := protocol.NewMessage(protocol.V1, protocol.Have, message.GroupID, idsBody([]id.Hash{messageID}))
+	return broadcaster.sendToAll(ctx, addrs, have, results)
+}
+
+// acceptHave pulls the announced messages that have not been seen from the
+// peer, unless they are already being pulled from another peer.
+func (broadcaster *broadcaster) acceptHave(ctx context.Context, from protocol.PeerID, message protocol.Message, ids []id.Hash) error {
+	now := time.Now()
+	wanted := []id.Hash{}
+	for _, messageID := range ids {
+		ok, err := broadcaster.seen.Seen(messageID)
+		if err != nil {
+			return newErrBroadcastInternal(fmt.Errorf("error getting message hash=%v: %v", messageID, err))
+		}
+		if ok {
+			continue
+		}
+
+		broadcaster.mu.Lock()
+		if p, ok := broadcaster.pulls[messageID]; ok {
+			p.announcers = append(p.announcers, from)
+			broadcaster.mu.Unlock()
+			continue
+		}
+		broadcaster.pulls[messageID] = &pull{
+			groupID:  message.GroupID,
+			deadline: now.Add(broadcaster.pullTimeout),
+		}
+		broadcaster.mu.Unlock()
+		wanted = append(wanted, messageID)
+	}
+	if len(wanted) == 0 {
+		return nil
+	}
+
+	to, err := broadcaster.dht.PeerAddress(from)
+	if err != nil {
+		return err
+	}
+	broadcaster.sendToAll(ctx, protocol.PeerAddresses{to}, protocol.NewMessage(protocol.V1, protocol.Want, message.GroupID, idsBody(wanted)), nil)
+	return nil
+}
+
+// acceptWant sends the wanted messages to the peer, if they are still kept.
+func (broadcaster *broadcaster) acceptWant(ctx context.Context, from protocol.PeerID, ids []id.Hash) error {
+	broadcaster.mu.Lock()
+	messages := make([]protocol.Message, 0, len(ids))
+	for _, messageID := range ids {
+		if message, ok := broadcaster.history.get(messageID); ok {
+			messages = append(messages, message)
+		}
+	}
+	broadcaster.mu.Unlock()
+	if len(messages) == 0 {
+		return nil
+	}
+
+	to, err := broadcaster.dht.PeerAddress(from)
+	if err != nil {
+		return err
+	}
+	for _, message := range messages {
+		broadcaster.sendToAll(ctx, protocol.PeerAddresses{to}, message, nil)
+	}
+	return nil
+}
+
+// retryPulls pulls the messages that have not been received within the
+// PullTimeout from the next peer that announced them. Messages are forgotten
+// when there are no more peers to pull them from.
+func (broadcaster *broadcaster) retryPulls(ctx context.Context) {
+	now := time.Now()
+	wants := []protocol.MessageOnTheWire{}
+
+	broadcaster.mu.Lock()
+	broadcaster.history.expire(now)
+	for messageID, p := range broadcaster.pulls {
+		if now.Before(p.deadline) {
+			continue
+		}
+		if len(p.announcers) == 0 {
+			delete(broadcaster.pulls, messageID)
+			continue
+		}
+		announcer := p.announcers[0]
+		p.announcers = p.announcers[1:]
+		p.deadline = now.Add(broadcaster.pullTimeout)
+
+		to, err := broadcaster.dht.PeerAddress(announcer)
+		if err != nil {
+			broadcaster.logger.Debugf("error pulling message hash=%v from %v: %v", messageID, announcer, err)
+			continue
+		}
+		wants = append(wants, protocol.MessageOnTheWire{
+			To:      to,
+			Message: protocol.NewMessage(protocol.V1, protocol.Want, p.groupID, idsBody([]id.Hash{messageID})),
+		})
+	}
+	broadcaster.mu.Unlock()
+
+	for _, want := range wants {
+		broadcaster.sendToAll(ctx, protocol.PeerAddresses{want.To}, want.Message, nil)
+	}
+}
+
+// decodeIDs returns the IDs in the body of a Have or Want message.
+func decodeIDs(message protocol.Message) ([]id.Hash, error) {
+	if len(message.Body) == 0 || len(message.Body)%len(id.Hash{}) != 0 {
+		return nil, fmt.Errorf("error accepting %v: malformed body of len=%v", message.Variant, len(message.Body))
+	}
+	ids := make([]id.Hash, len(message.Body)/len(id.Hash{}))
+	for i := range ids {
+		copy(ids[i][:], message.Body[i*len(id.Hash{}):])
+	}
+	return ids, nil
+}
+
+func validateMode(mode Mode) error {
+	switch mode {
+	case ModePush, ModeAnnounce:
+		return nil
+	default:
+		return fmt.Errorf("unsupported broadcast mode=%v", mode)
+	}
+}
@@ -0,0 +1,119 @@
+package broadcast_test
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/broadcast"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/protocol"
+)
+
+var _ = Describe("Modes", func() {
+
+	withMode := func(mode Mode) func(protocol.MessageSender, dht.DHT) Options {
+		return func(_ protocol.MessageSender, _ dht.DHT) Options {
+			return Options{Mode: mode, PullTimeout: 200 * time.Millisecond}
+		}
+	}
+
+	// receive expects every peer except the first one to receive exactly one
+	// message.
+	receive := func(events []chan protocol.Event) {
+		for i := 1; i < len(events); i++ {
+			Eventually(events[i], 5*time.Second).Should(Receive())
+			Consistently(events[i], 10*time.Millisecond).ShouldNot(Receive())
+		}
+	}
+
+	Context("when announcing messages", func() {
+		It("should pull each message once instead of pushing it to every peer", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			n := 8
+			broadcasters, events, groupID, sent := network(ctx, n, withMode(ModeAnnounce), nil)
+
+			Expect(broadcasters[0].Broadcast(ctx, groupID, RandomMessageBody())).To(Succeed())
+			receive(events)
+			Consistently(func() int64 { return atomic.LoadInt64(sent) }, 100*time.Millisecond).Should(Equal(int64(n - 1)))
+		})
+
+		It("should announce messages that are broadcast with the mode", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			n := 8
+			broadcasters, events, groupID, sent := network(ctx, n, withMode(ModePush), nil)
+
+			Expect(broadcasters[0].BroadcastWithMode(ctx, groupID, RandomMessageBody(), ModeAnnounce)).To(Succeed())
+			receive(events)
+			Consistently(func() int64 { return atomic.LoadInt64(sent) }, 100*time.Millisecond).Should(Equal(int64(n - 1)))
+
+			// Messages are pushed when they are broadcast without the mode.
+			atomic.StoreInt64(sent, 0)
+			Expect(broadcasters[0].Broadcast(ctx, groupID, RandomMessageBody())).To(Succeed())
+			receive(events)
+			Eventually(func() int64 { return atomic.LoadInt64(sent) }).Should(Equal(int64(n * n)))
+		})
+
+		It("should announce messages to groups with the mode", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			n := 8
+			broadcasters, events, groupID, sent := network(ctx, n, withMode(ModePush), nil)
+			for _, broadcaster := range broadcasters {
+				Expect(broadcaster.SetMode(groupID, ModeAnnounce)).To(Succeed())
+			}
+
+			Expect(broadcasters[0].Broadcast(ctx, groupID, RandomMessageBody())).To(Succeed())
+			receive(events)
+			Consistently(func() int64 { return atomic.LoadInt64(sent) }, 100*time.Millisecond).Should(Equal(int64(n - 1)))
+		})
+
+		It("should pull messages from other peers when a pull times out", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Drop the first message that is pulled by peer 1.
+			dropped := int32(0)
+			filter := func(to int, message protocol.Message) bool {
+				if to != 1 || message.Variant != protocol.Broadcast {
+					return true
+				}
+				return !atomic.CompareAndSwapInt32(&dropped, 0, 1)
+			}
+			broadcasters, events, groupID, _ := network(ctx, 8, withMode(ModeAnnounce), filter)
+
+			Expect(broadcasters[0].Broadcast(ctx, groupID, RandomMessageBody())).To(Succeed())
+			receive(events)
+			Expect(atomic.LoadInt32(&dropped)).Should(Equal(int32(1)))
+		})
+	})
+
+	Context("when using invalid modes", func() {
+		It("should return an error", func() {
+			broadcaster := NewBroadcasterWithOptions(Options{}, nil, nil, NewDHT(RandomAddress(), NewTable("dht"), nil))
+			Expect(broadcaster.BroadcastWithMode(context.Background(), RandomGroupID(), RandomMessageBody(), Mode("bogus"))).NotTo(Succeed())
+			Expect(broadcaster.SetMode(RandomGroupID(), Mode("bogus"))).NotTo(Succeed())
+			Expect(func() {
+				NewBroadcasterWithOptions(Options{Mode: Mode("bogus")}, nil, nil, NewDHT(RandomAddress(), NewTable("dht"), nil))
+			}).To(Panic())
+		})
+	})
+
+	Context("when accepting malformed announcements", func() {
+		It("should return an error", func() {
+			broadcaster := NewBroadcasterWithOptions(Options{}, nil, nil, NewDHT(RandomAddress(), NewTable("dht"), nil))
+			for _, variant := range []protocol.MessageVariant{protocol.Have, protocol.Want} {
+				for _, body := range [][]byte{{}, {1, 2, 3}} {
+					message := protocol.NewMessage(protocol.V1, variant, RandomGroupID(), body)
+					Expect(broadcaster.AcceptControl(context.Background(), RandomPeerID(), message)).NotTo(Succeed())
+				}
+			}
+		})
+	})
+})
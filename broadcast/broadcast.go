@@ -3,12 +3,14 @@ package broadcast
 import (
 	"context"
 	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/renproject/aw/dht"
 	"github.com/renproject/aw/protocol"
 	"github.com/renproject/id"
-	"github.com/renproject/kv"
 	"github.com/sirupsen/logrus"
 )
 
@@ -19,54 +21,206 @@ import (
 // In V1, when a Broadcaster accepts a message it will hash it and check to see
 // if it has seen this hash before. If the hash has been seen, nothing happens.
 // If the hash has not been seen, the Broadcaster emits and event and propagates
-// the message to all known peers.
+// the message to the peers selected by its Strategy, using the Mode of its
+// group.
 type Broadcaster interface {
-	// Broadcast a message to all peers in the network.
+	// Broadcast a message to all peers in the network. If the Broadcaster
+	// waits for results, it waits until the message has been sent to the
+	// peers selected by the Strategy, and returns an ErrBroadcasting if it
+	// cannot be sent to some of them before the context is done.
 	Broadcast(ctx context.Context, groupID protocol.GroupID, body protocol.MessageBody) error
 
+	// BroadcastWithMode broadcasts a message to all peers in the network,
+	// using the Mode instead of the Mode of the group. Peers that receive the
+	// message propagate it using the same Mode, if it is ModeAnnounce.
+	BroadcastWithMode(ctx context.Context, groupID protocol.GroupID, body protocol.MessageBody, mode Mode) error
+
+	// SetMode sets the Mode that is used to propagate the messages of the
+	// group.
+	SetMode(groupID protocol.GroupID, mode Mode) error
+
 	// AcceptBroadcast message from another peer in the network.
 	AcceptBroadcast(ctx context.Context, from protocol.PeerID, message protocol.Message) error
+
+	// AcceptControl message from another peer in the network. Have and Want
+	// messages are handled by the Broadcaster, and other messages are passed
+	// to the Strategy.
+	AcceptControl(ctx context.Context, from protocol.PeerID, message protocol.Message) error
+
+	// Run the Strategy, and retry pulling announced messages, until the
+	// context is done.
+	Run(ctx context.Context)
+}
+
+// Options are used to parameterise the behaviour of a Broadcaster.
+type Options struct {
+	Logger     logrus.FieldLogger
+	NumWorkers int
+
+	// Variant of the messages that are broadcast and accepted. Defaults to
+	// protocol.Broadcast. Other variants must carry a GroupID.
+	Variant protocol.MessageVariant
+
+	// Validate is called for every message that is accepted for the first
+	// time. Messages that fail validation are not emitted and not propagated
+	// to other peers. Defaults to accepting all messages.
+	Validate func(from protocol.PeerID, message protocol.Message) error
+
+	// SeenCache remembers the messages that have been seen. Defaults to a
+	// SeenCache with the default SeenCacheOptions.
+	SeenCache SeenCache
+
+	// Strategy selects the peers that messages are propagated to. Defaults to
+	// the Strategy returned by NewFloodStrategy.
+	Strategy Strategy
+
+	// Mode is used to propagate the messages of groups that do not have their
+	// own Mode. Defaults to ModePush.
+	Mode Mode
+
+	// PullTimeout is how long to wait for a message that has been pulled from
+	// a peer that announced it, before pulling it from the next peer that
+	// announced it. Defaults to 1 second.
+	PullTimeout time.Duration
+
+	// AnnounceHistory is how long announced messages are kept so that they
+	// can be pulled by other peers. At most AnnounceCapacity messages are
+	// kept. Defaults to 1 minute, and 1024 messages.
+	AnnounceHistory  time.Duration
+	AnnounceCapacity int
+
+	// WaitForResults makes Broadcast wait for the Results of its messages. It
+	// must only be set when the consumer of the messages reports the Result of
+	// every message (as the tcp.Client does), otherwise Broadcast blocks until
+	// its context is done. Defaults to false.
+	WaitForResults bool
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.Logger == nil {
+		options.Logger = logrus.New()
+	}
+	if options.NumWorkers <= 0 {
+		options.NumWorkers = 2 * runtime.NumCPU()
+	}
+	if options.Variant == 0 {
+		options.Variant = protocol.Broadcast
+	}
+	if options.Validate == nil {
+		options.Validate = func(protocol.PeerID, protocol.Message) error { return nil }
+	}
+	if options.SeenCache == nil {
+		seen, err := NewSeenCache(SeenCacheOptions{})
+		if err != nil {
+			panic(fmt.Errorf("invariant violation: cannot create seen cache: %v", err))
+		}
+		options.SeenCache = seen
+	}
+	if options.Mode == "" {
+		options.Mode = ModePush
+	}
+	if options.PullTimeout <= 0 {
+		options.PullTimeout = time.Second
+	}
+	if options.AnnounceHistory <= 0 {
+		options.AnnounceHistory = time.Minute
+	}
+	if options.AnnounceCapacity <= 0 {
+		options.AnnounceCapacity = 1024
+	}
 }
 
 type broadcaster struct {
 	logger     logrus.FieldLogger
 	numWorkers int
-	store      kv.Table
+	variant    protocol.MessageVariant
+	validate   func(from protocol.PeerID, message protocol.Message) error
+	seen       SeenCache
+	strategy   Strategy
 	messages   protocol.MessageSender
 	events     protocol.EventSender
 	dht        dht.DHT
+
+	defaultMode    Mode
+	pullTimeout    time.Duration
+	waitForResults bool
+
+	mu      *sync.Mutex
+	modes   map[protocol.GroupID]Mode
+	pulls   map[id.Hash]*pull
+	history *history // Announced messages that can be pulled
 }
 
 // NewBroadcaster returns a Broadcaster that will use the given Storage
 // interface and DHT interface for storing messages and peer addresses
 // respectively.
 func NewBroadcaster(logger logrus.FieldLogger, numWorkers int, messages protocol.MessageSender, events protocol.EventSender, dht dht.DHT) Broadcaster {
-	store := kv.NewTable(kv.NewMemDB(kv.GobCodec), "broadcaster")
+	return NewBroadcasterWithOptions(Options{Logger: logger, NumWorkers: numWorkers}, messages, events, dht)
+}
+
+// NewBroadcasterWithOptions returns a Broadcaster that broadcasts messages of
+// the variant in the Options, and only emits and propagates messages that pass
+// the validation in the Options.
+func NewBroadcasterWithOptions(options Options, messages protocol.MessageSender, events protocol.EventSender, dht dht.DHT) Broadcaster {
+	options.setZerosToDefaults()
+	if !options.Variant.HasGroupID() {
+		panic(fmt.Sprintf("invariant violation: broadcast variant=%d must have a group id", options.Variant))
+	}
+	if err := validateMode(options.Mode); err != nil {
+		panic(fmt.Errorf("invariant violation: %v", err))
+	}
+	if options.Strategy == nil {
+		options.Strategy = NewFloodStrategy(dht)
+	}
 	return &broadcaster{
-		logger:     logger,
-		numWorkers: numWorkers,
-		store:      store,
+		logger:     options.Logger,
+		numWorkers: options.NumWorkers,
+		variant:    options.Variant,
+		validate:   options.Validate,
+		seen:       options.SeenCache,
+		strategy:   options.Strategy,
 		messages:   messages,
 		events:     events,
 		dht:        dht,
+
+		defaultMode:    options.Mode,
+		pullTimeout:    options.PullTimeout,
+		waitForResults: options.WaitForResults,
+
+		mu:      new(sync.Mutex),
+		modes:   map[protocol.GroupID]Mode{},
+		pulls:   map[id.Hash]*pull{},
+		history: newHistory(options.AnnounceHistory, options.AnnounceCapacity),
 	}
 }
 
 // Broadcast a message to multiple remote servers in an attempt to saturate the
 // network.
 func (broadcaster *broadcaster) Broadcast(ctx context.Context, groupID protocol.GroupID, body protocol.MessageBody) error {
+	return broadcaster.broadcast(ctx, groupID, body, broadcaster.mode(groupID))
+}
+
+func (broadcaster *broadcaster) broadcast(ctx context.Context, groupID protocol.GroupID, body protocol.MessageBody, mode Mode) error {
 	// Ignore message if it already been sent.
-	message := protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, body)
-	ok, err := broadcaster.messageHashAlreadySeen(message.Hash())
+	message := protocol.NewMessage(protocol.V1, broadcaster.variant, groupID, body)
+	messageID := messageID(message)
+	ok, err := broadcaster.seen.Seen(messageID)
 	if err != nil {
-		return newErrBroadcastInternal(fmt.Errorf("error getting message hash=%v: %v", message.Hash(), err))
+		return newErrBroadcastInternal(fmt.Errorf("error getting message hash=%v: %v", messageID, err))
 	}
 	if ok {
 		return nil
 	}
+	return broadcaster.propagate(ctx, nil, messageID, message, mode)
+}
+
+// propagate a message that has not been seen to the peers selected by the
+// Strategy, using the Mode.
+func (broadcaster *broadcaster) propagate(ctx context.Context, from protocol.PeerID, messageID id.Hash, message protocol.Message, mode Mode) error {
+	groupID := message.GroupID
 
-	// Get all addresses in the group with the given ID.
-	addrs, err := broadcaster.dht.GroupAddresses(groupID)
+	// Get the addresses that the Strategy selects from the group.
+	message, addrs, err := broadcaster.strategy.Targets(from, message)
 	if err != nil {
 		return err
 	}
@@ -80,47 +234,94 @@ func (broadcaster *broadcaster) Broadcast(ctx context.Context, groupID protocol.
 
 	// Insert the message to cache to prevent getting a broadcast back of the same message before
 	// finish broadcasting.
-	if err := broadcaster.store.Insert(message.Hash().String(), true); err != nil {
+	if err := broadcaster.seen.Insert(messageID); err != nil {
 		return err
 	}
 
+	// Wait for messages that are broadcast by this peer to be sent, so that
+	// errors are returned to the caller.
+	var results chan error
+	if from == nil && broadcaster.waitForResults {
+		results = make(chan error, len(addrs))
+	}
+	sent := 0
+	if mode == ModeAnnounce {
+		sent = broadcaster.announce(ctx, messageID, message, addrs, results)
+	} else {
+		sent = broadcaster.sendToAll(ctx, addrs, message, results)
+	}
+	if results == nil {
+		return nil
+	}
+	errs := protocol.WaitForResults(ctx, results, sent)
+	if err := ctx.Err(); err != nil {
+		return newErrBroadcasting(err, groupID)
+	}
+	if len(errs) > 0 {
+		return newErrBroadcasting(fmt.Errorf("%v of %v messages not delivered: %v", len(errs), len(addrs), errs), groupID)
+	}
+	return nil
+}
+
+// sendToAll sends a message to all of the addresses, and returns the number
+// of messages that were sent. The outcome of each message is sent to the
+// results, if they are not nil.
+func (broadcaster *broadcaster) sendToAll(ctx context.Context, addrs protocol.PeerAddresses, message protocol.Message, results chan<- error) int {
+	sent := int64(0)
+	deadline, _ := ctx.Deadline()
 	protocol.ParForAllAddresses(addrs, broadcaster.numWorkers, func(to protocol.PeerAddress) {
 		if to == nil {
 			return
 		}
 		messageWire := protocol.MessageOnTheWire{
-			To:      to,
-			Message: message,
+			To:       to,
+			Message:  message,
+			Result:   results,
+			Deadline: deadline,
 		}
 
 		select {
 		case <-ctx.Done():
 			broadcaster.logger.Debugf("cannot send message to %v, %v", to.PeerID(), ctx.Err())
 		case broadcaster.messages <- messageWire:
+			atomic.AddInt64(&sent, 1)
 		}
 	})
-
-	return nil
+	return int(sent)
 }
 
 // AcceptBroadcast from a remote client and propagate it to all peers in the
 // network.
 func (broadcaster *broadcaster) AcceptBroadcast(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
 	// Pre-condition checks
-	if message.Version != protocol.V1 {
-		return protocol.NewErrMessageVersionIsNotSupported(message.Version)
+	if err := protocol.ValidateMessageVersion(message.Version); err != nil {
+		return err
 	}
-	if message.Variant != protocol.Broadcast {
+	if message.Variant != broadcaster.variant {
 		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
 	}
 
 	// Ignore messages that have already been seen
-	messageHash := message.Hash()
-	ok, err := broadcaster.messageHashAlreadySeen(messageHash)
+	messageHash := messageID(message)
+	ok, err := broadcaster.seen.Seen(messageHash)
 	if err != nil {
 		return newErrBroadcastInternal(fmt.Errorf("error getting message hash=%v: %v", messageHash, err))
 	}
 	if ok {
+		if handler, ok := broadcaster.strategy.(DuplicateHandler); ok {
+			handler.HandleDuplicate(ctx, from, message)
+		}
+		return nil
+	}
+
+	// Drop messages that fail validation, and remember them so that they are
+	// not validated again.
+	if err := broadcaster.validate(from, message); err != nil {
+		broadcaster.logger.Debugf("rejected broadcast from %v: %v", from, err)
+		broadcaster.announced(messageHash)
+		if err := broadcaster.seen.Insert(messageHash); err != nil {
+			return newErrBroadcastInternal(fmt.Errorf("error inserting message hash=%v: %v", messageHash, err))
+		}
 		return nil
 	}
 
@@ -144,18 +345,49 @@ func (broadcaster *broadcaster) AcceptBroadcast(ctx context.Context, from protoc
 	case broadcaster.events <- event:
 	}
 
-	// Re-broadcasting the message will downgrade its version to the version
-	// supported by this broadcaster
-	return broadcaster.Broadcast(ctx, message.GroupID, message.Body)
+	// Messages that were announced to this peer are announced to other peers.
+	mode := broadcaster.mode(message.GroupID)
+	if broadcaster.announced(messageHash) {
+		mode = ModeAnnounce
+	}
+	return broadcaster.propagate(ctx, from, messageHash, message, mode)
 }
 
-func (broadcaster *broadcaster) messageHashAlreadySeen(hash id.Hash) (bool, error) {
-	var exists bool
-	err := broadcaster.store.Get(hash.String(), &exists)
-	if err == kv.ErrKeyNotFound {
-		return false, nil
+func (broadcaster *broadcaster) AcceptControl(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	switch message.Variant {
+	case protocol.Have, protocol.Want:
+		// Pre-condition checks
+		if err := protocol.ValidateMessageVersion(message.Version); err != nil {
+			return err
+		}
+		ids, err := decodeIDs(message)
+		if err != nil {
+			return err
+		}
+		if message.Variant == protocol.Have {
+			return broadcaster.acceptHave(ctx, from, message, ids)
+		}
+		return broadcaster.acceptWant(ctx, from, ids)
+
+	default:
+		return broadcaster.strategy.AcceptControl(ctx, from, message)
+	}
+}
+
+func (broadcaster *broadcaster) Run(ctx context.Context) {
+	go broadcaster.strategy.Run(ctx)
+
+	ticker := time.NewTicker(broadcaster.pullTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			broadcaster.retryPulls(ctx)
+		}
 	}
-	return exists, err
 }
 
 // ErrBroadcastInternal is returned when there is an internal broadcasting
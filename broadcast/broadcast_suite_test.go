@@ -1,13 +1,80 @@
 package broadcast_test
 
 import (
+	"context"
+	"sync/atomic"
 	"testing"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/broadcast"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/protocol"
 )
 
 func TestBroadcast(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Broadcast Suite")
 }
+
+// network returns n Broadcasters in the same group that are connected to each
+// other, and the number of broadcast messages that have been sent. Messages
+// are dropped if the filter returns false.
+func network(ctx context.Context, n int, options func(protocol.MessageSender, dht.DHT) Options, filter func(to int, message protocol.Message) bool) ([]Broadcaster, []chan protocol.Event, protocol.GroupID, *int64) {
+	addrs := make(protocol.PeerAddresses, n)
+	ids := make(protocol.PeerIDs, n)
+	for i := range addrs {
+		addrs[i] = RandomAddress()
+		ids[i] = addrs[i].PeerID()
+	}
+	groupID := RandomGroupID()
+
+	broadcasters := make([]Broadcaster, n)
+	events := make([]chan protocol.Event, n)
+	messages := make([]chan protocol.MessageOnTheWire, n)
+	for i := range broadcasters {
+		dht := NewDHT(addrs[i], NewTable("dht"), nil)
+		for j := range addrs {
+			if i != j {
+				Expect(dht.AddPeerAddress(addrs[j])).To(Succeed())
+			}
+		}
+		Expect(dht.AddGroup(groupID, ids)).To(Succeed())
+		messages[i] = make(chan protocol.MessageOnTheWire, 1024)
+		events[i] = make(chan protocol.Event, 1024)
+		broadcasters[i] = NewBroadcasterWithOptions(options(messages[i], dht), messages[i], events[i], dht)
+	}
+
+	sent := new(int64)
+	forward := func(i int) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message := <-messages[i]:
+				for j := range ids {
+					if !ids[j].Equal(message.To.PeerID()) {
+						continue
+					}
+					if filter != nil && !filter(j, message.Message) {
+						continue
+					}
+					switch message.Message.Variant {
+					case protocol.Broadcast:
+						atomic.AddInt64(sent, 1)
+						broadcasters[j].AcceptBroadcast(ctx, ids[i], message.Message)
+					default:
+						broadcasters[j].AcceptControl(ctx, ids[i], message.Message)
+					}
+				}
+			}
+		}
+	}
+	for i := range broadcasters {
+		go broadcasters[i].Run(ctx)
+		go forward(i)
+	}
+	return broadcasters, events, groupID, sent
+}
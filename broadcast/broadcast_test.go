@@ -3,6 +3,7 @@ package broadcast_test
 import (
 	"bytes"
 	"context"
+	"errors"
 	"testing/quick"
 
 	. "github.com/onsi/ginkgo"
@@ -77,6 +78,33 @@ var _ = Describe("Broadcaster", func() {
 			Expect(quick.Check(check, nil)).Should(BeNil())
 		})
 
+		Context("when waiting for results", func() {
+			It("should return ErrBroadcasting if the message cannot be sent to some peers", func() {
+				messages := make(chan protocol.MessageOnTheWire, 128)
+				events := make(chan protocol.Event, 1)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				broadcaster := NewBroadcasterWithOptions(Options{WaitForResults: true}, messages, events, dht)
+
+				groupID, addrs, err := NewGroup(dht)
+				Expect(err).NotTo(HaveOccurred())
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go func() {
+					for i := 0; i < len(addrs); i++ {
+						message := <-messages
+						if i == 0 {
+							message.ReportResult(protocol.NewErrMessageNotDelivered(message.To.PeerID(), errors.New("unreachable")))
+							continue
+						}
+						message.ReportResult(nil)
+					}
+				}()
+				err = broadcaster.Broadcast(ctx, groupID, RandomMessageBody())
+				Expect(err).Should(BeAssignableToTypeOf(ErrBroadcasting{}))
+			})
+		})
+
 		Context("when the context is cancelled", func() {
 			It("should return ErrBroadcasting", func() {
 				check := func(messageBody []byte) bool {
@@ -269,4 +297,72 @@ var _ = Describe("Broadcaster", func() {
 			})
 		})
 	})
+	Context("when using options", func() {
+		It("should broadcast and accept messages of the variant", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			broadcaster := NewBroadcasterWithOptions(Options{Variant: protocol.Publish}, messages, events, dht)
+
+			groupID, addrs, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			Expect(broadcaster.Broadcast(ctx, groupID, RandomMessageBody())).NotTo(HaveOccurred())
+			for range addrs {
+				var message protocol.MessageOnTheWire
+				Eventually(messages).Should(Receive(&message))
+				Expect(message.Message.Variant).Should(Equal(protocol.Publish))
+			}
+
+			message := protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, RandomMessageBody())
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(HaveOccurred())
+			message = protocol.NewMessage(protocol.V1, protocol.Publish, groupID, RandomMessageBody())
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).NotTo(HaveOccurred())
+			Eventually(events).Should(Receive())
+		})
+
+		It("should panic for variants without a group id", func() {
+			Expect(func() {
+				NewBroadcasterWithOptions(Options{Variant: protocol.Cast}, nil, nil, nil)
+			}).To(Panic())
+		})
+
+		It("should not emit or propagate messages that fail validation", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			validated := 0
+			broadcaster := NewBroadcasterWithOptions(Options{
+				Validate: func(from protocol.PeerID, message protocol.Message) error {
+					validated++
+					if bytes.HasPrefix(message.Body, []byte("bad")) {
+						return errors.New("bad message")
+					}
+					return nil
+				},
+			}, messages, events, dht)
+
+			groupID, addrs, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			message := protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, []byte("bad message"))
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).NotTo(HaveOccurred())
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).NotTo(HaveOccurred())
+			Expect(validated).Should(Equal(1))
+			Expect(events).ShouldNot(Receive())
+			Expect(messages).ShouldNot(Receive())
+
+			message = protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, []byte("good message"))
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).NotTo(HaveOccurred())
+			Expect(validated).Should(Equal(2))
+			Eventually(events).Should(Receive())
+			for range addrs {
+				Eventually(messages).Should(Receive())
+			}
+		})
+	})
 })
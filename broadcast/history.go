@@ -0,0 +1,75 @@
+package broadcast
+
+import (
+	"time"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/id"
+)
+
+// history keeps the messages that have been seen recently, so that they can be
+// sent to peers that have missed them. It is not safe for concurrent use.
+type history struct {
+	duration time.Duration
+	capacity int
+
+	recent []recentMessage // In the order that they were seen
+	byID   map[id.Hash]protocol.Message
+}
+
+type recentMessage struct {
+	id   id.Hash
+	seen time.Time
+}
+
+// newHistory returns a history that keeps messages for the duration, and
+// keeps at most the capacity of messages.
+func newHistory(duration time.Duration, capacity int) *history {
+	return &history{
+		duration: duration,
+		capacity: capacity,
+		recent:   []recentMessage{},
+		byID:     map[id.Hash]protocol.Message{},
+	}
+}
+
+// insert a message, and return false if it was already in the history.
+func (history *history) insert(now time.Time, messageID id.Hash, message protocol.Message) bool {
+	if _, ok := history.byID[messageID]; ok {
+		return false
+	}
+	history.recent = append(history.recent, recentMessage{id: messageID, seen: now})
+	history.byID[messageID] = message
+	history.expire(now)
+	return true
+}
+
+// get the message with the ID, if it is in the history.
+func (history *history) get(messageID id.Hash) (protocol.Message, bool) {
+	message, ok := history.byID[messageID]
+	return message, ok
+}
+
+// groups returns the IDs of the messages in the history, by group.
+func (history *history) groups() map[protocol.GroupID][]id.Hash {
+	groups := map[protocol.GroupID][]id.Hash{}
+	for _, recent := range history.recent {
+		groupID := history.byID[recent.id].GroupID
+		groups[groupID] = append(groups[groupID], recent.id)
+	}
+	return groups
+}
+
+// expire the messages that are older than the duration, and the oldest
+// messages when there are more than the capacity.
+func (history *history) expire(now time.Time) {
+	n := 0
+	for n < len(history.recent) {
+		if now.Sub(history.recent[n].seen) < history.duration && len(history.recent)-n <= history.capacity {
+			break
+		}
+		delete(history.byID, history.recent[n].id)
+		n++
+	}
+	history.recent = history.recent[n:]
+}
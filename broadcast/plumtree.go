@@ -0,0 +1,366 @@
+package broadcast
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/id"
+	"github.com/sirupsen/logrus"
+)
+
+// PlumtreeOptions are used to parameterise the behaviour of the Plumtree
+// Strategy.
+type PlumtreeOptions struct {
+	// Fanout is the number of random peers in each group that messages are
+	// eagerly pushed to, before the tree has been pruned. Defaults to 4.
+	Fanout int `json:"fanout"`
+
+	// LazyInterval is how often the IDs of new messages are announced to the
+	// lazy peers in each group. Defaults to 100 milliseconds.
+	LazyInterval time.Duration `json:"lazyInterval"`
+
+	// Timeout is how long to wait for a message after it has been announced,
+	// before grafting the peer that announced it. GraftTimeout is how long to
+	// wait for a message after grafting a peer, before grafting the next peer
+	// that announced it. Defaults to 1 second, and half of the Timeout.
+	Timeout      time.Duration `json:"timeout"`
+	GraftTimeout time.Duration `json:"graftTimeout"`
+
+	// History is how long messages are kept so that they can be sent to peers
+	// that graft them. At most Capacity messages are kept. Defaults to 1
+	// minute, and 1024 messages.
+	History  time.Duration `json:"history"`
+	Capacity int           `json:"capacity"`
+}
+
+func (options *PlumtreeOptions) setZerosToDefaults() {
+	if options.Fanout <= 0 {
+		options.Fanout = 4
+	}
+	if options.LazyInterval <= 0 {
+		options.LazyInterval = 100 * time.Millisecond
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = time.Second
+	}
+	if options.GraftTimeout <= 0 {
+		options.GraftTimeout = options.Timeout / 2
+	}
+	if options.History <= 0 {
+		options.History = time.Minute
+	}
+	if options.Capacity <= 0 {
+		options.Capacity = 1024
+	}
+}
+
+// plumtreeGroup is the view that a peer has of a group. Members that are not
+// eager are lazy.
+type plumtreeGroup struct {
+	members map[string]protocol.PeerAddress
+	eager   map[string]bool
+
+	// announce are the IDs of the messages that have not been announced to
+	// the lazy members yet.
+	announce []id.Hash
+}
+
+// missingMessage is a message that has been announced, but not received.
+type missingMessage struct {
+	groupID    protocol.GroupID
+	announcers protocol.PeerIDs // Peers that have not been grafted yet
+	deadline   time.Time
+}
+
+type plumtreeStrategy struct {
+	options  PlumtreeOptions
+	logger   logrus.FieldLogger
+	messages protocol.MessageSender
+	dht      dht.DHT
+
+	mu      *sync.Mutex
+	groups  map[protocol.GroupID]*plumtreeGroup
+	history *history
+	missing map[id.Hash]*missingMessage
+}
+
+// NewPlumtreeStrategy returns a Strategy that eagerly pushes messages along a
+// spanning tree of each group, and lazily announces the IDs of messages to
+// the other members of the group. The tree starts as a random fanout of
+// members. Members that push duplicate messages are pruned from the tree,
+// and members that announce messages that are not received within the
+// timeout are grafted onto the tree. Control messages are sent through the
+// MessageSender.
+func NewPlumtreeStrategy(options PlumtreeOptions, logger logrus.FieldLogger, messages protocol.MessageSender, dht dht.DHT) Strategy {
+	options.setZerosToDefaults()
+	if logger == nil {
+		logger = logrus.New()
+	}
+	return &plumtreeStrategy{
+		options:  options,
+		logger:   logger,
+		messages: messages,
+		dht:      dht,
+
+		mu:      new(sync.Mutex),
+		groups:  map[protocol.GroupID]*plumtreeGroup{},
+		history: newHistory(options.History, options.Capacity),
+		missing: map[id.Hash]*missingMessage{},
+	}
+}
+
+func (strategy *plumtreeStrategy) Targets(from protocol.PeerID, message protocol.Message) (protocol.Message, protocol.PeerAddresses, error) {
+	strategy.mu.Lock()
+	defer strategy.mu.Unlock()
+
+	group, err := strategy.groupWithoutLock(message.GroupID)
+	if err != nil {
+		return protocol.Message{}, nil, err
+	}
+
+	// The peer that pushed the message is on the tree.
+	if from != nil {
+		if _, ok := group.members[from.String()]; ok {
+			group.eager[from.String()] = true
+		}
+	}
+
+	forward := protocol.NewMessage(protocol.V1, message.Variant, message.GroupID, message.Body)
+	messageID := messageID(forward)
+	strategy.history.insert(time.Now(), messageID, forward)
+	delete(strategy.missing, messageID)
+	group.announce = append(group.announce, messageID)
+
+	targets := make(protocol.PeerAddresses, 0, len(group.eager))
+	for peerID := range group.eager {
+		if from != nil && peerID == from.String() {
+			continue
+		}
+		targets = append(targets, group.members[peerID])
+	}
+	return forward, targets, nil
+}
+
+// HandleDuplicate prunes the peer that pushed a duplicate message from the
+// tree, and tells it to do the same.
+func (strategy *plumtreeStrategy) HandleDuplicate(ctx context.Context, from protocol.PeerID, message protocol.Message) {
+	if from == nil {
+		return
+	}
+
+	strategy.mu.Lock()
+	group, err := strategy.groupWithoutLock(message.GroupID)
+	if err != nil {
+		strategy.mu.Unlock()
+		strategy.logger.Debugf("error pruning %v: %v", from, err)
+		return
+	}
+	to, ok := group.members[from.String()]
+	delete(group.eager, from.String())
+	strategy.mu.Unlock()
+
+	if ok {
+		strategy.send(ctx, to, protocol.NewMessage(protocol.V1, protocol.Prune, message.GroupID, nil))
+	}
+}
+
+func (strategy *plumtreeStrategy) AcceptControl(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	// Pre-condition checks
+	if err := protocol.ValidateMessageVersion(message.Version); err != nil {
+		return err
+	}
+	switch message.Variant {
+	case protocol.IHave, protocol.Graft:
+		if len(message.Body)%len(id.Hash{}) != 0 {
+			return fmt.Errorf("error accepting %v: malformed body of len=%v", message.Variant, len(message.Body))
+		}
+	case protocol.Prune:
+		if len(message.Body) != 0 {
+			return fmt.Errorf("error accepting %v: malformed body of len=%v", message.Variant, len(message.Body))
+		}
+	default:
+		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
+	}
+	ids := make([]id.Hash, len(message.Body)/len(id.Hash{}))
+	for i := range ids {
+		copy(ids[i][:], message.Body[i*len(id.Hash{}):])
+	}
+
+	strategy.mu.Lock()
+	group, err := strategy.groupWithoutLock(message.GroupID)
+	if err != nil {
+		strategy.mu.Unlock()
+		return err
+	}
+	to, ok := group.members[from.String()]
+	if !ok {
+		strategy.mu.Unlock()
+		return fmt.Errorf("error accepting %v: peer=%v is not in group=%v", message.Variant, from, message.GroupID)
+	}
+
+	switch message.Variant {
+	case protocol.IHave:
+		// Wait for the messages that have not been received, and remember
+		// who announced them so that they can be grafted.
+		now := time.Now()
+		for _, messageID := range ids {
+			if _, ok := strategy.history.get(messageID); ok {
+				continue
+			}
+			missing, ok := strategy.missing[messageID]
+			if !ok {
+				missing = &missingMessage{groupID: message.GroupID, deadline: now.Add(strategy.options.Timeout)}
+				strategy.missing[messageID] = missing
+			}
+			missing.announcers = append(missing.announcers, from)
+		}
+		strategy.mu.Unlock()
+
+	case protocol.Graft:
+		// Put the peer back on the tree, and push the messages that it is
+		// missing, if they are still recent.
+		group.eager[from.String()] = true
+		messages := make([]protocol.Message, 0, len(ids))
+		for _, messageID := range ids {
+			if message, ok := strategy.history.get(messageID); ok {
+				messages = append(messages, message)
+			}
+		}
+		strategy.mu.Unlock()
+		for _, message := range messages {
+			strategy.send(ctx, to, message)
+		}
+
+	case protocol.Prune:
+		delete(group.eager, from.String())
+		strategy.mu.Unlock()
+	}
+	return nil
+}
+
+func (strategy *plumtreeStrategy) Run(ctx context.Context) {
+	ticker := time.NewTicker(strategy.options.LazyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, message := range strategy.tick(time.Now()) {
+				strategy.send(ctx, message.To, message.Message)
+			}
+		}
+	}
+}
+
+// tick returns the IHave messages that announce new messages to lazy peers,
+// and the Graft messages for the messages that have not been received within
+// their deadline.
+func (strategy *plumtreeStrategy) tick(now time.Time) []protocol.MessageOnTheWire {
+	strategy.mu.Lock()
+	defer strategy.mu.Unlock()
+
+	strategy.history.expire(now)
+	messages := []protocol.MessageOnTheWire{}
+
+	for groupID, group := range strategy.groups {
+		if len(group.announce) == 0 {
+			continue
+		}
+		ihave := protocol.NewMessage(protocol.V1, protocol.IHave, groupID, idsBody(group.announce))
+		group.announce = nil
+		for peerID, addr := range group.members {
+			if group.eager[peerID] {
+				continue
+			}
+			messages = append(messages, protocol.MessageOnTheWire{To: addr, Message: ihave})
+		}
+	}
+
+	type graft struct {
+		groupID protocol.GroupID
+		peerID  string
+	}
+	grafts := map[graft][]id.Hash{}
+	for messageID, missing := range strategy.missing {
+		if now.Before(missing.deadline) {
+			continue
+		}
+		if len(missing.announcers) == 0 {
+			delete(strategy.missing, messageID)
+			continue
+		}
+		announcer := missing.announcers[0]
+		missing.announcers = missing.announcers[1:]
+		missing.deadline = now.Add(strategy.options.GraftTimeout)
+
+		group, ok := strategy.groups[missing.groupID]
+		if !ok {
+			continue
+		}
+		if _, ok := group.members[announcer.String()]; !ok {
+			continue
+		}
+		group.eager[announcer.String()] = true
+		key := graft{groupID: missing.groupID, peerID: announcer.String()}
+		grafts[key] = append(grafts[key], messageID)
+	}
+	for key, ids := range grafts {
+		to := strategy.groups[key.groupID].members[key.peerID]
+		messages = append(messages, protocol.MessageOnTheWire{To: to, Message: protocol.NewMessage(protocol.V1, protocol.Graft, key.groupID, idsBody(ids))})
+	}
+	return messages
+}
+
+// groupWithoutLock returns the view of a group, after updating its members
+// from the DHT. New members are eager until there are Fanout eager members,
+// and lazy after that. It must be called while holding the mutex.
+func (strategy *plumtreeStrategy) groupWithoutLock(groupID protocol.GroupID) (*plumtreeGroup, error) {
+	addrs, err := strategy.dht.GroupAddresses(groupID)
+	if err != nil {
+		return nil, err
+	}
+	group, ok := strategy.groups[groupID]
+	if !ok {
+		group = &plumtreeGroup{
+			members: map[string]protocol.PeerAddress{},
+			eager:   map[string]bool{},
+		}
+		strategy.groups[groupID] = group
+	}
+
+	me := strategy.dht.Me().PeerID()
+	members := make(map[string]protocol.PeerAddress, len(addrs))
+	for _, i := range rand.Perm(len(addrs)) {
+		addr := addrs[i]
+		if addr.PeerID().Equal(me) {
+			continue
+		}
+		peerID := addr.PeerID().String()
+		members[peerID] = addr
+		if _, ok := group.members[peerID]; !ok && len(group.eager) < strategy.options.Fanout {
+			group.eager[peerID] = true
+		}
+	}
+	for peerID := range group.eager {
+		if _, ok := members[peerID]; !ok {
+			delete(group.eager, peerID)
+		}
+	}
+	group.members = members
+	return group, nil
+}
+
+func (strategy *plumtreeStrategy) send(ctx context.Context, to protocol.PeerAddress, message protocol.Message) {
+	select {
+	case <-ctx.Done():
+		strategy.logger.Debugf("cannot send message to %v, %v", to.PeerID(), ctx.Err())
+	case strategy.messages <- protocol.MessageOnTheWire{To: to, Message: message}:
+	}
+}
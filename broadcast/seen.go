@@ -0,0 +1,438 @@
+package broadcast
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/renproject/id"
+	"github.com/renproject/kv"
+)
+
+// SeenCacheMode selects how a SeenCache remembers message hashes.
+type SeenCacheMode string
+
+const (
+	// SeenCacheExact remembers every message hash until it expires, or until
+	// it is evicted to make space for newer hashes.
+	SeenCacheExact = SeenCacheMode("exact")
+
+	// SeenCacheBloom remembers message hashes in two rotating Bloom filters.
+	// It uses much less memory than SeenCacheExact, but a small fraction of
+	// new messages are reported as seen (see
+	// SeenCacheOptions.FalsePositiveRate).
+	SeenCacheBloom = SeenCacheMode("bloom")
+)
+
+// SeenCacheOptions are used to parameterise the behaviour of a SeenCache.
+type SeenCacheOptions struct {
+	Mode SeenCacheMode // Defaults to SeenCacheExact
+
+	// TTL is how long a message hash is remembered. Defaults to 10 minutes.
+	// In SeenCacheBloom mode, hashes are remembered for at least the TTL, and
+	// at most twice the TTL.
+	TTL time.Duration
+
+	// MaxEntries is the maximum number of message hashes that are remembered.
+	// The oldest hashes are evicted first. Defaults to 65536. In
+	// SeenCacheBloom mode, it is the capacity of each Bloom filter.
+	MaxEntries int
+
+	// FalsePositiveRate of each Bloom filter in SeenCacheBloom mode, when it
+	// is at capacity. Defaults to 0.001.
+	FalsePositiveRate float64
+
+	// Store persists message hashes in SeenCacheExact mode, so that messages
+	// that were seen before a restart are still ignored. The Store must not
+	// be shared with anything else. It is ignored in SeenCacheBloom mode.
+	// Defaults to only remembering hashes in memory.
+	Store kv.Table
+}
+
+func (options *SeenCacheOptions) setZerosToDefaults() {
+	if options.Mode == "" {
+		options.Mode = SeenCacheExact
+	}
+	if options.TTL <= 0 {
+		options.TTL = 10 * time.Minute
+	}
+	if options.MaxEntries <= 0 {
+		options.MaxEntries = 65536
+	}
+	if options.FalsePositiveRate <= 0 || options.FalsePositiveRate >= 1 {
+		options.FalsePositiveRate = 0.001
+	}
+}
+
+// SeenCacheStats are statistics about the lookups of a SeenCache.
+type SeenCacheStats struct {
+	Hits    uint64 // Number of lookups of hashes that had been seen
+	Misses  uint64 // Number of lookups of hashes that had not been seen
+	Entries int    // Number of hashes that are remembered
+}
+
+// A SeenCache remembers the hashes of messages that have been seen, so that
+// they are not emitted or propagated more than once. Implementations must be
+// safe for concurrent use.
+type SeenCache interface {
+	// Seen returns true if the hash has been inserted, and has not expired.
+	Seen(hash id.Hash) (bool, error)
+
+	// Insert the hash, so that it is seen until it expires.
+	Insert(hash id.Hash) error
+
+	// SeenOrInsert returns true if the hash has been inserted, and has not
+	// expired. Otherwise, it inserts the hash and returns false. The check and
+	// the insertion are atomic, so only one of many concurrent calls with the
+	// same hash returns false.
+	SeenOrInsert(hash id.Hash) (bool, error)
+
+	// Remove the hash, so that it is no longer seen. It is used to undo an
+	// insertion when the message cannot be handled. Hashes cannot be removed
+	// in SeenCacheBloom mode, and an error is returned instead.
+	Remove(hash id.Hash) error
+
+	// Stats returns the current SeenCacheStats.
+	Stats() SeenCacheStats
+}
+
+// NewSeenCache returns a SeenCache that uses the mode of the options. In
+// SeenCacheExact mode, it loads the unexpired hashes in the Store (if there
+// is one).
+func NewSeenCache(options SeenCacheOptions) (SeenCache, error) {
+	options.setZerosToDefaults()
+	switch options.Mode {
+	case SeenCacheExact:
+		return newExactSeenCache(options)
+	case SeenCacheBloom:
+		return newBloomSeenCache(options), nil
+	default:
+		return nil, fmt.Errorf("unsupported seen cache mode=%v", options.Mode)
+	}
+}
+
+// counters count the hits and misses of a SeenCache.
+type counters struct {
+	hits   uint64
+	misses uint64
+}
+
+func (counters *counters) count(seen bool) {
+	if seen {
+		atomic.AddUint64(&counters.hits, 1)
+		return
+	}
+	atomic.AddUint64(&counters.misses, 1)
+}
+
+func (counters *counters) stats(entries int) SeenCacheStats {
+	return SeenCacheStats{
+		Hits:    atomic.LoadUint64(&counters.hits),
+		Misses:  atomic.LoadUint64(&counters.misses),
+		Entries: entries,
+	}
+}
+
+type exactSeenCache struct {
+	counters
+	options SeenCacheOptions
+
+	mu      *sync.Mutex
+	expiry  map[string]time.Time
+	entries *list.List // Entries in order of expiry, oldest first
+}
+
+type entry struct {
+	key    string
+	expiry time.Time
+}
+
+func newExactSeenCache(options SeenCacheOptions) (*exactSeenCache, error) {
+	cache := &exactSeenCache{
+		options: options,
+		mu:      new(sync.Mutex),
+		expiry:  map[string]time.Time{},
+		entries: list.New(),
+	}
+	if options.Store == nil {
+		return cache, nil
+	}
+
+	// Load the hashes that were inserted before a restart.
+	stored := []entry{}
+	iter := options.Store.Iterator()
+	defer iter.Close()
+	for iter.Next() {
+		key, err := iter.Key()
+		if err != nil {
+			return nil, fmt.Errorf("error loading seen cache: %v", err)
+		}
+		var expiry int64
+		if err := iter.Value(&expiry); err != nil {
+			return nil, fmt.Errorf("error loading seen cache key=%v: %v", key, err)
+		}
+		stored = append(stored, entry{key: key, expiry: time.Unix(0, expiry)})
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].expiry.Before(stored[j].expiry)
+	})
+	for _, e := range stored {
+		cache.expiry[e.key] = e.expiry
+		cache.entries.PushBack(e)
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache, cache.evict(time.Now())
+}
+
+func (cache *exactSeenCache) Seen(hash id.Hash) (bool, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	now := time.Now()
+	if err := cache.evict(now); err != nil {
+		return false, err
+	}
+	expiry, ok := cache.expiry[hash.String()]
+	seen := ok && now.Before(expiry)
+	cache.count(seen)
+	return seen, nil
+}
+
+func (cache *exactSeenCache) Insert(hash id.Hash) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	return cache.insert(hash, time.Now())
+}
+
+func (cache *exactSeenCache) SeenOrInsert(hash id.Hash) (bool, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	now := time.Now()
+	if err := cache.evict(now); err != nil {
+		return false, err
+	}
+	expiry, ok := cache.expiry[hash.String()]
+	seen := ok && now.Before(expiry)
+	cache.count(seen)
+	if seen {
+		return true, nil
+	}
+	return false, cache.insert(hash, now)
+}
+
+func (cache *exactSeenCache) Remove(hash id.Hash) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	// The entry is left in the list, and is skipped as stale when it is
+	// evicted.
+	key := hash.String()
+	if _, ok := cache.expiry[key]; !ok {
+		return nil
+	}
+	delete(cache.expiry, key)
+	if cache.options.Store != nil {
+		if err := cache.options.Store.Delete(key); err != nil {
+			return fmt.Errorf("error deleting seen cache key=%v: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// insert the hash, if it has not been seen. It must be called while holding
+// the mutex.
+func (cache *exactSeenCache) insert(hash id.Hash, now time.Time) error {
+	key := hash.String()
+	if expiry, ok := cache.expiry[key]; ok && now.Before(expiry) {
+		return nil
+	}
+	e := entry{key: key, expiry: now.Add(cache.options.TTL)}
+	if cache.options.Store != nil {
+		if err := cache.options.Store.Insert(key, e.expiry.UnixNano()); err != nil {
+			return err
+		}
+	}
+	cache.expiry[key] = e.expiry
+	cache.entries.PushBack(e)
+	return cache.evict(now)
+}
+
+func (cache *exactSeenCache) Stats() SeenCacheStats {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	return cache.stats(len(cache.expiry))
+}
+
+// evict the entries that have expired, and the oldest entries when there are
+// more than MaxEntries. It must be called while holding the mutex.
+func (cache *exactSeenCache) evict(now time.Time) error {
+	for front := cache.entries.Front(); front != nil; front = cache.entries.Front() {
+		e := front.Value.(entry)
+		if now.Before(e.expiry) && len(cache.expiry) <= cache.options.MaxEntries {
+			return nil
+		}
+		cache.entries.Remove(front)
+
+		// The entry is stale if the hash was inserted again after it expired.
+		if expiry, ok := cache.expiry[e.key]; !ok || !expiry.Equal(e.expiry) {
+			continue
+		}
+		delete(cache.expiry, e.key)
+		if cache.options.Store != nil {
+			if err := cache.options.Store.Delete(e.key); err != nil {
+				return fmt.Errorf("error deleting seen cache key=%v: %v", e.key, err)
+			}
+		}
+	}
+	return nil
+}
+
+type bloomSeenCache struct {
+	counters
+	options SeenCacheOptions
+
+	mu       *sync.Mutex
+	current  *bloomFilter
+	previous *bloomFilter
+	rotated  time.Time
+}
+
+func newBloomSeenCache(options SeenCacheOptions) *bloomSeenCache {
+	return &bloomSeenCache{
+		options:  options,
+		mu:       new(sync.Mutex),
+		current:  newBloomFilter(options.MaxEntries, options.FalsePositiveRate),
+		previous: newBloomFilter(options.MaxEntries, options.FalsePositiveRate),
+		rotated:  time.Now(),
+	}
+}
+
+func (cache *bloomSeenCache) Seen(hash id.Hash) (bool, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.rotate(time.Now())
+	seen := cache.current.has(hash) || cache.previous.has(hash)
+	cache.count(seen)
+	return seen, nil
+}
+
+func (cache *bloomSeenCache) Insert(hash id.Hash) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.rotate(time.Now())
+	if cache.current.has(hash) {
+		return nil
+	}
+	cache.current.add(hash)
+	return nil
+}
+
+func (cache *bloomSeenCache) SeenOrInsert(hash id.Hash) (bool, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.rotate(time.Now())
+	seen := cache.current.has(hash) || cache.previous.has(hash)
+	cache.count(seen)
+	if !seen {
+		cache.current.add(hash)
+	}
+	return seen, nil
+}
+
+// Remove returns an error, because hashes cannot be removed from a Bloom
+// filter without also removing other hashes.
+func (cache *bloomSeenCache) Remove(hash id.Hash) error {
+	return fmt.Errorf("error removing hash=%v: cannot remove hashes in %v mode", hash, SeenCacheBloom)
+}
+
+func (cache *bloomSeenCache) Stats() SeenCacheStats {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	return cache.stats(cache.current.n + cache.previous.n)
+}
+
+// rotate the Bloom filters when the current filter is full, or is older than
+// the TTL. Hashes in the previous filter are forgotten. It must be called
+// while holding the mutex.
+func (cache *bloomSeenCache) rotate(now time.Time) {
+	if cache.current.n < cache.options.MaxEntries && now.Sub(cache.rotated) < cache.options.TTL {
+		return
+	}
+	cache.previous, cache.current = cache.current, cache.previous
+	cache.current.reset()
+	if now.Sub(cache.rotated) >= 2*cache.options.TTL {
+		// The previous filter has also expired.
+		cache.previous.reset()
+	}
+	cache.rotated = now
+}
+
+// bloomFilter is a Bloom filter of message hashes. Message hashes are already
+// uniformly distributed, so the indices of the filter are derived from the
+// hash using double hashing.
+type bloomFilter struct {
+	bits []uint64
+	m    uint64 // Number of bits
+	k    uint64 // Number of indices per hash
+	n    int    // Number of hashes added
+}
+
+func newBloomFilter(capacity int, falsePositiveRate float64) *bloomFilter {
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint64(math.Round(float64(m) / float64(capacity) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+func (filter *bloomFilter) add(hash id.Hash) {
+	h1, h2 := filter.hashes(hash)
+	for i := uint64(0); i < filter.k; i++ {
+		index := (h1 + i*h2) % filter.m
+		filter.bits[index/64] |= 1 << (index % 64)
+	}
+	filter.n++
+}
+
+func (filter *bloomFilter) has(hash id.Hash) bool {
+	h1, h2 := filter.hashes(hash)
+	for i := uint64(0); i < filter.k; i++ {
+		index := (h1 + i*h2) % filter.m
+		if filter.bits[index/64]&(1<<(index%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (filter *bloomFilter) reset() {
+	for i := range filter.bits {
+		filter.bits[i] = 0
+	}
+	filter.n = 0
+}
+
+func (filter *bloomFilter) hashes(hash id.Hash) (uint64, uint64) {
+	return binary.LittleEndian.Uint64(hash[0:8]), binary.LittleEndian.Uint64(hash[8:16]) | 1
+}
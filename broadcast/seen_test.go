@@ -0,0 +1,214 @@
+package broadcast_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/broadcast"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/id"
+)
+
+var _ = Describe("Seen cache", func() {
+
+	hash := func(i int) id.Hash {
+		data := [8]byte{}
+		binary.LittleEndian.PutUint64(data[:], uint64(i))
+		return sha256.Sum256(data[:])
+	}
+
+	for _, mode := range []SeenCacheMode{SeenCacheExact, SeenCacheBloom} {
+		mode := mode
+
+		Context("when using the "+string(mode)+" mode", func() {
+			It("should remember inserted hashes and count hits and misses", func() {
+				seen, err := NewSeenCache(SeenCacheOptions{Mode: mode})
+				Expect(err).NotTo(HaveOccurred())
+
+				for i := 0; i < 100; i++ {
+					Expect(seen.Seen(hash(i))).Should(BeFalse())
+					Expect(seen.Insert(hash(i))).Should(Succeed())
+					Expect(seen.Seen(hash(i))).Should(BeTrue())
+				}
+				stats := seen.Stats()
+				Expect(stats.Hits).Should(Equal(uint64(100)))
+				Expect(stats.Misses).Should(Equal(uint64(100)))
+				Expect(stats.Entries).Should(Equal(100))
+			})
+
+			It("should atomically check and insert hashes", func() {
+				seen, err := NewSeenCache(SeenCacheOptions{Mode: mode})
+				Expect(err).NotTo(HaveOccurred())
+
+				results := make(chan bool, 32)
+				for i := 0; i < 32; i++ {
+					go func() {
+						defer GinkgoRecover()
+						ok, err := seen.SeenOrInsert(hash(0))
+						Expect(err).NotTo(HaveOccurred())
+						results <- ok
+					}()
+				}
+				inserted := 0
+				for i := 0; i < 32; i++ {
+					if !<-results {
+						inserted++
+					}
+				}
+				Expect(inserted).Should(Equal(1))
+				Expect(seen.Seen(hash(0))).Should(BeTrue())
+			})
+
+			It("should forget hashes after they expire", func() {
+				seen, err := NewSeenCache(SeenCacheOptions{Mode: mode, TTL: 50 * time.Millisecond})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(seen.Insert(hash(0))).Should(Succeed())
+				Expect(seen.Seen(hash(0))).Should(BeTrue())
+				time.Sleep(110 * time.Millisecond)
+				Expect(seen.Seen(hash(0))).Should(BeFalse())
+				Expect(seen.Stats().Entries).Should(BeZero())
+			})
+
+			It("should not remember more than twice the maximum entries", func() {
+				seen, err := NewSeenCache(SeenCacheOptions{Mode: mode, MaxEntries: 100})
+				Expect(err).NotTo(HaveOccurred())
+
+				for i := 0; i < 1000; i++ {
+					Expect(seen.Insert(hash(i))).Should(Succeed())
+				}
+				Expect(seen.Stats().Entries).Should(BeNumerically("<=", 200))
+				Expect(seen.Seen(hash(999))).Should(BeTrue())
+				Expect(seen.Seen(hash(0))).Should(BeFalse())
+			})
+		})
+	}
+
+	Context("when using the exact mode", func() {
+		It("should evict the oldest hashes first", func() {
+			seen, err := NewSeenCache(SeenCacheOptions{MaxEntries: 10})
+			Expect(err).NotTo(HaveOccurred())
+
+			for i := 0; i < 20; i++ {
+				Expect(seen.Insert(hash(i))).Should(Succeed())
+			}
+			Expect(seen.Stats().Entries).Should(Equal(10))
+			for i := 0; i < 20; i++ {
+				Expect(seen.Seen(hash(i))).Should(Equal(i >= 10))
+			}
+		})
+
+		It("should remove hashes", func() {
+			store := NewTable("seen")
+			seen, err := NewSeenCache(SeenCacheOptions{MaxEntries: 10, Store: store})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(seen.SeenOrInsert(hash(0))).Should(BeFalse())
+			Expect(seen.Remove(hash(0))).Should(Succeed())
+			Expect(seen.Seen(hash(0))).Should(BeFalse())
+			Expect(store.Size()).Should(BeZero())
+			Expect(seen.SeenOrInsert(hash(0))).Should(BeFalse())
+			Expect(seen.Seen(hash(0))).Should(BeTrue())
+
+			// Removed hashes do not count towards the maximum entries.
+			Expect(seen.Remove(hash(0))).Should(Succeed())
+			for i := 1; i <= 10; i++ {
+				Expect(seen.Insert(hash(i))).Should(Succeed())
+			}
+			Expect(seen.Seen(hash(1))).Should(BeTrue())
+			Expect(seen.Stats().Entries).Should(Equal(10))
+		})
+
+		It("should remember hashes in the store across restarts", func() {
+			store := NewTable("seen")
+			seen, err := NewSeenCache(SeenCacheOptions{MaxEntries: 10, Store: store})
+			Expect(err).NotTo(HaveOccurred())
+			for i := 0; i < 20; i++ {
+				Expect(seen.Insert(hash(i))).Should(Succeed())
+			}
+			Expect(store.Size()).Should(Equal(10))
+
+			seen, err = NewSeenCache(SeenCacheOptions{MaxEntries: 5, Store: store})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(seen.Stats().Entries).Should(Equal(5))
+			Expect(store.Size()).Should(Equal(5))
+			for i := 0; i < 20; i++ {
+				Expect(seen.Seen(hash(i))).Should(Equal(i >= 15))
+			}
+		})
+
+		It("should delete expired hashes from the store", func() {
+			store := NewTable("seen")
+			seen, err := NewSeenCache(SeenCacheOptions{TTL: 50 * time.Millisecond, Store: store})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(seen.Insert(hash(0))).Should(Succeed())
+			time.Sleep(60 * time.Millisecond)
+
+			seen, err = NewSeenCache(SeenCacheOptions{TTL: 50 * time.Millisecond, Store: store})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(seen.Seen(hash(0))).Should(BeFalse())
+			Expect(store.Size()).Should(BeZero())
+		})
+	})
+
+	Context("when using the bloom mode", func() {
+		It("should not remove hashes", func() {
+			seen, err := NewSeenCache(SeenCacheOptions{Mode: SeenCacheBloom})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(seen.Insert(hash(0))).Should(Succeed())
+			Expect(seen.Remove(hash(0))).ShouldNot(Succeed())
+			Expect(seen.Seen(hash(0))).Should(BeTrue())
+		})
+
+		It("should have few false positives", func() {
+			seen, err := NewSeenCache(SeenCacheOptions{Mode: SeenCacheBloom, MaxEntries: 10000, FalsePositiveRate: 0.01})
+			Expect(err).NotTo(HaveOccurred())
+			for i := 0; i < 10000; i++ {
+				Expect(seen.Insert(hash(i))).Should(Succeed())
+			}
+			falsePositives := 0
+			for i := 10000; i < 20000; i++ {
+				ok, err := seen.Seen(hash(i))
+				Expect(err).NotTo(HaveOccurred())
+				if ok {
+					falsePositives++
+				}
+			}
+			Expect(falsePositives).Should(BeNumerically("<", 200))
+		})
+	})
+
+	Context("when using an unsupported mode", func() {
+		It("should return an error", func() {
+			_, err := NewSeenCache(SeenCacheOptions{Mode: SeenCacheMode("unsupported")})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when used by a broadcaster", func() {
+		It("should count duplicate messages as hits", func() {
+			seen, err := NewSeenCache(SeenCacheOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			broadcaster := NewBroadcasterWithOptions(Options{SeenCache: seen}, messages, events, dht)
+
+			groupID, _, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			message := protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, RandomMessageBody())
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+			Expect(seen.Stats()).Should(Equal(SeenCacheStats{Hits: 1, Misses: 1, Entries: 1}))
+		})
+	})
+})
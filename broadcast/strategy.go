@@ -0,0 +1,363 @@
+package broadcast
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/id"
+	"github.com/sirupsen/logrus"
+)
+
+// A Strategy decides which peers a Broadcaster propagates messages to.
+// Strategies that need to exchange control messages with other peers send
+// them using control variants, such as the Gossip variant. Implementations
+// must be safe for concurrent use.
+type Strategy interface {
+	// Targets returns the message that should be sent, and the addresses that
+	// it should be sent to, for a message that has not been seen before. The
+	// PeerID is nil when the message is being broadcast by this peer.
+	Targets(from protocol.PeerID, message protocol.Message) (protocol.Message, protocol.PeerAddresses, error)
+
+	// AcceptControl handles a control message from another peer.
+	AcceptControl(ctx context.Context, from protocol.PeerID, message protocol.Message) error
+
+	// Run the background tasks of the Strategy until the context is done.
+	Run(ctx context.Context)
+}
+
+// A DuplicateHandler is a Strategy that is told when a Broadcaster receives a
+// message that it has already seen.
+type DuplicateHandler interface {
+	HandleDuplicate(ctx context.Context, from protocol.PeerID, message protocol.Message)
+}
+
+type floodStrategy struct {
+	dht dht.DHT
+}
+
+// NewFloodStrategy returns a Strategy that sends every message to every peer
+// in its group. Every peer does the same when it sees the message for the
+// first time, so it costs O(n²) messages to broadcast to n peers, but it is
+// very robust.
+func NewFloodStrategy(dht dht.DHT) Strategy {
+	return floodStrategy{dht: dht}
+}
+
+func (strategy floodStrategy) Targets(from protocol.PeerID, message protocol.Message) (protocol.Message, protocol.PeerAddresses, error) {
+	addrs, err := strategy.dht.GroupAddresses(message.GroupID)
+	if err != nil {
+		return protocol.Message{}, nil, err
+	}
+	return protocol.NewMessage(protocol.V1, message.Variant, message.GroupID, message.Body), addrs, nil
+}
+
+func (strategy floodStrategy) AcceptControl(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
+}
+
+func (strategy floodStrategy) Run(ctx context.Context) {
+	<-ctx.Done()
+}
+
+const (
+	gossipDigest = byte(1) // The IDs of the messages that the sender has seen recently
+	gossipWant   = byte(2) // The IDs of the messages that the sender is missing
+)
+
+// GossipOptions are used to parameterise the behaviour of the gossip
+// Strategy.
+type GossipOptions struct {
+	// Fanout is the number of random peers in the group that a message is
+	// sent to by each peer. Defaults to 6.
+	Fanout int `json:"fanout"`
+
+	// TTL is the number of hops that a message is forwarded before it is
+	// dropped. It is carried in the V2 header of the message. Defaults to 6.
+	TTL uint8 `json:"ttl"`
+
+	// RepairInterval is how often the IDs of the recent messages are sent to
+	// RepairFanout random peers, so that they can pull the messages that they
+	// have missed. Defaults to 1 second.
+	RepairInterval time.Duration `json:"repairInterval"`
+	RepairFanout   int           `json:"repairFanout"` // Defaults to 2
+
+	// RepairHistory is how long messages are kept so that they can be pulled
+	// by other peers. At most RepairCapacity messages are kept. Defaults to 1
+	// minute, and 1024 messages.
+	RepairHistory  time.Duration `json:"repairHistory"`
+	RepairCapacity int           `json:"repairCapacity"`
+}
+
+func (options *GossipOptions) setZerosToDefaults() {
+	if options.Fanout <= 0 {
+		options.Fanout = 6
+	}
+	if options.TTL == 0 {
+		options.TTL = 6
+	}
+	if options.RepairInterval <= 0 {
+		options.RepairInterval = time.Second
+	}
+	if options.RepairFanout <= 0 {
+		options.RepairFanout = 2
+	}
+	if options.RepairHistory <= 0 {
+		options.RepairHistory = time.Minute
+	}
+	if options.RepairCapacity <= 0 {
+		options.RepairCapacity = 1024
+	}
+}
+
+type gossipStrategy struct {
+	options  GossipOptions
+	logger   logrus.FieldLogger
+	messages protocol.MessageSender
+	dht      dht.DHT
+
+	mu *sync.Mutex
+
+	// history of recent messages, that can be pulled by other peers.
+	history *history
+
+	// wanted messages, that have been pulled from other peers. They are not
+	// pulled again until the RepairInterval has passed.
+	wanted map[id.Hash]time.Time
+}
+
+// NewGossipStrategy returns a Strategy that sends every message to a random
+// fanout of peers in its group, until its TTL runs out. Every peer
+// periodically sends the IDs of the messages that it has seen recently to a
+// few random peers, which pull the messages that they have missed. Control
+// messages are sent through the MessageSender.
+func NewGossipStrategy(options GossipOptions, logger logrus.FieldLogger, messages protocol.MessageSender, dht dht.DHT) Strategy {
+	options.setZerosToDefaults()
+	if logger == nil {
+		logger = logrus.New()
+	}
+	return &gossipStrategy{
+		options:  options,
+		logger:   logger,
+		messages: messages,
+		dht:      dht,
+
+		mu:      new(sync.Mutex),
+		history: newHistory(options.RepairHistory, options.RepairCapacity),
+		wanted:  map[id.Hash]time.Time{},
+	}
+}
+
+func (strategy *gossipStrategy) Targets(from protocol.PeerID, message protocol.Message) (protocol.Message, protocol.PeerAddresses, error) {
+	ttl := strategy.options.TTL
+	if from != nil {
+		// Messages that are received through V1 sessions do not have a TTL,
+		// so they are forwarded as if they had not been forwarded before.
+		if remaining, ok := message.TTL(); ok {
+			if remaining == 0 {
+				strategy.remember(message)
+				return message, nil, nil
+			}
+			ttl = remaining - 1
+		}
+	}
+
+	forward := protocol.NewMessage(protocol.V2, message.Variant, message.GroupID, message.Body)
+	forward.SetTTL(ttl)
+	strategy.remember(forward)
+
+	addrs, err := strategy.dht.RandomPeerAddresses(message.GroupID, strategy.options.Fanout+2)
+	if err != nil {
+		return protocol.Message{}, nil, err
+	}
+	me := strategy.dht.Me().PeerID()
+	targets := make(protocol.PeerAddresses, 0, strategy.options.Fanout)
+	for _, addr := range addrs {
+		if len(targets) == strategy.options.Fanout {
+			break
+		}
+		if addr.PeerID().Equal(me) || (from != nil && addr.PeerID().Equal(from)) {
+			continue
+		}
+		targets = append(targets, addr)
+	}
+	return forward, targets, nil
+}
+
+func (strategy *gossipStrategy) AcceptControl(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	// Pre-condition checks
+	if err := protocol.ValidateMessageVersion(message.Version); err != nil {
+		return err
+	}
+	if message.Variant != protocol.Gossip {
+		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
+	}
+	if len(message.Body) < 1 || (len(message.Body)-1)%len(id.Hash{}) != 0 {
+		return fmt.Errorf("error accepting gossip: malformed body of len=%v", len(message.Body))
+	}
+	ids := make([]id.Hash, (len(message.Body)-1)/len(id.Hash{}))
+	for i := range ids {
+		copy(ids[i][:], message.Body[1+i*len(id.Hash{}):])
+	}
+
+	to, err := strategy.dht.PeerAddress(from)
+	if err != nil {
+		return err
+	}
+
+	switch message.Body[0] {
+	case gossipDigest:
+		// Pull the messages that have not been seen, unless they have
+		// already been pulled.
+		missing := strategy.missing(ids)
+		if len(missing) == 0 {
+			return nil
+		}
+		strategy.send(ctx, to, gossipFrame(gossipWant, missing))
+		return nil
+
+	case gossipWant:
+		// Push the messages that are wanted, if they are still recent.
+		for _, message := range strategy.lookup(ids) {
+			strategy.send(ctx, to, message)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("error accepting gossip: unexpected frame type=%d", message.Body[0])
+	}
+}
+
+func (strategy *gossipStrategy) Run(ctx context.Context) {
+	ticker := time.NewTicker(strategy.options.RepairInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			strategy.repair(ctx)
+		}
+	}
+}
+
+// repair sends the IDs of the recent messages in each group to random peers
+// in the group.
+func (strategy *gossipStrategy) repair(ctx context.Context) {
+	strategy.mu.Lock()
+	strategy.expireWithoutLock(time.Now())
+	groups := strategy.history.groups()
+	strategy.mu.Unlock()
+
+	me := strategy.dht.Me().PeerID()
+	for groupID, ids := range groups {
+		addrs, err := strategy.dht.RandomPeerAddresses(groupID, strategy.options.RepairFanout+1)
+		if err != nil {
+			strategy.logger.Debugf("error repairing group=%v: %v", groupID, err)
+			continue
+		}
+		digest := gossipFrame(gossipDigest, ids)
+		sent := 0
+		for _, addr := range addrs {
+			if sent == strategy.options.RepairFanout || addr.PeerID().Equal(me) {
+				continue
+			}
+			strategy.send(ctx, addr, digest)
+			sent++
+		}
+	}
+}
+
+// remember a message, so that it can be pulled by other peers.
+func (strategy *gossipStrategy) remember(message protocol.Message) {
+	strategy.mu.Lock()
+	defer strategy.mu.Unlock()
+
+	messageID := messageID(message)
+	if strategy.history.insert(time.Now(), messageID, message) {
+		delete(strategy.wanted, messageID)
+	}
+}
+
+// expireWithoutLock forgets the messages that are older than the
+// RepairHistory, and the oldest messages when there are more than the
+// RepairCapacity. It must be called while holding the mutex.
+func (strategy *gossipStrategy) expireWithoutLock(now time.Time) {
+	strategy.history.expire(now)
+
+	for messageID, wanted := range strategy.wanted {
+		if now.Sub(wanted) >= strategy.options.RepairInterval {
+			delete(strategy.wanted, messageID)
+		}
+	}
+}
+
+// missing returns the IDs that have not been seen recently, and have not been
+// pulled within the RepairInterval. They are marked as pulled.
+func (strategy *gossipStrategy) missing(ids []id.Hash) []id.Hash {
+	strategy.mu.Lock()
+	defer strategy.mu.Unlock()
+
+	now := time.Now()
+	missing := []id.Hash{}
+	for _, messageID := range ids {
+		if _, ok := strategy.history.get(messageID); ok {
+			continue
+		}
+		if wanted, ok := strategy.wanted[messageID]; ok && now.Sub(wanted) < strategy.options.RepairInterval {
+			continue
+		}
+		strategy.wanted[messageID] = now
+		missing = append(missing, messageID)
+	}
+	return missing
+}
+
+// lookup returns the recent messages with the IDs.
+func (strategy *gossipStrategy) lookup(ids []id.Hash) []protocol.Message {
+	strategy.mu.Lock()
+	defer strategy.mu.Unlock()
+
+	messages := []protocol.Message{}
+	for _, messageID := range ids {
+		if message, ok := strategy.history.get(messageID); ok {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+func (strategy *gossipStrategy) send(ctx context.Context, to protocol.PeerAddress, message protocol.Message) {
+	select {
+	case <-ctx.Done():
+		strategy.logger.Debugf("cannot send message to %v, %v", to.PeerID(), ctx.Err())
+	case strategy.messages <- protocol.MessageOnTheWire{To: to, Message: message}:
+	}
+}
+
+// gossipFrame returns a Gossip message with the frame type followed by the
+// IDs.
+func gossipFrame(frameType byte, ids []id.Hash) protocol.Message {
+	body := append(protocol.MessageBody{frameType}, idsBody(ids)...)
+	return protocol.NewMessage(protocol.V1, protocol.Gossip, protocol.NilGroupID, body)
+}
+
+// idsBody returns a message body that is the concatenation of the IDs.
+func idsBody(ids []id.Hash) protocol.MessageBody {
+	body := make(protocol.MessageBody, 0, len(ids)*len(id.Hash{}))
+	for _, messageID := range ids {
+		body = append(body, messageID[:]...)
+	}
+	return body
+}
+
+// messageID returns the ID of a broadcast message. It does not depend on the
+// version or the extensions of the message, because they can change from hop
+// to hop.
+func messageID(message protocol.Message) id.Hash {
+	return protocol.NewMessage(protocol.V1, message.Variant, message.GroupID, message.Body).Hash()
+}
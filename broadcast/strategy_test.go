@@ -0,0 +1,276 @@
+package broadcast_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/broadcast"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/phi"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Strategies", func() {
+
+	flood := func(_ protocol.MessageSender, dht dht.DHT) Options {
+		return Options{Strategy: NewFloodStrategy(dht)}
+	}
+
+	gossip := func(options GossipOptions) func(protocol.MessageSender, dht.DHT) Options {
+		return func(messages protocol.MessageSender, dht dht.DHT) Options {
+			return Options{Strategy: NewGossipStrategy(options, logrus.New(), messages, dht)}
+		}
+	}
+
+	plumtree := func(options PlumtreeOptions) func(protocol.MessageSender, dht.DHT) Options {
+		return func(messages protocol.MessageSender, dht dht.DHT) Options {
+			return Options{Strategy: NewPlumtreeStrategy(options, logrus.New(), messages, dht)}
+		}
+	}
+
+	Context("when using the flood strategy", func() {
+		It("should send every message to every peer", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			broadcasters, events, groupID, sent := network(ctx, 8, flood, nil)
+
+			Expect(broadcasters[0].Broadcast(ctx, groupID, RandomMessageBody())).To(Succeed())
+			for i := 1; i < len(events); i++ {
+				Eventually(events[i]).Should(Receive())
+			}
+			Eventually(func() int64 { return atomic.LoadInt64(sent) }).Should(Equal(int64(8 * 8)))
+		})
+
+		It("should not accept control messages", func() {
+			strategy := NewFloodStrategy(NewDHT(RandomAddress(), NewTable("dht"), nil))
+			message := protocol.NewMessage(protocol.V1, protocol.Gossip, protocol.NilGroupID, []byte{1})
+			Expect(strategy.AcceptControl(context.Background(), RandomPeerID(), message)).NotTo(Succeed())
+		})
+	})
+
+	Context("when using the gossip strategy", func() {
+		It("should deliver every message to every peer with fewer messages than flooding", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			n := 32
+			broadcasters, events, groupID, sent := network(ctx, n, gossip(GossipOptions{Fanout: 4, RepairInterval: 100 * time.Millisecond}), nil)
+
+			Expect(broadcasters[0].Broadcast(ctx, groupID, RandomMessageBody())).To(Succeed())
+			for i := 1; i < len(events); i++ {
+				Eventually(events[i], 5*time.Second).Should(Receive())
+				Consistently(events[i], 10*time.Millisecond).ShouldNot(Receive())
+			}
+			Expect(atomic.LoadInt64(sent)).Should(BeNumerically("<", n*n/2))
+		})
+
+		It("should stop forwarding messages when their TTL runs out", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			forwarded := int64(0)
+			filter := func(_ int, message protocol.Message) bool {
+				if message.Variant != protocol.Broadcast {
+					return true
+				}
+				ttl, ok := message.TTL()
+				Expect(ok).Should(BeTrue())
+				Expect(message.Version).Should(Equal(protocol.V2))
+				if ttl == 0 {
+					atomic.AddInt64(&forwarded, 1)
+				}
+				return true
+			}
+
+			broadcasters, _, groupID, sent := network(ctx, 16, gossip(GossipOptions{Fanout: 3, TTL: 1, RepairInterval: time.Hour}), filter)
+			Expect(broadcasters[0].Broadcast(ctx, groupID, RandomMessageBody())).To(Succeed())
+
+			// The broadcaster sends the message to 3 peers with a TTL of 1, and
+			// each of them sends it to 3 more peers with a TTL of 0.
+			Eventually(func() int64 { return atomic.LoadInt64(sent) }).Should(Equal(int64(3 + 3*3)))
+			Consistently(func() int64 { return atomic.LoadInt64(sent) }, 200*time.Millisecond).Should(Equal(int64(3 + 3*3)))
+			Expect(atomic.LoadInt64(&forwarded)).Should(Equal(int64(3 * 3)))
+		})
+
+		It("should repair messages that were missed", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			dropping := int32(1)
+			filter := func(to int, message protocol.Message) bool {
+				return to != 1 || message.Variant != protocol.Broadcast || atomic.LoadInt32(&dropping) == 0
+			}
+			broadcasters, events, groupID, _ := network(ctx, 8, gossip(GossipOptions{RepairInterval: 100 * time.Millisecond}), filter)
+
+			Expect(broadcasters[0].Broadcast(ctx, groupID, RandomMessageBody())).To(Succeed())
+			Eventually(events[2]).Should(Receive())
+			Consistently(events[1], 300*time.Millisecond).ShouldNot(Receive())
+
+			atomic.StoreInt32(&dropping, 0)
+			Eventually(events[1], 5*time.Second).Should(Receive())
+		})
+
+		It("should forward messages to peers that only support V1", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			// Handshake with a peer that only supports V1.
+			clientSignVerifier, serverSignVerifier := NewMockSignVerifier(), NewMockSignVerifier()
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+			serverSignVerifier.Whitelist(clientSignVerifier.ID())
+			serverCapabilities := protocol.DefaultCapabilities()
+			serverCapabilities.Versions = []protocol.MessageVersion{protocol.V1}
+			client := handshake.New(clientSignVerifier, handshake.NewGCMSessionManager())
+			server := handshake.NewWithOptions(serverSignVerifier, handshake.Options{Capabilities: serverCapabilities}, handshake.NewGCMSessionManager())
+
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+			var clientSession, serverSession protocol.Session
+			var clientErr, serverErr error
+			phi.ParBegin(func() {
+				clientSession, clientErr = client.Handshake(ctx, clientConn, nil)
+			}, func() {
+				serverSession, serverErr = server.AcceptHandshake(ctx, serverConn)
+			})
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverErr).NotTo(HaveOccurred())
+			Expect(clientSession.Negotiation().Version).Should(Equal(protocol.V1))
+
+			newStrategy := func() (Strategy, protocol.GroupID) {
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				addr := RandomAddress()
+				groupID := RandomGroupID()
+				Expect(dht.AddPeerAddress(addr)).To(Succeed())
+				Expect(dht.AddGroup(groupID, protocol.PeerIDs{addr.PeerID()})).To(Succeed())
+				return NewGossipStrategy(GossipOptions{TTL: 3}, logrus.New(), nil, dht), groupID
+			}
+
+			// Messages are forwarded as V2 messages with a TTL, which is
+			// dropped when they are written to the V1 peer.
+			strategy, groupID := newStrategy()
+			forward, targets, err := strategy.Targets(nil, protocol.NewMessage(protocol.V2, protocol.Broadcast, groupID, RandomMessageBody()))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(targets).To(HaveLen(1))
+			Expect(forward.Version).Should(Equal(protocol.V2))
+
+			buf := new(bytes.Buffer)
+			Expect(clientSession.WriteMessage(buf, forward)).To(Succeed())
+			received, err := serverSession.ReadMessageOnTheWire(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(received.Message.Version).Should(Equal(protocol.V1))
+			_, ok := received.Message.TTL()
+			Expect(ok).Should(BeFalse())
+			Expect(bytes.Equal(received.Message.Body, forward.Body)).Should(BeTrue())
+
+			// The V1 peer forwards the message as if it had not been forwarded
+			// before.
+			strategy, groupID = newStrategy()
+			received.Message.GroupID = groupID
+			forward, targets, err = strategy.Targets(received.From, received.Message)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(targets).To(HaveLen(1))
+			ttl, ok := forward.TTL()
+			Expect(ok).Should(BeTrue())
+			Expect(ttl).Should(Equal(uint8(3)))
+		})
+
+		It("should reject malformed control messages", func() {
+			strategy := NewGossipStrategy(GossipOptions{}, logrus.New(), nil, NewDHT(RandomAddress(), NewTable("dht"), nil))
+			for _, body := range [][]byte{{}, {1, 2, 3}} {
+				message := protocol.NewMessage(protocol.V1, protocol.Gossip, protocol.NilGroupID, body)
+				Expect(strategy.AcceptControl(context.Background(), RandomPeerID(), message)).NotTo(Succeed())
+			}
+			message := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, []byte{1})
+			Expect(strategy.AcceptControl(context.Background(), RandomPeerID(), message)).NotTo(Succeed())
+		})
+	})
+
+	Context("when using the plumtree strategy", func() {
+		It("should deliver every message to every peer", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			broadcasters, events, groupID, _ := network(ctx, 16, plumtree(PlumtreeOptions{Fanout: 3, LazyInterval: 50 * time.Millisecond, Timeout: 200 * time.Millisecond}), nil)
+
+			for i := 0; i < 4; i++ {
+				Expect(broadcasters[i].Broadcast(ctx, groupID, RandomMessageBody())).To(Succeed())
+			}
+			for i := range events {
+				for j := 0; j < 4; j++ {
+					if i == j {
+						continue
+					}
+					Eventually(events[i], 5*time.Second).Should(Receive())
+				}
+				Consistently(events[i], 10*time.Millisecond).ShouldNot(Receive())
+			}
+		})
+
+		It("should prune the tree so that later messages are pushed to each peer once", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			n := 16
+			broadcasters, events, groupID, sent := network(ctx, n, plumtree(PlumtreeOptions{Fanout: 3, LazyInterval: 50 * time.Millisecond, Timeout: 200 * time.Millisecond}), nil)
+
+			Expect(broadcasters[0].Broadcast(ctx, groupID, RandomMessageBody())).To(Succeed())
+			for i := 1; i < n; i++ {
+				Eventually(events[i], 5*time.Second).Should(Receive())
+			}
+			time.Sleep(500 * time.Millisecond)
+			atomic.StoreInt64(sent, 0)
+
+			Expect(broadcasters[0].Broadcast(ctx, groupID, RandomMessageBody())).To(Succeed())
+			for i := 1; i < n; i++ {
+				Eventually(events[i], 5*time.Second).Should(Receive())
+			}
+			Consistently(func() int64 { return atomic.LoadInt64(sent) }, 300*time.Millisecond).Should(Equal(int64(n - 1)))
+		})
+
+		It("should graft peers that announce messages that were missed", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			grafts := int64(0)
+			filter := func(to int, message protocol.Message) bool {
+				if message.Variant == protocol.Graft {
+					atomic.AddInt64(&grafts, 1)
+				}
+				return to != 1 || message.Variant != protocol.Broadcast || atomic.LoadInt64(&grafts) > 0
+			}
+			broadcasters, events, groupID, _ := network(ctx, 8, plumtree(PlumtreeOptions{Fanout: 3, LazyInterval: 50 * time.Millisecond, Timeout: 200 * time.Millisecond}), filter)
+
+			Expect(broadcasters[0].Broadcast(ctx, groupID, RandomMessageBody())).To(Succeed())
+			Eventually(events[1], 5*time.Second).Should(Receive())
+			Expect(atomic.LoadInt64(&grafts)).Should(BeNumerically(">", 0))
+		})
+
+		It("should reject malformed control messages", func() {
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			from := RandomAddress()
+			groupID := RandomGroupID()
+			Expect(dht.AddPeerAddress(from)).To(Succeed())
+			Expect(dht.AddGroup(groupID, protocol.PeerIDs{dht.Me().PeerID(), from.PeerID()})).To(Succeed())
+			strategy := NewPlumtreeStrategy(PlumtreeOptions{}, logrus.New(), nil, dht)
+
+			for _, message := range []protocol.Message{
+				protocol.NewMessage(protocol.V1, protocol.IHave, groupID, []byte{1, 2, 3}),
+				protocol.NewMessage(protocol.V1, protocol.Graft, groupID, []byte{1, 2, 3}),
+				protocol.NewMessage(protocol.V1, protocol.Prune, groupID, []byte{1}),
+				protocol.NewMessage(protocol.V1, protocol.Gossip, protocol.NilGroupID, []byte{1}),
+			} {
+				Expect(strategy.AcceptControl(context.Background(), from.PeerID(), message)).NotTo(Succeed())
+			}
+
+			// Control messages from peers that are not in the group are
+			// rejected.
+			message := protocol.NewMessage(protocol.V1, protocol.Prune, groupID, nil)
+			Expect(strategy.AcceptControl(context.Background(), RandomPeerID(), message)).NotTo(Succeed())
+			Expect(strategy.AcceptControl(context.Background(), from.PeerID(), message)).To(Succeed())
+		})
+	})
+})
@@ -11,23 +11,52 @@ import (
 )
 
 type Caster interface {
+	// Cast sends a message to a peer. If the Caster waits for results, it
+	// waits until the message has been sent, and returns an ErrCasting if the
+	// message cannot be sent before the context is done.
 	Cast(ctx context.Context, to protocol.PeerID, body protocol.MessageBody) error
 	AcceptCast(ctx context.Context, from protocol.PeerID, message protocol.Message) error
 }
 
+// Options are used to parameterise the behaviour of a Caster.
+type Options struct {
+	Logger logrus.FieldLogger
+
+	// WaitForResults makes Cast wait for the Result of its message. It must
+	// only be set when the consumer of the messages reports the Result of
+	// every message (as the tcp.Client does), otherwise Cast blocks until its
+	// context is done. Defaults to false.
+	WaitForResults bool
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.Logger == nil {
+		options.Logger = logrus.New()
+	}
+}
+
 type caster struct {
-	logger   logrus.FieldLogger
-	messages protocol.MessageSender
-	events   protocol.EventSender
-	dht      dht.DHT
+	logger         logrus.FieldLogger
+	waitForResults bool
+	messages       protocol.MessageSender
+	events         protocol.EventSender
+	dht            dht.DHT
 }
 
 func NewCaster(logger logrus.FieldLogger, messages protocol.MessageSender, events protocol.EventSender, dht dht.DHT) Caster {
+	return NewCasterWithOptions(Options{Logger: logger}, messages, events, dht)
+}
+
+// NewCasterWithOptions returns a Caster that waits for the results of its
+// messages, if the Options say so.
+func NewCasterWithOptions(options Options, messages protocol.MessageSender, events protocol.EventSender, dht dht.DHT) Caster {
+	options.setZerosToDefaults()
 	return &caster{
-		logger:   logger,
-		messages: messages,
-		events:   events,
-		dht:      dht,
+		logger:         options.Logger,
+		waitForResults: options.WaitForResults,
+		messages:       messages,
+		events:         events,
+		dht:            dht,
 	}
 }
 
@@ -36,9 +65,16 @@ func (caster *caster) Cast(ctx context.Context, to protocol.PeerID, body protoco
 	if err != nil {
 		return err
 	}
+	var results chan error
+	if caster.waitForResults {
+		results = make(chan error, 1)
+	}
+	deadline, _ := ctx.Deadline()
 	message := protocol.MessageOnTheWire{
-		To:      toAddr,
-		Message: protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, body),
+		To:       toAddr,
+		Message:  protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, body),
+		Result:   results,
+		Deadline: deadline,
 	}
 
 	// Check if context is already expired
@@ -53,14 +89,27 @@ func (caster *caster) Cast(ctx context.Context, to protocol.PeerID, body protoco
 	case <-ctx.Done():
 		return newErrCasting(to, ctx.Err())
 	case caster.messages <- message:
+		if results == nil {
+			return nil
+		}
+	}
+
+	// Wait for the message to be sent.
+	select {
+	case <-ctx.Done():
+		return newErrCasting(to, ctx.Err())
+	case err := <-results:
+		if err != nil {
+			return newErrCasting(to, err)
+		}
 		return nil
 	}
 }
 
 func (caster *caster) AcceptCast(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
 	// Pre-condition checks
-	if message.Version != protocol.V1 {
-		return protocol.NewErrMessageVersionIsNotSupported(message.Version)
+	if err := protocol.ValidateMessageVersion(message.Version); err != nil {
+		return err
 	}
 	if message.Variant != protocol.Cast {
 		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
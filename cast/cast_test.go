@@ -3,6 +3,7 @@ package cast_test
 import (
 	"bytes"
 	"context"
+	"errors"
 	"testing/quick"
 
 	. "github.com/onsi/ginkgo"
@@ -44,6 +45,51 @@ var _ = Describe("Caster", func() {
 			Expect(quick.Check(check, nil)).Should(BeNil())
 		})
 
+		Context("when waiting for results", func() {
+			It("should return nil once the message has been sent", func() {
+				messages := make(chan protocol.MessageOnTheWire, 1)
+				events := make(chan protocol.Event, 1)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				caster := NewCasterWithOptions(Options{WaitForResults: true}, messages, events, dht)
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				to := RandomAddress()
+				Expect(dht.AddPeerAddress(to)).NotTo(HaveOccurred())
+				errs := make(chan error, 1)
+				go func() {
+					errs <- caster.Cast(ctx, to.PeerID(), RandomMessageBody())
+				}()
+
+				var msg protocol.MessageOnTheWire
+				Eventually(messages).Should(Receive(&msg))
+				Consistently(errs).ShouldNot(Receive())
+				msg.ReportResult(nil)
+				Eventually(errs).Should(Receive(BeNil()))
+			})
+
+			It("should return ErrCasting if the message cannot be sent", func() {
+				messages := make(chan protocol.MessageOnTheWire, 1)
+				events := make(chan protocol.Event, 1)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				caster := NewCasterWithOptions(Options{WaitForResults: true}, messages, events, dht)
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				to := RandomAddress()
+				Expect(dht.AddPeerAddress(to)).NotTo(HaveOccurred())
+				go func() {
+					msg := <-messages
+					msg.ReportResult(protocol.NewErrMessageNotDelivered(to.PeerID(), errors.New("unreachable")))
+				}()
+				err := caster.Cast(ctx, to.PeerID(), RandomMessageBody())
+				Expect(err).Should(BeAssignableToTypeOf(ErrCasting{}))
+				Expect(err.(ErrCasting).PeerID.Equal(to.PeerID())).Should(BeTrue())
+			})
+		})
+
 		Context("when the context is cancelled", func() {
 			It("should return ErrCasting", func() {
 				check := func(message []byte) bool {
@@ -0,0 +1,94 @@
+package handshake
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// aeadSession seals message bodies with an AEAD. Nonces are read from a
+// pseudo-random generator that is seeded with the session key, so both peers
+// must read and write messages in lockstep.
+type aeadSession struct {
+	peerID protocol.PeerID
+	id     protocol.AEAD
+	aead   cipher.AEAD
+	rand   *rand.Rand
+	limits protocol.SizeLimits
+}
+
+func newAEADSession(peerID protocol.PeerID, key [32]byte, id protocol.AEAD, aead cipher.AEAD) protocol.Session {
+	seed := binary.BigEndian.Uint64(key[:8])
+	return &aeadSession{
+		peerID: peerID,
+		id:     id,
+		aead:   aead,
+		rand:   rand.New(rand.NewSource(int64(seed))),
+		limits: protocol.DefaultSizeLimits(),
+	}
+}
+
+func (session *aeadSession) setSizeLimits(limits protocol.SizeLimits) {
+	session.limits = limits
+}
+
+func (session *aeadSession) Negotiation() protocol.Negotiation {
+	return protocol.DefaultNegotiation(session.id)
+}
+
+func (session *aeadSession) ReadMessageOnTheWire(r io.Reader) (protocol.MessageOnTheWire, error) {
+	otw := protocol.MessageOnTheWire{}
+	otw.From = session.peerID
+	if err := otw.Message.UnmarshalReaderWithLimits(r, session.limits); err != nil {
+		return otw, err
+	}
+
+	nonce := make([]byte, session.aead.NonceSize())
+	_, err := session.rand.Read(nonce)
+	if err != nil {
+		return otw, err
+	}
+	otw.Message.Body, err = session.aead.Open(nil, nonce, otw.Message.Body, aeadAd(otw.Message))
+	if err != nil {
+		return otw, err
+	}
+	length := otw.Message.HeaderLength()
+	otw.Message.Length = protocol.MessageLength(len(otw.Message.Body) + length)
+	return otw, nil
+}
+
+func (session *aeadSession) WriteMessage(w io.Writer, message protocol.Message) error {
+	nonce := make([]byte, session.aead.NonceSize())
+	_, err := session.rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	message.Body = session.aead.Seal(nil, nonce, message.Body, aeadAd(message))
+	length := message.HeaderLength()
+	message.Length = protocol.MessageLength(len(message.Body) + length)
+
+	data, err := message.MarshalBinaryWithLimits(session.limits)
+	if err != nil {
+		return fmt.Errorf("error writing message: %v", err)
+	}
+	n, err := w.Write(data)
+	if n != len(data) {
+		return fmt.Errorf("error writing message: expected n=%v, got n=%v", len(data), n)
+	}
+	return err
+}
+
+// aeadAd returns the parts of the message header that are not modified by
+// encryption, including the extensions of V2 messages.
+func aeadAd(message protocol.Message) []byte {
+	extensions := extensionsAd(message)
+	ad := make([]byte, 4, 4+len(message.GroupID)+len(extensions))
+	binary.LittleEndian.PutUint16(ad[0:], uint16(message.Version))
+	binary.LittleEndian.PutUint16(ad[2:], uint16(message.Variant))
+	ad = append(ad, message.GroupID[:]...)
+	return append(ad, extensions...)
+}
@@ -0,0 +1,126 @@
+package handshake
+
+import (
+	"fmt"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/protocol"
+)
+
+// An Authorizer decides which peers are allowed to establish sessions.
+// Handshakers consult the Authorizer as soon as they have authenticated the
+// PeerID of the remote peer, and abort the handshake with an
+// ErrUnauthorizedPeer if the Authorizer returns an error. Implementations must
+// be safe for concurrent use.
+type Authorizer interface {
+	Authorize(peerID protocol.PeerID) error
+}
+
+type allowAll struct{}
+
+// NewAllowAll returns an Authorizer that authorizes all peers.
+func NewAllowAll() Authorizer {
+	return allowAll{}
+}
+
+func (allowAll) Authorize(protocol.PeerID) error {
+	return nil
+}
+
+type allowlist struct {
+	peerIDs map[string]struct{}
+}
+
+// NewAllowlist returns an Authorizer that only authorizes the given peers.
+func NewAllowlist(peerIDs ...protocol.PeerID) Authorizer {
+	list := allowlist{peerIDs: make(map[string]struct{}, len(peerIDs))}
+	for _, peerID := range peerIDs {
+		list.peerIDs[peerID.String()] = struct{}{}
+	}
+	return list
+}
+
+func (list allowlist) Authorize(peerID protocol.PeerID) error {
+	if _, ok := list.peerIDs[peerID.String()]; !ok {
+		return fmt.Errorf("peer=%v is not allowlisted", peerID)
+	}
+	return nil
+}
+
+type denylist struct {
+	peerIDs map[string]struct{}
+}
+
+// NewDenylist returns an Authorizer that authorizes all peers, except for the
+// given peers.
+func NewDenylist(peerIDs ...protocol.PeerID) Authorizer {
+	list := denylist{peerIDs: make(map[string]struct{}, len(peerIDs))}
+	for _, peerID := range peerIDs {
+		list.peerIDs[peerID.String()] = struct{}{}
+	}
+	return list
+}
+
+func (list denylist) Authorize(peerID protocol.PeerID) error {
+	if _, ok := list.peerIDs[peerID.String()]; ok {
+		return fmt.Errorf("peer=%v is denylisted", peerID)
+	}
+	return nil
+}
+
+type dhtGroupAuthorizer struct {
+	dht     dht.DHT
+	groupID protocol.GroupID
+}
+
+// NewDHTGroupAuthorizer returns an Authorizer that only authorizes the members
+// of a group in the DHT. Membership is checked during every handshake, so
+// changes to the group take effect for all new sessions.
+func NewDHTGroupAuthorizer(dht dht.DHT, groupID protocol.GroupID) Authorizer {
+	if dht == nil {
+		panic("invariant violation: DHT cannot be nil")
+	}
+	return dhtGroupAuthorizer{
+		dht:     dht,
+		groupID: groupID,
+	}
+}
+
+func (authorizer dhtGroupAuthorizer) Authorize(peerID protocol.PeerID) error {
+	peerIDs, err := authorizer.dht.GroupIDs(authorizer.groupID)
+	if err != nil {
+		return err
+	}
+	for _, member := range peerIDs {
+		if member.Equal(peerID) {
+			return nil
+		}
+	}
+	return fmt.Errorf("peer=%v is not a member of group=%v", peerID, authorizer.groupID)
+}
+
+// authorize the remote peer using the Authorizer.
+func authorize(authorizer Authorizer, peerID protocol.PeerID) error {
+	if err := authorizer.Authorize(peerID); err != nil {
+		return NewErrUnauthorizedPeer(peerID, err)
+	}
+	return nil
+}
+
+// ErrUnauthorizedPeer is returned when the Authorizer of a Handshaker rejects
+// the remote peer.
+type ErrUnauthorizedPeer struct {
+	error
+	PeerID protocol.PeerID
+	Reason error
+}
+
+// NewErrUnauthorizedPeer creates a new error which is returned when the remote
+// peer has been authenticated, but is not authorized to establish a session.
+func NewErrUnauthorizedPeer(peerID protocol.PeerID, reason error) error {
+	return ErrUnauthorizedPeer{
+		error:  fmt.Errorf("unauthorized peer=%v: %v", peerID, reason),
+		PeerID: peerID,
+		Reason: reason,
+	}
+}
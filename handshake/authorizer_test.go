@@ -0,0 +1,150 @@
+package handshake_test
+
+import (
+	"context"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/handshake"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/phi"
+)
+
+var _ = Describe("Authorizer", func() {
+
+	Context("when using an allowlist", func() {
+		It("should only authorize the given peers", func() {
+			allowed := RandomPeerID()
+			authorizer := NewAllowlist(allowed)
+			Expect(authorizer.Authorize(allowed)).To(Succeed())
+			Expect(authorizer.Authorize(RandomPeerID())).NotTo(Succeed())
+		})
+	})
+
+	Context("when using a denylist", func() {
+		It("should authorize all peers except for the given peers", func() {
+			denied := RandomPeerID()
+			authorizer := NewDenylist(denied)
+			Expect(authorizer.Authorize(denied)).NotTo(Succeed())
+			Expect(authorizer.Authorize(RandomPeerID())).To(Succeed())
+		})
+	})
+
+	Context("when using a dht group", func() {
+		It("should only authorize the current members of the group", func() {
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			groupID := RandomGroupID()
+			member, newMember := RandomPeerID(), RandomPeerID()
+			Expect(dht.AddGroup(groupID, protocol.PeerIDs{member})).To(Succeed())
+
+			authorizer := NewDHTGroupAuthorizer(dht, groupID)
+			Expect(authorizer.Authorize(member)).To(Succeed())
+			Expect(authorizer.Authorize(newMember)).NotTo(Succeed())
+
+			Expect(dht.AddGroup(groupID, protocol.PeerIDs{member, newMember})).To(Succeed())
+			Expect(authorizer.Authorize(newMember)).To(Succeed())
+		})
+
+		It("should not authorize any peers if the group does not exist", func() {
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			authorizer := NewDHTGroupAuthorizer(dht, RandomGroupID())
+			Expect(authorizer.Authorize(RandomPeerID())).NotTo(Succeed())
+		})
+
+		It("should panic if providing a nil DHT", func() {
+			Expect(func() {
+				_ = NewDHTGroupAuthorizer(nil, RandomGroupID())
+			}).Should(Panic())
+		})
+	})
+
+	Context("when handshaking", func() {
+		newHandshakers := map[string]func(protocol.SignVerifier, Authorizer) Handshaker{
+			"ecies": func(signVerifier protocol.SignVerifier, authorizer Authorizer) Handshaker {
+				return NewWithOptions(signVerifier, Options{Authorizer: authorizer}, NewGCMSessionManager())
+			},
+			"noise": func(signVerifier protocol.SignVerifier, authorizer Authorizer) Handshaker {
+				return NewNoiseWithOptions(signVerifier, Options{Authorizer: authorizer})
+			},
+		}
+
+		run := func(client, server Handshaker) (error, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			go func() {
+				<-ctx.Done()
+				clientConn.Close()
+				serverConn.Close()
+			}()
+
+			var clientErr, serverErr error
+			phi.ParBegin(func() {
+				_, clientErr = client.Handshake(ctx, clientConn, nil)
+				if clientErr != nil {
+					cancel()
+				}
+			}, func() {
+				_, serverErr = server.AcceptHandshake(ctx, serverConn)
+				if serverErr != nil {
+					cancel()
+				}
+			})
+			return clientErr, serverErr
+		}
+
+		for name, newHandshaker := range newHandshakers {
+			name, newHandshaker := name, newHandshaker
+
+			Context("when using the "+name+" handshaker", func() {
+				It("should succeed if both peers authorize each other", func() {
+					clientSignVerifier := NewMockSignVerifier()
+					serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+					clientSignVerifier.Whitelist(serverSignVerifier.ID())
+
+					client := newHandshaker(clientSignVerifier, NewAllowlist(SimplePeerID(serverSignVerifier.ID())))
+					server := newHandshaker(serverSignVerifier, NewAllowlist(SimplePeerID(clientSignVerifier.ID())))
+					clientErr, serverErr := run(client, server)
+					Expect(clientErr).NotTo(HaveOccurred())
+					Expect(serverErr).NotTo(HaveOccurred())
+				})
+
+				It("should return an ErrUnauthorizedPeer on the server if the server rejects the client", func() {
+					clientSignVerifier := NewMockSignVerifier()
+					serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+					clientSignVerifier.Whitelist(serverSignVerifier.ID())
+
+					client := newHandshaker(clientSignVerifier, nil)
+					server := newHandshaker(serverSignVerifier, NewDenylist(SimplePeerID(clientSignVerifier.ID())))
+					clientErr, serverErr := run(client, server)
+					Expect(serverErr).To(BeAssignableToTypeOf(ErrUnauthorizedPeer{}))
+					Expect(serverErr.(ErrUnauthorizedPeer).PeerID.String()).To(Equal(clientSignVerifier.ID()))
+					if name == "ecies" {
+						// The noise client sends its identity in the final
+						// handshake message, so it cannot observe the
+						// rejection until it uses the session.
+						Expect(clientErr).To(HaveOccurred())
+					}
+				})
+
+				It("should return an ErrUnauthorizedPeer on the client if the client rejects the server", func() {
+					clientSignVerifier := NewMockSignVerifier()
+					serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+					clientSignVerifier.Whitelist(serverSignVerifier.ID())
+
+					client := newHandshaker(clientSignVerifier, NewDenylist(SimplePeerID(serverSignVerifier.ID())))
+					server := newHandshaker(serverSignVerifier, nil)
+					clientErr, serverErr := run(client, server)
+					Expect(clientErr).To(BeAssignableToTypeOf(ErrUnauthorizedPeer{}))
+					Expect(clientErr.(ErrUnauthorizedPeer).PeerID.String()).To(Equal(serverSignVerifier.ID()))
+					Expect(serverErr).To(HaveOccurred())
+				})
+			})
+		}
+	})
+})
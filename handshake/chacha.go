@@ -0,0 +1,48 @@
+package handshake
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"github.com/renproject/aw/protocol"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+type chachaSessionManager struct{}
+
+// NewChaChaSessionManager returns a protocol.SessionManager that creates
+// ChaCha20-Poly1305 sessions. It is faster than AES-GCM on hardware without
+// AES instructions.
+func NewChaChaSessionManager() protocol.SessionManager {
+	return chachaSessionManager{}
+}
+
+func (chachaSessionManager) NewSession(peerID protocol.PeerID, key []byte) protocol.Session {
+	key32 := [32]byte{}
+	copy(key32[:], key)
+	return NewChaChaSession(peerID, key32)
+}
+
+func (chachaSessionManager) NewSessionKey() []byte {
+	key := [chacha20poly1305.KeySize]byte{}
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		panic(fmt.Errorf("invariant violation: cannot generate session key: %v", err))
+	}
+	return key[:]
+}
+
+func (chachaSessionManager) AEAD() protocol.AEAD {
+	return protocol.ChaCha20Poly1305
+}
+
+// NewChaChaSession returns a protocol.Session that seals message bodies with
+// ChaCha20-Poly1305, using the same framing and nonce scheme as
+// NewGCMSession.
+func NewChaChaSession(peerID protocol.PeerID, key [32]byte) protocol.Session {
+	aead, err := chacha20poly1305.New(key[:])
+	if err != nil {
+		panic(fmt.Errorf("invariant violation: cannot create chacha20poly1305: %v", err))
+	}
+	return newAEADSession(peerID, key, protocol.ChaCha20Poly1305, aead)
+}
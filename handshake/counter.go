@@ -0,0 +1,342 @@
+package handshake
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/renproject/aw/protocol"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// counterFlagNewEpoch is set on the first frame of every epoch. The frame
+	// carries the salt from which the key of the epoch is derived.
+	counterFlagNewEpoch = uint8(1)
+
+	counterHeaderLength = 1 + 4 + 8 // flags + epoch + counter
+	counterSaltLength   = 16
+)
+
+// counterKeyInfo is used as the HKDF info when deriving epoch keys.
+var counterKeyInfo = []byte("airwave counter session epoch key")
+
+// CounterSessionOptions are used to parameterise the rekeying behaviour of
+// counter sessions. A session rekeys after it has written MaxMessages
+// messages, or MaxBytes bytes of message bodies, with the same key (whichever
+// happens first).
+type CounterSessionOptions struct {
+	MaxMessages uint64 // Max messages sealed with one key. Defaults to 2^24.
+	MaxBytes    uint64 // Max bytes sealed with one key. Defaults to 4 GiB.
+}
+
+func (options *CounterSessionOptions) setZerosToDefaults() {
+	if options.MaxMessages == 0 {
+		options.MaxMessages = 1 << 24
+	}
+	if options.MaxBytes == 0 {
+		options.MaxBytes = 1 << 32
+	}
+}
+
+type counterSessionManager struct {
+	aead    protocol.AEAD
+	options CounterSessionOptions
+}
+
+// NewCounterSessionManager returns a protocol.SessionManager that creates
+// AES-256-GCM sessions with explicit message counters as nonces. See
+// NewCounterSession for more details.
+func NewCounterSessionManager(options CounterSessionOptions) protocol.SessionManager {
+	options.setZerosToDefaults()
+	return counterSessionManager{aead: protocol.AES256GCMCounter, options: options}
+}
+
+// NewChaChaCounterSessionManager returns a protocol.SessionManager that creates
+// ChaCha20-Poly1305 sessions with explicit message counters as nonces. See
+// NewChaChaCounterSession for more details.
+func NewChaChaCounterSessionManager(options CounterSessionOptions) protocol.SessionManager {
+	options.setZerosToDefaults()
+	return counterSessionManager{aead: protocol.ChaCha20Poly1305Counter, options: options}
+}
+
+func (manager counterSessionManager) NewSession(peerID protocol.PeerID, key []byte) protocol.Session {
+	key32 := [32]byte{}
+	copy(key32[:], key)
+	return newCounterSession(manager.aead, peerID, key32, manager.options)
+}
+
+func (counterSessionManager) NewSessionKey() []byte {
+	key := [32]byte{}
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		panic(fmt.Errorf("invariant violation: cannot generate session key: %v", err))
+	}
+	return key[:]
+}
+
+func (manager counterSessionManager) AEAD() protocol.AEAD {
+	return manager.aead
+}
+
+// counterDirection holds the key schedule for one direction of a counter
+// session.
+type counterDirection struct {
+	aead    protocol.AEAD
+	key     [32]byte // Key of the current epoch (or the session key, before the first epoch)
+	gcm     cipher.AEAD
+	started bool
+	epoch   uint32
+	counter uint64
+	bytes   uint64
+}
+
+// ratchet derives the key of the next epoch from the key of the current epoch
+// and the given salt.
+func (direction *counterDirection) ratchet(salt []byte) error {
+	kdf := hkdf.New(sha256.New, direction.key[:], salt, counterKeyInfo)
+	if _, err := io.ReadFull(kdf, direction.key[:]); err != nil {
+		return fmt.Errorf("error deriving epoch key: %v", err)
+	}
+	gcm, err := newCounterCipher(direction.aead, direction.key[:])
+	if err != nil {
+		return err
+	}
+	if direction.started {
+		direction.epoch++
+	}
+	direction.started = true
+	direction.gcm = gcm
+	direction.counter = 0
+	direction.bytes = 0
+	return nil
+}
+
+// newCounterCipher returns the cipher of the AEAD with the given key.
+func newCounterCipher(aead protocol.AEAD, key []byte) (cipher.AEAD, error) {
+	if aead == protocol.ChaCha20Poly1305Counter {
+		chacha, err := chacha20poly1305.New(key)
+		if err != nil {
+			return nil, fmt.Errorf("error creating chacha20poly1305: %v", err)
+		}
+		return chacha, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error creating galois/counter mode: %v", err)
+	}
+	return gcm, nil
+}
+
+type counterSession struct {
+	aead    protocol.AEAD
+	peerID  protocol.PeerID
+	options CounterSessionOptions
+	send    counterDirection
+	recv    counterDirection
+	limits  protocol.SizeLimits
+}
+
+// NewCounterSession returns a protocol.Session that seals message bodies with
+// AES-256-GCM, using explicit per-direction message counters as nonces.
+//
+// Each direction derives its own key from the session key and a random salt,
+// which is sent in-band at the start of every epoch, so the same session key
+// can safely be used by both peers. After MaxMessages messages or MaxBytes
+// bytes, the writer starts a new epoch by ratcheting its key forward with a
+// fresh salt. The reader expects every message in order and returns an
+// ErrMessageOutOfOrder for replayed, reordered or dropped messages.
+func NewCounterSession(peerID protocol.PeerID, key [32]byte, options CounterSessionOptions) protocol.Session {
+	return newCounterSession(protocol.AES256GCMCounter, peerID, key, options)
+}
+
+// NewChaChaCounterSession returns a protocol.Session that seals message bodies
+// with ChaCha20-Poly1305, using the same framing, counters and rekeying as
+// NewCounterSession. It is faster than NewCounterSession on hardware without
+// AES instructions.
+func NewChaChaCounterSession(peerID protocol.PeerID, key [32]byte, options CounterSessionOptions) protocol.Session {
+	return newCounterSession(protocol.ChaCha20Poly1305Counter, peerID, key, options)
+}
+
+func newCounterSession(aead protocol.AEAD, peerID protocol.PeerID, key [32]byte, options CounterSessionOptions) protocol.Session {
+	options.setZerosToDefaults()
+	return &counterSession{
+		aead:    aead,
+		peerID:  peerID,
+		options: options,
+		send:    counterDirection{aead: aead, key: key},
+		recv:    counterDirection{aead: aead, key: key},
+		limits:  protocol.DefaultSizeLimits(),
+	}
+}
+
+func (session *counterSession) setSizeLimits(limits protocol.SizeLimits) {
+	session.limits = limits
+}
+
+func (session *counterSession) ReadMessageOnTheWire(r io.Reader) (protocol.MessageOnTheWire, error) {
+	otw := protocol.MessageOnTheWire{}
+	otw.From = session.peerID
+	if err := otw.Message.UnmarshalReaderWithLimits(r, session.limits); err != nil {
+		return otw, err
+	}
+
+	body := otw.Message.Body
+	if len(body) < counterHeaderLength {
+		return otw, fmt.Errorf("error reading message: body length=%v is too short", len(body))
+	}
+	header := body[:counterHeaderLength]
+	flags := header[0]
+	epoch := binary.LittleEndian.Uint32(header[1:])
+	counter := binary.LittleEndian.Uint64(header[5:])
+	body = body[counterHeaderLength:]
+
+	// Check that this is exactly the message we expect next: either the next
+	// message in the current epoch, or the first message of the next epoch.
+	inOrder := false
+	if flags&counterFlagNewEpoch == 0 {
+		inOrder = session.recv.started && epoch == session.recv.epoch && counter == session.recv.counter
+	} else if session.recv.started {
+		inOrder = epoch == session.recv.epoch+1 && counter == 0
+	} else {
+		inOrder = epoch == 0 && counter == 0
+	}
+	if !inOrder {
+		return otw, NewErrMessageOutOfOrder(epoch, counter, session.recv.epoch, session.recv.counter)
+	}
+
+	ad := counterAd(otw.Message, header)
+	recv := session.recv
+	if flags&counterFlagNewEpoch != 0 {
+		if len(body) < counterSaltLength {
+			return otw, fmt.Errorf("error reading message: missing epoch salt")
+		}
+		salt := body[:counterSaltLength]
+		body = body[counterSaltLength:]
+		ad = append(ad, salt...)
+		if err := recv.ratchet(salt); err != nil {
+			return otw, err
+		}
+	}
+
+	plaintext, err := recv.gcm.Open(nil, counterNonce(counter), body, ad)
+	if err != nil {
+		return otw, err
+	}
+
+	// Only commit to the new state once the message has been authenticated.
+	recv.counter++
+	session.recv = recv
+
+	otw.Message.Body = plaintext
+	length := otw.Message.HeaderLength()
+	otw.Message.Length = protocol.MessageLength(len(otw.Message.Body) + length)
+	return otw, nil
+}
+
+func (session *counterSession) Negotiation() protocol.Negotiation {
+	return protocol.DefaultNegotiation(session.aead)
+}
+
+func (session *counterSession) WriteMessage(w io.Writer, message protocol.Message) error {
+	flags := uint8(0)
+	salt := []byte{}
+	if !session.send.started ||
+		session.send.counter >= session.options.MaxMessages ||
+		session.send.bytes >= session.options.MaxBytes {
+		if session.send.started && session.send.epoch == math.MaxUint32 {
+			return fmt.Errorf("error writing message: epochs exhausted")
+		}
+		salt = make([]byte, counterSaltLength)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return fmt.Errorf("error generating epoch salt: %v", err)
+		}
+		if err := session.send.ratchet(salt); err != nil {
+			return err
+		}
+		flags |= counterFlagNewEpoch
+	}
+
+	header := make([]byte, counterHeaderLength)
+	header[0] = flags
+	binary.LittleEndian.PutUint32(header[1:], session.send.epoch)
+	binary.LittleEndian.PutUint64(header[5:], session.send.counter)
+	ad := append(counterAd(message, header), salt...)
+
+	buf := bytes.NewBuffer(make([]byte, 0, counterHeaderLength+len(salt)+len(message.Body)+session.send.gcm.Overhead()))
+	buf.Write(header)
+	buf.Write(salt)
+	buf.Write(session.send.gcm.Seal(nil, counterNonce(session.send.counter), message.Body, ad))
+	session.send.counter++
+	session.send.bytes += uint64(len(message.Body))
+
+	message.Body = buf.Bytes()
+	length := message.HeaderLength()
+	message.Length = protocol.MessageLength(len(message.Body) + length)
+
+	data, err := message.MarshalBinaryWithLimits(session.limits)
+	if err != nil {
+		return fmt.Errorf("error writing message: %v", err)
+	}
+	n, err := w.Write(data)
+	if n != len(data) {
+		return fmt.Errorf("error writing message: expected n=%v, got n=%v", len(data), n)
+	}
+	return err
+}
+
+// counterNonce returns 32 bits of zeros followed by the big-endian counter.
+// Nonces are only unique within an epoch, because every epoch uses a new key.
+func counterNonce(counter uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// counterAd returns the additional data authenticated alongside the message
+// body: the parts of the message header that are not modified by encryption,
+// including the extensions of V2 messages, followed by the counter header.
+func counterAd(message protocol.Message, header []byte) []byte {
+	extensions := extensionsAd(message)
+	ad := make([]byte, 4, 4+len(message.GroupID)+len(extensions)+len(header)+counterSaltLength)
+	binary.LittleEndian.PutUint16(ad[0:], uint16(message.Version))
+	binary.LittleEndian.PutUint16(ad[2:], uint16(message.Variant))
+	ad = append(ad, message.GroupID[:]...)
+	ad = append(ad, extensions...)
+	return append(ad, header...)
+}
+
+// ErrMessageOutOfOrder is returned by a counter session when it reads a
+// message that is not the next message it expects. This happens when a
+// message has been replayed, reordered or dropped.
+type ErrMessageOutOfOrder struct {
+	error
+	Epoch           uint32
+	Counter         uint64
+	ExpectedEpoch   uint32
+	ExpectedCounter uint64
+}
+
+// NewErrMessageOutOfOrder creates a new error which is returned when a message
+// with the given epoch and counter is read, but the next message was expected
+// to have the expected counter (in the expected epoch, or at the start of the
+// following epoch).
+func NewErrMessageOutOfOrder(epoch uint32, counter uint64, expectedEpoch uint32, expectedCounter uint64) error {
+	return ErrMessageOutOfOrder{
+		error:           fmt.Errorf("message epoch=%v counter=%v is out of order: expected epoch=%v counter=%v", epoch, counter, expectedEpoch, expectedCounter),
+		Epoch:           epoch,
+		Counter:         counter,
+		ExpectedEpoch:   expectedEpoch,
+		ExpectedCounter: expectedCounter,
+	}
+}
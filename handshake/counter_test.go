@@ -0,0 +1,235 @@
+package handshake_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing/quick"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/handshake"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/renproject/aw/protocol"
+)
+
+var _ = Describe("Counter session manager", func() {
+
+	// epochOf returns the epoch and counter of a sealed message that has been
+	// written to the buffer, without consuming it.
+	epochOf := func(data []byte) (uint32, uint64) {
+		var message protocol.Message
+		Expect(message.UnmarshalBinary(data)).To(Succeed())
+		return binary.LittleEndian.Uint32(message.Body[1:]), binary.LittleEndian.Uint64(message.Body[5:])
+	}
+
+	Context("when writing and reading message with the same session keys", func() {
+		It("should be able to write and then read", func() {
+			manager := NewCounterSessionManager(CounterSessionOptions{})
+			sender, receiver := RandomPeerID(), RandomPeerID()
+			key := manager.NewSessionKey()
+			senderSession := manager.NewSession(receiver, key)
+			receiverSession := manager.NewSession(sender, key)
+
+			test := func() bool {
+				buf := bytes.NewBuffer([]byte{})
+				sentMsg := RandomMessage(protocol.V1, RandomMessageVariant())
+				Expect(senderSession.WriteMessage(buf, sentMsg)).NotTo(HaveOccurred())
+
+				receivedMsg, err := receiverSession.ReadMessageOnTheWire(buf)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(receivedMsg.From.Equal(sender)).Should(BeTrue())
+				return cmp.Equal(receivedMsg.Message, sentMsg, cmpopts.EquateEmpty())
+			}
+
+			Expect(quick.Check(test, nil)).NotTo(HaveOccurred())
+		})
+
+		It("should derive different keys for each direction", func() {
+			manager := NewCounterSessionManager(CounterSessionOptions{})
+			key := manager.NewSessionKey()
+			session1 := manager.NewSession(RandomPeerID(), key)
+			session2 := manager.NewSession(RandomPeerID(), key)
+
+			// Both sessions seal the same message with counter zero.
+			message := RandomMessage(protocol.V1, protocol.Cast)
+			buf1, buf2 := bytes.NewBuffer([]byte{}), bytes.NewBuffer([]byte{})
+			Expect(session1.WriteMessage(buf1, message)).To(Succeed())
+			Expect(session2.WriteMessage(buf2, message)).To(Succeed())
+			Expect(bytes.Equal(buf1.Bytes(), buf2.Bytes())).To(BeFalse())
+
+			// And they can still read each other's messages.
+			received, err := session2.ReadMessageOnTheWire(buf1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cmp.Equal(received.Message, message, cmpopts.EquateEmpty())).To(BeTrue())
+			received, err = session1.ReadMessageOnTheWire(buf2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cmp.Equal(received.Message, message, cmpopts.EquateEmpty())).To(BeTrue())
+		})
+	})
+
+	Context("when writing and reading message with the different session keys", func() {
+		It("should not be able to write and then read", func() {
+			manager := NewCounterSessionManager(CounterSessionOptions{})
+			session1 := manager.NewSession(RandomPeerID(), manager.NewSessionKey())
+			session2 := manager.NewSession(RandomPeerID(), manager.NewSessionKey())
+
+			buf := bytes.NewBuffer([]byte{})
+			Expect(session1.WriteMessage(buf, RandomMessage(protocol.V1, RandomMessageVariant()))).NotTo(HaveOccurred())
+			_, err := session2.ReadMessageOnTheWire(buf)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when a message is replayed", func() {
+		It("should return an ErrMessageOutOfOrder", func() {
+			manager := NewCounterSessionManager(CounterSessionOptions{})
+			key := manager.NewSessionKey()
+			sender := manager.NewSession(RandomPeerID(), key)
+			receiver := manager.NewSession(RandomPeerID(), key)
+
+			buf := bytes.NewBuffer([]byte{})
+			Expect(sender.WriteMessage(buf, RandomMessage(protocol.V1, protocol.Cast))).To(Succeed())
+			data := append([]byte{}, buf.Bytes()...)
+			_, err := receiver.ReadMessageOnTheWire(buf)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = receiver.ReadMessageOnTheWire(bytes.NewBuffer(data))
+			Expect(err).To(BeAssignableToTypeOf(ErrMessageOutOfOrder{}))
+			Expect(err.(ErrMessageOutOfOrder).Counter).To(Equal(uint64(0)))
+			Expect(err.(ErrMessageOutOfOrder).ExpectedCounter).To(Equal(uint64(1)))
+		})
+	})
+
+	Context("when messages are reordered", func() {
+		It("should return an ErrMessageOutOfOrder and keep accepting messages in order", func() {
+			manager := NewCounterSessionManager(CounterSessionOptions{})
+			key := manager.NewSessionKey()
+			sender := manager.NewSession(RandomPeerID(), key)
+			receiver := manager.NewSession(RandomPeerID(), key)
+
+			bufs := make([]*bytes.Buffer, 3)
+			for i := range bufs {
+				bufs[i] = bytes.NewBuffer([]byte{})
+				Expect(sender.WriteMessage(bufs[i], RandomMessage(protocol.V1, protocol.Cast))).To(Succeed())
+			}
+
+			_, err := receiver.ReadMessageOnTheWire(bufs[0])
+			Expect(err).NotTo(HaveOccurred())
+			_, err = receiver.ReadMessageOnTheWire(bytes.NewBuffer(bufs[2].Bytes()))
+			Expect(err).To(BeAssignableToTypeOf(ErrMessageOutOfOrder{}))
+			_, err = receiver.ReadMessageOnTheWire(bufs[1])
+			Expect(err).NotTo(HaveOccurred())
+			_, err = receiver.ReadMessageOnTheWire(bufs[2])
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Context("when a message has been tampered with", func() {
+		It("should return an error without advancing the counter", func() {
+			manager := NewCounterSessionManager(CounterSessionOptions{})
+			key := manager.NewSessionKey()
+			sender := manager.NewSession(RandomPeerID(), key)
+			receiver := manager.NewSession(RandomPeerID(), key)
+
+			buf := bytes.NewBuffer([]byte{})
+			Expect(sender.WriteMessage(buf, RandomMessage(protocol.V1, protocol.Cast))).To(Succeed())
+			data := append([]byte{}, buf.Bytes()...)
+			data[len(data)-1] ^= 0xFF
+			_, err := receiver.ReadMessageOnTheWire(bytes.NewBuffer(data))
+			Expect(err).To(HaveOccurred())
+
+			_, err = receiver.ReadMessageOnTheWire(buf)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Context("when the message limit of an epoch is reached", func() {
+		It("should rekey in-band", func() {
+			manager := NewCounterSessionManager(CounterSessionOptions{MaxMessages: 2})
+			key := manager.NewSessionKey()
+			sender := manager.NewSession(RandomPeerID(), key)
+			receiver := manager.NewSession(RandomPeerID(), key)
+
+			expected := [][2]uint64{{0, 0}, {0, 1}, {1, 0}, {1, 1}, {2, 0}}
+			for _, ec := range expected {
+				buf := bytes.NewBuffer([]byte{})
+				message := RandomMessage(protocol.V1, RandomMessageVariant())
+				Expect(sender.WriteMessage(buf, message)).To(Succeed())
+				epoch, counter := epochOf(buf.Bytes())
+				Expect(uint64(epoch)).To(Equal(ec[0]))
+				Expect(counter).To(Equal(ec[1]))
+
+				received, err := receiver.ReadMessageOnTheWire(buf)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cmp.Equal(received.Message, message, cmpopts.EquateEmpty())).To(BeTrue())
+			}
+		})
+	})
+
+	Context("when the byte limit of an epoch is reached", func() {
+		It("should rekey in-band", func() {
+			manager := NewCounterSessionManager(CounterSessionOptions{MaxBytes: 1})
+			key := manager.NewSessionKey()
+			sender := manager.NewSession(RandomPeerID(), key)
+			receiver := manager.NewSession(RandomPeerID(), key)
+
+			for i := 0; i < 3; i++ {
+				buf := bytes.NewBuffer([]byte{})
+				message := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, RandomBytes(8))
+				Expect(sender.WriteMessage(buf, message)).To(Succeed())
+				epoch, counter := epochOf(buf.Bytes())
+				Expect(epoch).To(Equal(uint32(i)))
+				Expect(counter).To(Equal(uint64(0)))
+
+				_, err := receiver.ReadMessageOnTheWire(buf)
+				Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	})
+
+	Context("when using ChaCha20-Poly1305", func() {
+		It("should be duplex", func() {
+			manager := NewChaChaCounterSessionManager(CounterSessionOptions{})
+			Expect(protocol.SessionManagerAEAD(manager)).To(Equal(protocol.ChaCha20Poly1305Counter))
+			Expect(protocol.SessionManagerAEAD(manager).IsDuplex()).To(BeTrue())
+			session := manager.NewSession(RandomPeerID(), manager.NewSessionKey())
+			Expect(session.Negotiation().AEAD).To(Equal(protocol.ChaCha20Poly1305Counter))
+		})
+
+		It("should be able to write and then read, and rekey in-band", func() {
+			manager := NewChaChaCounterSessionManager(CounterSessionOptions{MaxMessages: 2})
+			key := manager.NewSessionKey()
+			sender := manager.NewSession(RandomPeerID(), key)
+			receiver := manager.NewSession(RandomPeerID(), key)
+
+			expected := [][2]uint64{{0, 0}, {0, 1}, {1, 0}, {1, 1}, {2, 0}}
+			for _, ec := range expected {
+				buf := bytes.NewBuffer([]byte{})
+				message := RandomMessage(protocol.V1, RandomMessageVariant())
+				Expect(sender.WriteMessage(buf, message)).To(Succeed())
+				epoch, counter := epochOf(buf.Bytes())
+				Expect(uint64(epoch)).To(Equal(ec[0]))
+				Expect(counter).To(Equal(ec[1]))
+
+				received, err := receiver.ReadMessageOnTheWire(buf)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cmp.Equal(received.Message, message, cmpopts.EquateEmpty())).To(BeTrue())
+			}
+		})
+
+		It("should not be able to read messages sealed with AES-256-GCM", func() {
+			key := [32]byte{}
+			copy(key[:], RandomBytes(32))
+			sender := NewCounterSession(RandomPeerID(), key, CounterSessionOptions{})
+			receiver := NewChaChaCounterSession(RandomPeerID(), key, CounterSessionOptions{})
+
+			buf := bytes.NewBuffer([]byte{})
+			Expect(sender.WriteMessage(buf, RandomMessage(protocol.V1, protocol.Cast))).To(Succeed())
+			_, err := receiver.ReadMessageOnTheWire(buf)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -3,9 +3,7 @@ package handshake
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"encoding/binary"
 	"fmt"
-	"io"
 	"math/rand"
 
 	"github.com/renproject/aw/protocol"
@@ -35,11 +33,8 @@ func (gcmSessionManager) NewSessionKey() []byte {
 	return key[:]
 }
 
-type gcmSession struct {
-	peerID protocol.PeerID
-	key    [32]byte
-	gcm    cipher.AEAD
-	rand   *rand.Rand
+func (gcmSessionManager) AEAD() protocol.AEAD {
+	return protocol.AES256GCM
 }
 
 func NewGCMSession(peerID protocol.PeerID, key [32]byte) protocol.Session {
@@ -51,53 +46,5 @@ func NewGCMSession(peerID protocol.PeerID, key [32]byte) protocol.Session {
 	if err != nil {
 		panic(fmt.Errorf("invariant violation: cannot create galios/counter mode: %v", err))
 	}
-	seed := binary.BigEndian.Uint64(key[:8])
-	return &gcmSession{
-		peerID: peerID,
-		key:    key,
-		gcm:    gcm,
-		rand:   rand.New(rand.NewSource(int64(seed))),
-	}
-}
-
-func (session *gcmSession) ReadMessageOnTheWire(r io.Reader) (protocol.MessageOnTheWire, error) {
-	otw := protocol.MessageOnTheWire{}
-	otw.From = session.peerID
-	if err := otw.Message.UnmarshalReader(r); err != nil {
-		return otw, err
-	}
-
-	nonce := make([]byte, session.gcm.NonceSize())
-	_, err := session.rand.Read(nonce)
-	if err != nil {
-		return otw, err
-	}
-	otw.Message.Body, err = session.gcm.Open(nil, nonce, otw.Message.Body, nil)
-	if err != nil {
-		return otw, err
-	}
-	length := otw.Message.Variant.NonBodyLength()
-	otw.Message.Length = protocol.MessageLength(len(otw.Message.Body) + length)
-	return otw, nil
-}
-
-func (session *gcmSession) WriteMessage(w io.Writer, message protocol.Message) error {
-	nonce := make([]byte, session.gcm.NonceSize())
-	_, err := session.rand.Read(nonce)
-	if err != nil {
-		return err
-	}
-	message.Body = session.gcm.Seal(nil, nonce, message.Body, nil)
-	length := message.Variant.NonBodyLength()
-	message.Length = protocol.MessageLength(len(message.Body) + length)
-
-	data, err := message.MarshalBinary()
-	if err != nil {
-		return fmt.Errorf("error writing message: %v", err)
-	}
-	n, err := w.Write(data)
-	if n != len(data) {
-		return fmt.Errorf("error writing message: expected n=%v, got n=%v", len(data), n)
-	}
-	return err
+	return newAEADSession(peerID, key, protocol.AES256GCM, gcm)
 }
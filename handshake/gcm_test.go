@@ -74,5 +74,30 @@ var _ = Describe("GCM session manager", func() {
 				Expect(quick.Check(test, nil)).NotTo(HaveOccurred())
 			})
 		})
+
+		Context("when the header of a message has been tampered with", func() {
+			It("should fail to read the message", func() {
+				manager := NewGCMSessionManager()
+				key := manager.NewSessionKey()
+				sender := manager.NewSession(RandomPeerID(), key)
+				receiver := manager.NewSession(RandomPeerID(), key)
+
+				buf := bytes.NewBuffer([]byte{})
+				message := RandomMessage(protocol.V2, protocol.Cast)
+				message.SetTTL(3)
+				Expect(sender.WriteMessage(buf, message)).To(Succeed())
+
+				// Flip a byte of the TTL extension, without touching the
+				// sealed body.
+				var tampered protocol.Message
+				Expect(tampered.UnmarshalBinary(buf.Bytes())).To(Succeed())
+				tampered.Extensions[0].Value[0] ^= 0xFF
+				data, err := tampered.MarshalBinary()
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = receiver.ReadMessageOnTheWire(bytes.NewBuffer(data))
+				Expect(err).To(HaveOccurred())
+			})
+		})
 	})
 })
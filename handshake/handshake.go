@@ -12,13 +12,16 @@ import (
 	"github.com/ethereum/go-ethereum/crypto/ecies"
 	"github.com/ethereum/go-ethereum/crypto/secp256k1"
 	"github.com/renproject/aw/protocol"
+	"golang.org/x/sys/cpu"
 )
 
 type Handshaker interface {
 	// Handshake with a remote server by initiating, and then interactively
 	// completing, a handshake protocol. The remote server is accessed by
-	// reading/writing to the `io.ReaderWriter`.
-	Handshake(ctx context.Context, rw io.ReadWriter) (protocol.Session, error)
+	// reading/writing to the `io.ReaderWriter`. If the expected PeerID is not
+	// nil, the handshake is aborted with an ErrUnexpectedPeer as soon as the
+	// remote server authenticates itself as a different peer.
+	Handshake(ctx context.Context, rw io.ReadWriter, expected protocol.PeerID) (protocol.Session, error)
 
 	// AcceptHandshake from a remote client by waiting for the initiation of,
 	// and then interactively completing, a handshake protocol. The remote
@@ -27,25 +30,94 @@ type Handshaker interface {
 }
 
 type handshaker struct {
-	signVerifier   protocol.SignVerifier
-	sessionManager protocol.SessionManager
+	signVerifier         protocol.SignVerifier
+	capabilities         protocol.Capabilities
+	authorizer           Authorizer
+	tickets              *TicketStore
+	limits               protocol.SizeLimits
+	compressionThreshold int
+	sessionManagers      []protocol.SessionManager
 }
 
-func New(signVerifier protocol.SignVerifier, sessionManager protocol.SessionManager) Handshaker {
+// New returns a Handshaker that exchanges ECIES-encrypted session key halves,
+// using the default Options. See NewWithOptions for more details.
+func New(signVerifier protocol.SignVerifier, sessionManagers ...protocol.SessionManager) Handshaker {
+	return NewWithOptions(signVerifier, Options{}, sessionManagers...)
+}
+
+// NewWithOptions returns a Handshaker that exchanges ECIES-encrypted session
+// key halves. During the handshake, both peers exchange signed
+// protocol.Capabilities and negotiate the values used by the session. The
+// SessionManagers are given in order of preference, and replace the AEADs of
+// the Capabilities. The session is created by the first SessionManager of the
+// client whose AEAD is also supported by the server. The remote peer is
+// authorized before any session key is sent. If the Options contain a
+// TicketStore, the Handshaker issues resumption tickets to its clients, and
+// resumes sessions with servers that have issued tickets to it.
+func NewWithOptions(signVerifier protocol.SignVerifier, options Options, sessionManagers ...protocol.SessionManager) Handshaker {
 	if signVerifier == nil {
 		panic("invariant violation: SignVerifier cannot be nil")
 	}
-	if sessionManager == nil {
+	options.setZerosToDefaults()
+	capabilities := options.Capabilities
+	if len(sessionManagers) == 0 {
 		panic("invariant violation: SessionManager cannot be nil")
 	}
+	seen := map[protocol.AEAD]struct{}{}
+	capabilities.AEADs = make([]protocol.AEAD, len(sessionManagers))
+	for i, sessionManager := range sessionManagers {
+		if sessionManager == nil {
+			panic("invariant violation: SessionManager cannot be nil")
+		}
+		aead := protocol.SessionManagerAEAD(sessionManager)
+		if _, ok := seen[aead]; ok {
+			panic(fmt.Sprintf("invariant violation: duplicate SessionManager for aead=%v", aead))
+		}
+		seen[aead] = struct{}{}
+		capabilities.AEADs[i] = aead
+	}
 	return &handshaker{
-		signVerifier:   signVerifier,
-		sessionManager: sessionManager,
+		signVerifier:         signVerifier,
+		capabilities:         capabilities,
+		authorizer:           options.Authorizer,
+		tickets:              options.Tickets,
+		limits:               options.SizeLimits,
+		compressionThreshold: options.CompressionThreshold,
+		sessionManagers:      sessionManagers,
+	}
+}
+
+// NewSessionManagers returns the SessionManagers for all supported AEADs, in
+// order of preference. ChaCha20-Poly1305 is preferred when the CPU does not
+// implement AES instructions, and AES-256-GCM is preferred otherwise. For each
+// cipher, counter sessions are preferred, because they can be written by both
+// peers, so that one connection is enough for both directions.
+func NewSessionManagers() []protocol.SessionManager {
+	gcm := []protocol.SessionManager{NewCounterSessionManager(CounterSessionOptions{}), NewGCMSessionManager()}
+	chacha := []protocol.SessionManager{NewChaChaCounterSessionManager(CounterSessionOptions{}), NewChaChaSessionManager()}
+	if hasAESHardware() {
+		return append(gcm, chacha...)
 	}
+	return append(chacha, gcm...)
 }
 
-func (hs *handshaker) Handshake(ctx context.Context, rw io.ReadWriter) (protocol.Session, error) {
-	// 1. Write self ECDSA public key and Signature of it.
+func (hs *handshaker) Handshake(ctx context.Context, rw io.ReadWriter, expected protocol.PeerID) (protocol.Session, error) {
+	// Try to resume a session with the expected peer. If the server rejects
+	// the ticket, fall back to the full handshake.
+	if hs.tickets != nil && expected != nil {
+		if ticket, ok := hs.tickets.ticket(expected); ok {
+			session, err := hs.resume(rw, ticket)
+			if err != errTicketRejected {
+				return session, err
+			}
+			hs.tickets.forget(expected)
+		}
+	}
+	if err := write(rw, []byte{modeFull}); err != nil {
+		return nil, fmt.Errorf("error writing handshake mode: %v", err)
+	}
+
+	// 1. Write self ECDSA public key, capabilities and Signature of them.
 	localPrivateKey, err := ecdsa.GenerateKey(secp256k1.S256(), rand.Reader)
 	if err != nil {
 		return nil, fmt.Errorf("error generating new ecdsa key : %v", err)
@@ -54,14 +126,25 @@ func (hs *handshaker) Handshake(ctx context.Context, rw io.ReadWriter) (protocol
 		return nil, err
 	}
 
-	// 2. Read the remote ECDSA public key and verify the signature.
-	remotePublicKey, remotePeerID, err := hs.readPublicKey(rw)
+	// 2. Read the remote ECDSA public key and capabilities, and verify the
+	// signature.
+	remotePublicKey, remotePeerID, remoteCapabilities, err := hs.readPublicKey(rw)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyExpectedPeer(expected, remotePeerID); err != nil {
+		return nil, err
+	}
+	if err := authorize(hs.authorizer, remotePeerID); err != nil {
+		return nil, err
+	}
+	negotiation, sessionManager, err := hs.negotiate(hs.capabilities, remoteCapabilities)
 	if err != nil {
 		return nil, err
 	}
 
 	// 3. Generate a session key, encrypted with remote ECDSA key and write to server
-	localSessionKey := hs.sessionManager.NewSessionKey()
+	localSessionKey := sessionManager.NewSessionKey()
 	if err := hs.writeEncrypted(rw, localSessionKey, remotePublicKey); err != nil {
 		return nil, err
 	}
@@ -72,17 +155,49 @@ func (hs *handshaker) Handshake(ctx context.Context, rw io.ReadWriter) (protocol
 		return nil, err
 	}
 
-	return hs.sessionManager.NewSession(remotePeerID, xorSessionKeys(localSessionKey, remoteSessionKey)), nil
+	sessionKey, err := xorSessionKeys(localSessionKey, remoteSessionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// 5. Read the resumption ticket issued by the server.
+	if err := hs.readTicket(rw, remotePeerID, sessionKey, negotiation); err != nil {
+		return nil, err
+	}
+	return newNegotiatedSession(sessionManager.NewSession(remotePeerID, sessionKey), negotiation, hs.limits, hs.compressionThreshold), nil
 }
 
 func (hs *handshaker) AcceptHandshake(ctx context.Context, rw io.ReadWriter) (protocol.Session, error) {
-	// 1. Read the remote ECDSA public key and verify the signature.
-	remotePublicKey, remotePeerID, err := hs.readPublicKey(rw)
+	// 0. Read whether the client wants to resume a session. If the ticket is
+	// rejected, the client continues with the full handshake.
+	mode, err := hs.readMode(rw)
+	if err != nil {
+		return nil, err
+	}
+	if mode == modeResume {
+		session, ok, err := hs.acceptResumption(rw)
+		if err != nil || ok {
+			return session, err
+		}
+		if mode, err = hs.readMode(rw); err != nil {
+			return nil, err
+		}
+	}
+	if mode != modeFull {
+		return nil, fmt.Errorf("unexpected handshake mode=%v", mode)
+	}
+
+	// 1. Read the remote ECDSA public key and capabilities, and verify the
+	// signature.
+	remotePublicKey, remotePeerID, remoteCapabilities, err := hs.readPublicKey(rw)
 	if err != nil {
 		return nil, err
 	}
+	if err := authorize(hs.authorizer, remotePeerID); err != nil {
+		return nil, err
+	}
 
-	// 2. Write self ecdsa public key and Signature of it.
+	// 2. Write self ecdsa public key, capabilities and Signature of them.
 	localPrivateKey, err := ecdsa.GenerateKey(secp256k1.S256(), rand.Reader)
 	if err != nil {
 		return nil, fmt.Errorf("error generating new ecdsa key : %v", err)
@@ -90,6 +205,10 @@ func (hs *handshaker) AcceptHandshake(ctx context.Context, rw io.ReadWriter) (pr
 	if err := hs.writePublicKey(rw, localPrivateKey); err != nil {
 		return nil, err
 	}
+	negotiation, sessionManager, err := hs.negotiate(remoteCapabilities, hs.capabilities)
+	if err != nil {
+		return nil, err
+	}
 
 	// 3. Read and decrypt the session key from the client.
 	remoteSessionKey, err := hs.readEncrypted(rw, localPrivateKey)
@@ -98,21 +217,71 @@ func (hs *handshaker) AcceptHandshake(ctx context.Context, rw io.ReadWriter) (pr
 	}
 
 	// 4. Generate a session key and write to client
-	localSessionKey := hs.sessionManager.NewSessionKey()
+	localSessionKey := sessionManager.NewSessionKey()
 	if err := hs.writeEncrypted(rw, localSessionKey, remotePublicKey); err != nil {
 		return nil, err
 	}
-	return hs.sessionManager.NewSession(remotePeerID, xorSessionKeys(localSessionKey, remoteSessionKey)), nil
+	sessionKey, err := xorSessionKeys(localSessionKey, remoteSessionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// 5. Issue a resumption ticket to the client.
+	if err := hs.writeTicket(rw, remotePeerID, sessionKey, negotiation); err != nil {
+		return nil, err
+	}
+	return newNegotiatedSession(sessionManager.NewSession(remotePeerID, sessionKey), negotiation, hs.limits, hs.compressionThreshold), nil
 }
 
-// Write the ecdsa public along with a signature of it through the io.Writer
+// readMode reads the handshake mode chosen by the client.
+func (hs *handshaker) readMode(r io.Reader) (byte, error) {
+	mode, err := read(r, hs.limits.MaxHandshakeLength)
+	if err != nil {
+		return 0, wrapReadError("error reading handshake mode from io.Reader (potential rate limit)", err)
+	}
+	if len(mode) != 1 {
+		return 0, fmt.Errorf("error reading handshake mode: expected len=1, got len=%v", len(mode))
+	}
+	return mode[0], nil
+}
+
+// negotiate the values used by the session, and return the local
+// SessionManager for the negotiated AEAD.
+func (hs *handshaker) negotiate(client, server protocol.Capabilities) (protocol.Negotiation, protocol.SessionManager, error) {
+	negotiation, err := negotiate(client, server)
+	if err != nil {
+		return negotiation, nil, err
+	}
+	sessionManager, err := hs.sessionManager(negotiation.AEAD)
+	return negotiation, sessionManager, err
+}
+
+// sessionManager returns the local SessionManager for the AEAD.
+func (hs *handshaker) sessionManager(aead protocol.AEAD) (protocol.SessionManager, error) {
+	for _, sessionManager := range hs.sessionManagers {
+		if protocol.SessionManagerAEAD(sessionManager) == aead {
+			return sessionManager, nil
+		}
+	}
+	return nil, fmt.Errorf("invariant violation: no SessionManager for aead=%v", aead)
+}
+
+// Write the ecdsa public key and the capabilities, along with a signature of
+// them, through the io.Writer
 func (hs *handshaker) writePublicKey(w io.Writer, key *ecdsa.PrivateKey) error {
 	localPublicKey := key.PublicKey
 	localPublicKeyBytes := crypto.FromECDSAPub(&localPublicKey)
 	if err := write(w, localPublicKeyBytes); err != nil {
 		return fmt.Errorf("error writing ecdsa.PublicKey to io.Writer: %v", err)
 	}
-	pubKeySig, err := hs.signVerifier.Sign(hs.signVerifier.Hash(localPublicKeyBytes))
+	capabilitiesBytes, err := hs.capabilities.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("error marshaling capabilities: %v", err)
+	}
+	if err := write(w, capabilitiesBytes); err != nil {
+		return fmt.Errorf("error writing capabilities to io.Writer: %v", err)
+	}
+	pubKeySig, err := hs.signVerifier.Sign(hs.signVerifier.Hash(append(localPublicKeyBytes, capabilitiesBytes...)))
 	if err != nil {
 		return fmt.Errorf("invariant violation: cannot sign ecdsa.publickey: %v", err)
 	}
@@ -122,25 +291,34 @@ func (hs *handshaker) writePublicKey(w io.Writer, key *ecdsa.PrivateKey) error {
 	return nil
 }
 
-// Unmarshal the read data to an ecdsa.PublicKey and verify the signature.
-func (hs *handshaker) readPublicKey(r io.Reader) (*ecdsa.PublicKey, protocol.PeerID, error) {
-	remotePubKeyBytes, err := read(r)
+// Unmarshal the read data to an ecdsa.PublicKey and the capabilities, and
+// verify the signature.
+func (hs *handshaker) readPublicKey(r io.Reader) (*ecdsa.PublicKey, protocol.PeerID, protocol.Capabilities, error) {
+	capabilities := protocol.Capabilities{}
+	remotePubKeyBytes, err := read(r, hs.limits.MaxHandshakeLength)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error reading ecdsa.PublicKey from io.Reader (potential rate limit): %v", err)
+		return nil, nil, capabilities, wrapReadError("error reading ecdsa.PublicKey from io.Reader (potential rate limit)", err)
 	}
 	remotePublicKey, err := crypto.UnmarshalPubkey(remotePubKeyBytes)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error unmarshaling ecdsa PublicKey: %v", err)
+		return nil, nil, capabilities, fmt.Errorf("error unmarshaling ecdsa PublicKey: %v", err)
 	}
-	remotePubKeySig, err := read(r)
+	remoteCapabilitiesBytes, err := read(r, hs.limits.MaxHandshakeLength)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error reading ecdsa.PublicKey signature from io.Reader: %v", err)
+		return nil, nil, capabilities, wrapReadError("error reading capabilities from io.Reader", err)
 	}
-	remotePeerID, err := hs.signVerifier.Verify(hs.signVerifier.Hash(remotePubKeyBytes), remotePubKeySig)
+	remotePubKeySig, err := read(r, hs.limits.MaxHandshakeLength)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error verifying ecdsa.PublicKey: %v", err)
+		return nil, nil, capabilities, wrapReadError("error reading ecdsa.PublicKey signature from io.Reader", err)
 	}
-	return remotePublicKey, remotePeerID, nil
+	remotePeerID, err := hs.signVerifier.Verify(hs.signVerifier.Hash(append(remotePubKeyBytes, remoteCapabilitiesBytes...)), remotePubKeySig)
+	if err != nil {
+		return nil, nil, capabilities, fmt.Errorf("error verifying ecdsa.PublicKey: %v", err)
+	}
+	if err := capabilities.UnmarshalBinary(remoteCapabilitiesBytes); err != nil {
+		return nil, nil, capabilities, err
+	}
+	return remotePublicKey, remotePeerID, capabilities, nil
 }
 
 // encrypt the data with given public key and write the encrypted data through an io.Writer.
@@ -157,9 +335,9 @@ func (hs *handshaker) writeEncrypted(w io.Writer, data []byte, publicKey *ecdsa.
 
 // read data from the io.Reader and decrypted with the ecdsa.PrivateKey.
 func (hs *handshaker) readEncrypted(r io.Reader, privateKey *ecdsa.PrivateKey) ([]byte, error) {
-	encryptedSessionKey, err := read(r)
+	encryptedSessionKey, err := read(r, hs.limits.MaxHandshakeLength)
 	if err != nil {
-		return nil, fmt.Errorf("error reading ecdsa.PublicKey from io.Reader: %v", err)
+		return nil, wrapReadError("error reading ecdsa.PublicKey from io.Reader", err)
 	}
 	eciesPrivateKey := ecies.ImportECDSA(privateKey)
 	decryptedSessionKey, err := eciesPrivateKey.Decrypt(encryptedSessionKey, nil, nil)
@@ -174,19 +352,26 @@ func write(w io.Writer, data []byte) error {
 	if err := binary.Write(w, binary.LittleEndian, uint64(len(data))); err != nil {
 		return fmt.Errorf("error writing data len=%v: %v", len(data), err)
 	}
+	if len(data) == 0 {
+		// Some connections, like net.Pipe, block on empty writes until the
+		// remote peer reads, but nothing is read for empty data.
+		return nil
+	}
 	if err := binary.Write(w, binary.LittleEndian, data); err != nil {
 		return fmt.Errorf("error writing data: %v", err)
 	}
 	return nil
 }
 
-func read(r io.Reader) ([]byte, error) {
+// read data that has been written by write. An ErrHandshakeMessageTooLarge is
+// returned, before the data is read, if its length is greater than the max.
+func read(r io.Reader, max uint64) ([]byte, error) {
 	dataLen := uint64(0)
 	if err := binary.Read(r, binary.LittleEndian, &dataLen); err != nil {
 		return nil, fmt.Errorf("error reading data len=%v: %v", dataLen, err)
 	}
-	if dataLen > 1024*1024 {
-		return nil, fmt.Errorf("error reading data: len=%v is too big", dataLen)
+	if dataLen > max {
+		return nil, NewErrHandshakeMessageTooLarge(dataLen, max)
 	}
 	data := make([]byte, dataLen)
 	if err := binary.Read(r, binary.LittleEndian, &data); err != nil {
@@ -195,10 +380,73 @@ func read(r io.Reader) ([]byte, error) {
 	return data, nil
 }
 
-func xorSessionKeys(key1, key2 []byte) []byte {
-	sessionKey := make([]byte, 0)
+// wrapReadError adds context to an error returned by read. Errors about the
+// length of the data are returned as they are, so that they can be inspected
+// by the caller of the handshake.
+func wrapReadError(context string, err error) error {
+	if _, ok := err.(ErrHandshakeMessageTooLarge); ok {
+		return err
+	}
+	return fmt.Errorf("%v: %v", context, err)
+}
+
+func xorSessionKeys(key1, key2 []byte) ([]byte, error) {
+	if len(key1) != len(key2) {
+		return nil, fmt.Errorf("error combining session keys: expected len=%v, got len=%v", len(key1), len(key2))
+	}
+	sessionKey := make([]byte, 0, len(key1))
 	for i := 0; i < len(key1); i++ {
 		sessionKey = append(sessionKey, key1[i]^key2[i])
 	}
-	return sessionKey
+	return sessionKey, nil
+}
+
+func hasAESHardware() bool {
+	return cpu.X86.HasAES || cpu.ARM64.HasAES || cpu.S390X.HasAES
+}
+
+// verifyExpectedPeer returns an ErrUnexpectedPeer if a peer was expected, and
+// the remote peer is not that peer.
+func verifyExpectedPeer(expected, remote protocol.PeerID) error {
+	if expected == nil || expected.Equal(remote) {
+		return nil
+	}
+	return NewErrUnexpectedPeer(expected, remote)
+}
+
+// ErrUnexpectedPeer is returned when the remote peer of a handshake
+// authenticates itself as a different peer than the one that was expected.
+type ErrUnexpectedPeer struct {
+	error
+	Expected protocol.PeerID
+	Remote   protocol.PeerID
+}
+
+// NewErrUnexpectedPeer creates a new error which is returned when the expected
+// peer was dialed, but the remote peer authenticated itself as another peer.
+func NewErrUnexpectedPeer(expected, remote protocol.PeerID) error {
+	return ErrUnexpectedPeer{
+		error:    fmt.Errorf("unexpected peer: expected %v, got %v", expected, remote),
+		Expected: expected,
+		Remote:   remote,
+	}
+}
+
+// ErrHandshakeMessageTooLarge is returned when the remote peer of a handshake
+// sends a message that is larger than the MaxHandshakeLength of the
+// protocol.SizeLimits.
+type ErrHandshakeMessageTooLarge struct {
+	error
+	Length uint64
+	Max    uint64
+}
+
+// NewErrHandshakeMessageTooLarge creates a new error which is returned when a
+// handshake message is larger than the limit.
+func NewErrHandshakeMessageTooLarge(length, max uint64) error {
+	return ErrHandshakeMessageTooLarge{
+		error:  fmt.Errorf("handshake message length=%v is too large: max length=%v", length, max),
+		Length: length,
+		Max:    max,
+	}
 }
@@ -16,25 +16,32 @@ import (
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/renproject/aw/protocol"
 	"github.com/renproject/phi"
+	"golang.org/x/sys/cpu"
 )
 
 var _ = Describe("Handshaker", func() {
 
-	handshake := func(ctx context.Context, clientConn, serverConn io.ReadWriter) (protocol.Session, protocol.Session) {
+	handshakeWithSessionManagers := func(ctx context.Context, clientConn, serverConn io.ReadWriter, clientSessionManagers, serverSessionManagers []protocol.SessionManager) (protocol.Session, protocol.Session, error, error) {
 		clientSignVerifier := NewMockSignVerifier()
 		serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
 		clientSignVerifier.Whitelist(serverSignVerifier.ID())
 
-		clientHandshaker := New(clientSignVerifier, NewGCMSessionManager())
-		serverHandshaker := New(serverSignVerifier, NewGCMSessionManager())
+		clientHandshaker := New(clientSignVerifier, clientSessionManagers...)
+		serverHandshaker := New(serverSignVerifier, serverSessionManagers...)
 
 		var clientErr, serverError error
 		var clientSession, serverSession protocol.Session
 		phi.ParBegin(func() {
-			clientSession, clientErr = clientHandshaker.Handshake(ctx, clientConn)
+			clientSession, clientErr = clientHandshaker.Handshake(ctx, clientConn, nil)
 		}, func() {
 			serverSession, serverError = serverHandshaker.AcceptHandshake(ctx, serverConn)
 		})
+		return clientSession, serverSession, clientErr, serverError
+	}
+
+	handshake := func(ctx context.Context, clientConn, serverConn io.ReadWriter) (protocol.Session, protocol.Session) {
+		sessionManagers := []protocol.SessionManager{NewGCMSessionManager()}
+		clientSession, serverSession, clientErr, serverError := handshakeWithSessionManagers(ctx, clientConn, serverConn, sessionManagers, sessionManagers)
 		Expect(clientErr).NotTo(HaveOccurred())
 		Expect(serverError).NotTo(HaveOccurred())
 
@@ -53,6 +60,156 @@ var _ = Describe("Handshaker", func() {
 				_ = New(nil, NewGCMSessionManager())
 			}).Should(Panic())
 		})
+
+		It("should panic if providing no sessionManagers", func() {
+			Expect(func() {
+				_ = New(NewMockSignVerifier())
+			}).Should(Panic())
+		})
+
+		It("should panic if providing two sessionManagers with the same aead", func() {
+			Expect(func() {
+				_ = New(NewMockSignVerifier(), NewGCMSessionManager(), NewGCMSessionManager())
+			}).Should(Panic())
+		})
+	})
+
+	Context("when negotiating the aead", func() {
+		roundTrip := func(clientConn, serverConn io.ReadWriter, clientSession, serverSession protocol.Session) bool {
+			var writeErr, readErr error
+			var readMessage protocol.MessageOnTheWire
+			message := RandomMessage(protocol.V2, RandomMessageVariant())
+			phi.ParBegin(func() {
+				writeErr = clientSession.WriteMessage(clientConn, message)
+			}, func() {
+				readMessage, readErr = serverSession.ReadMessageOnTheWire(serverConn)
+			})
+			Expect(writeErr).NotTo(HaveOccurred())
+			Expect(readErr).NotTo(HaveOccurred())
+			return cmp.Equal(readMessage.Message, message, cmpopts.EquateEmpty())
+		}
+
+		It("should agree on the client's most preferred aead that the server supports", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			clientSession, serverSession, clientErr, serverErr := handshakeWithSessionManagers(ctx, clientConn, serverConn,
+				[]protocol.SessionManager{NewChaChaSessionManager(), NewGCMSessionManager()},
+				[]protocol.SessionManager{NewGCMSessionManager(), NewChaChaSessionManager()})
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverErr).NotTo(HaveOccurred())
+			Expect(roundTrip(clientConn, serverConn, clientSession, serverSession)).To(BeTrue())
+		})
+
+		It("should fall back to an aead that both peers support", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			clientSession, serverSession, clientErr, serverErr := handshakeWithSessionManagers(ctx, clientConn, serverConn,
+				[]protocol.SessionManager{NewChaChaSessionManager(), NewGCMSessionManager()},
+				[]protocol.SessionManager{NewGCMSessionManager()})
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverErr).NotTo(HaveOccurred())
+			Expect(roundTrip(clientConn, serverConn, clientSession, serverSession)).To(BeTrue())
+		})
+
+		It("should assume that SessionManagers without an aead use aes-256-gcm", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			// Embedding the interface hides the AEAD method of the
+			// SessionManager.
+			legacy := struct{ protocol.SessionManager }{NewGCMSessionManager()}
+			Expect(protocol.SessionManagerAEAD(legacy)).To(Equal(protocol.AES256GCM))
+
+			clientConn, serverConn := net.Pipe()
+			clientSession, serverSession, clientErr, serverErr := handshakeWithSessionManagers(ctx, clientConn, serverConn,
+				[]protocol.SessionManager{legacy},
+				[]protocol.SessionManager{NewChaChaSessionManager(), NewGCMSessionManager()})
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverErr).NotTo(HaveOccurred())
+			Expect(serverSession.Negotiation().AEAD).To(Equal(protocol.AES256GCM))
+			Expect(roundTrip(clientConn, serverConn, clientSession, serverSession)).To(BeTrue())
+		})
+
+		It("should return an ErrNoCommonAEAD if the peers do not support the same aeads", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			go func() {
+				<-ctx.Done()
+				clientConn.Close()
+				serverConn.Close()
+			}()
+			_, _, clientErr, serverErr := handshakeWithSessionManagers(ctx, clientConn, serverConn,
+				[]protocol.SessionManager{NewChaChaSessionManager()},
+				[]protocol.SessionManager{NewGCMSessionManager()})
+			Expect(clientErr).To(BeAssignableToTypeOf(ErrNoCommonAEAD{}))
+			Expect(serverErr).To(BeAssignableToTypeOf(ErrNoCommonAEAD{}))
+		})
+
+		It("should prefer the aeads that are fast on the local hardware, and then duplex aeads by default", func() {
+			aeads := []protocol.AEAD{}
+			for _, sessionManager := range NewSessionManagers() {
+				aeads = append(aeads, protocol.SessionManagerAEAD(sessionManager))
+			}
+			if cpu.X86.HasAES || cpu.ARM64.HasAES || cpu.S390X.HasAES {
+				Expect(aeads).To(Equal([]protocol.AEAD{protocol.AES256GCMCounter, protocol.AES256GCM, protocol.ChaCha20Poly1305Counter, protocol.ChaCha20Poly1305}))
+			} else {
+				Expect(aeads).To(Equal([]protocol.AEAD{protocol.ChaCha20Poly1305Counter, protocol.ChaCha20Poly1305, protocol.AES256GCMCounter, protocol.AES256GCM}))
+			}
+			Expect(aeads[0].IsDuplex()).To(BeTrue())
+		})
+	})
+
+	Context("when the client expects a specific server", func() {
+		expectedPeerHandshake := func(expected func(serverSignVerifier MockSignVerifier) protocol.PeerID) (error, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+
+			clientConn, serverConn := net.Pipe()
+			go func() {
+				<-ctx.Done()
+				clientConn.Close()
+				serverConn.Close()
+			}()
+
+			var clientErr, serverErr error
+			phi.ParBegin(func() {
+				_, clientErr = New(clientSignVerifier, NewGCMSessionManager()).Handshake(ctx, clientConn, expected(serverSignVerifier))
+				if clientErr != nil {
+					cancel()
+				}
+			}, func() {
+				_, serverErr = New(serverSignVerifier, NewGCMSessionManager()).AcceptHandshake(ctx, serverConn)
+			})
+			return clientErr, serverErr
+		}
+
+		It("should succeed if the server is the expected peer", func() {
+			clientErr, serverErr := expectedPeerHandshake(func(serverSignVerifier MockSignVerifier) protocol.PeerID {
+				return SimplePeerID(serverSignVerifier.ID())
+			})
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverErr).NotTo(HaveOccurred())
+		})
+
+		It("should return an ErrUnexpectedPeer if the server is another peer", func() {
+			expected := RandomPeerID()
+			clientErr, serverErr := expectedPeerHandshake(func(MockSignVerifier) protocol.PeerID {
+				return expected
+			})
+			Expect(clientErr).To(BeAssignableToTypeOf(ErrUnexpectedPeer{}))
+			Expect(clientErr.(ErrUnexpectedPeer).Expected).To(Equal(expected))
+			Expect(serverErr).To(HaveOccurred())
+		})
 	})
 
 	Context("when both client and server are honest", func() {
@@ -75,7 +232,7 @@ var _ = Describe("Handshaker", func() {
 				test := func() bool {
 					var clientErr, serverError error
 					var readMessage protocol.MessageOnTheWire
-					message := RandomMessage(protocol.V1, RandomMessageVariant())
+					message := RandomMessage(protocol.V2, RandomMessageVariant())
 
 					phi.ParBegin(func() {
 						clientErr = clientSession.WriteMessage(clientConn, message)
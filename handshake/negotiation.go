@@ -0,0 +1,264 @@
+package handshake
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// negotiate the values used by a session from the Capabilities of the client
+// and the server. Both peers know both Capabilities, so they will always agree
+// on the same protocol.Negotiation. The highest shared version is used, and the
+// preferences of the client are used for the AEAD and the compression.
+func negotiate(client, server protocol.Capabilities) (protocol.Negotiation, error) {
+	negotiation := protocol.Negotiation{
+		Variants:    []protocol.MessageVariant{},
+		Compression: protocol.NoCompression,
+	}
+
+	for _, version := range client.Versions {
+		if version <= negotiation.Version || protocol.ValidateMessageVersion(version) != nil {
+			continue
+		}
+		for _, serverVersion := range server.Versions {
+			if version == serverVersion {
+				negotiation.Version = version
+				break
+			}
+		}
+	}
+	if negotiation.Version == 0 {
+		return protocol.Negotiation{}, NewErrNoCommonVersion(client.Versions, server.Versions)
+	}
+
+	for _, variant := range client.Variants {
+		if protocol.ValidateMessageVariant(variant) != nil {
+			continue
+		}
+		for _, serverVariant := range server.Variants {
+			if variant == serverVariant {
+				negotiation.Variants = append(negotiation.Variants, variant)
+				break
+			}
+		}
+	}
+
+	aeadFound := false
+	for _, aead := range client.AEADs {
+		for _, serverAEAD := range server.AEADs {
+			if aead == serverAEAD {
+				negotiation.AEAD = aead
+				aeadFound = true
+				break
+			}
+		}
+		if aeadFound {
+			break
+		}
+	}
+	if !aeadFound {
+		return protocol.Negotiation{}, NewErrNoCommonAEAD(client.AEADs, server.AEADs)
+	}
+
+	compressionFound := false
+	for _, compression := range client.Compressions {
+		if protocol.ValidateCompression(compression) != nil {
+			continue
+		}
+		for _, serverCompression := range server.Compressions {
+			if compression == serverCompression {
+				negotiation.Compression = compression
+				compressionFound = true
+				break
+			}
+		}
+		if compressionFound {
+			break
+		}
+	}
+
+	return negotiation, nil
+}
+
+// sizeLimiter is implemented by the Sessions of this package, so that they
+// can validate the length of messages on the wire before reading them.
+type sizeLimiter interface {
+	setSizeLimits(limits protocol.SizeLimits)
+}
+
+const (
+	compressionFlagNone       = byte(0)
+	compressionFlagCompressed = byte(1)
+)
+
+// negotiatedSession wraps the Session created by a SessionManager, and
+// restricts it to the values negotiated during the handshake. Messages are
+// written at the negotiated version, which is the highest version that both
+// peers support, so V1 and V2 messages can be written on the same session.
+// When the negotiated version is V1, the Extensions of V2 messages are dropped.
+// Messages of variants that the remote peer does not support are rejected.
+// Messages that exceed the SizeLimits are also rejected, even if the wrapped
+// Session does not support SizeLimits. Rejected messages are not written, and
+// are returned as an ErrMessageRejected.
+//
+// If a compression has been negotiated, message bodies are prefixed with a
+// flag and compressed before they are passed to the wrapped Session, so that
+// they are compressed before they are encrypted. Bodies shorter than the
+// compression threshold, or that do not get shorter when compressed, are not
+// compressed.
+type negotiatedSession struct {
+	session              protocol.Session
+	negotiation          protocol.Negotiation
+	limits               protocol.SizeLimits
+	compressionThreshold int
+}
+
+func newNegotiatedSession(session protocol.Session, negotiation protocol.Negotiation, limits protocol.SizeLimits, compressionThreshold int) protocol.Session {
+	if limiter, ok := session.(sizeLimiter); ok {
+		limiter.setSizeLimits(limits)
+	}
+	return &negotiatedSession{
+		session:              session,
+		negotiation:          negotiation,
+		limits:               limits,
+		compressionThreshold: compressionThreshold,
+	}
+}
+
+func (session *negotiatedSession) ReadMessageOnTheWire(r io.Reader) (protocol.MessageOnTheWire, error) {
+	otw, err := session.session.ReadMessageOnTheWire(r)
+	if err != nil {
+		return otw, err
+	}
+	if otw.Message.Version > session.negotiation.Version {
+		return otw, protocol.NewErrMessageVersionIsNotSupported(otw.Message.Version)
+	}
+	if !session.negotiation.SupportsVariant(otw.Message.Variant) {
+		return otw, protocol.NewErrMessageVariantIsNotSupported(otw.Message.Variant)
+	}
+	if session.negotiation.Compression != protocol.NoCompression {
+		if otw.Message.Body, err = session.decompress(otw.Message); err != nil {
+			return otw, err
+		}
+		otw.Message.Length = protocol.MessageLength(otw.Message.HeaderLength() + len(otw.Message.Body))
+	}
+	if err := session.limits.ValidateMessageLength(otw.Message.Length, otw.Message.Variant); err != nil {
+		return otw, err
+	}
+	return otw, nil
+}
+
+func (session *negotiatedSession) WriteMessage(w io.Writer, message protocol.Message) error {
+	if !session.negotiation.SupportsVariant(message.Variant) {
+		return NewErrMessageRejected(protocol.NewErrMessageVariantIsNotSupported(message.Variant))
+	}
+	message.Version = session.negotiation.Version
+	if message.Version < protocol.V2 {
+		message.Extensions = nil
+	}
+	message.Length = protocol.MessageLength(message.HeaderLength() + len(message.Body))
+	if err := session.limits.ValidateMessageLength(message.Length, message.Variant); err != nil {
+		return NewErrMessageRejected(err)
+	}
+	if session.negotiation.Compression != protocol.NoCompression {
+		body, err := session.compress(message.Body)
+		if err != nil {
+			return err
+		}
+		message.Body = body
+		message.Length = protocol.MessageLength(message.HeaderLength() + len(message.Body))
+	}
+	return session.session.WriteMessage(w, message)
+}
+
+// compress the body, and prefix it with a flag that tells the remote peer
+// whether or not it has been compressed.
+func (session *negotiatedSession) compress(body protocol.MessageBody) (protocol.MessageBody, error) {
+	if len(body) >= session.compressionThreshold {
+		compressed, err := protocol.Compress(session.negotiation.Compression, body)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(body) {
+			return append(protocol.MessageBody{compressionFlagCompressed}, compressed...), nil
+		}
+	}
+	return append(protocol.MessageBody{compressionFlagNone}, body...), nil
+}
+
+// decompress the body of the message, if its flag says that it has been
+// compressed. The decompressed message cannot exceed the SizeLimits of its
+// variant.
+func (session *negotiatedSession) decompress(message protocol.Message) (protocol.MessageBody, error) {
+	if len(message.Body) == 0 {
+		return nil, fmt.Errorf("error decompressing message: missing compression flag")
+	}
+	flag, body := message.Body[0], message.Body[1:]
+	switch flag {
+	case compressionFlagNone:
+		return body, nil
+	case compressionFlagCompressed:
+		max := int(session.limits.MaxLength(message.Variant)) - message.HeaderLength()
+		return protocol.Decompress(session.negotiation.Compression, body, max)
+	default:
+		return nil, fmt.Errorf("error decompressing message: unknown compression flag=%v", flag)
+	}
+}
+
+func (session *negotiatedSession) Negotiation() protocol.Negotiation {
+	return session.negotiation
+}
+
+// ErrNoCommonVersion is returned when the client and server of a handshake do
+// not support any of the same message versions.
+type ErrNoCommonVersion struct {
+	error
+	ClientVersions []protocol.MessageVersion
+	ServerVersions []protocol.MessageVersion
+}
+
+// NewErrNoCommonVersion creates a new error which is returned when none of the
+// client message versions are supported by the server.
+func NewErrNoCommonVersion(clientVersions, serverVersions []protocol.MessageVersion) error {
+	return ErrNoCommonVersion{
+		error:          fmt.Errorf("no common message version: client supports %v, server supports %v", clientVersions, serverVersions),
+		ClientVersions: clientVersions,
+		ServerVersions: serverVersions,
+	}
+}
+
+// ErrNoCommonAEAD is returned when the client and server of a handshake do not
+// support any of the same AEADs.
+type ErrNoCommonAEAD struct {
+	error
+	ClientAEADs []protocol.AEAD
+	ServerAEADs []protocol.AEAD
+}
+
+// NewErrNoCommonAEAD creates a new error which is returned when none of the
+// client AEADs are supported by the server.
+func NewErrNoCommonAEAD(clientAEADs, serverAEADs []protocol.AEAD) error {
+	return ErrNoCommonAEAD{
+		error:       fmt.Errorf("no common aead: client supports %v, server supports %v", clientAEADs, serverAEADs),
+		ClientAEADs: clientAEADs,
+		ServerAEADs: serverAEADs,
+	}
+}
+
+// ErrMessageRejected is returned when a message is rejected before it is
+// written, because the remote peer cannot accept it. Nothing has been written,
+// so the session can still be used.
+type ErrMessageRejected struct {
+	error
+	Err error
+}
+
+// NewErrMessageRejected creates a new error which is returned when a message is
+// rejected before it is written.
+func NewErrMessageRejected(err error) error {
+	return ErrMessageRejected{
+		error: fmt.Errorf("message rejected: %v", err),
+		Err:   err,
+	}
+}
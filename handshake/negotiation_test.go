@@ -0,0 +1,434 @@
+package handshake_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/handshake"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/phi"
+)
+
+var _ = Describe("Capability negotiation", func() {
+
+	newHandshakers := map[string]func(protocol.SignVerifier, protocol.Capabilities) Handshaker{
+		"ecies": func(signVerifier protocol.SignVerifier, capabilities protocol.Capabilities) Handshaker {
+			return NewWithOptions(signVerifier, Options{Capabilities: capabilities}, NewGCMSessionManager())
+		},
+		"noise": func(signVerifier protocol.SignVerifier, capabilities protocol.Capabilities) Handshaker {
+			return NewNoiseWithOptions(signVerifier, Options{Capabilities: capabilities})
+		},
+	}
+
+	run := func(newHandshaker func(protocol.SignVerifier, protocol.Capabilities) Handshaker, clientCapabilities, serverCapabilities protocol.Capabilities) (protocol.Session, protocol.Session, error, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		clientSignVerifier := NewMockSignVerifier()
+		serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+		clientSignVerifier.Whitelist(serverSignVerifier.ID())
+
+		// Close the connections if a peer gives up on the handshake, so that
+		// the other peer does not block forever.
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			<-ctx.Done()
+			clientConn.Close()
+			serverConn.Close()
+		}()
+
+		var clientErr, serverErr error
+		var clientSession, serverSession protocol.Session
+		phi.ParBegin(func() {
+			clientSession, clientErr = newHandshaker(clientSignVerifier, clientCapabilities).Handshake(ctx, clientConn, nil)
+			if clientErr != nil {
+				cancel()
+			}
+		}, func() {
+			serverSession, serverErr = newHandshaker(serverSignVerifier, serverCapabilities).AcceptHandshake(ctx, serverConn)
+			if serverErr != nil {
+				cancel()
+			}
+		})
+		return clientSession, serverSession, clientErr, serverErr
+	}
+
+	for name, newHandshaker := range newHandshakers {
+		name, newHandshaker := name, newHandshaker
+
+		Context("when using the "+name+" handshaker", func() {
+			Context("when both peers use the default capabilities", func() {
+				It("should negotiate the same values on both sides", func() {
+					clientSession, serverSession, clientErr, serverErr := run(newHandshaker, protocol.DefaultCapabilities(), protocol.DefaultCapabilities())
+					Expect(clientErr).NotTo(HaveOccurred())
+					Expect(serverErr).NotTo(HaveOccurred())
+
+					negotiation := clientSession.Negotiation()
+					Expect(cmp.Equal(negotiation, serverSession.Negotiation())).Should(BeTrue())
+					Expect(negotiation.Version).Should(Equal(protocol.V2))
+					Expect(negotiation.Variants).Should(Equal(protocol.DefaultCapabilities().Variants))
+					Expect(negotiation.Compression).Should(Equal(protocol.NoCompression))
+					if name == "noise" {
+						Expect(negotiation.AEAD).Should(Equal(protocol.NoiseChaChaPoly))
+					} else {
+						Expect(negotiation.AEAD).Should(Equal(protocol.AES256GCM))
+					}
+				})
+			})
+
+			Context("when a peer supports versions that are unknown to the other", func() {
+				It("should negotiate the highest shared version", func() {
+					clientCapabilities := protocol.DefaultCapabilities()
+					clientCapabilities.Versions = []protocol.MessageVersion{protocol.MessageVersion(9), protocol.V1}
+
+					clientSession, serverSession, clientErr, serverErr := run(newHandshaker, clientCapabilities, protocol.DefaultCapabilities())
+					Expect(clientErr).NotTo(HaveOccurred())
+					Expect(serverErr).NotTo(HaveOccurred())
+					Expect(clientSession.Negotiation().Version).Should(Equal(protocol.V1))
+					Expect(serverSession.Negotiation().Version).Should(Equal(protocol.V1))
+				})
+			})
+
+			Context("when the peers do not share a version", func() {
+				It("should return an ErrNoCommonVersion", func() {
+					serverCapabilities := protocol.DefaultCapabilities()
+					serverCapabilities.Versions = []protocol.MessageVersion{protocol.MessageVersion(9)}
+
+					_, _, clientErr, serverErr := run(newHandshaker, protocol.DefaultCapabilities(), serverCapabilities)
+					Expect(clientErr).To(BeAssignableToTypeOf(ErrNoCommonVersion{}))
+					Expect(serverErr).To(HaveOccurred())
+				})
+			})
+
+			Context("when the server only supports some variants", func() {
+				It("should only read and write the shared variants", func() {
+					serverCapabilities := protocol.DefaultCapabilities()
+					serverCapabilities.Variants = []protocol.MessageVariant{protocol.Cast}
+
+					clientSession, serverSession, clientErr, serverErr := run(newHandshaker, protocol.DefaultCapabilities(), serverCapabilities)
+					Expect(clientErr).NotTo(HaveOccurred())
+					Expect(serverErr).NotTo(HaveOccurred())
+					Expect(clientSession.Negotiation().Variants).Should(Equal([]protocol.MessageVariant{protocol.Cast}))
+					Expect(clientSession.Negotiation().SupportsVariant(protocol.Ping)).Should(BeFalse())
+
+					buf := new(bytes.Buffer)
+					err := clientSession.WriteMessage(buf, RandomMessage(protocol.V1, protocol.Ping))
+					Expect(err).To(BeAssignableToTypeOf(ErrMessageRejected{}))
+					Expect(err.(ErrMessageRejected).Err).To(BeAssignableToTypeOf(protocol.ErrMessageVariantIsNotSupported{}))
+					Expect(buf.Len()).Should(Equal(0))
+
+					message := RandomMessage(protocol.V2, protocol.Cast)
+					Expect(clientSession.WriteMessage(buf, message)).To(Succeed())
+					received, err := serverSession.ReadMessageOnTheWire(buf)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(cmp.Equal(received.Message, message, cmpopts.EquateEmpty())).Should(BeTrue())
+				})
+			})
+
+			Context("when writing V1 and V2 messages on the same session", func() {
+				It("should write every message at the negotiated version", func() {
+					clientSession, serverSession, clientErr, serverErr := run(newHandshaker, protocol.DefaultCapabilities(), protocol.DefaultCapabilities())
+					Expect(clientErr).NotTo(HaveOccurred())
+					Expect(serverErr).NotTo(HaveOccurred())
+
+					buf := new(bytes.Buffer)
+					messages := []protocol.Message{
+						RandomMessage(protocol.V1, protocol.Cast),
+						RandomMessage(protocol.V2, protocol.Multicast),
+						RandomMessage(protocol.V1, protocol.Broadcast),
+						RandomMessage(protocol.V2, protocol.Cast),
+					}
+					messages[1].SetTTL(3)
+					messages[1].SetTraceContext([]byte("trace"))
+					messages[3].SetExtension(protocol.ExtensionType(1000), []byte("unknown"))
+					for _, message := range messages {
+						Expect(clientSession.WriteMessage(buf, message)).To(Succeed())
+					}
+					for _, message := range messages {
+						received, err := serverSession.ReadMessageOnTheWire(buf)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(received.Message.Version).Should(Equal(protocol.V2))
+						message.Version = protocol.V2
+						message.Length = protocol.MessageLength(message.HeaderLength() + len(message.Body))
+						Expect(cmp.Equal(received.Message, message, cmpopts.EquateEmpty())).Should(BeTrue())
+					}
+				})
+			})
+
+			Context("when the server only supports V1", func() {
+				It("should write V2 messages as V1 messages without extensions", func() {
+					serverCapabilities := protocol.DefaultCapabilities()
+					serverCapabilities.Versions = []protocol.MessageVersion{protocol.V1}
+
+					clientSession, serverSession, clientErr, serverErr := run(newHandshaker, protocol.DefaultCapabilities(), serverCapabilities)
+					Expect(clientErr).NotTo(HaveOccurred())
+					Expect(serverErr).NotTo(HaveOccurred())
+					Expect(clientSession.Negotiation().Version).Should(Equal(protocol.V1))
+
+					buf := new(bytes.Buffer)
+					message := RandomMessage(protocol.V2, protocol.Cast)
+					message.SetTTL(3)
+					Expect(clientSession.WriteMessage(buf, message)).To(Succeed())
+					received, err := serverSession.ReadMessageOnTheWire(buf)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(received.Message.Version).Should(Equal(protocol.V1))
+					Expect(received.Message.Extensions).Should(BeEmpty())
+					Expect(bytes.Equal(received.Message.Body, message.Body)).Should(BeTrue())
+				})
+			})
+		})
+	}
+})
+
+var _ = Describe("Size limits", func() {
+
+	newHandshakers := map[string]func(protocol.SignVerifier, protocol.SizeLimits) Handshaker{
+		"ecies": func(signVerifier protocol.SignVerifier, limits protocol.SizeLimits) Handshaker {
+			return NewWithOptions(signVerifier, Options{SizeLimits: limits}, NewGCMSessionManager())
+		},
+		"noise": func(signVerifier protocol.SignVerifier, limits protocol.SizeLimits) Handshaker {
+			return NewNoiseWithOptions(signVerifier, Options{SizeLimits: limits})
+		},
+	}
+
+	run := func(newHandshaker func(protocol.SignVerifier, protocol.SizeLimits) Handshaker, clientLimits, serverLimits protocol.SizeLimits) (protocol.Session, protocol.Session, error, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		clientSignVerifier := NewMockSignVerifier()
+		serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+		clientSignVerifier.Whitelist(serverSignVerifier.ID())
+
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			<-ctx.Done()
+			clientConn.Close()
+			serverConn.Close()
+		}()
+
+		var clientErr, serverErr error
+		var clientSession, serverSession protocol.Session
+		phi.ParBegin(func() {
+			clientSession, clientErr = newHandshaker(clientSignVerifier, clientLimits).Handshake(ctx, clientConn, nil)
+			if clientErr != nil {
+				cancel()
+			}
+		}, func() {
+			serverSession, serverErr = newHandshaker(serverSignVerifier, serverLimits).AcceptHandshake(ctx, serverConn)
+			if serverErr != nil {
+				cancel()
+			}
+		})
+		return clientSession, serverSession, clientErr, serverErr
+	}
+
+	messageWithBody := func(variant protocol.MessageVariant, n int) protocol.Message {
+		message := RandomMessage(protocol.V2, variant)
+		message.Body = RandomBytes(n)
+		message.Length = protocol.MessageLength(message.HeaderLength() + n)
+		return message
+	}
+
+	for name, newHandshaker := range newHandshakers {
+		name, newHandshaker := name, newHandshaker
+
+		Context("when using the "+name+" handshaker", func() {
+			Context("when writing a message that exceeds the limit of its variant", func() {
+				It("should return an ErrMessageRejected without writing anything", func() {
+					limits := protocol.SizeLimits{
+						MaxVariantLengths: map[protocol.MessageVariant]protocol.MessageLength{protocol.Ping: 64},
+					}
+					clientSession, _, clientErr, serverErr := run(newHandshaker, limits, limits)
+					Expect(clientErr).NotTo(HaveOccurred())
+					Expect(serverErr).NotTo(HaveOccurred())
+
+					buf := new(bytes.Buffer)
+					err := clientSession.WriteMessage(buf, messageWithBody(protocol.Ping, 128))
+					Expect(err).To(BeAssignableToTypeOf(ErrMessageRejected{}))
+					err = err.(ErrMessageRejected).Err
+					Expect(err).To(BeAssignableToTypeOf(protocol.ErrMessageLengthIsTooHigh{}))
+					Expect(err.(protocol.ErrMessageLengthIsTooHigh).Length).Should(Equal(protocol.MessageLength(138)))
+					Expect(err.(protocol.ErrMessageLengthIsTooHigh).Max).Should(Equal(protocol.MessageLength(64)))
+					Expect(buf.Len()).Should(Equal(0))
+
+					// Other variants are not affected by the limit.
+					Expect(clientSession.WriteMessage(buf, messageWithBody(protocol.Cast, 128))).To(Succeed())
+				})
+			})
+
+			Context("when reading a message that exceeds the limit of its variant", func() {
+				It("should return an ErrMessageLengthIsTooHigh", func() {
+					serverLimits := protocol.SizeLimits{
+						MaxVariantLengths: map[protocol.MessageVariant]protocol.MessageLength{protocol.Cast: 256},
+					}
+					clientSession, serverSession, clientErr, serverErr := run(newHandshaker, protocol.SizeLimits{}, serverLimits)
+					Expect(clientErr).NotTo(HaveOccurred())
+					Expect(serverErr).NotTo(HaveOccurred())
+
+					buf := new(bytes.Buffer)
+					Expect(clientSession.WriteMessage(buf, messageWithBody(protocol.Cast, 64))).To(Succeed())
+					_, err := serverSession.ReadMessageOnTheWire(buf)
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(clientSession.WriteMessage(buf, messageWithBody(protocol.Cast, 512))).To(Succeed())
+					_, err = serverSession.ReadMessageOnTheWire(buf)
+					Expect(err).To(BeAssignableToTypeOf(protocol.ErrMessageLengthIsTooHigh{}))
+					Expect(err.(protocol.ErrMessageLengthIsTooHigh).Length).Should(BeNumerically(">", 512))
+					Expect(err.(protocol.ErrMessageLengthIsTooHigh).Variant).Should(Equal(protocol.Cast))
+				})
+			})
+
+			Context("when a handshake message exceeds the handshake limit", func() {
+				It("should return an ErrHandshakeMessageTooLarge", func() {
+					serverLimits := protocol.SizeLimits{MaxHandshakeLength: 16}
+					_, _, _, serverErr := run(newHandshaker, protocol.SizeLimits{}, serverLimits)
+					Expect(serverErr).To(BeAssignableToTypeOf(ErrHandshakeMessageTooLarge{}))
+					Expect(serverErr.(ErrHandshakeMessageTooLarge).Length).Should(BeNumerically(">", 16))
+					Expect(serverErr.(ErrHandshakeMessageTooLarge).Max).Should(Equal(uint64(16)))
+				})
+			})
+		})
+	}
+})
+
+var _ = Describe("Compression", func() {
+
+	newHandshakers := map[string]func(protocol.SignVerifier, Options) Handshaker{
+		"ecies": func(signVerifier protocol.SignVerifier, options Options) Handshaker {
+			return NewWithOptions(signVerifier, options, NewGCMSessionManager())
+		},
+		"noise": func(signVerifier protocol.SignVerifier, options Options) Handshaker {
+			return NewNoiseWithOptions(signVerifier, options)
+		},
+	}
+
+	run := func(newHandshaker func(protocol.SignVerifier, Options) Handshaker, clientOptions, serverOptions Options) (protocol.Session, protocol.Session, error, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		clientSignVerifier := NewMockSignVerifier()
+		serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+		clientSignVerifier.Whitelist(serverSignVerifier.ID())
+
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			<-ctx.Done()
+			clientConn.Close()
+			serverConn.Close()
+		}()
+
+		var clientErr, serverErr error
+		var clientSession, serverSession protocol.Session
+		phi.ParBegin(func() {
+			clientSession, clientErr = newHandshaker(clientSignVerifier, clientOptions).Handshake(ctx, clientConn, nil)
+			if clientErr != nil {
+				cancel()
+			}
+		}, func() {
+			serverSession, serverErr = newHandshaker(serverSignVerifier, serverOptions).AcceptHandshake(ctx, serverConn)
+			if serverErr != nil {
+				cancel()
+			}
+		})
+		return clientSession, serverSession, clientErr, serverErr
+	}
+
+	withCompressions := func(compressions ...protocol.Compression) Options {
+		capabilities := protocol.DefaultCapabilities()
+		capabilities.Compressions = compressions
+		return Options{Capabilities: capabilities}
+	}
+
+	repetitiveMessage := func(n int) protocol.Message {
+		body := bytes.Repeat([]byte(`{"key":"value"}`), n)
+		return protocol.NewMessage(protocol.V2, protocol.Broadcast, RandomGroupID(), body)
+	}
+
+	for name, newHandshaker := range newHandshakers {
+		name, newHandshaker := name, newHandshaker
+
+		Context("when using the "+name+" handshaker", func() {
+			for _, compression := range []protocol.Compression{protocol.Snappy, protocol.Zstd} {
+				compression := compression
+
+				Context("when the client prefers "+compression.String(), func() {
+					It("should compress large messages before they are written", func() {
+						clientSession, serverSession, clientErr, serverErr := run(newHandshaker, withCompressions(compression), Options{})
+						Expect(clientErr).NotTo(HaveOccurred())
+						Expect(serverErr).NotTo(HaveOccurred())
+						Expect(clientSession.Negotiation().Compression).Should(Equal(compression))
+						Expect(serverSession.Negotiation().Compression).Should(Equal(compression))
+
+						buf := new(bytes.Buffer)
+						message := repetitiveMessage(1000)
+						Expect(clientSession.WriteMessage(buf, message)).To(Succeed())
+						Expect(buf.Len()).Should(BeNumerically("<", int(message.Length)/4))
+
+						received, err := serverSession.ReadMessageOnTheWire(buf)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(cmp.Equal(received.Message, message, cmpopts.EquateEmpty())).Should(BeTrue())
+					})
+
+					It("should not compress small messages", func() {
+						clientSession, serverSession, clientErr, serverErr := run(newHandshaker, withCompressions(compression), Options{})
+						Expect(clientErr).NotTo(HaveOccurred())
+						Expect(serverErr).NotTo(HaveOccurred())
+
+						buf := new(bytes.Buffer)
+						message := repetitiveMessage(4)
+						Expect(clientSession.WriteMessage(buf, message)).To(Succeed())
+						Expect(buf.Len()).Should(BeNumerically(">", int(message.Length)))
+
+						received, err := serverSession.ReadMessageOnTheWire(buf)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(cmp.Equal(received.Message, message, cmpopts.EquateEmpty())).Should(BeTrue())
+					})
+
+					It("should return an ErrDecompressedLengthIsTooHigh if the decompressed message exceeds the size limits", func() {
+						serverOptions := Options{
+							SizeLimits: protocol.SizeLimits{
+								MaxVariantLengths: map[protocol.MessageVariant]protocol.MessageLength{protocol.Broadcast: 1024},
+							},
+						}
+						clientSession, serverSession, clientErr, serverErr := run(newHandshaker, withCompressions(compression), serverOptions)
+						Expect(clientErr).NotTo(HaveOccurred())
+						Expect(serverErr).NotTo(HaveOccurred())
+
+						// The compressed message is within the limit, but the
+						// decompressed message is not.
+						buf := new(bytes.Buffer)
+						Expect(clientSession.WriteMessage(buf, repetitiveMessage(1000))).To(Succeed())
+						Expect(buf.Len()).Should(BeNumerically("<", 1024))
+						_, err := serverSession.ReadMessageOnTheWire(buf)
+						Expect(err).To(BeAssignableToTypeOf(protocol.ErrDecompressedLengthIsTooHigh{}))
+					})
+				})
+			}
+
+			Context("when the server does not support the compression of the client", func() {
+				It("should not compress messages", func() {
+					clientSession, serverSession, clientErr, serverErr := run(newHandshaker, withCompressions(protocol.Zstd), withCompressions(protocol.NoCompression, protocol.Snappy))
+					Expect(clientErr).NotTo(HaveOccurred())
+					Expect(serverErr).NotTo(HaveOccurred())
+					Expect(clientSession.Negotiation().Compression).Should(Equal(protocol.NoCompression))
+
+					buf := new(bytes.Buffer)
+					message := repetitiveMessage(1000)
+					Expect(clientSession.WriteMessage(buf, message)).To(Succeed())
+					Expect(buf.Len()).Should(BeNumerically(">", int(message.Length)))
+					received, err := serverSession.ReadMessageOnTheWire(buf)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(cmp.Equal(received.Message, message, cmpopts.EquateEmpty())).Should(BeTrue())
+				})
+			})
+		})
+	}
+})
@@ -0,0 +1,305 @@
+package handshake
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// noisePrologue is mixed into the handshake hash of every noise handshake, so
+// that handshakes cannot be confused with other applications of the same
+// Noise protocol.
+var noisePrologue = []byte("airwave")
+
+// noiseStaticKeyPrefix is prepended to the static noise public key before it
+// is signed using the protocol.SignVerifier. This prevents the signature from
+// being valid in any other context.
+var noiseStaticKeyPrefix = []byte("airwave-noise-static-key:")
+
+type noiseHandshaker struct {
+	signVerifier         protocol.SignVerifier
+	capabilities         protocol.Capabilities
+	authorizer           Authorizer
+	limits               protocol.SizeLimits
+	compressionThreshold int
+	staticKey            noiseKeyPair
+}
+
+// NewNoise returns a Handshaker that runs the Noise XX pattern, using the
+// default Options. See NewNoiseWithOptions for more details.
+func NewNoise(signVerifier protocol.SignVerifier) Handshaker {
+	return NewNoiseWithOptions(signVerifier, Options{})
+}
+
+// NewNoiseWithOptions returns a Handshaker that runs the Noise XX pattern
+// (Noise_XX_25519_ChaChaPoly_SHA256). Both peers exchange static X25519 keys
+// and protocol.Capabilities that are authenticated by signing them with the
+// protocol.SignVerifier, and the transcript of the entire handshake is bound
+// into the resulting session keys. The AEADs of the Capabilities are replaced
+// by protocol.NoiseChaChaPoly. The client authorizes the server before sending
+// its own static key, and the server authorizes the client before returning
+// the session. The static key is generated once and used for all handshakes.
+func NewNoiseWithOptions(signVerifier protocol.SignVerifier, options Options) Handshaker {
+	if signVerifier == nil {
+		panic("invariant violation: SignVerifier cannot be nil")
+	}
+	options.setZerosToDefaults()
+	staticKey, err := newNoiseKeyPair(rand.Reader)
+	if err != nil {
+		panic(fmt.Errorf("invariant violation: cannot generate static key: %v", err))
+	}
+	capabilities := options.Capabilities
+	capabilities.AEADs = []protocol.AEAD{protocol.NoiseChaChaPoly}
+	return &noiseHandshaker{
+		signVerifier:         signVerifier,
+		capabilities:         capabilities,
+		authorizer:           options.Authorizer,
+		limits:               options.SizeLimits,
+		compressionThreshold: options.CompressionThreshold,
+		staticKey:            staticKey,
+	}
+}
+
+func (hs *noiseHandshaker) Handshake(ctx context.Context, rw io.ReadWriter, expected protocol.PeerID) (protocol.Session, error) {
+	state, err := hs.newState(true)
+	if err != nil {
+		return nil, err
+	}
+
+	// 1. -> e
+	if err := hs.writeMessage(rw, state, nil); err != nil {
+		return nil, err
+	}
+
+	// 2. <- e, ee, s, es (with the remote capabilities and the signature of
+	// them and the remote static key)
+	remotePeerID, remoteCapabilities, err := hs.readMessage(rw, state)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyExpectedPeer(expected, remotePeerID); err != nil {
+		return nil, err
+	}
+	if err := authorize(hs.authorizer, remotePeerID); err != nil {
+		return nil, err
+	}
+	negotiation, err := negotiate(hs.capabilities, remoteCapabilities)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. -> s, se (with the local capabilities and the signature of them and
+	// the local static key)
+	payload, err := hs.signedPayload()
+	if err != nil {
+		return nil, err
+	}
+	if err := hs.writeMessage(rw, state, payload); err != nil {
+		return nil, err
+	}
+
+	send, recv := state.split()
+	return newNegotiatedSession(newNoiseSession(remotePeerID, send, recv), negotiation, hs.limits, hs.compressionThreshold), nil
+}
+
+func (hs *noiseHandshaker) AcceptHandshake(ctx context.Context, rw io.ReadWriter) (protocol.Session, error) {
+	state, err := hs.newState(false)
+	if err != nil {
+		return nil, err
+	}
+
+	// 1. -> e
+	msg, err := read(rw, hs.limits.MaxHandshakeLength)
+	if err != nil {
+		return nil, wrapReadError("error reading noise message from io.Reader (potential rate limit)", err)
+	}
+	if _, err := state.readMessage(msg); err != nil {
+		return nil, err
+	}
+
+	// 2. <- e, ee, s, es (with the local capabilities and the signature of
+	// them and the local static key)
+	payload, err := hs.signedPayload()
+	if err != nil {
+		return nil, err
+	}
+	if err := hs.writeMessage(rw, state, payload); err != nil {
+		return nil, err
+	}
+
+	// 3. -> s, se (with the remote capabilities and the signature of them and
+	// the remote static key)
+	remotePeerID, remoteCapabilities, err := hs.readMessage(rw, state)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorize(hs.authorizer, remotePeerID); err != nil {
+		return nil, err
+	}
+	negotiation, err := negotiate(remoteCapabilities, hs.capabilities)
+	if err != nil {
+		return nil, err
+	}
+
+	send, recv := state.split()
+	return newNegotiatedSession(newNoiseSession(remotePeerID, send, recv), negotiation, hs.limits, hs.compressionThreshold), nil
+}
+
+func (hs *noiseHandshaker) newState(initiator bool) (*noiseHandshakeState, error) {
+	ephemeralKey, err := newNoiseKeyPair(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return newNoiseHandshakeState(initiator, noisePrologue, hs.staticKey, ephemeralKey), nil
+}
+
+// Write the next handshake message, carrying the payload, through the
+// io.Writer.
+func (hs *noiseHandshaker) writeMessage(w io.Writer, state *noiseHandshakeState, payload []byte) error {
+	msg, err := state.writeMessage(payload)
+	if err != nil {
+		return fmt.Errorf("error building noise message: %v", err)
+	}
+	if err := write(w, msg); err != nil {
+		return fmt.Errorf("error writing noise message to io.Writer: %v", err)
+	}
+	return nil
+}
+
+// Read the next handshake message from the io.Reader. Its payload contains the
+// remote capabilities, and a signature of them and the remote static key.
+func (hs *noiseHandshaker) readMessage(r io.Reader, state *noiseHandshakeState) (protocol.PeerID, protocol.Capabilities, error) {
+	capabilities := protocol.Capabilities{}
+	msg, err := read(r, hs.limits.MaxHandshakeLength)
+	if err != nil {
+		return nil, capabilities, wrapReadError("error reading noise message from io.Reader", err)
+	}
+	payload, err := state.readMessage(msg)
+	if err != nil {
+		return nil, capabilities, err
+	}
+	buf := bytes.NewBuffer(payload)
+	capabilitiesBytes, err := read(buf, hs.limits.MaxHandshakeLength)
+	if err != nil {
+		return nil, capabilities, wrapReadError("error reading capabilities from noise payload", err)
+	}
+	sig, err := read(buf, hs.limits.MaxHandshakeLength)
+	if err != nil {
+		return nil, capabilities, wrapReadError("error reading signature from noise payload", err)
+	}
+	remotePeerID, err := hs.signVerifier.Verify(hs.signVerifier.Hash(staticKeyDigest(state.rs, capabilitiesBytes)), sig)
+	if err != nil {
+		return nil, capabilities, fmt.Errorf("error verifying noise static key: %v", err)
+	}
+	if err := capabilities.UnmarshalBinary(capabilitiesBytes); err != nil {
+		return nil, capabilities, err
+	}
+	return remotePeerID, capabilities, nil
+}
+
+// signedPayload returns the local capabilities, followed by a signature of them
+// and the local static key.
+func (hs *noiseHandshaker) signedPayload() ([]byte, error) {
+	capabilitiesBytes, err := hs.capabilities.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling capabilities: %v", err)
+	}
+	sig, err := hs.signVerifier.Sign(hs.signVerifier.Hash(staticKeyDigest(hs.staticKey.public[:], capabilitiesBytes)))
+	if err != nil {
+		return nil, fmt.Errorf("invariant violation: cannot sign noise static key: %v", err)
+	}
+	buf := new(bytes.Buffer)
+	if err := write(buf, capabilitiesBytes); err != nil {
+		return nil, err
+	}
+	if err := write(buf, sig); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func staticKeyDigest(staticKey, capabilities []byte) []byte {
+	digest := append(append([]byte{}, noiseStaticKeyPrefix...), staticKey...)
+	return append(digest, capabilities...)
+}
+
+// noiseSession encrypts messages using the cipher states derived at the end of
+// a noise handshake. Each direction has its own key and nonce counter, so
+// messages must be read in the order that they were written. The header of the
+// message is authenticated as additional data.
+type noiseSession struct {
+	peerID protocol.PeerID
+	send   *noiseCipherState
+	recv   *noiseCipherState
+	limits protocol.SizeLimits
+}
+
+func newNoiseSession(peerID protocol.PeerID, send, recv *noiseCipherState) protocol.Session {
+	return &noiseSession{
+		peerID: peerID,
+		send:   send,
+		recv:   recv,
+		limits: protocol.DefaultSizeLimits(),
+	}
+}
+
+func (session *noiseSession) setSizeLimits(limits protocol.SizeLimits) {
+	session.limits = limits
+}
+
+func (session *noiseSession) ReadMessageOnTheWire(r io.Reader) (protocol.MessageOnTheWire, error) {
+	otw := protocol.MessageOnTheWire{}
+	otw.From = session.peerID
+	if err := otw.Message.UnmarshalReaderWithLimits(r, session.limits); err != nil {
+		return otw, err
+	}
+
+	body, err := session.recv.decryptWithAd(noiseAd(otw.Message), otw.Message.Body)
+	if err != nil {
+		return otw, err
+	}
+	otw.Message.Body = body
+	length := otw.Message.HeaderLength()
+	otw.Message.Length = protocol.MessageLength(len(otw.Message.Body) + length)
+	return otw, nil
+}
+
+func (session *noiseSession) Negotiation() protocol.Negotiation {
+	return protocol.DefaultNegotiation(protocol.NoiseChaChaPoly)
+}
+
+func (session *noiseSession) WriteMessage(w io.Writer, message protocol.Message) error {
+	body, err := session.send.encryptWithAd(noiseAd(message), message.Body)
+	if err != nil {
+		return err
+	}
+	message.Body = body
+	length := message.HeaderLength()
+	message.Length = protocol.MessageLength(len(message.Body) + length)
+
+	data, err := message.MarshalBinaryWithLimits(session.limits)
+	if err != nil {
+		return fmt.Errorf("error writing message: %v", err)
+	}
+	n, err := w.Write(data)
+	if n != len(data) {
+		return fmt.Errorf("error writing message: expected n=%v, got n=%v", len(data), n)
+	}
+	return err
+}
+
+// noiseAd returns the parts of the message header that are not modified by
+// encryption, including the extensions of V2 messages.
+func noiseAd(message protocol.Message) []byte {
+	extensions := extensionsAd(message)
+	ad := make([]byte, 4, 4+len(message.GroupID)+len(extensions))
+	binary.LittleEndian.PutUint16(ad[0:], uint16(message.Version))
+	binary.LittleEndian.PutUint16(ad[2:], uint16(message.Variant))
+	ad = append(ad, message.GroupID[:]...)
+	return append(ad, extensions...)
+}
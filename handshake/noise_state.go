@@ -0,0 +1,353 @@
+package handshake
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// noiseProtocolName is mixed into the initial handshake hash, as required by
+// the Noise specification. It must change whenever the DH function, cipher or
+// hash used by the noise handshake changes.
+const noiseProtocolName = "Noise_XX_25519_ChaChaPoly_SHA256"
+
+// noiseKeyLength is the length of X25519 keys, ChaChaPoly keys and SHA256
+// digests.
+const noiseKeyLength = 32
+
+// noiseTagLength is the length of the authentication tag appended by
+// ChaChaPoly.
+const noiseTagLength = 16
+
+// errNoiseNonceExhausted is returned when a cipher state has used all of the
+// nonces available to its key.
+var errNoiseNonceExhausted = errors.New("noise nonce exhausted")
+
+type noiseToken uint8
+
+const (
+	noiseTokenE = noiseToken(iota)
+	noiseTokenS
+	noiseTokenEE
+	noiseTokenES
+	noiseTokenSE
+	noiseTokenSS
+)
+
+// noiseXX is the XX handshake pattern:
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+var noiseXX = [][]noiseToken{
+	{noiseTokenE},
+	{noiseTokenE, noiseTokenEE, noiseTokenS, noiseTokenES},
+	{noiseTokenS, noiseTokenSE},
+}
+
+type noiseKeyPair struct {
+	private [noiseKeyLength]byte
+	public  [noiseKeyLength]byte
+}
+
+func newNoiseKeyPair(r io.Reader) (noiseKeyPair, error) {
+	private := [noiseKeyLength]byte{}
+	if _, err := io.ReadFull(r, private[:]); err != nil {
+		return noiseKeyPair{}, fmt.Errorf("error generating x25519 key: %v", err)
+	}
+	return noiseKeyPairFromPrivate(private), nil
+}
+
+func noiseKeyPairFromPrivate(private [noiseKeyLength]byte) noiseKeyPair {
+	keyPair := noiseKeyPair{private: private}
+	curve25519.ScalarBaseMult(&keyPair.public, &keyPair.private)
+	return keyPair
+}
+
+func (keyPair noiseKeyPair) dh(public []byte) ([]byte, error) {
+	return curve25519.X25519(keyPair.private[:], public)
+}
+
+// noiseCipherState is the CipherState object from the Noise specification. A
+// cipher state with no key passes plaintext through unmodified.
+type noiseCipherState struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+func (cs *noiseCipherState) initializeKey(key []byte) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		panic(fmt.Errorf("invariant violation: cannot create chacha20poly1305: %v", err))
+	}
+	cs.aead = aead
+	cs.nonce = 0
+}
+
+func (cs *noiseCipherState) hasKey() bool {
+	return cs.aead != nil
+}
+
+func (cs *noiseCipherState) encryptWithAd(ad, plaintext []byte) ([]byte, error) {
+	if !cs.hasKey() {
+		return plaintext, nil
+	}
+	nonce, err := cs.nextNonce()
+	if err != nil {
+		return nil, err
+	}
+	return cs.aead.Seal(nil, nonce, plaintext, ad), nil
+}
+
+func (cs *noiseCipherState) decryptWithAd(ad, ciphertext []byte) ([]byte, error) {
+	if !cs.hasKey() {
+		return ciphertext, nil
+	}
+	nonce, err := cs.nextNonce()
+	if err != nil {
+		return nil, err
+	}
+	return cs.aead.Open(nil, nonce, ciphertext, ad)
+}
+
+// nextNonce encodes the current nonce as 32 bits of zeros followed by a
+// little-endian 64-bit counter, and then increments the counter. The maximum
+// counter value is reserved by the specification.
+func (cs *noiseCipherState) nextNonce() ([]byte, error) {
+	if cs.nonce == math.MaxUint64 {
+		return nil, errNoiseNonceExhausted
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], cs.nonce)
+	cs.nonce++
+	return nonce, nil
+}
+
+// noiseSymmetricState is the SymmetricState object from the Noise
+// specification.
+type noiseSymmetricState struct {
+	cs noiseCipherState
+	ck [noiseKeyLength]byte
+	h  [noiseKeyLength]byte
+}
+
+func (ss *noiseSymmetricState) initializeSymmetric(protocolName string) {
+	if len(protocolName) <= noiseKeyLength {
+		copy(ss.h[:], protocolName)
+	} else {
+		ss.h = sha256.Sum256([]byte(protocolName))
+	}
+	ss.ck = ss.h
+}
+
+func (ss *noiseSymmetricState) mixKey(ikm []byte) {
+	ck, key := noiseHKDF(ss.ck[:], ikm)
+	copy(ss.ck[:], ck)
+	ss.cs.initializeKey(key)
+}
+
+func (ss *noiseSymmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(ss.h[:])
+	h.Write(data)
+	copy(ss.h[:], h.Sum(nil))
+}
+
+func (ss *noiseSymmetricState) encryptAndHash(plaintext []byte) ([]byte, error) {
+	ciphertext, err := ss.cs.encryptWithAd(ss.h[:], plaintext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(ciphertext)
+	return ciphertext, nil
+}
+
+func (ss *noiseSymmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := ss.cs.decryptWithAd(ss.h[:], ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+func (ss *noiseSymmetricState) split() (*noiseCipherState, *noiseCipherState) {
+	key1, key2 := noiseHKDF(ss.ck[:], nil)
+	cs1, cs2 := new(noiseCipherState), new(noiseCipherState)
+	cs1.initializeKey(key1)
+	cs2.initializeKey(key2)
+	return cs1, cs2
+}
+
+// noiseHandshakeState is the HandshakeState object from the Noise
+// specification, specialised to the XX pattern (which has no pre-messages).
+type noiseHandshakeState struct {
+	ss        noiseSymmetricState
+	initiator bool
+	s         noiseKeyPair
+	e         noiseKeyPair
+	rs        []byte
+	re        []byte
+	step      int
+}
+
+func newNoiseHandshakeState(initiator bool, prologue []byte, s, e noiseKeyPair) *noiseHandshakeState {
+	hs := &noiseHandshakeState{
+		initiator: initiator,
+		s:         s,
+		e:         e,
+	}
+	hs.ss.initializeSymmetric(noiseProtocolName)
+	hs.ss.mixHash(prologue)
+	return hs
+}
+
+// isWriter returns true if the local peer writes the next handshake message.
+// The initiator writes all even numbered messages.
+func (hs *noiseHandshakeState) isWriter() bool {
+	return (hs.step%2 == 0) == hs.initiator
+}
+
+func (hs *noiseHandshakeState) isFinished() bool {
+	return hs.step >= len(noiseXX)
+}
+
+// writeMessage returns the next handshake message, with the given payload
+// encrypted at the end of it.
+func (hs *noiseHandshakeState) writeMessage(payload []byte) ([]byte, error) {
+	if hs.isFinished() || !hs.isWriter() {
+		return nil, fmt.Errorf("invariant violation: unexpected noise write at step=%v", hs.step)
+	}
+	message := []byte{}
+	for _, token := range noiseXX[hs.step] {
+		switch token {
+		case noiseTokenE:
+			message = append(message, hs.e.public[:]...)
+			hs.ss.mixHash(hs.e.public[:])
+		case noiseTokenS:
+			ciphertext, err := hs.ss.encryptAndHash(hs.s.public[:])
+			if err != nil {
+				return nil, err
+			}
+			message = append(message, ciphertext...)
+		default:
+			if err := hs.mixDH(token); err != nil {
+				return nil, err
+			}
+		}
+	}
+	ciphertext, err := hs.ss.encryptAndHash(payload)
+	if err != nil {
+		return nil, err
+	}
+	hs.step++
+	return append(message, ciphertext...), nil
+}
+
+// readMessage consumes the next handshake message, and returns the payload
+// that was encrypted at the end of it.
+func (hs *noiseHandshakeState) readMessage(message []byte) ([]byte, error) {
+	if hs.isFinished() || hs.isWriter() {
+		return nil, fmt.Errorf("invariant violation: unexpected noise read at step=%v", hs.step)
+	}
+	for _, token := range noiseXX[hs.step] {
+		switch token {
+		case noiseTokenE:
+			if len(message) < noiseKeyLength {
+				return nil, fmt.Errorf("error reading noise ephemeral key: message too short")
+			}
+			hs.re = append([]byte{}, message[:noiseKeyLength]...)
+			message = message[noiseKeyLength:]
+			hs.ss.mixHash(hs.re)
+		case noiseTokenS:
+			length := noiseKeyLength
+			if hs.ss.cs.hasKey() {
+				length += noiseTagLength
+			}
+			if len(message) < length {
+				return nil, fmt.Errorf("error reading noise static key: message too short")
+			}
+			rs, err := hs.ss.decryptAndHash(message[:length])
+			if err != nil {
+				return nil, fmt.Errorf("error decrypting noise static key: %v", err)
+			}
+			hs.rs = rs
+			message = message[length:]
+		default:
+			if err := hs.mixDH(token); err != nil {
+				return nil, err
+			}
+		}
+	}
+	payload, err := hs.ss.decryptAndHash(message)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting noise payload: %v", err)
+	}
+	hs.step++
+	return payload, nil
+}
+
+// mixDH performs the DH operation described by the token, from the point of
+// view of the local peer, and mixes the result into the chaining key.
+func (hs *noiseHandshakeState) mixDH(token noiseToken) error {
+	var local noiseKeyPair
+	var remote []byte
+	switch token {
+	case noiseTokenEE:
+		local, remote = hs.e, hs.re
+	case noiseTokenSS:
+		local, remote = hs.s, hs.rs
+	case noiseTokenES:
+		if hs.initiator {
+			local, remote = hs.e, hs.rs
+		} else {
+			local, remote = hs.s, hs.re
+		}
+	case noiseTokenSE:
+		if hs.initiator {
+			local, remote = hs.s, hs.re
+		} else {
+			local, remote = hs.e, hs.rs
+		}
+	default:
+		return fmt.Errorf("invariant violation: unknown noise token=%v", token)
+	}
+	secret, err := local.dh(remote)
+	if err != nil {
+		return fmt.Errorf("error computing x25519 shared secret: %v", err)
+	}
+	hs.ss.mixKey(secret)
+	return nil
+}
+
+// split returns the cipher states for sending and receiving transport
+// messages, from the point of view of the local peer.
+func (hs *noiseHandshakeState) split() (send *noiseCipherState, recv *noiseCipherState) {
+	cs1, cs2 := hs.ss.split()
+	if hs.initiator {
+		return cs1, cs2
+	}
+	return cs2, cs1
+}
+
+// noiseHKDF is the two output HKDF function from the Noise specification.
+func noiseHKDF(chainingKey, ikm []byte) ([]byte, []byte) {
+	tempKey := noiseHMAC(chainingKey, ikm)
+	output1 := noiseHMAC(tempKey, []byte{0x01})
+	output2 := noiseHMAC(tempKey, append(append([]byte{}, output1...), 0x02))
+	return output1, output2
+}
+
+func noiseHMAC(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
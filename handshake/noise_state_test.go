@@ -0,0 +1,146 @@
+package handshake
+
+import (
+	"bytes"
+	"encoding/hex"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// The test vectors are for Noise_XX_25519_ChaChaPoly_SHA256 with the prologue
+// "airwave", and were generated using an independent implementation of the
+// Noise protocol framework (github.com/flynn/noise).
+var noiseXXVectors = struct {
+	initStatic, respStatic, initEphemeral, respEphemeral byte
+
+	payloads   [3]string
+	messages   [3]string
+	hash       string
+	transports [2]string
+}{
+	// Private keys are the 32 consecutive bytes starting at the given value.
+	initStatic:    0x00,
+	respStatic:    0x20,
+	initEphemeral: 0x40,
+	respEphemeral: 0x60,
+
+	payloads: [3]string{"msg1", "msg2", "msg3"},
+	messages: [3]string{
+		"79a631eede1bf9c98f12032cdeadd0e7a079398fc786b88cc846ec89af85a51a6d736731",
+		"675dd574ed7789310b3d2e7681f3790b466c773b1521fecf36577958371ea52ff8fbbd167814c44b0bb328d5e48aaa31dfd99f21b507a9124257638ff45516cccaefa7b02e1b4c8ad15a8990a5750c5d6155a49ad29cb81ebc96f3de6cfa6bc4df4fe531",
+		"0e9eb889e33411638c7b00a161b3ad9460a27b9c7abb509b53cb745363f938a4bf582672ab1d63a0ca46f7ef52b6b2269325182120e6f6f077b35286a53aa9cfa23ae5f8",
+	},
+	hash: "c063e8148eb5963b58000dbd4581f4b4d82429d7d4e2a02aadf2a38b25bb8e95",
+	transports: [2]string{
+		// "transport1" from the initiator to the responder.
+		"9beb1cdf3c94896ac93a81fac45835ea3b7526270aaa00673bef",
+		// "transport2" from the responder to the initiator.
+		"e8d030f16ce921b1efa0fa64877742b6c3b54c6c5f729d8d009e",
+	},
+}
+
+var _ = Describe("Noise XX state machine", func() {
+
+	keyPair := func(start byte) noiseKeyPair {
+		private := [noiseKeyLength]byte{}
+		for i := range private {
+			private[i] = start + byte(i)
+		}
+		return noiseKeyPairFromPrivate(private)
+	}
+
+	decodeHex := func(s string) []byte {
+		data, err := hex.DecodeString(s)
+		Expect(err).NotTo(HaveOccurred())
+		return data
+	}
+
+	Context("when running the handshake with fixed keys", func() {
+		It("should produce the messages, hash and transport ciphertexts of the test vectors", func() {
+			vectors := noiseXXVectors
+			initiator := newNoiseHandshakeState(true, noisePrologue, keyPair(vectors.initStatic), keyPair(vectors.initEphemeral))
+			responder := newNoiseHandshakeState(false, noisePrologue, keyPair(vectors.respStatic), keyPair(vectors.respEphemeral))
+
+			for i := range vectors.messages {
+				writer, reader := initiator, responder
+				if i%2 == 1 {
+					writer, reader = responder, initiator
+				}
+				message, err := writer.writeMessage([]byte(vectors.payloads[i]))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(message).To(Equal(decodeHex(vectors.messages[i])))
+
+				payload, err := reader.readMessage(message)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(payload)).To(Equal(vectors.payloads[i]))
+			}
+			Expect(initiator.isFinished()).To(BeTrue())
+			Expect(responder.isFinished()).To(BeTrue())
+			Expect(initiator.ss.h[:]).To(Equal(decodeHex(vectors.hash)))
+			Expect(responder.ss.h[:]).To(Equal(decodeHex(vectors.hash)))
+			Expect(bytes.Equal(initiator.rs, responder.s.public[:])).To(BeTrue())
+			Expect(bytes.Equal(responder.rs, initiator.s.public[:])).To(BeTrue())
+
+			initSend, initRecv := initiator.split()
+			respSend, respRecv := responder.split()
+
+			ciphertext, err := initSend.encryptWithAd(nil, []byte("transport1"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ciphertext).To(Equal(decodeHex(vectors.transports[0])))
+			plaintext, err := respRecv.decryptWithAd(nil, ciphertext)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(plaintext)).To(Equal("transport1"))
+
+			ciphertext, err = respSend.encryptWithAd(nil, []byte("transport2"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ciphertext).To(Equal(decodeHex(vectors.transports[1])))
+			plaintext, err = initRecv.decryptWithAd(nil, ciphertext)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(plaintext)).To(Equal("transport2"))
+		})
+	})
+
+	Context("when a handshake message has been tampered with", func() {
+		It("should fail to read the message", func() {
+			initiator := newNoiseHandshakeState(true, noisePrologue, keyPair(0x00), keyPair(0x40))
+			responder := newNoiseHandshakeState(false, noisePrologue, keyPair(0x20), keyPair(0x60))
+
+			message, err := initiator.writeMessage(nil)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = responder.readMessage(message)
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err = responder.writeMessage(nil)
+			Expect(err).NotTo(HaveOccurred())
+			message[len(message)-1] ^= 0xFF
+			_, err = initiator.readMessage(message)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when the prologues do not match", func() {
+		It("should fail to read the second message", func() {
+			initiator := newNoiseHandshakeState(true, []byte("foo"), keyPair(0x00), keyPair(0x40))
+			responder := newNoiseHandshakeState(false, []byte("bar"), keyPair(0x20), keyPair(0x60))
+
+			message, err := initiator.writeMessage(nil)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = responder.readMessage(message)
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err = responder.writeMessage(nil)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = initiator.readMessage(message)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when messages are written out of turn", func() {
+		It("should return an error", func() {
+			responder := newNoiseHandshakeState(false, noisePrologue, keyPair(0x20), keyPair(0x60))
+			_, err := responder.writeMessage(nil)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,195 @@
+package handshake_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing/quick"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/handshake"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/phi"
+)
+
+var _ = Describe("Noise handshaker", func() {
+
+	handshake := func(ctx context.Context, clientConn, serverConn io.ReadWriter, client, server Handshaker) (protocol.Session, protocol.Session, error, error) {
+		var clientErr, serverErr error
+		var clientSession, serverSession protocol.Session
+		phi.ParBegin(func() {
+			clientSession, clientErr = client.Handshake(ctx, clientConn, nil)
+		}, func() {
+			serverSession, serverErr = server.AcceptHandshake(ctx, serverConn)
+		})
+		return clientSession, serverSession, clientErr, serverErr
+	}
+
+	Context("when initializing handshake", func() {
+		It("should panic if providing a nil SignVerifier", func() {
+			Expect(func() {
+				_ = NewNoise(nil)
+			}).Should(Panic())
+		})
+	})
+
+	Context("when both client and server are honest", func() {
+		It("should authenticate the client and server, and cipher and decipher messages in both directions", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+
+			clientConn, serverConn := net.Pipe()
+			clientSession, serverSession, clientErr, serverErr := handshake(ctx, clientConn, serverConn, NewNoise(clientSignVerifier), NewNoise(serverSignVerifier))
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverErr).NotTo(HaveOccurred())
+
+			test := func() bool {
+				var writeErr, readErr error
+				var readMessage protocol.MessageOnTheWire
+				message := RandomMessage(protocol.V2, RandomMessageVariant())
+
+				phi.ParBegin(func() {
+					writeErr = clientSession.WriteMessage(clientConn, message)
+				}, func() {
+					readMessage, readErr = serverSession.ReadMessageOnTheWire(serverConn)
+				})
+				Expect(writeErr).NotTo(HaveOccurred())
+				Expect(readErr).NotTo(HaveOccurred())
+				Expect(readMessage.From.String()).To(Equal(clientSignVerifier.ID()))
+				Expect(cmp.Equal(readMessage.Message, message, cmpopts.EquateEmpty())).To(BeTrue())
+
+				phi.ParBegin(func() {
+					writeErr = serverSession.WriteMessage(serverConn, message)
+				}, func() {
+					readMessage, readErr = clientSession.ReadMessageOnTheWire(clientConn)
+				})
+				Expect(writeErr).NotTo(HaveOccurred())
+				Expect(readErr).NotTo(HaveOccurred())
+				Expect(readMessage.From.String()).To(Equal(serverSignVerifier.ID()))
+				return cmp.Equal(readMessage.Message, message, cmpopts.EquateEmpty())
+			}
+
+			Expect(quick.Check(test, nil)).NotTo(HaveOccurred())
+		})
+	})
+
+	Context("when the client expects a specific server", func() {
+		expectedPeerHandshake := func(expected func(serverSignVerifier MockSignVerifier) protocol.PeerID) (error, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+
+			clientConn, serverConn := net.Pipe()
+			go func() {
+				<-ctx.Done()
+				clientConn.Close()
+				serverConn.Close()
+			}()
+
+			var clientErr, serverErr error
+			phi.ParBegin(func() {
+				_, clientErr = NewNoise(clientSignVerifier).Handshake(ctx, clientConn, expected(serverSignVerifier))
+				if clientErr != nil {
+					cancel()
+				}
+			}, func() {
+				_, serverErr = NewNoise(serverSignVerifier).AcceptHandshake(ctx, serverConn)
+			})
+			return clientErr, serverErr
+		}
+
+		It("should succeed if the server is the expected peer", func() {
+			clientErr, serverErr := expectedPeerHandshake(func(serverSignVerifier MockSignVerifier) protocol.PeerID {
+				return SimplePeerID(serverSignVerifier.ID())
+			})
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverErr).NotTo(HaveOccurred())
+		})
+
+		It("should return an ErrUnexpectedPeer if the server is another peer", func() {
+			expected := RandomPeerID()
+			clientErr, serverErr := expectedPeerHandshake(func(MockSignVerifier) protocol.PeerID {
+				return expected
+			})
+			Expect(clientErr).To(BeAssignableToTypeOf(ErrUnexpectedPeer{}))
+			Expect(clientErr.(ErrUnexpectedPeer).Expected).To(Equal(expected))
+			Expect(serverErr).To(HaveOccurred())
+		})
+	})
+
+	Context("when the server does not trust the client", func() {
+		It("should return an error on both sides", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier()
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+			go func() {
+				// Unblock the client once the server has rejected it.
+				<-ctx.Done()
+				clientConn.Close()
+			}()
+			_, _, _, serverErr := handshake(ctx, clientConn, serverConn, NewNoise(clientSignVerifier), NewNoise(serverSignVerifier))
+			Expect(serverErr).To(HaveOccurred())
+		})
+	})
+
+	Context("when the client does not trust the server", func() {
+		It("should return an error before sending the client static key", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			go func() {
+				<-ctx.Done()
+				serverConn.Close()
+			}()
+			_, _, clientErr, serverErr := handshake(ctx, clientConn, serverConn, NewNoise(clientSignVerifier), NewNoise(serverSignVerifier))
+			Expect(clientErr).To(HaveOccurred())
+			Expect(serverErr).To(HaveOccurred())
+		})
+	})
+
+	Context("when the client is using a different handshaker", func() {
+		It("should fail the handshake", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+
+			clientConn, serverConn := net.Pipe()
+			go func() {
+				<-ctx.Done()
+				clientConn.Close()
+				serverConn.Close()
+			}()
+			_, _, clientErr, serverErr := handshake(ctx, clientConn, serverConn, New(clientSignVerifier, NewGCMSessionManager()), NewNoise(serverSignVerifier))
+			Expect(clientErr).To(HaveOccurred())
+			Expect(serverErr).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,51 @@
+package handshake
+
+import "github.com/renproject/aw/protocol"
+
+// Options are used to parameterise the behaviour of a Handshaker.
+type Options struct {
+	// Capabilities advertised to the remote peer. Empty lists default to the
+	// lists of protocol.DefaultCapabilities. The AEADs are always replaced by
+	// the AEADs supported by the Handshaker.
+	Capabilities protocol.Capabilities
+
+	// Authorizer is consulted as soon as the remote PeerID has been
+	// authenticated. Defaults to authorizing all peers.
+	Authorizer Authorizer
+
+	// Tickets is used to issue and redeem session resumption tickets. Only
+	// the ECIES Handshaker supports resumption. Defaults to nil, which
+	// disables resumption.
+	Tickets *TicketStore
+
+	// SizeLimits bound the length of handshake messages, and of the messages
+	// read and written by the sessions created by the Handshaker. Zero values
+	// default to the values of protocol.DefaultSizeLimits.
+	SizeLimits protocol.SizeLimits
+
+	// CompressionThreshold is the minimum length of the message bodies that
+	// are compressed, when a compression has been negotiated. The compression
+	// is chosen using the Compressions of the Capabilities. Defaults to 256
+	// bytes.
+	CompressionThreshold int
+}
+
+func (options *Options) setZerosToDefaults() {
+	defaults := protocol.DefaultCapabilities()
+	if len(options.Capabilities.Versions) == 0 {
+		options.Capabilities.Versions = defaults.Versions
+	}
+	if len(options.Capabilities.Variants) == 0 {
+		options.Capabilities.Variants = defaults.Variants
+	}
+	if len(options.Capabilities.Compressions) == 0 {
+		options.Capabilities.Compressions = defaults.Compressions
+	}
+	if options.Authorizer == nil {
+		options.Authorizer = NewAllowAll()
+	}
+	options.SizeLimits.SetZerosToDefaults()
+	if options.CompressionThreshold <= 0 {
+		options.CompressionThreshold = 256
+	}
+}
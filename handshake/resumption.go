@@ -0,0 +1,421 @@
+package handshake
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// modeFull is sent by a client that wants to run the full handshake.
+	modeFull = byte(0)
+	// modeResume is sent by a client that presents a resumption ticket.
+	modeResume = byte(1)
+
+	// statusRejected is sent by a server that cannot redeem a resumption
+	// ticket. The client falls back to the full handshake.
+	statusRejected = byte(0)
+	// statusAccepted is sent by a server that has redeemed a resumption
+	// ticket.
+	statusAccepted = byte(1)
+
+	ticketIDLength        = 32
+	resumptionSecretLen   = 32
+	resumptionNonceLength = 32
+)
+
+var (
+	infoResumptionSecret = []byte("aw resumption secret")
+	infoResumedKey       = []byte("aw resumed session key")
+	labelClientFinished  = []byte("aw client finished")
+	labelServerFinished  = []byte("aw server finished")
+)
+
+// errTicketRejected is returned to the client when the server did not redeem
+// its resumption ticket.
+var errTicketRejected = fmt.Errorf("resumption ticket rejected")
+
+// A TicketStore keeps the resumption tickets of a Handshaker. As a server, the
+// Handshaker issues a ticket to every client that completes a full handshake.
+// As a client, the Handshaker keeps the ticket issued by every server, and
+// presents it the next time that it dials the same server. Resuming a session
+// takes a single round trip, and derives a fresh session key from the secret
+// of the ticket and nonces chosen by both peers, without any ECIES operations.
+//
+// Tickets are bound to both peers: a server only redeems a ticket for the
+// client that it was issued to, and a client only presents a ticket to the
+// server that issued it. A TicketStore is safe for concurrent use.
+type TicketStore struct {
+	ttl time.Duration
+
+	mu           *sync.Mutex
+	issued       map[[ticketIDLength]byte]issuedTicket
+	issuedByPeer map[string][ticketIDLength]byte
+	received     map[string]receivedTicket
+}
+
+type issuedTicket struct {
+	peerID      protocol.PeerID
+	secret      []byte
+	negotiation protocol.Negotiation
+	expiry      time.Time
+}
+
+type receivedTicket struct {
+	id          [ticketIDLength]byte
+	peerID      protocol.PeerID
+	secret      []byte
+	negotiation protocol.Negotiation
+	expiry      time.Time
+}
+
+// NewTicketStore returns a TicketStore that issues tickets which expire after
+// the given duration.
+func NewTicketStore(ttl time.Duration) *TicketStore {
+	if ttl <= 0 {
+		panic(fmt.Sprintf("invariant violation: ticket ttl must be positive, got %v", ttl))
+	}
+	return &TicketStore{
+		ttl:          ttl,
+		mu:           new(sync.Mutex),
+		issued:       map[[ticketIDLength]byte]issuedTicket{},
+		issuedByPeer: map[string][ticketIDLength]byte{},
+		received:     map[string]receivedTicket{},
+	}
+}
+
+// Revoke all tickets that have been issued to, or received from, the peer. The
+// next handshake with the peer will be a full handshake.
+func (store *TicketStore) Revoke(peerID protocol.PeerID) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if id, ok := store.issuedByPeer[peerID.String()]; ok {
+		delete(store.issued, id)
+		delete(store.issuedByPeer, peerID.String())
+	}
+	delete(store.received, peerID.String())
+}
+
+// RevokeAll tickets that have been issued or received.
+func (store *TicketStore) RevokeAll() {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.issued = map[[ticketIDLength]byte]issuedTicket{}
+	store.issuedByPeer = map[string][ticketIDLength]byte{}
+	store.received = map[string]receivedTicket{}
+}
+
+// issue a ticket to the peer, replacing any ticket previously issued to the
+// peer.
+func (store *TicketStore) issue(peerID protocol.PeerID, secret []byte, negotiation protocol.Negotiation) ([ticketIDLength]byte, error) {
+	id := [ticketIDLength]byte{}
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, fmt.Errorf("error generating ticket id: %v", err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	for otherID, ticket := range store.issued {
+		if now.After(ticket.expiry) {
+			delete(store.issued, otherID)
+			delete(store.issuedByPeer, ticket.peerID.String())
+		}
+	}
+	if oldID, ok := store.issuedByPeer[peerID.String()]; ok {
+		delete(store.issued, oldID)
+	}
+	store.issued[id] = issuedTicket{
+		peerID:      peerID,
+		secret:      secret,
+		negotiation: negotiation,
+		expiry:      now.Add(store.ttl),
+	}
+	store.issuedByPeer[peerID.String()] = id
+	return id, nil
+}
+
+// redeem an issued ticket, if it exists and has not expired.
+func (store *TicketStore) redeem(id [ticketIDLength]byte) (issuedTicket, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	ticket, ok := store.issued[id]
+	if !ok {
+		return issuedTicket{}, false
+	}
+	if time.Now().After(ticket.expiry) {
+		delete(store.issued, id)
+		delete(store.issuedByPeer, ticket.peerID.String())
+		return issuedTicket{}, false
+	}
+	return ticket, true
+}
+
+// receive a ticket issued by the peer.
+func (store *TicketStore) receive(peerID protocol.PeerID, id [ticketIDLength]byte, ttl time.Duration, secret []byte, negotiation protocol.Negotiation) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.received[peerID.String()] = receivedTicket{
+		id:          id,
+		peerID:      peerID,
+		secret:      secret,
+		negotiation: negotiation,
+		expiry:      time.Now().Add(ttl),
+	}
+}
+
+// ticket returns the unexpired ticket received from the peer.
+func (store *TicketStore) ticket(peerID protocol.PeerID) (receivedTicket, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	ticket, ok := store.received[peerID.String()]
+	if !ok {
+		return receivedTicket{}, false
+	}
+	if time.Now().After(ticket.expiry) {
+		delete(store.received, peerID.String())
+		return receivedTicket{}, false
+	}
+	return ticket, true
+}
+
+// forget the ticket received from the peer, after the peer has rejected it.
+func (store *TicketStore) forget(peerID protocol.PeerID) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.received, peerID.String())
+}
+
+// resume a session with the server that issued the ticket. It returns
+// errTicketRejected if the server did not redeem the ticket, in which case the
+// client can continue with the full handshake on the same connection.
+func (hs *handshaker) resume(rw io.ReadWriter, ticket receivedTicket) (protocol.Session, error) {
+	sessionManager, err := hs.sessionManager(ticket.negotiation.AEAD)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorize(hs.authorizer, ticket.peerID); err != nil {
+		return nil, err
+	}
+
+	// 1. Write the ticket id, a nonce, and proof that we know the secret of
+	// the ticket.
+	clientNonce := make([]byte, resumptionNonceLength)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %v", err)
+	}
+	if err := write(rw, []byte{modeResume}); err != nil {
+		return nil, fmt.Errorf("error writing handshake mode: %v", err)
+	}
+	if err := write(rw, ticket.id[:]); err != nil {
+		return nil, fmt.Errorf("error writing ticket id: %v", err)
+	}
+	if err := write(rw, clientNonce); err != nil {
+		return nil, fmt.Errorf("error writing nonce: %v", err)
+	}
+	if err := write(rw, finished(ticket.secret, labelClientFinished, ticket.id[:], clientNonce)); err != nil {
+		return nil, fmt.Errorf("error writing client finished: %v", err)
+	}
+
+	// 2. Read whether the server has redeemed the ticket and, if so, its
+	// nonce and proof that it knows the secret of the ticket.
+	status, err := read(rw, hs.limits.MaxHandshakeLength)
+	if err != nil {
+		return nil, wrapReadError("error reading resumption status", err)
+	}
+	if len(status) != 1 {
+		return nil, fmt.Errorf("error reading resumption status: expected len=1, got len=%v", len(status))
+	}
+	if status[0] == statusRejected {
+		return nil, errTicketRejected
+	}
+	serverNonce, err := read(rw, hs.limits.MaxHandshakeLength)
+	if err != nil {
+		return nil, wrapReadError("error reading nonce", err)
+	}
+	if len(serverNonce) != resumptionNonceLength {
+		return nil, fmt.Errorf("error reading nonce: expected len=%v, got len=%v", resumptionNonceLength, len(serverNonce))
+	}
+	serverFinished, err := read(rw, hs.limits.MaxHandshakeLength)
+	if err != nil {
+		return nil, wrapReadError("error reading server finished", err)
+	}
+	if !hmac.Equal(serverFinished, finished(ticket.secret, labelServerFinished, ticket.id[:], clientNonce, serverNonce)) {
+		return nil, fmt.Errorf("error verifying server finished")
+	}
+
+	sessionKey, err := resumedSessionKey(ticket.secret, clientNonce, serverNonce, len(sessionManager.NewSessionKey()))
+	if err != nil {
+		return nil, err
+	}
+	return newNegotiatedSession(sessionManager.NewSession(ticket.peerID, sessionKey), ticket.negotiation, hs.limits, hs.compressionThreshold), nil
+}
+
+// acceptResumption from a client that has presented a ticket. It returns false
+// if the ticket has been rejected, in which case the client continues with the
+// full handshake on the same connection.
+func (hs *handshaker) acceptResumption(rw io.ReadWriter) (protocol.Session, bool, error) {
+	// 1. Read the ticket id, the client nonce and the client proof.
+	id, err := read(rw, hs.limits.MaxHandshakeLength)
+	if err != nil {
+		return nil, false, wrapReadError("error reading ticket id", err)
+	}
+	if len(id) != ticketIDLength {
+		return nil, false, fmt.Errorf("error reading ticket id: expected len=%v, got len=%v", ticketIDLength, len(id))
+	}
+	clientNonce, err := read(rw, hs.limits.MaxHandshakeLength)
+	if err != nil {
+		return nil, false, wrapReadError("error reading nonce", err)
+	}
+	if len(clientNonce) != resumptionNonceLength {
+		return nil, false, fmt.Errorf("error reading nonce: expected len=%v, got len=%v", resumptionNonceLength, len(clientNonce))
+	}
+	clientFinished, err := read(rw, hs.limits.MaxHandshakeLength)
+	if err != nil {
+		return nil, false, wrapReadError("error reading client finished", err)
+	}
+
+	ticketID := [ticketIDLength]byte{}
+	copy(ticketID[:], id)
+	var ticket issuedTicket
+	ok := false
+	if hs.tickets != nil {
+		ticket, ok = hs.tickets.redeem(ticketID)
+	}
+	if !ok {
+		if err := write(rw, []byte{statusRejected}); err != nil {
+			return nil, false, fmt.Errorf("error writing resumption status: %v", err)
+		}
+		return nil, false, nil
+	}
+	if !hmac.Equal(clientFinished, finished(ticket.secret, labelClientFinished, id, clientNonce)) {
+		return nil, false, fmt.Errorf("error verifying client finished")
+	}
+	if err := authorize(hs.authorizer, ticket.peerID); err != nil {
+		return nil, false, err
+	}
+	sessionManager, err := hs.sessionManager(ticket.negotiation.AEAD)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// 2. Write a nonce and proof that we know the secret of the ticket.
+	serverNonce := make([]byte, resumptionNonceLength)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, false, fmt.Errorf("error generating nonce: %v", err)
+	}
+	if err := write(rw, []byte{statusAccepted}); err != nil {
+		return nil, false, fmt.Errorf("error writing resumption status: %v", err)
+	}
+	if err := write(rw, serverNonce); err != nil {
+		return nil, false, fmt.Errorf("error writing nonce: %v", err)
+	}
+	if err := write(rw, finished(ticket.secret, labelServerFinished, id, clientNonce, serverNonce)); err != nil {
+		return nil, false, fmt.Errorf("error writing server finished: %v", err)
+	}
+
+	sessionKey, err := resumedSessionKey(ticket.secret, clientNonce, serverNonce, len(sessionManager.NewSessionKey()))
+	if err != nil {
+		return nil, false, err
+	}
+	return newNegotiatedSession(sessionManager.NewSession(ticket.peerID, sessionKey), ticket.negotiation, hs.limits, hs.compressionThreshold), true, nil
+}
+
+// writeTicket issues a ticket to the client after a full handshake. An empty
+// ticket is written if the Handshaker does not issue tickets.
+func (hs *handshaker) writeTicket(w io.Writer, peerID protocol.PeerID, sessionKey []byte, negotiation protocol.Negotiation) error {
+	if hs.tickets == nil {
+		if err := write(w, []byte{}); err != nil {
+			return fmt.Errorf("error writing ticket: %v", err)
+		}
+		return nil
+	}
+	secret, err := resumptionSecret(sessionKey)
+	if err != nil {
+		return err
+	}
+	id, err := hs.tickets.issue(peerID, secret, negotiation)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, ticketIDLength+8)
+	copy(data, id[:])
+	binary.LittleEndian.PutUint64(data[ticketIDLength:], uint64(hs.tickets.ttl/time.Millisecond))
+	if err := write(w, data); err != nil {
+		return fmt.Errorf("error writing ticket: %v", err)
+	}
+	return nil
+}
+
+// readTicket issued by the server after a full handshake. The ticket is
+// ignored if the Handshaker does not keep tickets.
+func (hs *handshaker) readTicket(r io.Reader, peerID protocol.PeerID, sessionKey []byte, negotiation protocol.Negotiation) error {
+	data, err := read(r, hs.limits.MaxHandshakeLength)
+	if err != nil {
+		return wrapReadError("error reading ticket", err)
+	}
+	if len(data) == 0 || hs.tickets == nil {
+		return nil
+	}
+	if len(data) != ticketIDLength+8 {
+		return fmt.Errorf("error reading ticket: expected len=%v, got len=%v", ticketIDLength+8, len(data))
+	}
+	secret, err := resumptionSecret(sessionKey)
+	if err != nil {
+		return err
+	}
+	id := [ticketIDLength]byte{}
+	copy(id[:], data)
+	ttl := time.Duration(binary.LittleEndian.Uint64(data[ticketIDLength:])) * time.Millisecond
+	if ttl > hs.tickets.ttl {
+		ttl = hs.tickets.ttl
+	}
+	hs.tickets.receive(peerID, id, ttl, secret, negotiation)
+	return nil
+}
+
+// resumptionSecret derives the secret of a ticket from the key of the session
+// during which it was issued. The session key itself is never reused.
+func resumptionSecret(sessionKey []byte) ([]byte, error) {
+	secret := make([]byte, resumptionSecretLen)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, sessionKey, nil, infoResumptionSecret), secret); err != nil {
+		return nil, fmt.Errorf("error deriving resumption secret: %v", err)
+	}
+	return secret, nil
+}
+
+// resumedSessionKey derives a fresh session key from the secret of a ticket and
+// the nonces of both peers.
+func resumedSessionKey(secret, clientNonce, serverNonce []byte, n int) ([]byte, error) {
+	salt := append(append([]byte{}, clientNonce...), serverNonce...)
+	sessionKey := make([]byte, n)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, infoResumedKey), sessionKey); err != nil {
+		return nil, fmt.Errorf("error deriving session key: %v", err)
+	}
+	return sessionKey, nil
+}
+
+// finished returns the proof that a peer knows the secret of a ticket.
+func finished(secret, label []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(label)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
@@ -0,0 +1,227 @@
+package handshake_test
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/handshake"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/phi"
+)
+
+// countingSignVerifier counts the signatures produced during handshakes, so
+// that tests can tell full handshakes from resumed sessions.
+type countingSignVerifier struct {
+	MockSignVerifier
+	signatures *int64
+}
+
+func (sv countingSignVerifier) Sign(digest []byte) ([]byte, error) {
+	atomic.AddInt64(sv.signatures, 1)
+	return sv.MockSignVerifier.Sign(digest)
+}
+
+var _ = Describe("Session resumption", func() {
+
+	type peers struct {
+		clientSignVerifier, serverSignVerifier MockSignVerifier
+		clientTickets, serverTickets           *TicketStore
+		client, server                         Handshaker
+		signatures                             *int64
+	}
+
+	newPeers := func(ttl time.Duration, serverAuthorizer Authorizer) peers {
+		clientSignVerifier := NewMockSignVerifier()
+		serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+		clientSignVerifier.Whitelist(serverSignVerifier.ID())
+
+		signatures := new(int64)
+		clientTickets, serverTickets := NewTicketStore(ttl), NewTicketStore(ttl)
+		client := NewWithOptions(countingSignVerifier{clientSignVerifier, signatures}, Options{Tickets: clientTickets}, NewGCMSessionManager())
+		server := NewWithOptions(countingSignVerifier{serverSignVerifier, signatures}, Options{Tickets: serverTickets, Authorizer: serverAuthorizer}, NewGCMSessionManager())
+		return peers{clientSignVerifier, serverSignVerifier, clientTickets, serverTickets, client, server, signatures}
+	}
+
+	// run a handshake, and send a message from the client to the server
+	// through the resulting sessions. It returns the number of signatures
+	// produced during the handshake.
+	run := func(p peers) (int64, error, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		go func() {
+			<-ctx.Done()
+			clientConn.Close()
+			serverConn.Close()
+		}()
+
+		before := atomic.LoadInt64(p.signatures)
+		var clientSession, serverSession protocol.Session
+		var clientErr, serverErr error
+		phi.ParBegin(func() {
+			clientSession, clientErr = p.client.Handshake(ctx, clientConn, SimplePeerID(p.serverSignVerifier.ID()))
+			if clientErr != nil {
+				cancel()
+			}
+		}, func() {
+			serverSession, serverErr = p.server.AcceptHandshake(ctx, serverConn)
+			if serverErr != nil {
+				cancel()
+			}
+		})
+		signatures := atomic.LoadInt64(p.signatures) - before
+		if clientErr != nil || serverErr != nil {
+			return signatures, clientErr, serverErr
+		}
+
+		message := RandomMessage(protocol.V2, protocol.Cast)
+		var received protocol.MessageOnTheWire
+		var writeErr, readErr error
+		phi.ParBegin(func() {
+			writeErr = clientSession.WriteMessage(clientConn, message)
+		}, func() {
+			received, readErr = serverSession.ReadMessageOnTheWire(serverConn)
+		})
+		Expect(writeErr).NotTo(HaveOccurred())
+		Expect(readErr).NotTo(HaveOccurred())
+		Expect(received.From.String()).Should(Equal(p.clientSignVerifier.ID()))
+		Expect(cmp.Equal(received.Message, message, cmpopts.EquateEmpty())).Should(BeTrue())
+		return signatures, nil, nil
+	}
+
+	Context("when initializing a ticket store", func() {
+		It("should panic if the ttl is not positive", func() {
+			Expect(func() {
+				_ = NewTicketStore(0)
+			}).Should(Panic())
+		})
+	})
+
+	Context("when reconnecting to a server that has issued a ticket", func() {
+		It("should resume the session without signing anything", func() {
+			p := newPeers(time.Minute, nil)
+			signatures, clientErr, serverErr := run(p)
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverErr).NotTo(HaveOccurred())
+			Expect(signatures).Should(Equal(int64(2)))
+
+			for i := 0; i < 3; i++ {
+				signatures, clientErr, serverErr = run(p)
+				Expect(clientErr).NotTo(HaveOccurred())
+				Expect(serverErr).NotTo(HaveOccurred())
+				Expect(signatures).Should(Equal(int64(0)))
+			}
+		})
+	})
+
+	Context("when the ticket has expired", func() {
+		It("should fall back to the full handshake", func() {
+			p := newPeers(time.Second, nil)
+			_, clientErr, serverErr := run(p)
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverErr).NotTo(HaveOccurred())
+
+			time.Sleep(1100 * time.Millisecond)
+			signatures, clientErr, serverErr := run(p)
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverErr).NotTo(HaveOccurred())
+			Expect(signatures).Should(Equal(int64(2)))
+		})
+	})
+
+	Context("when the server has revoked the ticket", func() {
+		It("should fall back to the full handshake on the same connection", func() {
+			p := newPeers(time.Minute, nil)
+			_, clientErr, serverErr := run(p)
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverErr).NotTo(HaveOccurred())
+
+			p.serverTickets.Revoke(SimplePeerID(p.clientSignVerifier.ID()))
+			signatures, clientErr, serverErr := run(p)
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverErr).NotTo(HaveOccurred())
+			Expect(signatures).Should(Equal(int64(2)))
+
+			// The new ticket can be used to resume the session again.
+			signatures, clientErr, serverErr = run(p)
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverErr).NotTo(HaveOccurred())
+			Expect(signatures).Should(Equal(int64(0)))
+		})
+	})
+
+	Context("when the client has revoked the ticket", func() {
+		It("should run the full handshake", func() {
+			p := newPeers(time.Minute, nil)
+			_, clientErr, serverErr := run(p)
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverErr).NotTo(HaveOccurred())
+
+			p.clientTickets.RevokeAll()
+			signatures, clientErr, serverErr := run(p)
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverErr).NotTo(HaveOccurred())
+			Expect(signatures).Should(Equal(int64(2)))
+		})
+	})
+
+	Context("when the client is no longer authorized", func() {
+		It("should return an ErrUnauthorizedPeer instead of resuming the session", func() {
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			groupID := RandomGroupID()
+			p := newPeers(time.Minute, NewDHTGroupAuthorizer(dht, groupID))
+			Expect(dht.AddGroup(groupID, protocol.PeerIDs{SimplePeerID(p.clientSignVerifier.ID())})).To(Succeed())
+			_, clientErr, serverErr := run(p)
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverErr).NotTo(HaveOccurred())
+
+			Expect(dht.AddGroup(groupID, protocol.PeerIDs{RandomPeerID()})).To(Succeed())
+			_, _, serverErr = run(p)
+			Expect(serverErr).To(BeAssignableToTypeOf(ErrUnauthorizedPeer{}))
+		})
+	})
+
+	Context("when the server does not issue tickets", func() {
+		It("should always run the full handshake", func() {
+			p := newPeers(time.Minute, nil)
+			p.server = New(countingSignVerifier{p.serverSignVerifier, p.signatures}, NewGCMSessionManager())
+			for i := 0; i < 2; i++ {
+				signatures, clientErr, serverErr := run(p)
+				Expect(clientErr).NotTo(HaveOccurred())
+				Expect(serverErr).NotTo(HaveOccurred())
+				Expect(signatures).Should(Equal(int64(2)))
+			}
+		})
+	})
+
+	Context("when the ticket is presented to a different server", func() {
+		It("should not present the ticket", func() {
+			p := newPeers(time.Minute, nil)
+			_, clientErr, serverErr := run(p)
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverErr).NotTo(HaveOccurred())
+
+			// The client only presents the ticket to the server that issued it,
+			// so it runs the full handshake with a different server.
+			other := NewMockSignVerifier(p.clientSignVerifier.ID())
+			p.clientSignVerifier.Whitelist(other.ID())
+			p.server = NewWithOptions(countingSignVerifier{other, p.signatures}, Options{Tickets: NewTicketStore(time.Minute)}, NewGCMSessionManager())
+			p.serverSignVerifier = other
+			signatures, clientErr, serverErr := run(p)
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverErr).NotTo(HaveOccurred())
+			Expect(signatures).Should(Equal(int64(2)))
+		})
+	})
+})
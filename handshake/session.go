@@ -24,23 +24,36 @@ func (insecureSessionManager) NewSessionKey() []byte {
 	return []byte{}
 }
 
+func (insecureSessionManager) AEAD() protocol.AEAD {
+	return protocol.NoAEAD
+}
+
 type insecureSession struct {
 	peerID protocol.PeerID
+	limits protocol.SizeLimits
 }
 
 func newInsecureSession(peerID protocol.PeerID) protocol.Session {
-	return &insecureSession{peerID: peerID}
+	return &insecureSession{peerID: peerID, limits: protocol.DefaultSizeLimits()}
+}
+
+func (session *insecureSession) setSizeLimits(limits protocol.SizeLimits) {
+	session.limits = limits
 }
 
 func (session *insecureSession) ReadMessageOnTheWire(r io.Reader) (protocol.MessageOnTheWire, error) {
 	otw := protocol.MessageOnTheWire{}
 	otw.From = session.peerID
-	err := otw.Message.UnmarshalReader(r)
+	err := otw.Message.UnmarshalReaderWithLimits(r, session.limits)
 	return otw, err
 }
 
+func (session *insecureSession) Negotiation() protocol.Negotiation {
+	return protocol.DefaultNegotiation(protocol.NoAEAD)
+}
+
 func (session *insecureSession) WriteMessage(w io.Writer, message protocol.Message) error {
-	data, err := message.MarshalBinary()
+	data, err := message.MarshalBinaryWithLimits(session.limits)
 	if err != nil {
 		return err
 	}
@@ -50,3 +63,18 @@ func (session *insecureSession) WriteMessage(w io.Writer, message protocol.Messa
 	}
 	return err
 }
+
+// extensionsAd returns the extension area of V2 messages, which is not
+// modified by encryption, so that sessions can authenticate it as additional
+// data. Extensions that cannot be marshaled are ignored here, because the
+// message will also fail to be marshaled.
+func extensionsAd(message protocol.Message) []byte {
+	if message.Version < protocol.V2 {
+		return nil
+	}
+	data, err := message.Extensions.MarshalBinary()
+	if err != nil {
+		return nil
+	}
+	return data
+}
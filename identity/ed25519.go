@@ -0,0 +1,160 @@
+package identity
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/renproject/aw/protocol"
+	"golang.org/x/crypto/ed25519"
+)
+
+// ed25519SigLength is the length of an Ed25519 signature envelope, which is
+// the public key of the signatory followed by the signature.
+const ed25519SigLength = ed25519.PublicKeySize + ed25519.SignatureSize
+
+// Ed25519PeerID is an Ed25519 public key.
+type Ed25519PeerID [ed25519.PublicKeySize]byte
+
+// NewEd25519PeerID returns the Ed25519PeerID of an Ed25519 public key. It
+// panics if the public key does not have the correct length.
+func NewEd25519PeerID(pubKey ed25519.PublicKey) Ed25519PeerID {
+	if len(pubKey) != ed25519.PublicKeySize {
+		panic(fmt.Sprintf("invariant violation: invalid public key length: expected %v, got %v", ed25519.PublicKeySize, len(pubKey)))
+	}
+	peerID := Ed25519PeerID{}
+	copy(peerID[:], pubKey)
+	return peerID
+}
+
+// PubKey returns the Ed25519 public key of the Ed25519PeerID.
+func (peerID Ed25519PeerID) PubKey() ed25519.PublicKey {
+	return ed25519.PublicKey(peerID[:])
+}
+
+// String returns the hex encoding of the Ed25519PeerID.
+func (peerID Ed25519PeerID) String() string {
+	return hex.EncodeToString(peerID[:])
+}
+
+// Equal returns true if the given PeerID is the same Ed25519PeerID.
+func (peerID Ed25519PeerID) Equal(other protocol.PeerID) bool {
+	otherPeerID, ok := other.(Ed25519PeerID)
+	if !ok {
+		return false
+	}
+	return peerID == otherPeerID
+}
+
+// Ed25519PeerIDCodec encodes an Ed25519PeerID as its 32 raw bytes.
+type Ed25519PeerIDCodec struct{}
+
+// NewEd25519PeerIDCodec returns a PeerIDCodec for Ed25519PeerIDs.
+func NewEd25519PeerIDCodec() protocol.PeerIDCodec {
+	return Ed25519PeerIDCodec{}
+}
+
+// Encode implements the `protocol.PeerIDCodec` interface.
+func (codec Ed25519PeerIDCodec) Encode(id protocol.PeerID) ([]byte, error) {
+	peerID, ok := id.(Ed25519PeerID)
+	if !ok {
+		return nil, fmt.Errorf("unsupported peer id of type: %T", id)
+	}
+	return peerID[:], nil
+}
+
+// Decode implements the `protocol.PeerIDCodec` interface.
+func (codec Ed25519PeerIDCodec) Decode(data []byte) (protocol.PeerID, error) {
+	if len(data) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid peer id length: expected %v, got %v", ed25519.PublicKeySize, len(data))
+	}
+	return NewEd25519PeerID(data), nil
+}
+
+// Ed25519SignVerifier signs digests with an Ed25519 private key. Ed25519 public
+// keys cannot be recovered from signatures, so every signature is an envelope
+// that carries the public key of the signatory, and Verify returns the
+// Ed25519PeerID of that public key once the signature has been checked. Like
+// the Secp256k1SignVerifier, it does not decide whether the signatory is
+// trusted.
+type Ed25519SignVerifier struct {
+	privKey ed25519.PrivateKey
+	peerID  Ed25519PeerID
+}
+
+// NewEd25519SignVerifier returns an Ed25519SignVerifier that signs with the
+// given private key.
+func NewEd25519SignVerifier(privKey ed25519.PrivateKey) *Ed25519SignVerifier {
+	if len(privKey) != ed25519.PrivateKeySize {
+		panic(fmt.Sprintf("invariant violation: invalid private key length: expected %v, got %v", ed25519.PrivateKeySize, len(privKey)))
+	}
+	return &Ed25519SignVerifier{
+		privKey: privKey,
+		peerID:  NewEd25519PeerID(privKey.Public().(ed25519.PublicKey)),
+	}
+}
+
+// GenerateEd25519SignVerifier returns an Ed25519SignVerifier with a random
+// private key.
+func GenerateEd25519SignVerifier() (*Ed25519SignVerifier, error) {
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("error generating private key: %v", err)
+	}
+	return NewEd25519SignVerifier(privKey), nil
+}
+
+// PeerID returns the Ed25519PeerID of the private key.
+func (sv *Ed25519SignVerifier) PeerID() Ed25519PeerID {
+	return sv.peerID
+}
+
+// PrivKey returns the private key used for signing.
+func (sv *Ed25519SignVerifier) PrivKey() ed25519.PrivateKey {
+	return sv.privKey
+}
+
+// Sign implements the `protocol.SignVerifier` interface. The returned
+// signature is in the [PubKey || Sig] format.
+func (sv *Ed25519SignVerifier) Sign(digest []byte) ([]byte, error) {
+	sig := make([]byte, 0, ed25519SigLength)
+	sig = append(sig, sv.peerID[:]...)
+	sig = append(sig, ed25519.Sign(sv.privKey, digest)...)
+	return sig, nil
+}
+
+// Verify implements the `protocol.SignVerifier` interface. It returns the
+// Ed25519PeerID of the public key in the signature envelope.
+func (sv *Ed25519SignVerifier) Verify(digest, sig []byte) (protocol.PeerID, error) {
+	if len(sig) != ed25519SigLength {
+		return nil, fmt.Errorf("invalid signature length: expected %v, got %v", ed25519SigLength, len(sig))
+	}
+	peerID := NewEd25519PeerID(sig[:ed25519.PublicKeySize])
+	if !ed25519.Verify(peerID.PubKey(), digest, sig[ed25519.PublicKeySize:]) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	return peerID, nil
+}
+
+// Hash implements the `protocol.SignVerifier` interface using SHA256.
+func (sv *Ed25519SignVerifier) Hash(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+// SigLength implements the `protocol.SignVerifier` interface.
+func (sv *Ed25519SignVerifier) SigLength() uint64 {
+	return ed25519SigLength
+}
+
+func unmarshalEd25519PrivKey(data []byte, peerID string) (ed25519.PrivateKey, error) {
+	if len(data) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid private key length: expected %v, got %v", ed25519.SeedSize, len(data))
+	}
+	privKey := ed25519.NewKeyFromSeed(data)
+	if expected := NewEd25519PeerID(privKey.Public().(ed25519.PublicKey)).String(); expected != peerID {
+		return nil, fmt.Errorf("private key does not match peer id: expected %v, got %v", peerID, expected)
+	}
+	return privKey, nil
+}
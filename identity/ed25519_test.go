@@ -0,0 +1,215 @@
+package identity_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing/quick"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/identity"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/aw/testutil"
+	"github.com/renproject/phi"
+	"golang.org/x/crypto/ed25519"
+)
+
+var _ = Describe("Ed25519", func() {
+
+	newSignVerifier := func() *Ed25519SignVerifier {
+		signVerifier, err := GenerateEd25519SignVerifier()
+		Expect(err).NotTo(HaveOccurred())
+		return signVerifier
+	}
+
+	Context("when initializing a sign verifier", func() {
+		It("should panic if providing a private key with the wrong length", func() {
+			Expect(func() {
+				_ = NewEd25519SignVerifier(ed25519.PrivateKey{})
+			}).Should(Panic())
+		})
+	})
+
+	Context("when signing and verifying", func() {
+		It("should return the peer id from the signature envelope", func() {
+			signer, verifier := newSignVerifier(), newSignVerifier()
+			test := func(data []byte) bool {
+				digest := signer.Hash(data)
+				sig, err := signer.Sign(digest)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(uint64(len(sig))).Should(Equal(signer.SigLength()))
+
+				peerID, err := verifier.Verify(digest, sig)
+				Expect(err).NotTo(HaveOccurred())
+				return peerID.Equal(signer.PeerID())
+			}
+			Expect(quick.Check(test, nil)).NotTo(HaveOccurred())
+		})
+
+		It("should return an error if the digest is different", func() {
+			signer := newSignVerifier()
+			sig, err := signer.Sign(signer.Hash([]byte("hello")))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = signer.Verify(signer.Hash([]byte("world")), sig)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should return an error if the public key in the envelope is replaced", func() {
+			signer, impostor := newSignVerifier(), newSignVerifier()
+			digest := signer.Hash([]byte("hello"))
+			sig, err := signer.Sign(digest)
+			Expect(err).NotTo(HaveOccurred())
+
+			impostorID := impostor.PeerID()
+			copy(sig, impostorID[:])
+			_, err = signer.Verify(digest, sig)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should return an error if the signature has the wrong length", func() {
+			signer := newSignVerifier()
+			digest := signer.Hash([]byte("hello"))
+			sig, err := signer.Sign(digest)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = signer.Verify(digest, sig[1:])
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when encoding and decoding peer ids", func() {
+		It("should return the same peer id", func() {
+			codec := NewEd25519PeerIDCodec()
+			peerID := newSignVerifier().PeerID()
+			data, err := codec.Encode(peerID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data).Should(HaveLen(ed25519.PublicKeySize))
+
+			decoded, err := codec.Decode(data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decoded.Equal(peerID)).Should(BeTrue())
+			Expect(decoded.String()).Should(Equal(peerID.String()))
+		})
+
+		It("should return an error when encoding other peer ids", func() {
+			_, err := NewEd25519PeerIDCodec().Encode(testutil.RandomPeerID())
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should return an error when decoding data with the wrong length", func() {
+			_, err := NewEd25519PeerIDCodec().Decode(make([]byte, ed25519.PublicKeySize-1))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when handshaking", func() {
+		newHandshakers := map[string]func(protocol.SignVerifier, handshake.Authorizer) handshake.Handshaker{
+			"ecies": func(signVerifier protocol.SignVerifier, authorizer handshake.Authorizer) handshake.Handshaker {
+				return handshake.NewWithOptions(signVerifier, handshake.Options{Authorizer: authorizer}, handshake.NewGCMSessionManager())
+			},
+			"noise": func(signVerifier protocol.SignVerifier, authorizer handshake.Authorizer) handshake.Handshaker {
+				return handshake.NewNoiseWithOptions(signVerifier, handshake.Options{Authorizer: authorizer})
+			},
+		}
+
+		run := func(client, server handshake.Handshaker, clientConn, serverConn io.ReadWriteCloser, expected protocol.PeerID) (protocol.Session, protocol.Session, error, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			// Close the connections if a peer gives up on the handshake, so
+			// that the other peer does not block forever.
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-done:
+				case <-ctx.Done():
+					clientConn.Close()
+					serverConn.Close()
+				}
+			}()
+
+			var clientSession, serverSession protocol.Session
+			var clientErr, serverErr error
+			phi.ParBegin(func() {
+				clientSession, clientErr = client.Handshake(ctx, clientConn, expected)
+				if clientErr != nil {
+					cancel()
+				}
+			}, func() {
+				serverSession, serverErr = server.AcceptHandshake(ctx, serverConn)
+				if serverErr != nil {
+					cancel()
+				}
+			})
+			return clientSession, serverSession, clientErr, serverErr
+		}
+
+		for name, newHandshaker := range newHandshakers {
+			newHandshaker := newHandshaker
+
+			Context("when using the "+name+" handshaker", func() {
+				It("should establish a session that can send and receive messages", func() {
+					clientSignVerifier, serverSignVerifier := newSignVerifier(), newSignVerifier()
+					client := newHandshaker(clientSignVerifier, handshake.NewAllowlist(serverSignVerifier.PeerID()))
+					server := newHandshaker(serverSignVerifier, handshake.NewAllowlist(clientSignVerifier.PeerID()))
+
+					clientConn, serverConn := net.Pipe()
+					defer clientConn.Close()
+					defer serverConn.Close()
+					clientSession, serverSession, clientErr, serverErr := run(client, server, clientConn, serverConn, serverSignVerifier.PeerID())
+					Expect(clientErr).NotTo(HaveOccurred())
+					Expect(serverErr).NotTo(HaveOccurred())
+
+					test := func() bool {
+						message := testutil.RandomMessage(protocol.V2, testutil.RandomMessageVariant())
+						var received protocol.MessageOnTheWire
+						var writeErr, readErr error
+						phi.ParBegin(func() {
+							writeErr = clientSession.WriteMessage(clientConn, message)
+						}, func() {
+							received, readErr = serverSession.ReadMessageOnTheWire(serverConn)
+						})
+						Expect(writeErr).NotTo(HaveOccurred())
+						Expect(readErr).NotTo(HaveOccurred())
+						Expect(received.From.Equal(clientSignVerifier.PeerID())).Should(BeTrue())
+						return cmp.Equal(received.Message, message, cmpopts.EquateEmpty())
+					}
+					Expect(quick.Check(test, nil)).NotTo(HaveOccurred())
+				})
+
+				It("should return an ErrUnexpectedPeer if the server is not the expected peer", func() {
+					clientSignVerifier, serverSignVerifier := newSignVerifier(), newSignVerifier()
+					client := newHandshaker(clientSignVerifier, nil)
+					server := newHandshaker(serverSignVerifier, nil)
+
+					clientConn, serverConn := net.Pipe()
+					defer clientConn.Close()
+					defer serverConn.Close()
+					_, _, clientErr, serverErr := run(client, server, clientConn, serverConn, newSignVerifier().PeerID())
+					Expect(clientErr).To(BeAssignableToTypeOf(handshake.ErrUnexpectedPeer{}))
+					Expect(serverErr).To(HaveOccurred())
+				})
+
+				It("should return an ErrUnauthorizedPeer if the client is not authorized", func() {
+					clientSignVerifier, serverSignVerifier := newSignVerifier(), newSignVerifier()
+					client := newHandshaker(clientSignVerifier, nil)
+					server := newHandshaker(serverSignVerifier, handshake.NewAllowlist(newSignVerifier().PeerID()))
+
+					clientConn, serverConn := net.Pipe()
+					defer clientConn.Close()
+					defer serverConn.Close()
+					_, _, _, serverErr := run(client, server, clientConn, serverConn, nil)
+					Expect(serverErr).To(BeAssignableToTypeOf(handshake.ErrUnauthorizedPeer{}))
+				})
+			})
+		}
+	})
+})
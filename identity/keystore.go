@@ -0,0 +1,299 @@
+package identity
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	keystoreVersion = 1
+	keystoreKDF     = "scrypt"
+	keystoreCipher  = "aes-256-gcm"
+
+	// KeyTypeSecp256k1 identifies secp256k1 private keys in a keystore file.
+	KeyTypeSecp256k1 = "secp256k1"
+
+	// KeyTypeEd25519 identifies Ed25519 private keys in a keystore file.
+	KeyTypeEd25519 = "ed25519"
+)
+
+// KeystoreOptions are used to parameterise the encryption of keystore files.
+// They are only used when saving keys, because the parameters are stored in
+// the keystore file.
+type KeystoreOptions struct {
+	ScryptN int // Defaults to 2^18
+	ScryptR int // Defaults to 8
+	ScryptP int // Defaults to 1
+}
+
+func (options *KeystoreOptions) setZerosToDefaults() {
+	if options.ScryptN <= 0 {
+		options.ScryptN = 1 << 18
+	}
+	if options.ScryptR <= 0 {
+		options.ScryptR = 8
+	}
+	if options.ScryptP <= 0 {
+		options.ScryptP = 1
+	}
+}
+
+// keystoreJSON is the format of a keystore file. The private key is encrypted
+// using AES-256-GCM, with a key that is derived from the passphrase using
+// scrypt. The key type and the PeerID are authenticated as additional data, so
+// they cannot be modified without the passphrase.
+type keystoreJSON struct {
+	Version int          `json:"version"`
+	Type    string       `json:"type"`
+	PeerID  string       `json:"peerID"`
+	Crypto  keystoreData `json:"crypto"`
+}
+
+type keystoreData struct {
+	KDF        string         `json:"kdf"`
+	KDFParams  keystoreParams `json:"kdfParams"`
+	Cipher     string         `json:"cipher"`
+	Nonce      string         `json:"nonce"`
+	Ciphertext string         `json:"ciphertext"`
+}
+
+type keystoreParams struct {
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+	Salt string `json:"salt"`
+}
+
+// SaveSecp256k1Key encrypts a secp256k1 private key using the passphrase, and
+// writes it to a keystore file at the given path. The file is only readable by
+// the current user.
+func SaveSecp256k1Key(path string, privKey *ecdsa.PrivateKey, passphrase string, options KeystoreOptions) error {
+	if privKey == nil {
+		panic("invariant violation: private key cannot be nil")
+	}
+	return saveKey(path, KeyTypeSecp256k1, NewSecp256k1PeerID(privKey.PublicKey).String(), marshalSecp256k1PrivKey(privKey), passphrase, options)
+}
+
+// LoadSecp256k1Key reads a keystore file from the given path, and decrypts the
+// secp256k1 private key using the passphrase.
+func LoadSecp256k1Key(path, passphrase string) (*ecdsa.PrivateKey, error) {
+	peerID, data, err := loadKey(path, KeyTypeSecp256k1, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalSecp256k1PrivKey(data, peerID)
+}
+
+// LoadOrGenerateSecp256k1Key loads the secp256k1 private key from the keystore
+// file at the given path. If the file does not exist, a new private key is
+// generated and saved to the path. This is the recommended way to manage the
+// identity of a long-running node.
+func LoadOrGenerateSecp256k1Key(path, passphrase string, options KeystoreOptions) (*ecdsa.PrivateKey, error) {
+	privKey, err := LoadSecp256k1Key(path, passphrase)
+	if err == nil || !os.IsNotExist(err) {
+		return privKey, err
+	}
+	if privKey, err = crypto.GenerateKey(); err != nil {
+		return nil, fmt.Errorf("error generating private key: %v", err)
+	}
+	if err := SaveSecp256k1Key(path, privKey, passphrase, options); err != nil {
+		return nil, err
+	}
+	return privKey, nil
+}
+
+// SaveEd25519Key encrypts the seed of an Ed25519 private key using the
+// passphrase, and writes it to a keystore file at the given path. The file is
+// only readable by the current user.
+func SaveEd25519Key(path string, privKey ed25519.PrivateKey, passphrase string, options KeystoreOptions) error {
+	if len(privKey) != ed25519.PrivateKeySize {
+		panic(fmt.Sprintf("invariant violation: invalid private key length: expected %v, got %v", ed25519.PrivateKeySize, len(privKey)))
+	}
+	peerID := NewEd25519PeerID(privKey.Public().(ed25519.PublicKey))
+	return saveKey(path, KeyTypeEd25519, peerID.String(), privKey.Seed(), passphrase, options)
+}
+
+// LoadEd25519Key reads a keystore file from the given path, and decrypts the
+// Ed25519 private key using the passphrase.
+func LoadEd25519Key(path, passphrase string) (ed25519.PrivateKey, error) {
+	peerID, data, err := loadKey(path, KeyTypeEd25519, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalEd25519PrivKey(data, peerID)
+}
+
+// LoadOrGenerateEd25519Key loads the Ed25519 private key from the keystore file
+// at the given path. If the file does not exist, a new private key is
+// generated and saved to the path.
+func LoadOrGenerateEd25519Key(path, passphrase string, options KeystoreOptions) (ed25519.PrivateKey, error) {
+	privKey, err := LoadEd25519Key(path, passphrase)
+	if err == nil || !os.IsNotExist(err) {
+		return privKey, err
+	}
+	if _, privKey, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		return nil, fmt.Errorf("error generating private key: %v", err)
+	}
+	if err := SaveEd25519Key(path, privKey, passphrase, options); err != nil {
+		return nil, err
+	}
+	return privKey, nil
+}
+
+func saveKey(path, keyType, peerID string, key []byte, passphrase string, options KeystoreOptions) error {
+	options.setZerosToDefaults()
+
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("error generating salt: %v", err)
+	}
+	gcm, err := newKeystoreCipher(passphrase, salt, options.ScryptN, options.ScryptR, options.ScryptP)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("error generating nonce: %v", err)
+	}
+	ciphertext := gcm.Seal(nil, nonce, key, keystoreAdditionalData(keyType, peerID))
+
+	data, err := json.MarshalIndent(keystoreJSON{
+		Version: keystoreVersion,
+		Type:    keyType,
+		PeerID:  peerID,
+		Crypto: keystoreData{
+			KDF: keystoreKDF,
+			KDFParams: keystoreParams{
+				N:    options.ScryptN,
+				R:    options.ScryptR,
+				P:    options.ScryptP,
+				Salt: hex.EncodeToString(salt),
+			},
+			Cipher:     keystoreCipher,
+			Nonce:      hex.EncodeToString(nonce),
+			Ciphertext: hex.EncodeToString(ciphertext),
+		},
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling keystore: %v", err)
+	}
+	return writeFileAtomically(path, data, 0600)
+}
+
+func loadKey(path, keyType, passphrase string) (string, []byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	keystore := keystoreJSON{}
+	if err := json.Unmarshal(data, &keystore); err != nil {
+		return "", nil, fmt.Errorf("error unmarshaling keystore: %v", err)
+	}
+	if keystore.Version != keystoreVersion {
+		return "", nil, fmt.Errorf("unsupported keystore version=%v", keystore.Version)
+	}
+	if keystore.Type != keyType {
+		return "", nil, fmt.Errorf("unexpected key type: expected %v, got %v", keyType, keystore.Type)
+	}
+	if keystore.Crypto.KDF != keystoreKDF || keystore.Crypto.Cipher != keystoreCipher {
+		return "", nil, fmt.Errorf("unsupported keystore kdf=%v cipher=%v", keystore.Crypto.KDF, keystore.Crypto.Cipher)
+	}
+
+	salt, err := hex.DecodeString(keystore.Crypto.KDFParams.Salt)
+	if err != nil {
+		return "", nil, fmt.Errorf("error decoding salt: %v", err)
+	}
+	nonce, err := hex.DecodeString(keystore.Crypto.Nonce)
+	if err != nil {
+		return "", nil, fmt.Errorf("error decoding nonce: %v", err)
+	}
+	ciphertext, err := hex.DecodeString(keystore.Crypto.Ciphertext)
+	if err != nil {
+		return "", nil, fmt.Errorf("error decoding ciphertext: %v", err)
+	}
+	params := keystore.Crypto.KDFParams
+	gcm, err := newKeystoreCipher(passphrase, salt, params.N, params.R, params.P)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return "", nil, fmt.Errorf("invalid nonce length: expected %v, got %v", gcm.NonceSize(), len(nonce))
+	}
+	key, err := gcm.Open(nil, nonce, ciphertext, keystoreAdditionalData(keystore.Type, keystore.PeerID))
+	if err != nil {
+		return "", nil, NewErrInvalidPassphrase(path)
+	}
+	return keystore.PeerID, key, nil
+}
+
+func newKeystoreCipher(passphrase string, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, n, r, p, 32)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving key: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func keystoreAdditionalData(keyType, peerID string) []byte {
+	return []byte(fmt.Sprintf("%v:%v", keyType, peerID))
+}
+
+// writeFileAtomically writes the data to a temporary file in the same
+// directory, and renames it to the path, so that an existing keystore is never
+// left partially written.
+func writeFileAtomically(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// ErrInvalidPassphrase is returned when a keystore file cannot be decrypted,
+// because the passphrase is wrong or the file has been modified.
+type ErrInvalidPassphrase struct {
+	error
+	Path string
+}
+
+// NewErrInvalidPassphrase creates a new error which is returned when a
+// keystore file cannot be decrypted.
+func NewErrInvalidPassphrase(path string) error {
+	return ErrInvalidPassphrase{
+		error: fmt.Errorf("invalid passphrase for keystore=%v", path),
+		Path:  path,
+	}
+}
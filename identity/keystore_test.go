@@ -0,0 +1,145 @@
+package identity_test
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/identity"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+var _ = Describe("Keystore", func() {
+
+	// Use cheap scrypt parameters to keep the tests fast.
+	options := KeystoreOptions{ScryptN: 1 << 4}
+
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "keystore")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	Context("when saving and loading a secp256k1 key", func() {
+		It("should return the same key", func() {
+			path := filepath.Join(dir, "key.json")
+			privKey, err := crypto.GenerateKey()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(SaveSecp256k1Key(path, privKey, "passphrase", options)).To(Succeed())
+
+			loaded, err := LoadSecp256k1Key(path, "passphrase")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(crypto.FromECDSA(loaded)).Should(Equal(crypto.FromECDSA(privKey)))
+		})
+
+		It("should only be readable by the current user", func() {
+			path := filepath.Join(dir, "key.json")
+			privKey, err := crypto.GenerateKey()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(SaveSecp256k1Key(path, privKey, "passphrase", options)).To(Succeed())
+
+			info, err := os.Stat(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).Should(Equal(os.FileMode(0600)))
+		})
+
+		It("should not store the key in plaintext", func() {
+			path := filepath.Join(dir, "key.json")
+			privKey, err := crypto.GenerateKey()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(SaveSecp256k1Key(path, privKey, "passphrase", options)).To(Succeed())
+
+			data, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).ShouldNot(ContainSubstring(hex.EncodeToString(crypto.FromECDSA(privKey))))
+		})
+	})
+
+	Context("when loading with the wrong passphrase", func() {
+		It("should return an ErrInvalidPassphrase", func() {
+			path := filepath.Join(dir, "key.json")
+			privKey, err := crypto.GenerateKey()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(SaveSecp256k1Key(path, privKey, "passphrase", options)).To(Succeed())
+
+			_, err = LoadSecp256k1Key(path, "wrong passphrase")
+			Expect(err).To(BeAssignableToTypeOf(ErrInvalidPassphrase{}))
+		})
+	})
+
+	Context("when the peer id in the keystore has been modified", func() {
+		It("should return an ErrInvalidPassphrase", func() {
+			path := filepath.Join(dir, "key.json")
+			privKey, err := crypto.GenerateKey()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(SaveSecp256k1Key(path, privKey, "passphrase", options)).To(Succeed())
+
+			other, err := crypto.GenerateKey()
+			Expect(err).NotTo(HaveOccurred())
+			data, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			data = []byte(strings.Replace(string(data), NewSecp256k1PeerID(privKey.PublicKey).String(), NewSecp256k1PeerID(other.PublicKey).String(), 1))
+			Expect(ioutil.WriteFile(path, data, 0600)).To(Succeed())
+
+			_, err = LoadSecp256k1Key(path, "passphrase")
+			Expect(err).To(BeAssignableToTypeOf(ErrInvalidPassphrase{}))
+		})
+	})
+
+	Context("when loading or generating a key", func() {
+		It("should generate a key the first time, and load it afterwards", func() {
+			path := filepath.Join(dir, "key.json")
+			privKey, err := LoadOrGenerateSecp256k1Key(path, "passphrase", options)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(path).Should(BeAnExistingFile())
+
+			loaded, err := LoadOrGenerateSecp256k1Key(path, "passphrase", options)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(crypto.FromECDSA(loaded)).Should(Equal(crypto.FromECDSA(privKey)))
+		})
+
+		It("should not overwrite an existing key if the passphrase is wrong", func() {
+			path := filepath.Join(dir, "key.json")
+			_, err := LoadOrGenerateSecp256k1Key(path, "passphrase", options)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = LoadOrGenerateSecp256k1Key(path, "wrong passphrase", options)
+			Expect(err).To(BeAssignableToTypeOf(ErrInvalidPassphrase{}))
+		})
+	})
+
+	Context("when saving and loading an ed25519 key", func() {
+		It("should return the same key", func() {
+			path := filepath.Join(dir, "key.json")
+			privKey, err := LoadOrGenerateEd25519Key(path, "passphrase", options)
+			Expect(err).NotTo(HaveOccurred())
+
+			loaded, err := LoadEd25519Key(path, "passphrase")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded).Should(Equal(privKey))
+
+			_, err = LoadEd25519Key(path, "wrong passphrase")
+			Expect(err).To(BeAssignableToTypeOf(ErrInvalidPassphrase{}))
+		})
+
+		It("should not load the key as a secp256k1 key", func() {
+			path := filepath.Join(dir, "key.json")
+			_, err := LoadOrGenerateEd25519Key(path, "passphrase", options)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = LoadSecp256k1Key(path, "passphrase")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
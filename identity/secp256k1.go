@@ -0,0 +1,143 @@
+package identity
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/renproject/aw/protocol"
+)
+
+// secp256k1SigLength is the length of a recoverable secp256k1 signature in the
+// [R || S || V] format.
+const secp256k1SigLength = 65
+
+// Secp256k1PeerID is the Ethereum address of a secp256k1 public key.
+type Secp256k1PeerID [common.AddressLength]byte
+
+// NewSecp256k1PeerID returns the Secp256k1PeerID of a secp256k1 public key.
+func NewSecp256k1PeerID(pubKey ecdsa.PublicKey) Secp256k1PeerID {
+	return Secp256k1PeerID(crypto.PubkeyToAddress(pubKey))
+}
+
+// String returns the checksummed hex encoding of the Secp256k1PeerID.
+func (peerID Secp256k1PeerID) String() string {
+	return common.Address(peerID).Hex()
+}
+
+// Equal returns true if the given PeerID is the same Secp256k1PeerID.
+func (peerID Secp256k1PeerID) Equal(other protocol.PeerID) bool {
+	otherPeerID, ok := other.(Secp256k1PeerID)
+	if !ok {
+		return false
+	}
+	return peerID == otherPeerID
+}
+
+// Secp256k1PeerIDCodec encodes a Secp256k1PeerID as its 20 raw bytes.
+type Secp256k1PeerIDCodec struct{}
+
+// NewSecp256k1PeerIDCodec returns a PeerIDCodec for Secp256k1PeerIDs.
+func NewSecp256k1PeerIDCodec() protocol.PeerIDCodec {
+	return Secp256k1PeerIDCodec{}
+}
+
+// Encode implements the `protocol.PeerIDCodec` interface.
+func (codec Secp256k1PeerIDCodec) Encode(id protocol.PeerID) ([]byte, error) {
+	peerID, ok := id.(Secp256k1PeerID)
+	if !ok {
+		return nil, fmt.Errorf("unsupported peer id of type: %T", id)
+	}
+	return peerID[:], nil
+}
+
+// Decode implements the `protocol.PeerIDCodec` interface.
+func (codec Secp256k1PeerIDCodec) Decode(data []byte) (protocol.PeerID, error) {
+	peerID := Secp256k1PeerID{}
+	if len(data) != len(peerID) {
+		return nil, fmt.Errorf("invalid peer id length: expected %v, got %v", len(peerID), len(data))
+	}
+	copy(peerID[:], data)
+	return peerID, nil
+}
+
+// Secp256k1SignVerifier signs digests with a secp256k1 private key, and
+// recovers the Secp256k1PeerID of the signatory when verifying signatures.
+// Verify does not decide whether the signatory is trusted; use a
+// handshake.Authorizer to restrict which peers can establish sessions.
+type Secp256k1SignVerifier struct {
+	privKey *ecdsa.PrivateKey
+	peerID  Secp256k1PeerID
+}
+
+// NewSecp256k1SignVerifier returns a Secp256k1SignVerifier that signs with the
+// given private key.
+func NewSecp256k1SignVerifier(privKey *ecdsa.PrivateKey) *Secp256k1SignVerifier {
+	if privKey == nil {
+		panic("invariant violation: private key cannot be nil")
+	}
+	return &Secp256k1SignVerifier{
+		privKey: privKey,
+		peerID:  NewSecp256k1PeerID(privKey.PublicKey),
+	}
+}
+
+// PeerID returns the Secp256k1PeerID of the private key.
+func (sv *Secp256k1SignVerifier) PeerID() Secp256k1PeerID {
+	return sv.peerID
+}
+
+// PrivKey returns the private key used for signing.
+func (sv *Secp256k1SignVerifier) PrivKey() *ecdsa.PrivateKey {
+	return sv.privKey
+}
+
+// Sign implements the `protocol.SignVerifier` interface. The digest must be 32
+// bytes, and the returned signature is in the [R || S || V] format.
+func (sv *Secp256k1SignVerifier) Sign(digest []byte) ([]byte, error) {
+	return crypto.Sign(digest, sv.privKey)
+}
+
+// Verify implements the `protocol.SignVerifier` interface. It returns the
+// Secp256k1PeerID of the public key recovered from the signature.
+func (sv *Secp256k1SignVerifier) Verify(digest, sig []byte) (protocol.PeerID, error) {
+	if len(sig) != secp256k1SigLength {
+		return nil, fmt.Errorf("invalid signature length: expected %v, got %v", secp256k1SigLength, len(sig))
+	}
+	pubKey, err := crypto.SigToPub(digest, sig)
+	if err != nil {
+		return nil, fmt.Errorf("error recovering public key: %v", err)
+	}
+	if !crypto.VerifySignature(crypto.FromECDSAPub(pubKey), digest, sig[:secp256k1SigLength-1]) {
+		// Reject malleable signatures, so that every message has exactly one
+		// valid signature.
+		return nil, fmt.Errorf("invalid signature")
+	}
+	return NewSecp256k1PeerID(*pubKey), nil
+}
+
+// Hash implements the `protocol.SignVerifier` interface using Keccak256.
+func (sv *Secp256k1SignVerifier) Hash(data []byte) []byte {
+	return crypto.Keccak256(data)
+}
+
+// SigLength implements the `protocol.SignVerifier` interface.
+func (sv *Secp256k1SignVerifier) SigLength() uint64 {
+	return secp256k1SigLength
+}
+
+func marshalSecp256k1PrivKey(privKey *ecdsa.PrivateKey) []byte {
+	return crypto.FromECDSA(privKey)
+}
+
+func unmarshalSecp256k1PrivKey(data []byte, peerID string) (*ecdsa.PrivateKey, error) {
+	privKey, err := crypto.ToECDSA(data)
+	if err != nil {
+		return nil, err
+	}
+	if expected := NewSecp256k1PeerID(privKey.PublicKey).String(); expected != peerID {
+		return nil, fmt.Errorf("private key does not match peer id: expected %v, got %v", peerID, expected)
+	}
+	return privKey, nil
+}
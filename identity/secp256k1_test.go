@@ -0,0 +1,137 @@
+package identity_test
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"testing/quick"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/identity"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/aw/testutil"
+	"github.com/renproject/phi"
+)
+
+var _ = Describe("Secp256k1", func() {
+
+	newSignVerifier := func() *Secp256k1SignVerifier {
+		privKey, err := crypto.GenerateKey()
+		Expect(err).NotTo(HaveOccurred())
+		return NewSecp256k1SignVerifier(privKey)
+	}
+
+	Context("when initializing a sign verifier", func() {
+		It("should panic if providing a nil private key", func() {
+			Expect(func() {
+				_ = NewSecp256k1SignVerifier(nil)
+			}).Should(Panic())
+		})
+	})
+
+	Context("when signing and verifying", func() {
+		It("should recover the peer id of the signatory", func() {
+			signer, verifier := newSignVerifier(), newSignVerifier()
+			test := func(data []byte) bool {
+				digest := signer.Hash(data)
+				sig, err := signer.Sign(digest)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(uint64(len(sig))).Should(Equal(signer.SigLength()))
+
+				peerID, err := verifier.Verify(digest, sig)
+				Expect(err).NotTo(HaveOccurred())
+				return peerID.Equal(signer.PeerID())
+			}
+			Expect(quick.Check(test, nil)).NotTo(HaveOccurred())
+		})
+
+		It("should not recover the peer id of the signatory if the digest is different", func() {
+			signer := newSignVerifier()
+			sig, err := signer.Sign(signer.Hash([]byte("hello")))
+			Expect(err).NotTo(HaveOccurred())
+
+			peerID, err := signer.Verify(signer.Hash([]byte("world")), sig)
+			if err == nil {
+				Expect(peerID.Equal(signer.PeerID())).Should(BeFalse())
+			}
+		})
+
+		It("should return an error if the signature has the wrong length", func() {
+			signer := newSignVerifier()
+			digest := signer.Hash([]byte("hello"))
+			sig, err := signer.Sign(digest)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = signer.Verify(digest, sig[1:])
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when encoding and decoding peer ids", func() {
+		It("should return the same peer id", func() {
+			codec := NewSecp256k1PeerIDCodec()
+			peerID := newSignVerifier().PeerID()
+			data, err := codec.Encode(peerID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data).Should(HaveLen(20))
+
+			decoded, err := codec.Decode(data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decoded.Equal(peerID)).Should(BeTrue())
+			Expect(decoded.String()).Should(Equal(peerID.String()))
+		})
+
+		It("should return an error when encoding other peer ids", func() {
+			_, err := NewSecp256k1PeerIDCodec().Encode(testutil.RandomPeerID())
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should return an error when decoding data with the wrong length", func() {
+			data := make([]byte, 21)
+			_, err := rand.Read(data)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = NewSecp256k1PeerIDCodec().Decode(data)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when handshaking", func() {
+		It("should establish a session between the authenticated peers", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientSignVerifier, serverSignVerifier := newSignVerifier(), newSignVerifier()
+			client := handshake.New(clientSignVerifier, handshake.NewGCMSessionManager())
+			server := handshake.New(serverSignVerifier, handshake.NewGCMSessionManager())
+
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			var clientSession, serverSession protocol.Session
+			var clientErr, serverErr error
+			phi.ParBegin(func() {
+				clientSession, clientErr = client.Handshake(ctx, clientConn, serverSignVerifier.PeerID())
+			}, func() {
+				serverSession, serverErr = server.AcceptHandshake(ctx, serverConn)
+			})
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverErr).NotTo(HaveOccurred())
+
+			message := testutil.RandomMessage(protocol.V1, protocol.Cast)
+			go func() {
+				defer GinkgoRecover()
+				Expect(clientSession.WriteMessage(clientConn, message)).To(Succeed())
+			}()
+			received, err := serverSession.ReadMessageOnTheWire(serverConn)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(received.From.Equal(clientSignVerifier.PeerID())).Should(BeTrue())
+			Expect(received.Message.Body).Should(Equal(message.Body))
+		})
+	})
+})
@@ -2,34 +2,131 @@ package multicast
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/renproject/aw/broadcast"
 	"github.com/renproject/aw/dht"
 	"github.com/renproject/aw/protocol"
+	"github.com/renproject/id"
 	"github.com/sirupsen/logrus"
 )
 
 type Multicaster interface {
+	// Multicast sends a message to all peers in the group. If the Multicaster
+	// waits for results, it waits until the message has been sent to each of
+	// them, and returns an ErrMulticasting if the message cannot be sent to
+	// some of them before the context is done.
 	Multicast(ctx context.Context, groupID protocol.GroupID, body protocol.MessageBody) error
+
+	// ReliableMulticast sends a message to all peers in the group, and waits
+	// for each of them to acknowledge it. Peers that have not acknowledged
+	// the message are sent it again every RetryInterval, until they all have,
+	// or until the context is done. It returns the DeliveryReport, and an
+	// ErrMulticasting if some of the peers have not acknowledged the message.
+	ReliableMulticast(ctx context.Context, groupID protocol.GroupID, body protocol.MessageBody) (DeliveryReport, error)
+
 	AcceptMulticast(ctx context.Context, from protocol.PeerID, message protocol.Message) error
+
+	// AcceptAck from a peer that has received a reliable multicast.
+	AcceptAck(ctx context.Context, from protocol.PeerID, message protocol.Message) error
+}
+
+// Options are used to parameterise the behaviour of a Multicaster.
+type Options struct {
+	Logger     logrus.FieldLogger
+	NumWorkers int
+
+	// SeenCache remembers the messages that have been received, so that they
+	// are only emitted once. Messages are identified by their sender, and by
+	// their ID (for reliable multicasts) or their hash. Defaults to a
+	// broadcast.SeenCache with the default options.
+	SeenCache broadcast.SeenCache
+
+	// RetryInterval is how often a reliable multicast is sent again to the
+	// peers that have not acknowledged it. Defaults to 1 second.
+	RetryInterval time.Duration
+
+	// WaitForResults makes Multicast wait for the Results of its messages. It
+	// must only be set when the consumer of the messages reports the Result of
+	// every message (as the tcp.Client does), otherwise Multicast blocks until
+	// its context is done. Defaults to false.
+	WaitForResults bool
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.Logger == nil {
+		options.Logger = logrus.New()
+	}
+	if options.NumWorkers <= 0 {
+		options.NumWorkers = 2 * runtime.NumCPU()
+	}
+	if options.SeenCache == nil {
+		seen, err := broadcast.NewSeenCache(broadcast.SeenCacheOptions{})
+		if err != nil {
+			panic(fmt.Errorf("invariant violation: cannot create seen cache: %v", err))
+		}
+		options.SeenCache = seen
+	}
+	if options.RetryInterval <= 0 {
+		options.RetryInterval = time.Second
+	}
+}
+
+// A DeliveryReport lists the peers in a group that have, and have not,
+// acknowledged a reliable multicast.
+type DeliveryReport struct {
+	Delivered   protocol.PeerIDs
+	Undelivered protocol.PeerIDs
+}
+
+// delivery is a reliable multicast that is waiting for acknowledgements.
+type delivery struct {
+	acked   map[string]bool // Members of the group, and whether they have acked
+	pending int             // Number of members that have not acked
+	done    chan struct{}   // Closed when all members have acked
 }
 
 type multicaster struct {
-	logger     logrus.FieldLogger
-	numWorkers int
-	messages   protocol.MessageSender
-	events     protocol.EventSender
-	dht        dht.DHT
+	logger         logrus.FieldLogger
+	numWorkers     int
+	seen           broadcast.SeenCache
+	retryInterval  time.Duration
+	waitForResults bool
+	messages       protocol.MessageSender
+	events         protocol.EventSender
+	dht            dht.DHT
+
+	mu         *sync.Mutex
+	deliveries map[id.Hash]*delivery
 }
 
 func NewMulticaster(logger logrus.FieldLogger, numWorkers int, messages protocol.MessageSender, events protocol.EventSender, dht dht.DHT) Multicaster {
+	return NewMulticasterWithOptions(Options{Logger: logger, NumWorkers: numWorkers}, messages, events, dht)
+}
+
+// NewMulticasterWithOptions returns a Multicaster that ignores duplicate
+// messages using the SeenCache in the Options, and retries reliable
+// multicasts every RetryInterval.
+func NewMulticasterWithOptions(options Options, messages protocol.MessageSender, events protocol.EventSender, dht dht.DHT) Multicaster {
+	options.setZerosToDefaults()
 	return &multicaster{
-		logger:     logger,
-		numWorkers: numWorkers,
-		messages:   messages,
-		events:     events,
-		dht:        dht,
+		logger:         options.Logger,
+		numWorkers:     options.NumWorkers,
+		seen:           options.SeenCache,
+		retryInterval:  options.RetryInterval,
+		waitForResults: options.WaitForResults,
+		messages:       messages,
+		events:         events,
+		dht:            dht,
+
+		mu:         new(sync.Mutex),
+		deliveries: map[id.Hash]*delivery{},
 	}
 }
 
@@ -46,54 +143,243 @@ func (multicaster *multicaster) Multicast(ctx context.Context, groupID protocol.
 	default:
 	}
 
-	protocol.ParForAllAddresses(addrs, multicaster.numWorkers, func(to protocol.PeerAddress) {
-		if to == nil {
-			return
+	var results chan error
+	if multicaster.waitForResults {
+		results = make(chan error, len(addrs))
+	}
+	sent := multicaster.sendToAll(ctx, addrs, protocol.NewMessage(protocol.V1, protocol.Multicast, groupID, body), results)
+	if results == nil {
+		return nil
+	}
+
+	// Wait for the message to be sent to all of the addresses.
+	errs := protocol.WaitForResults(ctx, results, sent)
+	if err := ctx.Err(); err != nil {
+		return newErrMulticasting(err, groupID)
+	}
+	if len(errs) > 0 {
+		return newErrMulticasting(fmt.Errorf("%v of %v messages not delivered: %v", len(errs), len(addrs), errs), groupID)
+	}
+	return nil
+}
+
+func (multicaster *multicaster) ReliableMulticast(ctx context.Context, groupID protocol.GroupID, body protocol.MessageBody) (DeliveryReport, error) {
+	members, err := multicaster.dht.GroupIDs(groupID)
+	if err != nil {
+		return DeliveryReport{}, err
+	}
+
+	// Reliable multicasts carry a random ID in their V2 header, so that they
+	// can be acknowledged, and so that retries are not emitted more than once.
+	// Peers that only support V1 cannot acknowledge them.
+	messageID := id.Hash{}
+	if _, err := rand.Read(messageID[:]); err != nil {
+		return DeliveryReport{}, fmt.Errorf("error multicasting to group %v: %v", groupID, err)
+	}
+	message := protocol.NewMessage(protocol.V2, protocol.Multicast, groupID, body)
+	message.SetID(messageID)
+
+	d := &delivery{
+		acked: make(map[string]bool, len(members)),
+		done:  make(chan struct{}),
+	}
+	for _, member := range members {
+		if _, ok := d.acked[member.String()]; !ok {
+			d.acked[member.String()] = false
+			d.pending++
 		}
-		messageWire := protocol.MessageOnTheWire{
-			To:      to,
-			Message: protocol.NewMessage(protocol.V1, protocol.Multicast, groupID, body),
+	}
+	if d.pending == 0 {
+		close(d.done)
+	}
+	multicaster.mu.Lock()
+	multicaster.deliveries[messageID] = d
+	multicaster.mu.Unlock()
+	defer func() {
+		multicaster.mu.Lock()
+		delete(multicaster.deliveries, messageID)
+		multicaster.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(multicaster.retryInterval)
+	defer ticker.Stop()
+
+	for {
+		addrs, err := multicaster.unacked(groupID, d)
+		if err != nil {
+			return multicaster.report(members, d), err
 		}
+		multicaster.sendToAll(ctx, addrs, message, nil)
 
 		select {
+		case <-d.done:
+			return multicaster.report(members, d), nil
 		case <-ctx.Done():
-			multicaster.logger.Debugf("cannot send message to %v, %v", to.PeerID(), ctx.Err())
-		case multicaster.messages <- messageWire:
+			return multicaster.report(members, d), newErrMulticasting(ctx.Err(), groupID)
+		case <-ticker.C:
 		}
-	})
-
-	return nil
+	}
 }
 
 func (multicaster *multicaster) AcceptMulticast(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
-	// TODO: Multicasting will always emit an event for a received message, even
-	// if the message has been seen before. Should this be changed?
-	if message.Version != protocol.V1 {
-		return protocol.NewErrMessageVersionIsNotSupported(message.Version)
+	if err := protocol.ValidateMessageVersion(message.Version); err != nil {
+		return err
 	}
 	if message.Variant != protocol.Multicast {
 		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
 	}
 
-	event := protocol.EventMessageReceived{
-		Time:    time.Now(),
-		Message: message.Body,
-		From:    from,
+	// Ignore messages that have already been received from the peer, but
+	// acknowledge them again in case the previous acknowledgement was lost.
+	messageID, reliable := message.ID()
+	if !reliable {
+		messageID = message.Hash()
 	}
+	// The message is marked as seen before it is emitted, so that concurrent
+	// duplicates are not emitted, and is unmarked if it cannot be emitted.
+	seenID := id.Hash(sha256.Sum256(append([]byte(from.String()), messageID[:]...)))
+	ok, err := multicaster.seen.SeenOrInsert(seenID)
+	if err != nil {
+		return newErrAcceptingMulticast(fmt.Errorf("error inserting message hash=%v: %v", seenID, err))
+	}
+	if !ok {
+		event := protocol.EventMessageReceived{
+			Time:    time.Now(),
+			Message: message.Body,
+			From:    from,
+		}
 
-	// Check if context is already expired
-	select {
-	case <-ctx.Done():
-		return newErrAcceptingMulticast(ctx.Err())
-	default:
+		// Check if context is already expired
+		select {
+		case <-ctx.Done():
+			return multicaster.unsee(seenID, ctx.Err())
+		default:
+		}
+
+		select {
+		case <-ctx.Done():
+			return multicaster.unsee(seenID, ctx.Err())
+		case multicaster.events <- event:
+		}
+	}
+	if !reliable {
+		return nil
 	}
 
-	select {
-	case <-ctx.Done():
-		return newErrAcceptingMulticast(ctx.Err())
-	case multicaster.events <- event:
+	to, err := multicaster.dht.PeerAddress(from)
+	if err != nil {
+		return newErrAcceptingMulticast(err)
+	}
+	multicaster.sendToAll(ctx, protocol.PeerAddresses{to}, protocol.NewMessage(protocol.V1, protocol.Ack, protocol.NilGroupID, messageID[:]), nil)
+	return nil
+}
+
+func (multicaster *multicaster) AcceptAck(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	if err := protocol.ValidateMessageVersion(message.Version); err != nil {
+		return err
+	}
+	if message.Variant != protocol.Ack {
+		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
+	}
+	if len(message.Body) != len(id.Hash{}) {
+		return fmt.Errorf("error accepting ack: expected len=%v, got len=%v", len(id.Hash{}), len(message.Body))
+	}
+	messageID := id.Hash{}
+	copy(messageID[:], message.Body)
+
+	multicaster.mu.Lock()
+	defer multicaster.mu.Unlock()
+
+	// Acknowledgements of multicasts that are no longer waiting, and from
+	// peers that are not in the group, are ignored.
+	d, ok := multicaster.deliveries[messageID]
+	if !ok {
 		return nil
 	}
+	if acked, ok := d.acked[from.String()]; !ok || acked {
+		return nil
+	}
+	d.acked[from.String()] = true
+	d.pending--
+	if d.pending == 0 {
+		close(d.done)
+	}
+	return nil
+}
+
+// unacked returns the addresses of the members of the group that have not
+// acknowledged the delivery.
+func (multicaster *multicaster) unacked(groupID protocol.GroupID, d *delivery) (protocol.PeerAddresses, error) {
+	addrs, err := multicaster.dht.GroupAddresses(groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	multicaster.mu.Lock()
+	defer multicaster.mu.Unlock()
+
+	unacked := make(protocol.PeerAddresses, 0, d.pending)
+	for _, addr := range addrs {
+		if acked, ok := d.acked[addr.PeerID().String()]; ok && !acked {
+			unacked = append(unacked, addr)
+		}
+	}
+	return unacked, nil
+}
+
+// report returns the DeliveryReport of the members of the group.
+func (multicaster *multicaster) report(members protocol.PeerIDs, d *delivery) DeliveryReport {
+	multicaster.mu.Lock()
+	defer multicaster.mu.Unlock()
+
+	report := DeliveryReport{
+		Delivered:   protocol.PeerIDs{},
+		Undelivered: protocol.PeerIDs{},
+	}
+	for _, member := range members {
+		if d.acked[member.String()] {
+			report.Delivered = append(report.Delivered, member)
+		} else {
+			report.Undelivered = append(report.Undelivered, member)
+		}
+	}
+	return report
+}
+
+// unsee removes the message hash from the SeenCache, because the message could
+// not be emitted, and returns the error that stopped it from being emitted.
+func (multicaster *multicaster) unsee(seenID id.Hash, err error) error {
+	if removeErr := multicaster.seen.Remove(seenID); removeErr != nil {
+		return newErrAcceptingMulticast(fmt.Errorf("%v, and %v", err, removeErr))
+	}
+	return newErrAcceptingMulticast(err)
+}
+
+// sendToAll sends a message to all of the addresses, and returns the number
+// of messages that were sent. The outcome of each message is sent to the
+// results, if they are not nil.
+func (multicaster *multicaster) sendToAll(ctx context.Context, addrs protocol.PeerAddresses, message protocol.Message, results chan<- error) int {
+	sent := int64(0)
+	deadline, _ := ctx.Deadline()
+	protocol.ParForAllAddresses(addrs, multicaster.numWorkers, func(to protocol.PeerAddress) {
+		if to == nil {
+			return
+		}
+		messageWire := protocol.MessageOnTheWire{
+			To:       to,
+			Message:  message,
+			Result:   results,
+			Deadline: deadline,
+		}
+
+		select {
+		case <-ctx.Done():
+			multicaster.logger.Debugf("cannot send message to %v, %v", to.PeerID(), ctx.Err())
+		case multicaster.messages <- messageWire:
+			atomic.AddInt64(&sent, 1)
+		}
+	})
+	return int(sent)
 }
 
 type ErrMulticasting struct {
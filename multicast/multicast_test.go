@@ -3,7 +3,10 @@ package multicast_test
 import (
 	"bytes"
 	"context"
+	"errors"
+	"sync/atomic"
 	"testing/quick"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -15,6 +18,61 @@ import (
 )
 
 var _ = Describe("Multicaster", func() {
+
+	// network returns n Multicasters in the same group that are connected to
+	// each other. Messages are dropped if the filter returns false.
+	network := func(ctx context.Context, n int, filter func(to int, message protocol.Message) bool) ([]Multicaster, []chan protocol.Event, protocol.PeerIDs, protocol.GroupID) {
+		addrs := RandomAddresses(n)
+		ids := make(protocol.PeerIDs, n)
+		for i := range addrs {
+			ids[i] = addrs[i].PeerID()
+		}
+		groupID := RandomGroupID()
+
+		multicasters := make([]Multicaster, n)
+		events := make([]chan protocol.Event, n)
+		messages := make([]chan protocol.MessageOnTheWire, n)
+		for i := range multicasters {
+			dht := NewDHT(addrs[i], NewTable("dht"), nil)
+			for j := range addrs {
+				if i != j {
+					Expect(dht.AddPeerAddress(addrs[j])).To(Succeed())
+				}
+			}
+			Expect(dht.AddGroup(groupID, ids)).To(Succeed())
+			messages[i] = make(chan protocol.MessageOnTheWire, 1024)
+			events[i] = make(chan protocol.Event, 1024)
+			multicasters[i] = NewMulticasterWithOptions(Options{RetryInterval: 50 * time.Millisecond}, messages[i], events[i], dht)
+		}
+
+		forward := func(i int) {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case message := <-messages[i]:
+					for j := range multicasters {
+						if !ids[j].Equal(message.To.PeerID()) {
+							continue
+						}
+						if filter != nil && !filter(j, message.Message) {
+							continue
+						}
+						if message.Message.Variant == protocol.Ack {
+							multicasters[j].AcceptAck(ctx, ids[i], message.Message)
+						} else {
+							multicasters[j].AcceptMulticast(ctx, ids[i], message.Message)
+						}
+					}
+				}
+			}
+		}
+		for i := range multicasters {
+			go forward(i)
+		}
+		return multicasters, events, ids, groupID
+	}
+
 	Context("when multicasting", func() {
 		It("should be able to send messages", func() {
 			check := func(messageBody []byte) bool {
@@ -44,6 +102,33 @@ var _ = Describe("Multicaster", func() {
 			Expect(quick.Check(check, nil)).Should(BeNil())
 		})
 
+		Context("when waiting for results", func() {
+			It("should return ErrMulticasting if the message cannot be sent to some peers", func() {
+				messages := make(chan protocol.MessageOnTheWire, 128)
+				events := make(chan protocol.Event, 1)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				multicaster := NewMulticasterWithOptions(Options{WaitForResults: true}, messages, events, dht)
+
+				groupID, addrs, err := NewGroup(dht)
+				Expect(err).NotTo(HaveOccurred())
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go func() {
+					for i := 0; i < len(addrs); i++ {
+						message := <-messages
+						if i == 0 {
+							message.ReportResult(protocol.NewErrMessageNotDelivered(message.To.PeerID(), errors.New("unreachable")))
+							continue
+						}
+						message.ReportResult(nil)
+					}
+				}()
+				err = multicaster.Multicast(ctx, groupID, RandomMessageBody())
+				Expect(err).Should(BeAssignableToTypeOf(ErrMulticasting{}))
+			})
+		})
+
 		Context("when the context is cancelled", func() {
 			It("should return ErrMulticasting", func() {
 				check := func(messageBody []byte) bool {
@@ -171,5 +256,172 @@ var _ = Describe("Multicaster", func() {
 				Expect(multicaster.AcceptMulticast(ctx, RandomPeerID(), message)).To(HaveOccurred())
 			})
 		})
+
+		Context("when the message has already been received", func() {
+			It("should only emit it once", func() {
+				messages := make(chan protocol.MessageOnTheWire, 16)
+				events := make(chan protocol.Event, 16)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				multicaster := NewMulticaster(logrus.New(), 8, messages, events, dht)
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				from := RandomPeerID()
+				message := protocol.NewMessage(protocol.V1, protocol.Multicast, RandomGroupID(), RandomMessageBody())
+				Expect(multicaster.AcceptMulticast(ctx, from, message)).To(Succeed())
+				Expect(multicaster.AcceptMulticast(ctx, from, message)).To(Succeed())
+				Eventually(events).Should(Receive())
+				Consistently(events, 100*time.Millisecond).ShouldNot(Receive())
+
+				// The same message from a different peer is emitted.
+				Expect(multicaster.AcceptMulticast(ctx, RandomPeerID(), message)).To(Succeed())
+				Eventually(events).Should(Receive())
+			})
+
+			It("should only emit it once when it is received concurrently", func() {
+				messages := make(chan protocol.MessageOnTheWire, 16)
+				events := make(chan protocol.Event)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				multicaster := NewMulticaster(logrus.New(), 8, messages, events, dht)
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				// Nothing reads the events until every duplicate has been
+				// accepted, so the first message is still being emitted when
+				// its duplicates are accepted.
+				from := RandomPeerID()
+				message := protocol.NewMessage(protocol.V1, protocol.Multicast, RandomGroupID(), RandomMessageBody())
+				errs := make(chan error, 8)
+				for i := 0; i < 8; i++ {
+					go func() {
+						errs <- multicaster.AcceptMulticast(ctx, from, message)
+					}()
+				}
+				for i := 0; i < 7; i++ {
+					Eventually(errs).Should(Receive(BeNil()))
+				}
+				Eventually(events).Should(Receive())
+				Eventually(errs).Should(Receive(BeNil()))
+				Consistently(events, 100*time.Millisecond).ShouldNot(Receive())
+			})
+
+			It("should emit it again if it could not be emitted", func() {
+				messages := make(chan protocol.MessageOnTheWire, 16)
+				events := make(chan protocol.Event)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				multicaster := NewMulticaster(logrus.New(), 8, messages, events, dht)
+
+				from := RandomPeerID()
+				message := protocol.NewMessage(protocol.V1, protocol.Multicast, RandomGroupID(), RandomMessageBody())
+				timeoutCtx, timeoutCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+				defer timeoutCancel()
+				Expect(multicaster.AcceptMulticast(timeoutCtx, from, message)).To(BeAssignableToTypeOf(ErrAcceptingMulticast{}))
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go multicaster.AcceptMulticast(ctx, from, message)
+				Eventually(events).Should(Receive())
+			})
+		})
+	})
+
+	Context("when reliably multicasting", func() {
+		It("should deliver the message to every peer and report it", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			multicasters, events, ids, groupID := network(ctx, 8, nil)
+
+			body := RandomMessageBody()
+			report, err := multicasters[0].ReliableMulticast(ctx, groupID, body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.Delivered).Should(ConsistOf(ids))
+			Expect(report.Undelivered).Should(BeEmpty())
+			for i := range events {
+				var event protocol.EventMessageReceived
+				Eventually(events[i]).Should(Receive(&event))
+				Expect(bytes.Equal(event.Message, body)).Should(BeTrue())
+			}
+		})
+
+		It("should retry peers that have not acknowledged the message", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Drop the first two messages that are sent to peer 1.
+			dropped := int32(0)
+			filter := func(to int, message protocol.Message) bool {
+				if to != 1 || message.Variant != protocol.Multicast {
+					return true
+				}
+				return atomic.AddInt32(&dropped, 1) > 2
+			}
+			multicasters, events, ids, groupID := network(ctx, 4, filter)
+
+			report, err := multicasters[0].ReliableMulticast(ctx, groupID, RandomMessageBody())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.Delivered).Should(ConsistOf(ids))
+			Expect(atomic.LoadInt32(&dropped)).Should(BeNumerically(">", 2))
+
+			// Retries are only emitted once.
+			for i := range events {
+				Eventually(events[i]).Should(Receive())
+				Consistently(events[i], 100*time.Millisecond).ShouldNot(Receive())
+			}
+		})
+
+		It("should report peers that have not acknowledged the message when the context is done", func() {
+			// Drop all messages that are sent to peer 1.
+			filter := func(to int, message protocol.Message) bool {
+				return to != 1
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			multicasters, _, ids, groupID := network(ctx, 4, filter)
+
+			multicastCtx, multicastCancel := context.WithTimeout(ctx, 300*time.Millisecond)
+			defer multicastCancel()
+			report, err := multicasters[0].ReliableMulticast(multicastCtx, groupID, RandomMessageBody())
+			Expect(err).Should(BeAssignableToTypeOf(ErrMulticasting{}))
+			Expect(report.Delivered).Should(ConsistOf(ids[0], ids[2], ids[3]))
+			Expect(report.Undelivered).Should(ConsistOf(ids[1]))
+		})
+
+		It("should report peers without addresses as undelivered", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			multicaster := NewMulticasterWithOptions(Options{RetryInterval: 50 * time.Millisecond}, messages, events, dht)
+
+			groupID := RandomGroupID()
+			ids := RandomPeerIDs()
+			Expect(dht.AddGroup(groupID, ids)).To(Succeed())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			report, err := multicaster.ReliableMulticast(ctx, groupID, RandomMessageBody())
+			Expect(err).Should(HaveOccurred())
+			Expect(report.Delivered).Should(BeEmpty())
+			Expect(report.Undelivered).Should(ConsistOf(ids))
+		})
+	})
+
+	Context("when accepting malformed acks", func() {
+		It("should return an error", func() {
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			multicaster := NewMulticaster(logrus.New(), 8, nil, nil, dht)
+
+			for _, body := range [][]byte{{}, {1, 2, 3}, make([]byte, 33)} {
+				message := protocol.NewMessage(protocol.V1, protocol.Ack, protocol.NilGroupID, body)
+				Expect(multicaster.AcceptAck(context.Background(), RandomPeerID(), message)).NotTo(Succeed())
+			}
+			message := protocol.NewMessage(protocol.V1, protocol.Multicast, RandomGroupID(), make([]byte, 32))
+			Expect(multicaster.AcceptAck(context.Background(), RandomPeerID(), message)).NotTo(Succeed())
+
+			// Unknown acks are ignored.
+			message = protocol.NewMessage(protocol.V1, protocol.Ack, protocol.NilGroupID, make([]byte, 32))
+			Expect(multicaster.AcceptAck(context.Background(), RandomPeerID(), message)).To(Succeed())
+		})
 	})
 })
@@ -5,7 +5,42 @@ import (
 	"runtime"
 	"time"
 
+	"github.com/renproject/aw/broadcast"
+	"github.com/renproject/aw/handshake"
 	"github.com/renproject/aw/protocol"
+	"github.com/renproject/aw/tcp"
+)
+
+// HandshakeProtocol selects the handshake.Handshaker that NewTCP uses to
+// authenticate connections.
+type HandshakeProtocol string
+
+const (
+	// HandshakeECIES exchanges ECIES-encrypted session key halves (see
+	// handshake.New).
+	HandshakeECIES = HandshakeProtocol("ecies")
+
+	// HandshakeNoiseXX runs the Noise XX pattern (see handshake.NewNoise).
+	HandshakeNoiseXX = HandshakeProtocol("noise-xx")
+)
+
+// BroadcastStrategy selects the broadcast.Strategy that a Peer uses to
+// propagate broadcast messages.
+type BroadcastStrategy string
+
+const (
+	// BroadcastFlood sends every message to every peer in its group (see
+	// broadcast.NewFloodStrategy).
+	BroadcastFlood = BroadcastStrategy("flood")
+
+	// BroadcastGossip sends every message to a random fanout of peers in its
+	// group (see broadcast.NewGossipStrategy).
+	BroadcastGossip = BroadcastStrategy("gossip")
+
+	// BroadcastPlumtree pushes every message along a spanning tree of its
+	// group, and announces it to the other peers in the group (see
+	// broadcast.NewPlumtreeStrategy).
+	BroadcastPlumtree = BroadcastStrategy("plumtree")
 )
 
 type Options struct {
@@ -13,13 +48,72 @@ type Options struct {
 	BootstrapAddresses protocol.PeerAddresses
 
 	// Optional
-	DisablePeerDiscovery bool          `json:"disablePeerDiscovery"` // Defaults to false
-	Capacity             int           `json:"capacity"`             // capacity of internal channel
-	NumWorkers           int           `json:"numWorkers"`           // Defaults to 2x the number of CPUs
-	Alpha                int           `json:"alpha"`                // Defaults to 2x the number of BootstrapAddress
-	BootstrapDuration    time.Duration `json:"bootstrapDuration"`    // Defaults to 1 hour
-	MinPingTimeout       time.Duration `json:"minPingTimeout"`       // Defaults to 1 second
-	MaxPingTimeout       time.Duration `json:"maxPingTimeout"`       // Defaults to 30 seconds
+	DisablePeerDiscovery bool              `json:"disablePeerDiscovery"` // Defaults to false
+	Capacity             int               `json:"capacity"`             // capacity of internal channel
+	NumWorkers           int               `json:"numWorkers"`           // Defaults to 2x the number of CPUs
+	Alpha                int               `json:"alpha"`                // Defaults to 2x the number of BootstrapAddress
+	BootstrapDuration    time.Duration     `json:"bootstrapDuration"`    // Defaults to 1 hour
+	MinPingTimeout       time.Duration     `json:"minPingTimeout"`       // Defaults to 1 second
+	MaxPingTimeout       time.Duration     `json:"maxPingTimeout"`       // Defaults to 30 seconds
+	Handshake            HandshakeProtocol `json:"handshake"`            // Defaults to HandshakeECIES
+
+	// ResumptionTicketTTL is how long session resumption tickets are valid
+	// when using HandshakeECIES. Resumed sessions skip the ECIES key exchange
+	// when reconnecting to a peer. Defaults to 1 hour, and a negative value
+	// disables resumption.
+	ResumptionTicketTTL time.Duration `json:"resumptionTicketTTL"`
+
+	// SizeLimits bound the length of handshake messages, and of the messages
+	// sent and received by this Peer. Limits can differ per message variant.
+	// Zero values default to the values of protocol.DefaultSizeLimits.
+	SizeLimits protocol.SizeLimits `json:"sizeLimits"`
+
+	// Compressions that this Peer supports, in order of preference. When this
+	// Peer connects to another peer, the first compression that both support
+	// is used to compress message bodies that are longer than the
+	// CompressionThreshold. Defaults to supporting all compressions, but
+	// preferring none.
+	Compressions         []protocol.Compression `json:"compressions"`
+	CompressionThreshold int                    `json:"compressionThreshold"` // Defaults to 256 bytes
+
+	// Authorizer restricts which peers can connect to, and be connected to by,
+	// this Peer. Defaults to authorizing all peers.
+	Authorizer handshake.Authorizer `json:"-"`
+
+	// BroadcastSeenCache remembers the broadcast messages that have been
+	// seen, so that they are not emitted or propagated more than once. It can
+	// be created with broadcast.NewSeenCache to bound its memory, to persist
+	// it across restarts, or to read its statistics. Defaults to a
+	// broadcast.SeenCache with the default options.
+	BroadcastSeenCache broadcast.SeenCache `json:"-"`
+
+	// MulticastSeenCache remembers the multicast messages that have been
+	// received, so that they are not emitted more than once. Defaults to a
+	// broadcast.SeenCache with the default options.
+	MulticastSeenCache broadcast.SeenCache `json:"-"`
+
+	// MulticastRetryInterval is how often a reliable multicast is sent again
+	// to the peers that have not acknowledged it. Defaults to 1 second.
+	MulticastRetryInterval time.Duration `json:"multicastRetryInterval"`
+
+	// BroadcastStrategy selects how broadcast messages are propagated. Gossip
+	// parameterises the BroadcastGossip strategy, and Plumtree parameterises
+	// the BroadcastPlumtree strategy. Defaults to BroadcastFlood.
+	BroadcastStrategy BroadcastStrategy         `json:"broadcastStrategy"`
+	Gossip            broadcast.GossipOptions   `json:"gossip"`
+	Plumtree          broadcast.PlumtreeOptions `json:"plumtree"`
+
+	// BroadcastMode is how broadcast messages are propagated to groups that
+	// do not have their own mode (see Peer.SetBroadcastMode). Defaults to
+	// broadcast.ModePush.
+	BroadcastMode broadcast.Mode `json:"broadcastMode"`
+
+	// RetryPolicy is how the tcp.Client created by NewTCP retries messages
+	// that cannot be sent, and CircuitBreaker is how it stops sending
+	// messages to peers that keep failing. Zero values default to the
+	// defaults of tcp.ClientOptions.
+	RetryPolicy    tcp.RetryPolicy           `json:"retryPolicy"`
+	CircuitBreaker tcp.CircuitBreakerOptions `json:"circuitBreaker"`
 }
 
 func (options *Options) SetZeroToDefault() error {
@@ -50,6 +144,28 @@ func (options *Options) SetZeroToDefault() error {
 	if options.MaxPingTimeout <= 0 {
 		options.MaxPingTimeout = 30 * time.Second
 	}
+	if options.ResumptionTicketTTL == 0 {
+		options.ResumptionTicketTTL = time.Hour
+	}
+	options.SizeLimits.SetZerosToDefaults()
+	if len(options.Compressions) == 0 {
+		options.Compressions = protocol.DefaultCapabilities().Compressions
+	}
+	for _, compression := range options.Compressions {
+		if err := protocol.ValidateCompression(compression); err != nil {
+			return err
+		}
+	}
+	if options.CompressionThreshold <= 0 {
+		options.CompressionThreshold = 256
+	}
+	switch options.Handshake {
+	case "":
+		options.Handshake = HandshakeECIES
+	case HandshakeECIES, HandshakeNoiseXX:
+	default:
+		return fmt.Errorf("unsupported handshake protocol %q", options.Handshake)
+	}
 
 	return nil
 }
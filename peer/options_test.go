@@ -8,6 +8,8 @@ import (
 	. "github.com/onsi/gomega"
 	. "github.com/renproject/aw/peer"
 	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/protocol"
 )
 
 var _ = Describe("options", func() {
@@ -26,6 +28,25 @@ var _ = Describe("options", func() {
 			Expect(option.NumWorkers).Should(Equal(2 * runtime.NumCPU()))
 			Expect(option.Alpha).Should(Equal(24))
 			Expect(option.BootstrapDuration).Should(Equal(time.Hour))
+			Expect(option.Handshake).Should(Equal(HandshakeECIES))
+			Expect(option.SizeLimits).Should(Equal(protocol.DefaultSizeLimits()))
+			Expect(option.Compressions).Should(Equal(protocol.DefaultCapabilities().Compressions))
+		})
+
+		It("should return an error if a compression is not supported", func() {
+			option := Options{
+				Me:           RandomAddress(),
+				Compressions: []protocol.Compression{protocol.Snappy, protocol.Compression(9)},
+			}
+			Expect(option.SetZeroToDefault()).To(HaveOccurred())
+		})
+
+		It("should return an error if the handshake protocol is not supported", func() {
+			option := Options{
+				Me:        RandomAddress(),
+				Handshake: HandshakeProtocol("unknown"),
+			}
+			Expect(option.SetZeroToDefault()).To(HaveOccurred())
 		})
 	})
 })
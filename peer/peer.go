@@ -3,7 +3,9 @@ package peer
 import (
 	"context"
 	"fmt"
+	"io"
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/renproject/aw/broadcast"
@@ -13,6 +15,10 @@ import (
 	"github.com/renproject/aw/multicast"
 	"github.com/renproject/aw/pingpong"
 	"github.com/renproject/aw/protocol"
+	"github.com/renproject/aw/pubsub"
+	"github.com/renproject/aw/rbc"
+	"github.com/renproject/aw/rpc"
+	"github.com/renproject/aw/stream"
 	"github.com/renproject/aw/tcp"
 	"github.com/renproject/kv"
 	"github.com/sirupsen/logrus"
@@ -25,9 +31,33 @@ type Peer interface {
 
 	Cast(context.Context, protocol.PeerID, protocol.MessageBody) error
 
+	SendStream(context.Context, protocol.PeerID, io.Reader) error
+
+	Request(context.Context, protocol.PeerID, protocol.MessageBody) (protocol.MessageBody, error)
+
+	HandleRequests(rpc.Handler)
+
+	HandleVariant(protocol.MessageVariant, Handler) error
+
+	Network() Network
+
 	Multicast(context.Context, protocol.GroupID, protocol.MessageBody) error
 
+	ReliableMulticast(context.Context, protocol.GroupID, protocol.MessageBody) (multicast.DeliveryReport, error)
+
 	Broadcast(context.Context, protocol.GroupID, protocol.MessageBody) error
+
+	BroadcastWithMode(context.Context, protocol.GroupID, protocol.MessageBody, broadcast.Mode) error
+
+	SetBroadcastMode(protocol.GroupID, broadcast.Mode) error
+
+	ReliableBroadcast(context.Context, protocol.GroupID, uint64, protocol.MessageBody) error
+
+	Subscribe(context.Context, string) (*pubsub.Subscription, error)
+
+	Publish(context.Context, string, protocol.MessageBody) error
+
+	ValidateTopic(string, pubsub.Validator) error
 }
 
 type peer struct {
@@ -49,6 +79,15 @@ type peer struct {
 	pingPonger  pingpong.PingPonger
 	multicaster multicast.Multicaster
 	broadcaster broadcast.Broadcaster
+	reliable    rbc.ReliableBroadcaster
+	streamer    stream.Streamer
+	requester   rpc.Requester
+	pubsub      pubsub.PubSub
+
+	// handlers of each message variant
+	network    Network
+	handlersMu *sync.RWMutex
+	handlers   map[protocol.MessageVariant]Handler
 }
 
 func New(options Options, logger logrus.FieldLogger, codec protocol.PeerAddressCodec, dht dht.DHT, handshaker handshake.Handshaker, client protocol.Client, server protocol.Server, events protocol.EventSender) Peer {
@@ -64,12 +103,38 @@ func New(options Options, logger logrus.FieldLogger, codec protocol.PeerAddressC
 		NumWorkers: options.NumWorkers,
 		Alpha:      options.Alpha,
 	}
-	caster := cast.NewCaster(logger, clientMessages, events, dht)
+	caster := cast.NewCasterWithOptions(cast.Options{Logger: logger, WaitForResults: true}, clientMessages, events, dht)
 	pingponger := pingpong.NewPingPonger(pingpongOption, dht, clientMessages, events, codec)
-	multicaster := multicast.NewMulticaster(logger, options.NumWorkers, clientMessages, events, dht)
-	broadcaster := broadcast.NewBroadcaster(logger, options.NumWorkers, clientMessages, events, dht)
-
-	return &peer{
+	multicaster := multicast.NewMulticasterWithOptions(multicast.Options{
+		Logger:         logger,
+		NumWorkers:     options.NumWorkers,
+		SeenCache:      options.MulticastSeenCache,
+		RetryInterval:  options.MulticastRetryInterval,
+		WaitForResults: true,
+	}, clientMessages, events, dht)
+	var strategy broadcast.Strategy
+	switch options.BroadcastStrategy {
+	case BroadcastGossip:
+		strategy = broadcast.NewGossipStrategy(options.Gossip, logger, clientMessages, dht)
+	case BroadcastPlumtree:
+		strategy = broadcast.NewPlumtreeStrategy(options.Plumtree, logger, clientMessages, dht)
+	default:
+		strategy = broadcast.NewFloodStrategy(dht)
+	}
+	broadcaster := broadcast.NewBroadcasterWithOptions(broadcast.Options{
+		Logger:         logger,
+		NumWorkers:     options.NumWorkers,
+		SeenCache:      options.BroadcastSeenCache,
+		Strategy:       strategy,
+		Mode:           options.BroadcastMode,
+		WaitForResults: true,
+	}, clientMessages, events, dht)
+	reliable := rbc.NewReliableBroadcaster(rbc.Options{Logger: logger, NumWorkers: options.NumWorkers}, clientMessages, events, dht)
+	streamer := stream.NewStreamer(stream.Options{Logger: logger, SizeLimits: options.SizeLimits}, clientMessages, events, dht)
+	requester := rpc.NewRequester(rpc.Options{Logger: logger}, clientMessages, dht)
+	pubsub := pubsub.NewPubSub(pubsub.Options{Logger: logger, NumWorkers: options.NumWorkers}, clientMessages, dht)
+
+	peer := &peer{
 		logger:         logger,
 		options:        options,
 		dht:            dht,
@@ -83,7 +148,22 @@ func New(options Options, logger logrus.FieldLogger, codec protocol.PeerAddressC
 		pingPonger:     pingponger,
 		multicaster:    multicaster,
 		broadcaster:    broadcaster,
+		reliable:       reliable,
+		streamer:       streamer,
+		requester:      requester,
+		pubsub:         pubsub,
+
+		network: Network{
+			Logger:   logger,
+			DHT:      dht,
+			Messages: clientMessages,
+			Events:   events,
+		},
+		handlersMu: new(sync.RWMutex),
+		handlers:   map[protocol.MessageVariant]Handler{},
 	}
+	peer.handleBuiltInVariants()
+	return peer
 }
 
 func NewTCP(options Options, logger logrus.FieldLogger, codec protocol.PeerAddressCodec, events protocol.EventSender, signVerifier protocol.SignVerifier, poolOptions tcp.ConnPoolOptions, serverOptions tcp.ServerOptions) Peer {
@@ -95,18 +175,72 @@ func NewTCP(options Options, logger logrus.FieldLogger, codec protocol.PeerAddre
 	if err != nil {
 		panic(fmt.Errorf("pre-condition violation: fail to initialize dht, err = %v", err))
 	}
-	handshaker := handshake.New(signVerifier, handshake.NewGCMSessionManager())
+	capabilities := protocol.DefaultCapabilities()
+	capabilities.Compressions = options.Compressions
+	handshakeOptions := handshake.Options{
+		Capabilities:         capabilities,
+		Authorizer:           options.Authorizer,
+		SizeLimits:           options.SizeLimits,
+		CompressionThreshold: options.CompressionThreshold,
+	}
+	if options.ResumptionTicketTTL > 0 {
+		handshakeOptions.Tickets = handshake.NewTicketStore(options.ResumptionTicketTTL)
+	}
+	var handshaker handshake.Handshaker
+	switch options.Handshake {
+	case HandshakeNoiseXX:
+		handshaker = handshake.NewNoiseWithOptions(signVerifier, handshakeOptions)
+	default:
+		handshaker = handshake.NewWithOptions(signVerifier, handshakeOptions, handshake.NewSessionManagers()...)
+	}
+	replies := make(chan protocol.MessageOnTheWire, options.Capacity)
+	poolOptions.Replies = replies
+	if poolOptions.Me == nil {
+		poolOptions.Me = options.Me.PeerID()
+	}
 	connPool := tcp.NewConnPool(poolOptions, logger, handshaker)
-	client := tcp.NewClient(logger, connPool)
-	server := tcp.NewServer(serverOptions, logger, handshaker)
+	client := tcp.NewClientWithOptions(tcp.ClientOptions{RetryPolicy: options.RetryPolicy, CircuitBreaker: options.CircuitBreaker}, logger, connPool)
+	serverOptions.SizeLimits = options.SizeLimits
+	server := replyServer{
+		Server:  tcp.NewServerWithConnPool(serverOptions, logger, handshaker, events, connPool),
+		replies: replies,
+	}
 	return New(options, logger, codec, dht, handshaker, client, server, events)
 }
 
+// replyServer runs a protocol.Server, and also forwards the messages that
+// remote peers write back through the sessions of outgoing connections, so
+// that they are handled in the same way as incoming messages.
+type replyServer struct {
+	protocol.Server
+	replies protocol.MessageReceiver
+}
+
+func (server replyServer) Run(ctx context.Context, messages protocol.MessageSender) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case messageOtw := <-server.replies:
+				select {
+				case <-ctx.Done():
+					return
+				case messages <- messageOtw:
+				}
+			}
+		}
+	}()
+	server.Server.Run(ctx, messages)
+}
+
 func (peer *peer) Run(ctx context.Context) {
 	// Start both the client and server before bootstrapping
 	go peer.client.Run(ctx, peer.clientMessages)
 	go peer.server.Run(ctx, peer.serverMessages)
 	go peer.handleMessage(ctx)
+	go peer.broadcaster.Run(ctx)
+	go peer.pubsub.Run(ctx)
 
 	// Start bootstrapping
 	peer.bootstrap(ctx)
@@ -176,14 +310,54 @@ func (peer *peer) Cast(ctx context.Context, to protocol.PeerID, data protocol.Me
 	return peer.caster.Cast(ctx, to, data)
 }
 
+func (peer *peer) SendStream(ctx context.Context, to protocol.PeerID, r io.Reader) error {
+	return peer.streamer.SendStream(ctx, to, r)
+}
+
+func (peer *peer) Request(ctx context.Context, to protocol.PeerID, body protocol.MessageBody) (protocol.MessageBody, error) {
+	return peer.requester.Request(ctx, to, body)
+}
+
+func (peer *peer) HandleRequests(handler rpc.Handler) {
+	peer.requester.Handle(handler)
+}
+
 func (peer *peer) Multicast(ctx context.Context, groupID protocol.GroupID, data protocol.MessageBody) error {
 	return peer.multicaster.Multicast(ctx, groupID, data)
 }
 
+func (peer *peer) ReliableMulticast(ctx context.Context, groupID protocol.GroupID, data protocol.MessageBody) (multicast.DeliveryReport, error) {
+	return peer.multicaster.ReliableMulticast(ctx, groupID, data)
+}
+
 func (peer *peer) Broadcast(ctx context.Context, groupID protocol.GroupID, data protocol.MessageBody) error {
 	return peer.broadcaster.Broadcast(ctx, groupID, data)
 }
 
+func (peer *peer) BroadcastWithMode(ctx context.Context, groupID protocol.GroupID, data protocol.MessageBody, mode broadcast.Mode) error {
+	return peer.broadcaster.BroadcastWithMode(ctx, groupID, data, mode)
+}
+
+func (peer *peer) SetBroadcastMode(groupID protocol.GroupID, mode broadcast.Mode) error {
+	return peer.broadcaster.SetMode(groupID, mode)
+}
+
+func (peer *peer) ReliableBroadcast(ctx context.Context, groupID protocol.GroupID, sequence uint64, data protocol.MessageBody) error {
+	return peer.reliable.Broadcast(ctx, groupID, sequence, data)
+}
+
+func (peer *peer) Subscribe(ctx context.Context, topic string) (*pubsub.Subscription, error) {
+	return peer.pubsub.Subscribe(ctx, topic)
+}
+
+func (peer *peer) Publish(ctx context.Context, topic string, body protocol.MessageBody) error {
+	return peer.pubsub.Publish(ctx, topic, body)
+}
+
+func (peer *peer) ValidateTopic(topic string, validator pubsub.Validator) error {
+	return peer.pubsub.Validate(topic, validator)
+}
+
 func (peer *peer) bootstrap(ctx context.Context) {
 	if peer.options.DisablePeerDiscovery {
 		return
@@ -244,18 +418,11 @@ func (peer *peer) handleMessage(ctx context.Context) {
 }
 
 func (peer *peer) receiveMessageOnTheWire(ctx context.Context, messageOtw protocol.MessageOnTheWire) error {
-	switch messageOtw.Message.Variant {
-	case protocol.Ping:
-		return peer.pingPonger.AcceptPing(ctx, messageOtw.Message)
-	case protocol.Pong:
-		return peer.pingPonger.AcceptPong(ctx, messageOtw.Message)
-	case protocol.Broadcast:
-		return peer.broadcaster.AcceptBroadcast(ctx, messageOtw.From, messageOtw.Message)
-	case protocol.Multicast:
-		return peer.multicaster.AcceptMulticast(ctx, messageOtw.From, messageOtw.Message)
-	case protocol.Cast:
-		return peer.caster.AcceptCast(ctx, messageOtw.From, messageOtw.Message)
-	default:
+	peer.handlersMu.RLock()
+	handler, ok := peer.handlers[messageOtw.Message.Variant]
+	peer.handlersMu.RUnlock()
+	if !ok {
 		return protocol.NewErrMessageVariantIsNotSupported(messageOtw.Message.Variant)
 	}
+	return handler(ctx, peer.network, messageOtw)
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"testing/quick"
 	"time"
@@ -14,6 +15,8 @@ import (
 
 	"github.com/renproject/aw/peer"
 	"github.com/renproject/aw/protocol"
+	"github.com/renproject/aw/pubsub"
+	"github.com/renproject/aw/tcp"
 	"github.com/renproject/phi"
 	"github.com/sirupsen/logrus"
 )
@@ -71,6 +74,114 @@ var _ = Describe("Peer", func() {
 		return true
 	}
 
+	streamTest := func(ctx context.Context, peers []peer.Peer, events []chan protocol.Event) {
+		streamCtx, streamCancel := context.WithTimeout(ctx, 30*time.Second)
+		defer streamCancel()
+
+		sender, receiver := RandomSenderAndReceiver(len(peers))
+		payload := RandomBytes(1 + rand.Intn(4*1024*1024))
+		errs := make(chan error, 1)
+		go func() {
+			errs <- peers[sender].SendStream(streamCtx, peers[receiver].Me().PeerID(), bytes.NewReader(payload))
+		}()
+
+		stream, ok := ReadStream(streamCtx, events[receiver])
+		Expect(ok).Should(BeTrue())
+		Expect(stream.From.Equal(peers[sender].Me().PeerID())).Should(BeTrue())
+		data, err := ioutil.ReadAll(stream.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Equal(data, payload)).Should(BeTrue())
+		Expect(<-errs).NotTo(HaveOccurred())
+	}
+
+	requestTest := func(ctx context.Context, peers []peer.Peer) {
+		requestCtx, requestCancel := context.WithTimeout(ctx, 10*time.Second)
+		defer requestCancel()
+
+		sender, receiver := RandomSenderAndReceiver(len(peers))
+		messageBody := RandomMessageBody()
+		response, err := peers[sender].Request(requestCtx, peers[receiver].Me().PeerID(), messageBody)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Equal(response, append(messageBody, []byte(peers[receiver].Me().PeerID().String())...))).Should(BeTrue())
+	}
+
+	pubsubTest := func(ctx context.Context, peers []peer.Peer, subscriptions []*pubsub.Subscription) {
+		pubsubCtx, pubsubCancel := context.WithTimeout(ctx, 10*time.Second)
+		defer pubsubCancel()
+
+		sender := rand.Intn(len(peers))
+		messageBody := RandomMessageBody()
+		Expect(peers[sender].Publish(pubsubCtx, "topic", messageBody)).Should(Succeed())
+		for i := range subscriptions {
+			if subscriptions[i] == nil {
+				continue
+			}
+			select {
+			case <-pubsubCtx.Done():
+				Fail("cannot receive published message")
+			case message := <-subscriptions[i].Messages():
+				Expect(message.Topic).Should(Equal("topic"))
+				Expect(bytes.Equal(message.Body, messageBody)).Should(BeTrue())
+			}
+		}
+	}
+
+	reliableTest := func(ctx context.Context, peers []peer.Peer, events []chan protocol.Event, groupID protocol.GroupID, sequence uint64) {
+		reliableCtx, reliableCancel := context.WithTimeout(ctx, 10*time.Second)
+		defer reliableCancel()
+
+		sender := rand.Intn(len(peers))
+		messageBody := RandomMessageBody()
+		Expect(peers[sender].ReliableBroadcast(reliableCtx, groupID, sequence, messageBody)).Should(Succeed())
+		for i := range peers {
+			event, ok := ReadReliable(reliableCtx, events[i])
+			Expect(ok).Should(BeTrue())
+			Expect(event.Origin.Equal(peers[sender].Me().PeerID())).Should(BeTrue())
+			Expect(event.Sequence).Should(Equal(sequence))
+			Expect(bytes.Equal(event.Message, messageBody)).Should(BeTrue())
+		}
+	}
+
+	reliableMulticastTest := func(ctx context.Context, peers []peer.Peer, events []chan protocol.Event, groupID protocol.GroupID) {
+		multicastCtx, multicastCancel := context.WithTimeout(ctx, 10*time.Second)
+		defer multicastCancel()
+
+		sender := rand.Intn(len(peers))
+		messageBody := RandomMessageBody()
+		report, err := peers[sender].ReliableMulticast(multicastCtx, groupID, messageBody)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Delivered).Should(HaveLen(len(peers)))
+		Expect(report.Undelivered).Should(BeEmpty())
+		for i := range peers {
+			message, ok := ReadChannel(multicastCtx, events[i])
+			Expect(ok).Should(BeTrue())
+			Expect(message.From.Equal(peers[sender].Me().PeerID())).Should(BeTrue())
+			Expect(bytes.Equal(message.Message, messageBody)).Should(BeTrue())
+		}
+	}
+
+	variantTest := func(ctx context.Context, peers []peer.Peer, events []chan protocol.Event) {
+		variantCtx, variantCancel := context.WithTimeout(ctx, 10*time.Second)
+		defer variantCancel()
+
+		sender, receiver := RandomSenderAndReceiver(len(peers))
+		messageBody := RandomMessageBody()
+		messageOtw := protocol.MessageOnTheWire{
+			To:      peers[receiver].Me(),
+			Message: protocol.NewMessage(protocol.V1, echoVariant, protocol.NilGroupID, messageBody),
+		}
+		select {
+		case <-variantCtx.Done():
+			Fail("cannot send echo message")
+		case peers[sender].Network().Messages <- messageOtw:
+		}
+
+		message, ok := ReadChannel(variantCtx, events[receiver])
+		Expect(ok).Should(BeTrue())
+		Expect(message.From.Equal(peers[sender].Me().PeerID())).Should(BeTrue())
+		Expect(bytes.Equal(message.Message, messageBody)).Should(BeTrue())
+	}
+
 	Context("single group network", func() {
 		networkOption := []struct {
 			B int // num of bootstrap nodes
@@ -122,6 +233,17 @@ var _ = Describe("Peer", func() {
 					}
 					Expect(quick.Check(cast, nil)).NotTo(HaveOccurred())
 
+					// Expect custom variants are working as expected.
+					logrus.Print("Testing custom variants...")
+					for i := range peers {
+						Expect(peers[i].HandleVariant(echoVariant, handleEcho)).Should(Succeed())
+					}
+					variant := func() bool {
+						variantTest(ctx, peers, events)
+						return true
+					}
+					Expect(quick.Check(variant, nil)).NotTo(HaveOccurred())
+
 					// Expect multicast is working as expected
 					logrus.Print("Testing multicast messages...")
 					multicast := func() bool {
@@ -145,8 +267,142 @@ var _ = Describe("Peer", func() {
 						return broadcastTest(ctx, peers, events, message)
 					}
 					Expect(quick.Check(broadcast, nil)).NotTo(HaveOccurred())
+
+					// Expect requests are working as expected
+					logrus.Print("Testing requests...")
+					for i := range peers {
+						id := peers[i].Me().PeerID().String()
+						peers[i].HandleRequests(func(_ context.Context, _ protocol.PeerID, body protocol.MessageBody) (protocol.MessageBody, error) {
+							return append(body, []byte(id)...), nil
+						})
+					}
+					request := func() bool {
+						requestTest(ctx, peers)
+						return true
+					}
+					Expect(quick.Check(request, nil)).NotTo(HaveOccurred())
+
+					// Expect publish/subscribe is working as expected
+					logrus.Print("Testing publish/subscribe...")
+					subscriptions := make([]*pubsub.Subscription, len(peers))
+					for i := range peers {
+						if i%2 == 0 {
+							continue
+						}
+						subscription, err := peers[i].Subscribe(ctx, "topic")
+						Expect(err).NotTo(HaveOccurred())
+						defer subscription.Unsubscribe()
+						subscriptions[i] = subscription
+					}
+					time.Sleep(time.Second)
+					publish := func() bool {
+						pubsubTest(ctx, peers, subscriptions)
+						return true
+					}
+					Expect(quick.Check(publish, nil)).NotTo(HaveOccurred())
+
+					// Expect reliable broadcast is working as expected
+					logrus.Print("Testing reliable broadcast...")
+					groupID := RandomGroupID()
+					group := make(protocol.PeerIDs, 7)
+					for i := range group {
+						group[i] = peers[i].Me().PeerID()
+					}
+					for i := range group {
+						Expect(peers[i].AddGroup(groupID, group)).Should(Succeed())
+					}
+					for sequence := uint64(0); sequence < 5; sequence++ {
+						reliableTest(ctx, peers[:len(group)], events[:len(group)], groupID, sequence)
+					}
+
+					// Expect reliable multicast is working as expected
+					logrus.Print("Testing reliable multicast...")
+					for i := 0; i < 5; i++ {
+						reliableMulticastTest(ctx, peers[:len(group)], events[:len(group)], groupID)
+					}
+
+					// Expect streaming is working as expected
+					logrus.Print("Testing streams...")
+					for i := 0; i < 5; i++ {
+						streamTest(ctx, peers, events)
+					}
 				})
 			})
 		}
 	})
+
+	Context("when a peer cannot be dialed", func() {
+		// undialablePeers returns two peers with the default options. The first
+		// peer advertises an address at which nothing is listening, like a peer
+		// behind a NAT. The second peer only knows the address of the first
+		// peer if known is true.
+		undialablePeers := func(ctx context.Context, port int, known bool) ([]peer.Peer, []chan protocol.Event, []protocol.PeerAddress) {
+			signVerifiers := NewSignVerifiers(2)
+			addrs := []protocol.PeerAddress{
+				NewSimpleTCPPeerAddress(signVerifiers[0].ID(), "127.0.0.1", fmt.Sprintf("%v", port)),
+				NewSimpleTCPPeerAddress(signVerifiers[1].ID(), "127.0.0.1", fmt.Sprintf("%v", port+2)),
+			}
+			hosts := []string{fmt.Sprintf(":%v", port+1), fmt.Sprintf(":%v", port+2)}
+			peers := make([]peer.Peer, 2)
+			events := make([]chan protocol.Event, 2)
+			for i := range peers {
+				events[i] = make(chan protocol.Event, 16)
+				options := peer.Options{Me: addrs[i]}
+				serverOptions := tcp.ServerOptions{Host: hosts[i], RateLimit: -1}
+				peers[i] = peer.NewTCP(options, logrus.New(), SimpleTCPPeerAddressCodec{}, events[i], signVerifiers[i], tcp.ConnPoolOptions{}, serverOptions)
+				if i == 0 || known {
+					Expect(peers[i].AddPeerAddress(addrs[1-i])).Should(Succeed())
+				}
+				go peers[i].Run(ctx)
+			}
+			time.Sleep(100 * time.Millisecond)
+			return peers, events, addrs
+		}
+
+		It("should reply through the connection that the peer has dialed", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer func() {
+				cancel()
+				time.Sleep(2 * time.Second)
+			}()
+			peers, events, addrs := undialablePeers(ctx, 18100, true)
+
+			for i := 0; i < 5; i++ {
+				messageBody := RandomMessageBody()
+				Expect(peers[0].Cast(ctx, addrs[1].PeerID(), messageBody)).Should(Succeed())
+				message, ok := ReadChannel(ctx, events[1])
+				Expect(ok).Should(BeTrue())
+				Expect(bytes.Equal(message.Message, messageBody)).Should(BeTrue())
+
+				reply := RandomMessageBody()
+				Expect(peers[1].Cast(ctx, addrs[0].PeerID(), reply)).Should(Succeed())
+				message, ok = ReadChannel(ctx, events[0])
+				Expect(ok).Should(BeTrue())
+				Expect(message.From.Equal(addrs[1].PeerID())).Should(BeTrue())
+				Expect(bytes.Equal(message.Message, reply)).Should(BeTrue())
+			}
+		})
+
+		It("should respond to requests through the session that they were read from", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer func() {
+				cancel()
+				time.Sleep(2 * time.Second)
+			}()
+
+			// The second peer does not know the address of the first peer, so
+			// responses can only be written back through the session.
+			peers, _, addrs := undialablePeers(ctx, 18110, false)
+			peers[1].HandleRequests(func(ctx context.Context, from protocol.PeerID, body protocol.MessageBody) (protocol.MessageBody, error) {
+				return append(body, body...), nil
+			})
+
+			for i := 0; i < 5; i++ {
+				body := RandomMessageBody()
+				response, err := peers[0].Request(ctx, addrs[1].PeerID(), body)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(bytes.Equal(response, append(body, body...))).Should(BeTrue())
+			}
+		})
+	})
 })
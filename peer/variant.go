@@ -0,0 +1,133 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// A Network gives the Handler of a MessageVariant access to the Peer that
+// received the message.
+type Network struct {
+	Logger logrus.FieldLogger
+	DHT    dht.DHT
+
+	// Messages are sent to the PeerAddress in their To field.
+	Messages protocol.MessageSender
+
+	// Events are sent to the application.
+	Events protocol.EventSender
+}
+
+// A Handler accepts the messages of a MessageVariant that are received by a
+// Peer. Handlers are called one message at a time, so they should not block.
+type Handler func(ctx context.Context, network Network, messageOtw protocol.MessageOnTheWire) error
+
+// HandleVariant registers the Handler for messages of the variant. The variant
+// must have been registered with protocol.RegisterMessageVariant, and each
+// variant can only have one Handler. The built-in variants are handled using
+// the same mechanism.
+func (peer *peer) HandleVariant(variant protocol.MessageVariant, handler Handler) error {
+	if err := protocol.ValidateMessageVariant(variant); err != nil {
+		return err
+	}
+	if handler == nil {
+		return fmt.Errorf("error handling message variant=%v: nil handler", variant)
+	}
+
+	peer.handlersMu.Lock()
+	defer peer.handlersMu.Unlock()
+
+	if _, ok := peer.handlers[variant]; ok {
+		return NewErrMessageVariantIsAlreadyHandled(variant)
+	}
+	peer.handlers[variant] = handler
+	return nil
+}
+
+// Network returns the Network that is given to Handlers, so that applications
+// can send messages of their own variants.
+func (peer *peer) Network() Network {
+	return peer.network
+}
+
+// handleBuiltInVariants registers the Handlers of the built-in variants.
+func (peer *peer) handleBuiltInVariants() {
+	handlers := map[protocol.MessageVariant]Handler{
+		protocol.Ping: func(ctx context.Context, _ Network, messageOtw protocol.MessageOnTheWire) error {
+			return peer.pingPonger.AcceptPing(ctx, messageOtw.Message)
+		},
+		protocol.Pong: func(ctx context.Context, _ Network, messageOtw protocol.MessageOnTheWire) error {
+			return peer.pingPonger.AcceptPong(ctx, messageOtw.Message)
+		},
+		protocol.Broadcast: func(ctx context.Context, _ Network, messageOtw protocol.MessageOnTheWire) error {
+			return peer.broadcaster.AcceptBroadcast(ctx, messageOtw.From, messageOtw.Message)
+		},
+		protocol.Gossip: func(ctx context.Context, _ Network, messageOtw protocol.MessageOnTheWire) error {
+			return peer.broadcaster.AcceptControl(ctx, messageOtw.From, messageOtw.Message)
+		},
+		protocol.IHave: func(ctx context.Context, _ Network, messageOtw protocol.MessageOnTheWire) error {
+			return peer.broadcaster.AcceptControl(ctx, messageOtw.From, messageOtw.Message)
+		},
+		protocol.Graft: func(ctx context.Context, _ Network, messageOtw protocol.MessageOnTheWire) error {
+			return peer.broadcaster.AcceptControl(ctx, messageOtw.From, messageOtw.Message)
+		},
+		protocol.Prune: func(ctx context.Context, _ Network, messageOtw protocol.MessageOnTheWire) error {
+			return peer.broadcaster.AcceptControl(ctx, messageOtw.From, messageOtw.Message)
+		},
+		protocol.Have: func(ctx context.Context, _ Network, messageOtw protocol.MessageOnTheWire) error {
+			return peer.broadcaster.AcceptControl(ctx, messageOtw.From, messageOtw.Message)
+		},
+		protocol.Want: func(ctx context.Context, _ Network, messageOtw protocol.MessageOnTheWire) error {
+			return peer.broadcaster.AcceptControl(ctx, messageOtw.From, messageOtw.Message)
+		},
+		protocol.Reliable: func(ctx context.Context, _ Network, messageOtw protocol.MessageOnTheWire) error {
+			return peer.reliable.AcceptReliable(ctx, messageOtw.From, messageOtw.Message)
+		},
+		protocol.Multicast: func(ctx context.Context, _ Network, messageOtw protocol.MessageOnTheWire) error {
+			return peer.multicaster.AcceptMulticast(ctx, messageOtw.From, messageOtw.Message)
+		},
+		protocol.Ack: func(ctx context.Context, _ Network, messageOtw protocol.MessageOnTheWire) error {
+			return peer.multicaster.AcceptAck(ctx, messageOtw.From, messageOtw.Message)
+		},
+		protocol.Cast: func(ctx context.Context, _ Network, messageOtw protocol.MessageOnTheWire) error {
+			return peer.caster.AcceptCast(ctx, messageOtw.From, messageOtw.Message)
+		},
+		protocol.Stream: func(ctx context.Context, _ Network, messageOtw protocol.MessageOnTheWire) error {
+			return peer.streamer.AcceptStream(ctx, messageOtw.From, messageOtw.Message)
+		},
+		protocol.Request: func(ctx context.Context, _ Network, messageOtw protocol.MessageOnTheWire) error {
+			return peer.requester.AcceptRequest(ctx, messageOtw.From, messageOtw.Message, messageOtw.Reply)
+		},
+		protocol.Response: func(ctx context.Context, _ Network, messageOtw protocol.MessageOnTheWire) error {
+			return peer.requester.AcceptResponse(ctx, messageOtw.From, messageOtw.Message)
+		},
+		protocol.Publish: func(ctx context.Context, _ Network, messageOtw protocol.MessageOnTheWire) error {
+			return peer.pubsub.AcceptPublish(ctx, messageOtw.From, messageOtw.Message)
+		},
+	}
+	for variant, handler := range handlers {
+		if err := peer.HandleVariant(variant, handler); err != nil {
+			panic(fmt.Errorf("invariant violation: cannot handle built-in variant=%v: %v", variant, err))
+		}
+	}
+}
+
+// ErrMessageVariantIsAlreadyHandled is returned when a Handler is registered
+// for a MessageVariant that already has one.
+type ErrMessageVariantIsAlreadyHandled struct {
+	error
+	Variant protocol.MessageVariant
+}
+
+// NewErrMessageVariantIsAlreadyHandled creates a new error which is returned
+// when the given message variant already has a Handler.
+func NewErrMessageVariantIsAlreadyHandled(variant protocol.MessageVariant) error {
+	return ErrMessageVariantIsAlreadyHandled{
+		error:   fmt.Errorf("message variant=%v is already handled", variant),
+		Variant: variant,
+	}
+}
@@ -0,0 +1,75 @@
+package peer_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/peer"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/aw/tcp"
+	"github.com/sirupsen/logrus"
+)
+
+// echoVariant is a custom variant used to test the variant registry. Peers
+// emit an event for each echo message that they receive.
+const echoVariant = protocol.MessageVariant(0x7A01)
+
+func init() {
+	if err := protocol.RegisterMessageVariant(protocol.VariantDefinition{Variant: echoVariant, Name: "echo"}); err != nil {
+		panic(err)
+	}
+}
+
+func handleEcho(ctx context.Context, network Network, messageOtw protocol.MessageOnTheWire) error {
+	event := protocol.EventMessageReceived{
+		Message: messageOtw.Message.Body,
+		From:    messageOtw.From,
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case network.Events <- event:
+		return nil
+	}
+}
+
+var _ = Describe("Variants", func() {
+	newPeer := func() Peer {
+		signVerifier := NewMockSignVerifier()
+		options := Options{Me: NewSimpleTCPPeerAddress(signVerifier.ID(), "127.0.0.1", "18000")}
+		events := make(chan protocol.Event, 1)
+		return NewTCP(options, logrus.New(), SimpleTCPPeerAddressCodec{}, events, signVerifier, tcp.ConnPoolOptions{}, tcp.ServerOptions{})
+	}
+
+	Context("when handling a registered variant", func() {
+		It("should only accept one handler", func() {
+			peer := newPeer()
+			Expect(peer.HandleVariant(echoVariant, handleEcho)).Should(Succeed())
+			Expect(peer.HandleVariant(echoVariant, handleEcho)).Should(BeAssignableToTypeOf(ErrMessageVariantIsAlreadyHandled{}))
+		})
+
+		It("should not accept a nil handler", func() {
+			peer := newPeer()
+			Expect(peer.HandleVariant(echoVariant, nil)).ShouldNot(Succeed())
+		})
+	})
+
+	Context("when handling a built-in variant", func() {
+		It("should return an error", func() {
+			peer := newPeer()
+			for _, variant := range []protocol.MessageVariant{protocol.Ping, protocol.Pong, protocol.Cast, protocol.Multicast, protocol.Broadcast} {
+				Expect(peer.HandleVariant(variant, handleEcho)).Should(BeAssignableToTypeOf(ErrMessageVariantIsAlreadyHandled{}))
+			}
+		})
+	})
+
+	Context("when handling an unregistered variant", func() {
+		It("should return an error", func() {
+			peer := newPeer()
+			Expect(peer.HandleVariant(InvalidMessageVariant(), handleEcho)).Should(BeAssignableToTypeOf(protocol.ErrMessageVariantIsNotSupported{}))
+		})
+	})
+})
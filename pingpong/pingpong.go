@@ -66,8 +66,8 @@ func (pp *pingPonger) Ping(ctx context.Context, to protocol.PeerID) error {
 
 func (pp *pingPonger) AcceptPing(ctx context.Context, message protocol.Message) error {
 	// Pre-condition checks
-	if message.Version != protocol.V1 {
-		return protocol.NewErrMessageVersionIsNotSupported(message.Version)
+	if err := protocol.ValidateMessageVersion(message.Version); err != nil {
+		return err
 	}
 	if message.Variant != protocol.Ping {
 		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
@@ -101,8 +101,8 @@ func (pp *pingPonger) AcceptPing(ctx context.Context, message protocol.Message)
 
 func (pp *pingPonger) AcceptPong(ctx context.Context, message protocol.Message) error {
 	// Pre-condition checks
-	if message.Version != protocol.V1 {
-		return protocol.NewErrMessageVersionIsNotSupported(message.Version)
+	if err := protocol.ValidateMessageVersion(message.Version); err != nil {
+		return err
 	}
 	if message.Variant != protocol.Pong {
 		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
@@ -54,7 +54,7 @@ func (id GroupID) Equal(another GroupID) bool {
 // ValidateGroupID checks if the GroupID is valid under the given message
 // variant
 func ValidateGroupID(groupID GroupID, variant MessageVariant) error {
-	if variant != Broadcast && variant != Multicast {
+	if !variant.HasGroupID() {
 		if groupID != NilGroupID {
 			return ErrInvalidGroupID
 		}
@@ -24,6 +24,7 @@ var _ = Describe("PeerAddress", func() {
 				Expect(ValidateGroupID(RandomGroupID(), Cast)).NotTo(BeNil())
 				Expect(ValidateGroupID(RandomGroupID(), Multicast)).To(BeNil())
 				Expect(ValidateGroupID(RandomGroupID(), Broadcast)).To(BeNil())
+				Expect(ValidateGroupID(RandomGroupID(), Publish)).To(BeNil())
 			})
 		})
 
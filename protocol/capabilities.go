@@ -0,0 +1,168 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Compression identifies the codec that a Session uses to compress message
+// bodies before they are secured.
+type Compression uint8
+
+const (
+	NoCompression = Compression(0) // Message bodies are not compressed
+	Snappy        = Compression(1) // Message bodies are compressed using snappy
+	Zstd          = Compression(2) // Message bodies are compressed using zstd
+)
+
+func (compression Compression) String() string {
+	switch compression {
+	case NoCompression:
+		return "none"
+	case Snappy:
+		return "snappy"
+	case Zstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("compression(%d)", uint8(compression))
+	}
+}
+
+// Capabilities describe everything that a Peer supports. Peers exchange signed
+// Capabilities during the handshake, and use them to agree on a Negotiation.
+// All lists are given in order of preference.
+type Capabilities struct {
+	Versions     []MessageVersion
+	Variants     []MessageVariant
+	AEADs        []AEAD
+	Compressions []Compression
+}
+
+// DefaultCapabilities returns the Capabilities of this implementation: all
+// message versions, all registered message variants and all compressions. No compression
+// is preferred, so compression is only used when a client prefers it. The
+// AEADs are left empty, because they are filled by the Handshaker from its
+// SessionManagers.
+func DefaultCapabilities() Capabilities {
+	return Capabilities{
+		Versions:     []MessageVersion{V2, V1},
+		Variants:     MessageVariants(),
+		AEADs:        []AEAD{},
+		Compressions: []Compression{NoCompression, Snappy, Zstd},
+	}
+}
+
+// MarshalBinary implements the `BinaryMarshaler` interface. Every list is
+// encoded as a uint16 length followed by its elements.
+func (capabilities Capabilities) MarshalBinary() ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	if err := writeList(buffer, len(capabilities.Versions), capabilities.Versions); err != nil {
+		return nil, fmt.Errorf("error marshaling versions: %v", err)
+	}
+	if err := writeList(buffer, len(capabilities.Variants), capabilities.Variants); err != nil {
+		return nil, fmt.Errorf("error marshaling variants: %v", err)
+	}
+	if err := writeList(buffer, len(capabilities.AEADs), capabilities.AEADs); err != nil {
+		return nil, fmt.Errorf("error marshaling aeads: %v", err)
+	}
+	if err := writeList(buffer, len(capabilities.Compressions), capabilities.Compressions); err != nil {
+		return nil, fmt.Errorf("error marshaling compressions: %v", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalBinary implements the `BinaryUnmarshaler` interface. Unknown
+// versions, variants, AEADs and compressions are kept, so that they can be
+// ignored during negotiation.
+func (capabilities *Capabilities) UnmarshalBinary(data []byte) error {
+	reader := bytes.NewReader(data)
+
+	n, err := readListLength(reader)
+	if err != nil {
+		return fmt.Errorf("error unmarshaling versions: %v", err)
+	}
+	capabilities.Versions = make([]MessageVersion, n)
+	if err := binary.Read(reader, binary.LittleEndian, capabilities.Versions); err != nil {
+		return fmt.Errorf("error unmarshaling versions: %v", err)
+	}
+
+	if n, err = readListLength(reader); err != nil {
+		return fmt.Errorf("error unmarshaling variants: %v", err)
+	}
+	capabilities.Variants = make([]MessageVariant, n)
+	if err := binary.Read(reader, binary.LittleEndian, capabilities.Variants); err != nil {
+		return fmt.Errorf("error unmarshaling variants: %v", err)
+	}
+
+	if n, err = readListLength(reader); err != nil {
+		return fmt.Errorf("error unmarshaling aeads: %v", err)
+	}
+	capabilities.AEADs = make([]AEAD, n)
+	if err := binary.Read(reader, binary.LittleEndian, capabilities.AEADs); err != nil {
+		return fmt.Errorf("error unmarshaling aeads: %v", err)
+	}
+
+	if n, err = readListLength(reader); err != nil {
+		return fmt.Errorf("error unmarshaling compressions: %v", err)
+	}
+	capabilities.Compressions = make([]Compression, n)
+	if err := binary.Read(reader, binary.LittleEndian, capabilities.Compressions); err != nil {
+		return fmt.Errorf("error unmarshaling compressions: %v", err)
+	}
+
+	if reader.Len() != 0 {
+		return fmt.Errorf("error unmarshaling capabilities: %v unexpected bytes", reader.Len())
+	}
+	return nil
+}
+
+func writeList(w io.Writer, n int, list interface{}) error {
+	if n > 0xFFFF {
+		return fmt.Errorf("len=%v is too big", n)
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint16(n)); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, list)
+}
+
+func readListLength(r io.Reader) (int, error) {
+	n := uint16(0)
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// Negotiation holds the values that two Peers agreed on during a handshake,
+// based on the Capabilities that they exchanged.
+type Negotiation struct {
+	Version     MessageVersion   // Highest message version supported by both Peers
+	Variants    []MessageVariant // Message variants supported by both Peers
+	AEAD        AEAD
+	Compression Compression
+}
+
+// DefaultNegotiation returns the Negotiation that is assumed by Sessions that
+// are created without a handshake: the first message version, all message
+// variants and no compression.
+func DefaultNegotiation(aead AEAD) Negotiation {
+	return Negotiation{
+		Version:     V1,
+		Variants:    DefaultCapabilities().Variants,
+		AEAD:        aead,
+		Compression: NoCompression,
+	}
+}
+
+// SupportsVariant returns true if both Peers support the message variant.
+func (negotiation Negotiation) SupportsVariant(variant MessageVariant) bool {
+	for _, supported := range negotiation.Variants {
+		if supported == variant {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package protocol_test
+
+import (
+	"math/rand"
+	"testing/quick"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/protocol"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+var _ = Describe("Capabilities", func() {
+	Context("when marshaling and unmarshaling capabilities", func() {
+		It("should get the same capabilities", func() {
+			test := func(versions []uint16, variants []uint16, aeads []uint8, compressions []uint8) bool {
+				capabilities := Capabilities{}
+				for _, version := range versions {
+					capabilities.Versions = append(capabilities.Versions, MessageVersion(version))
+				}
+				for _, variant := range variants {
+					capabilities.Variants = append(capabilities.Variants, MessageVariant(variant))
+				}
+				for _, aead := range aeads {
+					capabilities.AEADs = append(capabilities.AEADs, AEAD(aead))
+				}
+				for _, compression := range compressions {
+					capabilities.Compressions = append(capabilities.Compressions, Compression(compression))
+				}
+
+				data, err := capabilities.MarshalBinary()
+				Expect(err).NotTo(HaveOccurred())
+
+				var newCapabilities Capabilities
+				Expect(newCapabilities.UnmarshalBinary(data)).Should(Succeed())
+				return cmp.Equal(capabilities, newCapabilities, cmpopts.EquateEmpty())
+			}
+
+			Expect(quick.Check(test, nil)).Should(Succeed())
+		})
+
+		It("should return an error when unmarshaling malformed data", func() {
+			data, err := DefaultCapabilities().MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+
+			var capabilities Capabilities
+			Expect(capabilities.UnmarshalBinary(data[:rand.Intn(len(data))])).ShouldNot(Succeed())
+			Expect(capabilities.UnmarshalBinary(append(data, 0))).ShouldNot(Succeed())
+		})
+	})
+
+	Context("when using the default negotiation", func() {
+		It("should support all variants at the first version", func() {
+			negotiation := DefaultNegotiation(AES256GCM)
+			Expect(negotiation.Version).Should(Equal(V1))
+			Expect(negotiation.AEAD).Should(Equal(AES256GCM))
+			Expect(negotiation.Compression).Should(Equal(NoCompression))
+			for _, variant := range []MessageVariant{Ping, Pong, Cast, Multicast, Broadcast} {
+				Expect(negotiation.SupportsVariant(variant)).Should(BeTrue())
+			}
+			Expect(negotiation.SupportsVariant(MessageVariant(0))).Should(BeFalse())
+		})
+	})
+
+	Context("when checking if an aead is duplex", func() {
+		It("should only return true for aeads with a nonce per direction", func() {
+			Expect(NoAEAD.IsDuplex()).Should(BeTrue())
+			Expect(AES256GCMCounter.IsDuplex()).Should(BeTrue())
+			Expect(NoiseChaChaPoly.IsDuplex()).Should(BeTrue())
+			Expect(ChaCha20Poly1305Counter.IsDuplex()).Should(BeTrue())
+			Expect(AES256GCM.IsDuplex()).Should(BeFalse())
+			Expect(ChaCha20Poly1305.IsDuplex()).Should(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/DataDog/zstd"
+	"github.com/golang/snappy"
+)
+
+// ValidateCompression checks if the given compression is supported.
+func ValidateCompression(compression Compression) error {
+	switch compression {
+	case NoCompression, Snappy, Zstd:
+		return nil
+	default:
+		return NewErrCompressionIsNotSupported(compression)
+	}
+}
+
+// Compress the data using the given compression.
+func Compress(compression Compression, data []byte) ([]byte, error) {
+	switch compression {
+	case NoCompression:
+		return data, nil
+	case Snappy:
+		return snappy.Encode(nil, data), nil
+	case Zstd:
+		compressed, err := zstd.Compress(nil, data)
+		if err != nil {
+			return nil, fmt.Errorf("error compressing data: %v", err)
+		}
+		return compressed, nil
+	default:
+		return nil, NewErrCompressionIsNotSupported(compression)
+	}
+}
+
+// Decompress the data using the given compression. An
+// ErrDecompressedLengthIsTooHigh is returned as soon as the decompressed data
+// is known to be longer than the max, so that a small message cannot be used
+// to allocate large amounts of memory.
+func Decompress(compression Compression, data []byte, max int) ([]byte, error) {
+	switch compression {
+	case NoCompression:
+		if len(data) > max {
+			return nil, NewErrDecompressedLengthIsTooHigh(compression, len(data), max)
+		}
+		return data, nil
+	case Snappy:
+		// The decoded length is stored in the header of the data, so it can be
+		// checked before anything is allocated.
+		length, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing data: %v", err)
+		}
+		if length > max {
+			return nil, NewErrDecompressedLengthIsTooHigh(compression, length, max)
+		}
+		decompressed, err := snappy.Decode(nil, data)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing data: %v", err)
+		}
+		return decompressed, nil
+	case Zstd:
+		// The decoded length stored in the header of the data is optional, so
+		// the data is streamed and reading stops after the max.
+		reader := zstd.NewReader(bytes.NewReader(data))
+		defer reader.Close()
+		decompressed, err := ioutil.ReadAll(io.LimitReader(reader, int64(max)+1))
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing data: %v", err)
+		}
+		if len(decompressed) > max {
+			return nil, NewErrDecompressedLengthIsTooHigh(compression, len(decompressed), max)
+		}
+		return decompressed, nil
+	default:
+		return nil, NewErrCompressionIsNotSupported(compression)
+	}
+}
@@ -0,0 +1,72 @@
+package protocol_test
+
+import (
+	"bytes"
+	"testing/quick"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/protocol"
+)
+
+var _ = Describe("Compression", func() {
+
+	compressions := []Compression{NoCompression, Snappy, Zstd}
+
+	Context("Compression", func() {
+		It("should implement the Stringer interface", func() {
+			Expect(NoCompression.String()).To(Equal("none"))
+			Expect(Snappy.String()).To(Equal("snappy"))
+			Expect(Zstd.String()).To(Equal("zstd"))
+			Expect(Compression(9).String()).To(Equal("compression(9)"))
+		})
+
+		It("should return an error for unsupported compressions", func() {
+			Expect(ValidateCompression(Compression(9))).To(BeAssignableToTypeOf(ErrCompressionIsNotSupported{}))
+			_, err := Compress(Compression(9), []byte{})
+			Expect(err).To(BeAssignableToTypeOf(ErrCompressionIsNotSupported{}))
+			_, err = Decompress(Compression(9), []byte{}, 1024)
+			Expect(err).To(BeAssignableToTypeOf(ErrCompressionIsNotSupported{}))
+		})
+	})
+
+	for _, compression := range compressions {
+		compression := compression
+
+		Context("when using "+compression.String(), func() {
+			It("should get the same data after compressing and decompressing", func() {
+				test := func(data []byte) bool {
+					compressed, err := Compress(compression, data)
+					Expect(err).NotTo(HaveOccurred())
+					decompressed, err := Decompress(compression, compressed, len(data))
+					Expect(err).NotTo(HaveOccurred())
+					return bytes.Equal(data, decompressed)
+				}
+
+				Expect(quick.Check(test, nil)).Should(Succeed())
+			})
+
+			It("should return an ErrDecompressedLengthIsTooHigh when the data exceeds the max", func() {
+				data := make([]byte, 1024*1024)
+				compressed, err := Compress(compression, data)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = Decompress(compression, compressed, 1024)
+				Expect(err).To(BeAssignableToTypeOf(ErrDecompressedLengthIsTooHigh{}))
+				Expect(err.(ErrDecompressedLengthIsTooHigh).Length).Should(BeNumerically(">", 1024))
+				Expect(err.(ErrDecompressedLengthIsTooHigh).Max).Should(Equal(1024))
+			})
+		})
+	}
+
+	Context("when compressing repetitive data", func() {
+		It("should return less data", func() {
+			data := bytes.Repeat([]byte(`{"type":"broadcast","value":1}`), 100)
+			for _, compression := range []Compression{Snappy, Zstd} {
+				compressed, err := Compress(compression, data)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(len(compressed)).Should(BeNumerically("<", len(data)/4))
+			}
+		})
+	})
+})
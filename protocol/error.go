@@ -25,6 +25,24 @@ func NewErrMessageLengthIsTooLow(length MessageLength) error {
 	}
 }
 
+type ErrMessageLengthIsTooHigh struct {
+	error
+	Length  MessageLength
+	Max     MessageLength
+	Variant MessageVariant
+}
+
+// NewErrMessageLengthIsTooHigh creates a new error which is returned when the
+// message length exceeds the limit for its variant.
+func NewErrMessageLengthIsTooHigh(length, max MessageLength, variant MessageVariant) error {
+	return ErrMessageLengthIsTooHigh{
+		error:   fmt.Errorf("message length=%d is too high: %v messages are limited to length=%d", length, variant, max),
+		Length:  length,
+		Max:     max,
+		Variant: variant,
+	}
+}
+
 type ErrMessageVersionIsNotSupported struct {
 	error
 	Version MessageVersion
@@ -52,3 +70,72 @@ func NewErrMessageVariantIsNotSupported(variant MessageVariant) error {
 		Variant: variant,
 	}
 }
+
+// ErrMessageVariantIsAlreadyRegistered is returned when a MessageVariant is
+// registered more than once.
+type ErrMessageVariantIsAlreadyRegistered struct {
+	error
+	Variant MessageVariant
+	Name    string
+}
+
+// NewErrMessageVariantIsAlreadyRegistered creates a new error which is
+// returned when the given message variant has already been registered with
+// the given name.
+func NewErrMessageVariantIsAlreadyRegistered(variant MessageVariant, name string) error {
+	return ErrMessageVariantIsAlreadyRegistered{
+		error:   fmt.Errorf("message variant=%d is already registered as %v", variant, name),
+		Variant: variant,
+		Name:    name,
+	}
+}
+
+type ErrCompressionIsNotSupported struct {
+	error
+	Compression Compression
+}
+
+// NewErrCompressionIsNotSupported creates a new error which is returned when
+// the given compression is not supported.
+func NewErrCompressionIsNotSupported(compression Compression) error {
+	return ErrCompressionIsNotSupported{
+		error:       fmt.Errorf("compression=%d is not supported", compression),
+		Compression: compression,
+	}
+}
+
+// ErrDecompressedLengthIsTooHigh is returned when decompressing data would
+// exceed the max length. If the compression does not store the decompressed
+// length, the Length is the number of bytes decompressed before giving up.
+type ErrDecompressedLengthIsTooHigh struct {
+	error
+	Compression Compression
+	Length      int
+	Max         int
+}
+
+// NewErrDecompressedLengthIsTooHigh creates a new error which is returned when
+// the decompressed length exceeds the max length.
+func NewErrDecompressedLengthIsTooHigh(compression Compression, length, max int) error {
+	return ErrDecompressedLengthIsTooHigh{
+		error:       fmt.Errorf("decompressed length=%d is too high: %v data is limited to length=%d", length, compression, max),
+		Compression: compression,
+		Length:      length,
+		Max:         max,
+	}
+}
+
+// ErrMessageNotDelivered is returned when a message cannot be sent to a Peer.
+type ErrMessageNotDelivered struct {
+	error
+	PeerID PeerID
+}
+
+// NewErrMessageNotDelivered creates a new error which is returned when a
+// message cannot be sent to the given peer.
+func NewErrMessageNotDelivered(peerID PeerID, err error) error {
+	return ErrMessageNotDelivered{
+		error:  fmt.Errorf("message not delivered to %v: %v", peerID, err),
+		PeerID: peerID,
+	}
+}
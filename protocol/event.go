@@ -1,6 +1,10 @@
 package protocol
 
-import "time"
+import (
+	"encoding/hex"
+	"io"
+	"time"
+)
 
 // EventSender is used for sending Event.
 type EventSender chan<- Event
@@ -31,3 +35,51 @@ type EventMessageReceived struct {
 
 // EventMessageReceived implements the Event interface.
 func (EventMessageReceived) IsEvent() {}
+
+// EventPeerRejected is triggered when a Peer has been authenticated, but is not
+// authorized to connect to us.
+type EventPeerRejected struct {
+	Time   time.Time
+	PeerID PeerID
+	Reason error
+}
+
+// EventPeerRejected implements the Event interface.
+func (EventPeerRejected) IsEvent() {}
+
+// EventReliableDelivered is triggered when a message that has been reliably
+// broadcast to a group is delivered. It is triggered at most once for each
+// Origin and Sequence.
+type EventReliableDelivered struct {
+	Time     time.Time
+	GroupID  GroupID
+	Origin   PeerID
+	Sequence uint64
+	Message  MessageBody
+}
+
+// EventReliableDelivered implements the Event interface.
+func (EventReliableDelivered) IsEvent() {}
+
+// StreamID identifies a stream between two Peers.
+type StreamID [16]byte
+
+// String implements the `Stringer` interface.
+func (id StreamID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// EventStreamReceived is triggered when a Peer starts streaming to us. The
+// Reader returns the payload of the stream as it arrives, and returns an error
+// if the stream is cancelled, times out, or fails its integrity check. The
+// Reader must be read until it returns an error, or closed to cancel the
+// stream.
+type EventStreamReceived struct {
+	Time     time.Time
+	From     PeerID
+	StreamID StreamID
+	Reader   io.ReadCloser
+}
+
+// EventStreamReceived implements the Event interface.
+func (EventStreamReceived) IsEvent() {}
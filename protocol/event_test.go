@@ -18,4 +18,16 @@ var _ = Describe("Events", func() {
 			Expect(func() { EventMessageReceived{}.IsEvent() }).ToNot(Panic())
 		})
 	})
+
+	Context("when defining EventReliableDelivered", func() {
+		It("should implement the Event interface", func() {
+			Expect(func() { EventReliableDelivered{}.IsEvent() }).ToNot(Panic())
+		})
+	})
+
+	Context("when defining EventStreamReceived", func() {
+		It("should implement the Event interface", func() {
+			Expect(func() { EventStreamReceived{}.IsEvent() }).ToNot(Panic())
+		})
+	})
 })
@@ -0,0 +1,215 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/renproject/id"
+)
+
+// ExtensionType identifies the value of an Extension.
+type ExtensionType uint16
+
+const (
+	ExtensionMessageID    = ExtensionType(1) // 32 byte ID of the message
+	ExtensionTTL          = ExtensionType(2) // Number of hops left, as a uint8
+	ExtensionPriority     = ExtensionType(3) // Priority of the message, as a uint8
+	ExtensionTraceContext = ExtensionType(4) // Opaque trace context, such as a W3C traceparent
+)
+
+func (extensionType ExtensionType) String() string {
+	switch extensionType {
+	case ExtensionMessageID:
+		return "id"
+	case ExtensionTTL:
+		return "ttl"
+	case ExtensionPriority:
+		return "priority"
+	case ExtensionTraceContext:
+		return "trace"
+	default:
+		return fmt.Sprintf("extension(%d)", uint16(extensionType))
+	}
+}
+
+// Extension is a type-length-value field in the header of a V2 message. Each
+// Extension is encoded as its uint16 type, followed by the uint16 length of its
+// value, followed by its value. Extensions of unknown types are kept when a
+// message is unmarshaled, so that they can be skipped safely.
+type Extension struct {
+	Type  ExtensionType
+	Value []byte
+}
+
+// Extensions is a list of Extensions, with at most one Extension per type.
+type Extensions []Extension
+
+// encodedLength returns the number of bytes needed to marshal the Extensions,
+// excluding the uint16 length that prefixes the extension area.
+func (extensions Extensions) encodedLength() int {
+	n := 0
+	for _, extension := range extensions {
+		n += 4 + len(extension.Value)
+	}
+	return n
+}
+
+// MarshalBinary implements the `BinaryMarshaler` interface. It returns the
+// extension area of a V2 message header, without its length prefix.
+func (extensions Extensions) MarshalBinary() ([]byte, error) {
+	if n := extensions.encodedLength(); n > math.MaxUint16 {
+		return nil, fmt.Errorf("error marshaling extensions: length=%v is too high", n)
+	}
+	buffer := new(bytes.Buffer)
+	for _, extension := range extensions {
+		if err := binary.Write(buffer, binary.LittleEndian, extension.Type); err != nil {
+			return nil, fmt.Errorf("error marshaling extension type=%v: %v", extension.Type, err)
+		}
+		if err := binary.Write(buffer, binary.LittleEndian, uint16(len(extension.Value))); err != nil {
+			return nil, fmt.Errorf("error marshaling extension length=%v: %v", len(extension.Value), err)
+		}
+		buffer.Write(extension.Value)
+	}
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalBinary implements the `BinaryUnmarshaler` interface. It reads the
+// extension area of a V2 message header, without its length prefix.
+func (extensions *Extensions) UnmarshalBinary(data []byte) error {
+	reader := bytes.NewReader(data)
+	*extensions = Extensions{}
+	for reader.Len() > 0 {
+		extension := Extension{}
+		if err := binary.Read(reader, binary.LittleEndian, &extension.Type); err != nil {
+			return fmt.Errorf("error unmarshaling extension type: %v", err)
+		}
+		length := uint16(0)
+		if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
+			return fmt.Errorf("error unmarshaling extension length: %v", err)
+		}
+		extension.Value = make([]byte, length)
+		if _, err := io.ReadFull(reader, extension.Value); err != nil {
+			return fmt.Errorf("error unmarshaling extension value: %v", err)
+		}
+		if _, ok := extensions.Get(extension.Type); ok {
+			return fmt.Errorf("error unmarshaling extensions: duplicate extension type=%v", extension.Type)
+		}
+		*extensions = append(*extensions, extension)
+	}
+	return nil
+}
+
+// Get the value of the Extension with the given type.
+func (extensions Extensions) Get(extensionType ExtensionType) ([]byte, bool) {
+	for _, extension := range extensions {
+		if extension.Type == extensionType {
+			return extension.Value, true
+		}
+	}
+	return nil, false
+}
+
+// HeaderLength returns the length of the message (ex-messageBody). For V1
+// messages, this is the NonBodyLength of the variant. For V2 messages, this
+// also includes the uint16 length of the extension area, and the extensions.
+func (message Message) HeaderLength() int {
+	length := message.Variant.NonBodyLength()
+	if message.Version >= V2 {
+		length += 2 + message.Extensions.encodedLength()
+	}
+	return length
+}
+
+// Extension returns the value of the Extension with the given type. Extensions
+// are only sent with V2 messages.
+func (message Message) Extension(extensionType ExtensionType) ([]byte, bool) {
+	return message.Extensions.Get(extensionType)
+}
+
+// SetExtension sets the value of the Extension with the given type, replacing
+// any existing value, and updates the length of the message.
+func (message *Message) SetExtension(extensionType ExtensionType, value []byte) {
+	if len(value) > math.MaxUint16 {
+		panic(fmt.Sprintf("invariant violation: extension length=%v is too high", len(value)))
+	}
+	extensions := make(Extensions, 0, len(message.Extensions)+1)
+	for _, extension := range message.Extensions {
+		if extension.Type != extensionType {
+			extensions = append(extensions, extension)
+		}
+	}
+	message.Extensions = append(extensions, Extension{Type: extensionType, Value: value})
+	message.Length = MessageLength(message.HeaderLength() + len(message.Body))
+}
+
+// RemoveExtension removes the Extension with the given type, and updates the
+// length of the message.
+func (message *Message) RemoveExtension(extensionType ExtensionType) {
+	extensions := make(Extensions, 0, len(message.Extensions))
+	for _, extension := range message.Extensions {
+		if extension.Type != extensionType {
+			extensions = append(extensions, extension)
+		}
+	}
+	message.Extensions = extensions
+	message.Length = MessageLength(message.HeaderLength() + len(message.Body))
+}
+
+// ID returns the ID of the message, if it has one.
+func (message Message) ID() (id.Hash, bool) {
+	value, ok := message.Extension(ExtensionMessageID)
+	if !ok || len(value) != len(id.Hash{}) {
+		return id.Hash{}, false
+	}
+	hash := id.Hash{}
+	copy(hash[:], value)
+	return hash, true
+}
+
+// SetID sets the ID of the message.
+func (message *Message) SetID(hash id.Hash) {
+	message.SetExtension(ExtensionMessageID, hash[:])
+}
+
+// TTL returns the number of hops that the message can still be forwarded, if
+// it has a TTL.
+func (message Message) TTL() (uint8, bool) {
+	value, ok := message.Extension(ExtensionTTL)
+	if !ok || len(value) != 1 {
+		return 0, false
+	}
+	return value[0], true
+}
+
+// SetTTL sets the number of hops that the message can still be forwarded.
+func (message *Message) SetTTL(ttl uint8) {
+	message.SetExtension(ExtensionTTL, []byte{ttl})
+}
+
+// Priority returns the priority of the message, if it has one. Higher values
+// have a higher priority.
+func (message Message) Priority() (uint8, bool) {
+	value, ok := message.Extension(ExtensionPriority)
+	if !ok || len(value) != 1 {
+		return 0, false
+	}
+	return value[0], true
+}
+
+// SetPriority sets the priority of the message.
+func (message *Message) SetPriority(priority uint8) {
+	message.SetExtension(ExtensionPriority, []byte{priority})
+}
+
+// TraceContext returns the trace context of the message, if it has one.
+func (message Message) TraceContext() ([]byte, bool) {
+	return message.Extension(ExtensionTraceContext)
+}
+
+// SetTraceContext sets the trace context of the message.
+func (message *Message) SetTraceContext(traceContext []byte) {
+	message.SetExtension(ExtensionTraceContext, traceContext)
+}
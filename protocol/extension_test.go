@@ -0,0 +1,116 @@
+package protocol_test
+
+import (
+	"bytes"
+	"testing/quick"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/protocol"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/id"
+)
+
+var _ = Describe("Extensions", func() {
+
+	Context("ExtensionType", func() {
+		It("should implement the Stringer interface", func() {
+			Expect(ExtensionMessageID.String()).To(Equal("id"))
+			Expect(ExtensionTTL.String()).To(Equal("ttl"))
+			Expect(ExtensionPriority.String()).To(Equal("priority"))
+			Expect(ExtensionTraceContext.String()).To(Equal("trace"))
+			Expect(ExtensionType(1000).String()).To(Equal("extension(1000)"))
+		})
+	})
+
+	Context("when marshaling and unmarshaling extensions", func() {
+		It("should keep the order and the unknown types", func() {
+			test := func(values [][]byte) bool {
+				extensions := Extensions{}
+				for i, value := range values {
+					extensions = append(extensions, Extension{Type: ExtensionType(i), Value: value})
+				}
+				data, err := extensions.MarshalBinary()
+				Expect(err).NotTo(HaveOccurred())
+
+				newExtensions := Extensions{}
+				Expect(newExtensions.UnmarshalBinary(data)).To(Succeed())
+				Expect(newExtensions).To(HaveLen(len(extensions)))
+				for i := range extensions {
+					Expect(newExtensions[i].Type).To(Equal(extensions[i].Type))
+					Expect(bytes.Equal(newExtensions[i].Value, extensions[i].Value)).To(BeTrue())
+				}
+				return true
+			}
+
+			Expect(quick.Check(test, nil)).Should(Succeed())
+		})
+
+		It("should return an error for duplicate types", func() {
+			extensions := Extensions{{Type: ExtensionTTL, Value: []byte{1}}, {Type: ExtensionTTL, Value: []byte{2}}}
+			data, err := extensions.MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+			Expect((&Extensions{}).UnmarshalBinary(data)).To(HaveOccurred())
+		})
+
+		It("should return an error for truncated values", func() {
+			extensions := Extensions{{Type: ExtensionTraceContext, Value: RandomBytes(16)}}
+			data, err := extensions.MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+			Expect((&Extensions{}).UnmarshalBinary(data[:len(data)-1])).To(HaveOccurred())
+		})
+	})
+
+	Context("when using the accessors of a message", func() {
+		It("should return the values that have been set", func() {
+			message := NewMessage(V2, Cast, NilGroupID, RandomMessageBody())
+			_, ok := message.ID()
+			Expect(ok).To(BeFalse())
+
+			hash := id.Hash(RandomGroupID())
+			message.SetID(hash)
+			message.SetTTL(7)
+			message.SetPriority(2)
+			message.SetTraceContext([]byte("00-trace-01"))
+
+			messageID, ok := message.ID()
+			Expect(ok).To(BeTrue())
+			Expect(messageID).To(Equal(hash))
+			ttl, ok := message.TTL()
+			Expect(ok).To(BeTrue())
+			Expect(ttl).To(Equal(uint8(7)))
+			priority, ok := message.Priority()
+			Expect(ok).To(BeTrue())
+			Expect(priority).To(Equal(uint8(2)))
+			traceContext, ok := message.TraceContext()
+			Expect(ok).To(BeTrue())
+			Expect(string(traceContext)).To(Equal("00-trace-01"))
+		})
+
+		It("should replace existing values and keep the length up to date", func() {
+			message := NewMessage(V2, Multicast, RandomGroupID(), RandomMessageBody())
+			Expect(int(message.Length)).To(Equal(Multicast.NonBodyLength() + 2 + len(message.Body)))
+
+			message.SetTTL(7)
+			message.SetTTL(6)
+			Expect(message.Extensions).To(HaveLen(1))
+			Expect(int(message.Length)).To(Equal(Multicast.NonBodyLength() + 2 + 5 + len(message.Body)))
+
+			message.RemoveExtension(ExtensionTTL)
+			_, ok := message.TTL()
+			Expect(ok).To(BeFalse())
+			Expect(int(message.Length)).To(Equal(Multicast.NonBodyLength() + 2 + len(message.Body)))
+		})
+
+		It("should ignore known extensions with malformed values", func() {
+			message := NewMessage(V2, Cast, NilGroupID, RandomMessageBody())
+			message.SetExtension(ExtensionTTL, []byte{1, 2})
+			message.SetExtension(ExtensionMessageID, []byte{1})
+			_, ok := message.TTL()
+			Expect(ok).To(BeFalse())
+			_, ok = message.ID()
+			Expect(ok).To(BeFalse())
+		})
+	})
+})
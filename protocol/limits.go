@@ -0,0 +1,91 @@
+package protocol
+
+const (
+	// DefaultMaxMessageLength is the default limit on the length of a message.
+	DefaultMaxMessageLength = MessageLength(10 * 1024 * 1024)
+
+	// DefaultMaxHandshakeLength is the default limit on the length of a
+	// message that is exchanged during a handshake.
+	DefaultMaxHandshakeLength = uint64(1024 * 1024)
+)
+
+// SizeLimits bound the length of messages, and of the messages that are
+// exchanged during handshakes. Limits apply to the length of messages on the
+// wire, so they include the overhead that is added by a Session.
+type SizeLimits struct {
+	// MaxMessageLength applies to message variants that do not have their own
+	// limit. Defaults to 10 MiB.
+	MaxMessageLength MessageLength `json:"maxMessageLength"`
+
+	// MaxVariantLengths overrides MaxMessageLength for specific message
+	// variants. For example, Ping and Pong messages can be limited to a few
+	// bytes, while Cast messages are allowed to be large.
+	MaxVariantLengths map[MessageVariant]MessageLength `json:"maxVariantLengths"`
+
+	// MaxHandshakeLength applies to every message that is exchanged during a
+	// handshake. Defaults to 1 MiB.
+	MaxHandshakeLength uint64 `json:"maxHandshakeLength"`
+}
+
+// DefaultSizeLimits returns SizeLimits with all values set to their defaults.
+func DefaultSizeLimits() SizeLimits {
+	limits := SizeLimits{}
+	limits.SetZerosToDefaults()
+	return limits
+}
+
+// SetZerosToDefaults sets all zero values to their defaults. Zero limits in
+// MaxVariantLengths are removed, so that the variant uses MaxMessageLength.
+func (limits *SizeLimits) SetZerosToDefaults() {
+	if limits.MaxMessageLength == 0 {
+		limits.MaxMessageLength = DefaultMaxMessageLength
+	}
+	if limits.MaxHandshakeLength == 0 {
+		limits.MaxHandshakeLength = DefaultMaxHandshakeLength
+	}
+	maxVariantLengths := make(map[MessageVariant]MessageLength, len(limits.MaxVariantLengths))
+	for variant, length := range limits.MaxVariantLengths {
+		if length != 0 {
+			maxVariantLengths[variant] = length
+		}
+	}
+	limits.MaxVariantLengths = maxVariantLengths
+}
+
+// MaxLength returns the limit on the length of messages of the given variant.
+func (limits SizeLimits) MaxLength(variant MessageVariant) MessageLength {
+	if length, ok := limits.MaxVariantLengths[variant]; ok && length != 0 {
+		return length
+	}
+	if limits.MaxMessageLength == 0 {
+		return DefaultMaxMessageLength
+	}
+	return limits.MaxMessageLength
+}
+
+// MaxReadLength returns the largest limit of all message variants. It bounds
+// how much can be read from a connection for a single message.
+func (limits SizeLimits) MaxReadLength() MessageLength {
+	max := limits.MaxLength(MessageVariant(0))
+	for variant := range limits.MaxVariantLengths {
+		if length := limits.MaxLength(variant); length > max {
+			max = length
+		}
+	}
+	return max
+}
+
+// ValidateMessageLength checks if the length is valid for the variant, and
+// does not exceed the limit of the variant.
+func (limits SizeLimits) ValidateMessageLength(length MessageLength, variant MessageVariant) error {
+	if err := ValidateMessageVariant(variant); err != nil {
+		return err
+	}
+	if int(length) < variant.NonBodyLength() {
+		return NewErrMessageLengthIsTooLow(length)
+	}
+	if max := limits.MaxLength(variant); length > max {
+		return NewErrMessageLengthIsTooHigh(length, max, variant)
+	}
+	return nil
+}
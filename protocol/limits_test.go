@@ -0,0 +1,100 @@
+package protocol_test
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/protocol"
+	. "github.com/renproject/aw/testutil"
+)
+
+var _ = Describe("Size limits", func() {
+
+	Context("when setting zero values to defaults", func() {
+		It("should use the default limits", func() {
+			limits := SizeLimits{}
+			limits.SetZerosToDefaults()
+			Expect(limits.MaxMessageLength).Should(Equal(DefaultMaxMessageLength))
+			Expect(limits.MaxHandshakeLength).Should(Equal(DefaultMaxHandshakeLength))
+			Expect(limits.MaxLength(Cast)).Should(Equal(DefaultMaxMessageLength))
+		})
+
+		It("should not override the limits that have been set", func() {
+			limits := SizeLimits{
+				MaxMessageLength:  1024,
+				MaxVariantLengths: map[MessageVariant]MessageLength{Ping: 64, Pong: 0},
+			}
+			limits.SetZerosToDefaults()
+			Expect(limits.MaxLength(Ping)).Should(Equal(MessageLength(64)))
+			Expect(limits.MaxLength(Pong)).Should(Equal(MessageLength(1024)))
+			Expect(limits.MaxLength(Cast)).Should(Equal(MessageLength(1024)))
+		})
+	})
+
+	Context("when getting the max read length", func() {
+		It("should return the largest limit of all variants", func() {
+			limits := SizeLimits{
+				MaxMessageLength:  1024,
+				MaxVariantLengths: map[MessageVariant]MessageLength{Ping: 64, Cast: 4096},
+			}
+			Expect(limits.MaxReadLength()).Should(Equal(MessageLength(4096)))
+
+			limits.MaxVariantLengths = map[MessageVariant]MessageLength{Ping: 64}
+			Expect(limits.MaxReadLength()).Should(Equal(MessageLength(1024)))
+		})
+	})
+
+	Context("when validating message lengths", func() {
+		limits := SizeLimits{
+			MaxMessageLength:  1024,
+			MaxVariantLengths: map[MessageVariant]MessageLength{Ping: 64},
+		}
+
+		It("should accept lengths within the limit of the variant", func() {
+			Expect(limits.ValidateMessageLength(64, Ping)).To(Succeed())
+			Expect(limits.ValidateMessageLength(1024, Cast)).To(Succeed())
+		})
+
+		It("should return an ErrMessageLengthIsTooHigh for lengths above the limit of the variant", func() {
+			err := limits.ValidateMessageLength(65, Ping)
+			Expect(err).To(BeAssignableToTypeOf(ErrMessageLengthIsTooHigh{}))
+			Expect(err.(ErrMessageLengthIsTooHigh).Length).Should(Equal(MessageLength(65)))
+			Expect(err.(ErrMessageLengthIsTooHigh).Max).Should(Equal(MessageLength(64)))
+			Expect(err.(ErrMessageLengthIsTooHigh).Variant).Should(Equal(Ping))
+
+			Expect(limits.ValidateMessageLength(1025, Cast)).To(BeAssignableToTypeOf(ErrMessageLengthIsTooHigh{}))
+		})
+
+		It("should return an ErrMessageLengthIsTooLow for lengths below the non-body length", func() {
+			Expect(limits.ValidateMessageLength(39, Multicast)).To(BeAssignableToTypeOf(ErrMessageLengthIsTooLow{}))
+		})
+	})
+
+	Context("when marshaling and unmarshaling messages with limits", func() {
+		limits := SizeLimits{
+			MaxVariantLengths: map[MessageVariant]MessageLength{Ping: 64},
+		}
+
+		It("should not marshal messages that exceed the limit", func() {
+			message := RandomMessage(V1, Ping)
+			message.Body = RandomBytes(128)
+			message.Length = MessageLength(Ping.NonBodyLength() + 128)
+			_, err := message.MarshalBinaryWithLimits(limits)
+			Expect(err).To(BeAssignableToTypeOf(ErrMessageLengthIsTooHigh{}))
+		})
+
+		It("should not unmarshal messages that exceed the limit", func() {
+			message := RandomMessage(V1, Ping)
+			message.Body = RandomBytes(128)
+			message.Length = MessageLength(Ping.NonBodyLength() + 128)
+			data, err := message.MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+
+			unmarshaled := Message{}
+			err = unmarshaled.UnmarshalReaderWithLimits(bytes.NewReader(data), limits)
+			Expect(err).To(BeAssignableToTypeOf(ErrMessageLengthIsTooHigh{}))
+			Expect(unmarshaled.UnmarshalReader(bytes.NewReader(data))).To(Succeed())
+		})
+	})
+})
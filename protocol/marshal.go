@@ -7,11 +7,24 @@ import (
 	"io"
 )
 
-// MarshalBinary implements `BinaryMarshaler` interface.
+// MarshalBinary implements `BinaryMarshaler` interface. The message length is
+// validated using the DefaultSizeLimits.
 func (message Message) MarshalBinary() ([]byte, error) {
+	return message.MarshalBinaryWithLimits(DefaultSizeLimits())
+}
+
+// MarshalBinaryWithLimits marshals the message, after validating its length
+// using the given SizeLimits.
+//
+// V1 messages are marshaled as the length, version and variant, followed by
+// the group ID for variants that have one (such as Multicast and Broadcast),
+// followed by the body. V2 messages also have an extension area between the
+// group ID and the body: the uint16 length of the area, followed by the
+// Extensions. The Extensions of V1 messages are not marshaled.
+func (message Message) MarshalBinaryWithLimits(limits SizeLimits) ([]byte, error) {
 
 	// Validate message length, version and variant.
-	if err := ValidateMessageLength(message.Length, message.Variant); err != nil {
+	if err := limits.ValidateMessageLength(message.Length, message.Variant); err != nil {
 		return nil, err
 	}
 	if err := ValidateMessageVersion(message.Version); err != nil {
@@ -31,13 +44,24 @@ func (message Message) MarshalBinary() ([]byte, error) {
 	if err := binary.Write(buffer, binary.LittleEndian, message.Variant); err != nil {
 		return nil, fmt.Errorf("error marshaling message variant=%v: %v", message.Variant, err)
 	}
-	if message.Version == V1 {
-		if message.Variant == Broadcast || message.Variant == Multicast {
-			if err := binary.Write(buffer, binary.LittleEndian, message.GroupID); err != nil {
-				return nil, fmt.Errorf("error marshaling message group id=%v: %v", message.GroupID, err)
-			}
+	if message.Variant.HasGroupID() {
+		if err := binary.Write(buffer, binary.LittleEndian, message.GroupID); err != nil {
+			return nil, fmt.Errorf("error marshaling message group id=%v: %v", message.GroupID, err)
 		}
 	}
+	if message.Version >= V2 {
+		if int(message.Length) < message.HeaderLength() {
+			return nil, NewErrMessageLengthIsTooLow(message.Length)
+		}
+		extensions, err := message.Extensions.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		if err := binary.Write(buffer, binary.LittleEndian, uint16(len(extensions))); err != nil {
+			return nil, fmt.Errorf("error marshaling message extensions length=%v: %v", len(extensions), err)
+		}
+		buffer.Write(extensions)
+	}
 	if err := binary.Write(buffer, binary.LittleEndian, message.Body); err != nil {
 		return nil, fmt.Errorf("error marshaling message body: %v", err)
 	}
@@ -50,8 +74,15 @@ func (message *Message) UnmarshalBinary(data []byte) error {
 }
 
 // UnmarshalReader reads bytes from an `io.Reader` and unmarshals them into
-// itself.
+// itself. The message length is validated using the DefaultSizeLimits.
 func (message *Message) UnmarshalReader(reader io.Reader) error {
+	return message.UnmarshalReaderWithLimits(reader, DefaultSizeLimits())
+}
+
+// UnmarshalReaderWithLimits reads bytes from an `io.Reader` and unmarshals them
+// into itself. The message length is validated using the given SizeLimits
+// before the message body is read.
+func (message *Message) UnmarshalReaderWithLimits(reader io.Reader, limits SizeLimits) error {
 	// Read the message length
 	if err := binary.Read(reader, binary.LittleEndian, &message.Length); err != nil {
 		return err
@@ -74,21 +105,40 @@ func (message *Message) UnmarshalReader(reader io.Reader) error {
 	}
 
 	// Validate the message length
-	if err := ValidateMessageLength(message.Length, message.Variant); err != nil {
+	if err := limits.ValidateMessageLength(message.Length, message.Variant); err != nil {
 		return err
 	}
 
-	// Read the group ID if the message is a Broadcast or a Multicast
-	if message.Version == V1 {
-		if message.Variant == Broadcast || message.Variant == Multicast {
-			if err := binary.Read(reader, binary.LittleEndian, &message.GroupID); err != nil {
-				return fmt.Errorf("error unmarshaling message group id: %v", err)
-			}
+	// Read the group ID if the variant has one (such as Broadcast and Multicast)
+	if message.Variant.HasGroupID() {
+		if err := binary.Read(reader, binary.LittleEndian, &message.GroupID); err != nil {
+			return fmt.Errorf("error unmarshaling message group id: %v", err)
+		}
+	}
+
+	// Read the extensions if the message is V2. Code that only understands V1
+	// can ignore the extensions, because the body starts after the extension
+	// area.
+	message.Extensions = nil
+	if message.Version >= V2 {
+		extensionsLength := uint16(0)
+		if err := binary.Read(reader, binary.LittleEndian, &extensionsLength); err != nil {
+			return fmt.Errorf("error unmarshaling message extensions length: %v", err)
+		}
+		if int(message.Length) < message.Variant.NonBodyLength()+2+int(extensionsLength) {
+			return NewErrMessageLengthIsTooLow(message.Length)
+		}
+		extensions := make([]byte, extensionsLength)
+		if _, err := io.ReadFull(reader, extensions); err != nil {
+			return fmt.Errorf("error unmarshaling message extensions: %v", err)
+		}
+		if err := message.Extensions.UnmarshalBinary(extensions); err != nil {
+			return err
 		}
 	}
 
 	// Read the message body.
-	message.Body = make(MessageBody, int(message.Length)-message.Variant.NonBodyLength())
+	message.Body = make(MessageBody, int(message.Length)-message.HeaderLength())
 	if err := binary.Read(reader, binary.LittleEndian, message.Body); err != nil {
 		return fmt.Errorf("error unmarshaling message body: %v", err)
 	}
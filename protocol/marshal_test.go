@@ -1,6 +1,7 @@
 package protocol_test
 
 import (
+	"bytes"
 	"encoding/binary"
 	"math/rand"
 	"testing/quick"
@@ -31,6 +32,71 @@ var _ = Describe("marshaling and unmarshaling", func() {
 
 			Expect(quick.Check(test, nil)).Should(Succeed())
 		})
+
+		It("should get the same V2 message with extensions after marshaling and unmarshaling", func() {
+			test := func(ttl, priority uint8, traceContext []byte) bool {
+				message := RandomMessage(V2, RandomMessageVariant())
+				message.SetID(message.Hash())
+				message.SetTTL(ttl)
+				message.SetPriority(priority)
+				message.SetTraceContext(traceContext)
+				message.SetExtension(ExtensionType(1000), RandomBytes(16))
+
+				data, err := message.MarshalBinary()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(len(data)).Should(Equal(int(message.Length)))
+
+				var newMessage Message
+				Expect(newMessage.UnmarshalBinary(data)).Should(Succeed())
+
+				return cmp.Equal(message, newMessage, cmpopts.EquateEmpty())
+			}
+
+			Expect(quick.Check(test, nil)).Should(Succeed())
+		})
+
+		It("should drop the extensions of V1 messages", func() {
+			message := NewMessage(V1, Cast, NilGroupID, RandomMessageBody())
+			message.SetTTL(3)
+			Expect(int(message.Length)).Should(Equal(Cast.NonBodyLength() + len(message.Body)))
+
+			data, err := message.MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+
+			var newMessage Message
+			Expect(newMessage.UnmarshalBinary(data)).Should(Succeed())
+			_, ok := newMessage.TTL()
+			Expect(ok).Should(BeFalse())
+			Expect(newMessage.Body).Should(Equal(message.Body))
+		})
+
+		It("should read V1 and V2 messages from the same stream", func() {
+			test := func() bool {
+				messages := make([]Message, 8)
+				buffer := new(bytes.Buffer)
+				for i := range messages {
+					if rand.Intn(2) == 0 {
+						messages[i] = RandomMessage(V1, RandomMessageVariant())
+					} else {
+						messages[i] = RandomMessage(V2, RandomMessageVariant())
+						messages[i].SetTTL(uint8(i))
+						messages[i].SetExtension(ExtensionType(rand.Intn(1000)+1000), RandomBytes(rand.Intn(64)))
+					}
+					data, err := messages[i].MarshalBinary()
+					Expect(err).NotTo(HaveOccurred())
+					buffer.Write(data)
+				}
+
+				for i := range messages {
+					var message Message
+					Expect(message.UnmarshalReader(buffer)).Should(Succeed())
+					Expect(cmp.Equal(messages[i], message, cmpopts.EquateEmpty())).Should(BeTrue())
+				}
+				return buffer.Len() == 0
+			}
+
+			Expect(quick.Check(test, nil)).Should(Succeed())
+		})
 	})
 
 	Context("when marshaling a message", func() {
@@ -83,6 +149,33 @@ var _ = Describe("marshaling and unmarshaling", func() {
 			Expect(quick.Check(test, nil)).Should(Succeed())
 		})
 
+		It("should return an error when the extensions of a V2 message exceed the message length", func() {
+			message := NewMessage(V2, Cast, NilGroupID, MessageBody{})
+			message.SetTraceContext(RandomBytes(32))
+			data, err := message.MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+
+			// Shorten the message length, so that the extensions do not fit.
+			binary.LittleEndian.PutUint32(data, uint32(Cast.NonBodyLength()+2))
+			var newMessage Message
+			Expect(newMessage.UnmarshalBinary(data)).To(BeAssignableToTypeOf(ErrMessageLengthIsTooLow{}))
+		})
+
+		It("should return an error when the extensions of a V2 message are malformed", func() {
+			message := NewMessage(V2, Cast, NilGroupID, RandomMessageBody())
+			data, err := message.MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+
+			// Claim a single extension of 3 bytes, which cannot hold a type
+			// and a length.
+			malformed := append([]byte{}, data[:Cast.NonBodyLength()]...)
+			malformed = append(malformed, 3, 0, 1, 0, 0)
+			malformed = append(malformed, message.Body...)
+			binary.LittleEndian.PutUint32(malformed, uint32(len(malformed)))
+			var newMessage Message
+			Expect(newMessage.UnmarshalBinary(malformed)).To(HaveOccurred())
+		})
+
 		It("should return an error when the message length is less than 8", func() {
 			test := func() bool {
 				data := make([]byte, 4)
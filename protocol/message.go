@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"time"
 
 	"github.com/renproject/id"
 )
@@ -13,6 +14,37 @@ type MessageOnTheWire struct {
 	To      PeerAddress
 	From    PeerID
 	Message Message
+
+	// Reply is set for messages that have been read from a Session that can
+	// also be written by this Peer. Messages sent to Reply are written back
+	// through the same Session, instead of a new connection to the sender. It
+	// is nil if the Session cannot be written, or has been closed.
+	Reply MessageSender
+
+	// Result receives the outcome of sending the message, if it is not nil:
+	// nil once the message has been written to a connection, or an
+	// ErrMessageNotDelivered once the Client has given up. At most one
+	// outcome is sent, and it is dropped if Result is full, so Result should
+	// be buffered. Consumers of a MessageSender other than the Client might
+	// never report an outcome, so senders should only wait for one when they
+	// know that their consumer reports it.
+	Result chan<- error
+
+	// Deadline is when the Client stops trying to send the message, usually
+	// the deadline of the context of the sender. It is ignored if it is zero.
+	Deadline time.Time
+}
+
+// ReportResult sends the outcome of sending the message to its Result, if it
+// has one. It never blocks.
+func (messageOtw MessageOnTheWire) ReportResult(err error) {
+	if messageOtw.Result == nil {
+		return
+	}
+	select {
+	case messageOtw.Result <- err:
+	default:
+	}
 }
 
 // MessageSender is used for sending MessageOnTheWire.
@@ -24,25 +56,11 @@ type MessageReceiver <-chan MessageOnTheWire
 // MessageLength indicates the length of the entire message.
 type MessageLength uint32
 
-// ValidateMessageLength checks if the length is valid.
+// ValidateMessageLength checks if the length is valid, using the
+// DefaultSizeLimits. Use SizeLimits.ValidateMessageLength to apply other
+// limits.
 func ValidateMessageLength(length MessageLength, variant MessageVariant) error {
-	if length > 10*1024*1024 {
-		// TODO: Allow length restriction to be specified as an option.
-		return fmt.Errorf("message length=%v is too big", length)
-	}
-	switch variant {
-	case Cast, Ping, Pong:
-		if int(length) < variant.NonBodyLength() {
-			return NewErrMessageLengthIsTooLow(length)
-		}
-	case Multicast, Broadcast:
-		if int(length) < variant.NonBodyLength() {
-			return NewErrMessageLengthIsTooLow(length)
-		}
-	default:
-		return NewErrMessageVariantIsNotSupported(variant)
-	}
-	return nil
+	return DefaultSizeLimits().ValidateMessageLength(length, variant)
 }
 
 // MessageVersion indicates the version of the message.
@@ -50,12 +68,15 @@ type MessageVersion uint16
 
 const (
 	V1 = MessageVersion(1)
+	V2 = MessageVersion(2) // Adds Extensions to the header
 )
 
 func (version MessageVersion) String() string {
 	switch version {
 	case V1:
 		return "v1"
+	case V2:
+		return "v2"
 	default:
 		panic(NewErrMessageVersionIsNotSupported(version))
 	}
@@ -64,7 +85,7 @@ func (version MessageVersion) String() string {
 // ValidateMessageVersion checks if the given version is supported.
 func ValidateMessageVersion(version MessageVersion) error {
 	switch version {
-	case V1:
+	case V1, V2:
 		return nil
 	default:
 		return NewErrMessageVersionIsNotSupported(version)
@@ -80,46 +101,53 @@ const (
 	Cast      = MessageVariant(3)
 	Multicast = MessageVariant(4)
 	Broadcast = MessageVariant(5)
+	Stream    = MessageVariant(6)
+	Request   = MessageVariant(7)
+	Response  = MessageVariant(8)
+	Publish   = MessageVariant(9)
+	Gossip    = MessageVariant(10)
+	IHave     = MessageVariant(11)
+	Graft     = MessageVariant(12)
+	Prune     = MessageVariant(13)
+	Reliable  = MessageVariant(14)
+	Have      = MessageVariant(15)
+	Want      = MessageVariant(16)
+	Ack       = MessageVariant(17)
 )
 
+// String returns the name of a registered variant. It panics if the variant
+// is not registered.
 func (variant MessageVariant) String() string {
-	switch variant {
-	case Ping:
-		return "ping"
-	case Pong:
-		return "pong"
-	case Cast:
-		return "cast"
-	case Multicast:
-		return "multicast"
-	case Broadcast:
-		return "broadcast"
-	default:
+	definition, ok := LookupMessageVariant(variant)
+	if !ok {
 		panic(NewErrMessageVariantIsNotSupported(variant))
 	}
+	return definition.Name
 }
 
 // Returns the message length (ex-messageBody) which equals to
 // len(MessageLength) + len(MessageVersion) + len(MessageVariant) + len(GroupID)
 func (variant MessageVariant) NonBodyLength() int {
-	switch variant {
-	case Ping, Pong, Cast:
-		return 8 // 4(uint32) + 2(uint16) + 2(uint16) + 0
-	case Multicast, Broadcast:
-		return 40 // 4(uint32) + 2(uint16) + 2(uint16) + 32([32]byte)
-	default:
+	definition, ok := LookupMessageVariant(variant)
+	if !ok {
 		panic(NewErrMessageVariantIsNotSupported(variant))
 	}
+	return definition.NonBodyLength()
+}
+
+// HasGroupID returns true if messages of the variant carry a GroupID. It
+// returns false if the variant is not registered.
+func (variant MessageVariant) HasGroupID() bool {
+	definition, ok := LookupMessageVariant(variant)
+	return ok && definition.HasGroupID
 }
 
-// ValidateMessageVariant checks if the given variant is supported.
+// ValidateMessageVariant checks if the given variant is registered.
 func ValidateMessageVariant(variant MessageVariant) error {
-	switch variant {
-	case Ping, Pong, Cast, Multicast, Broadcast:
-		return nil
-	default:
+	if _, ok := LookupMessageVariant(variant); !ok {
 		return NewErrMessageVariantIsNotSupported(variant)
 	}
+	return nil
 }
 
 // MessageBody contains the content of the message.
@@ -130,13 +158,16 @@ func (body MessageBody) String() string {
 	return base64.RawStdEncoding.EncodeToString(body)
 }
 
-// Message is the object used for communicating in the network.
+// Message is the object used for communicating in the network. Extensions
+// are only sent with V2 messages, and are dropped when the message is sent
+// with V1.
 type Message struct {
-	Length  MessageLength
-	Version MessageVersion
-	Variant MessageVariant
-	GroupID GroupID
-	Body    MessageBody
+	Length     MessageLength
+	Version    MessageVersion
+	Variant    MessageVariant
+	GroupID    GroupID
+	Extensions Extensions
+	Body       MessageBody
 }
 
 // NewMessage returns a new message with given version, variant and body.
@@ -150,15 +181,14 @@ func NewMessage(version MessageVersion, variant MessageVariant, groupID GroupID,
 	if err := ValidateGroupID(groupID, variant); err != nil {
 		panic(err)
 	}
-	length := MessageLength(variant.NonBodyLength() + len(body))
-
-	return Message{
-		Length:  length,
+	message := Message{
 		Version: version,
 		Variant: variant,
 		GroupID: groupID,
 		Body:    body,
 	}
+	message.Length = MessageLength(message.HeaderLength() + len(body))
+	return message
 }
 
 // Hash returns the hash of the message.
@@ -2,8 +2,11 @@ package protocol_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"errors"
 	"testing/quick"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -30,6 +33,18 @@ var _ = Describe("Protocol", func() {
 			Expect(Cast.String()).To(Equal("cast"))
 			Expect(Multicast.String()).To(Equal("multicast"))
 			Expect(Broadcast.String()).To(Equal("broadcast"))
+			Expect(Stream.String()).To(Equal("stream"))
+			Expect(Request.String()).To(Equal("request"))
+			Expect(Response.String()).To(Equal("response"))
+			Expect(Publish.String()).To(Equal("publish"))
+			Expect(Gossip.String()).To(Equal("gossip"))
+			Expect(IHave.String()).To(Equal("ihave"))
+			Expect(Graft.String()).To(Equal("graft"))
+			Expect(Prune.String()).To(Equal("prune"))
+			Expect(Reliable.String()).To(Equal("reliable"))
+			Expect(Have.String()).To(Equal("have"))
+			Expect(Want.String()).To(Equal("want"))
+			Expect(Ack.String()).To(Equal("ack"))
 		})
 
 		It("should panic for invalid variants", func() {
@@ -42,6 +57,18 @@ var _ = Describe("Protocol", func() {
 			Expect(Cast.NonBodyLength()).To(Equal(8))
 			Expect(Multicast.NonBodyLength()).To(Equal(40))
 			Expect(Broadcast.NonBodyLength()).To(Equal(40))
+			Expect(Stream.NonBodyLength()).To(Equal(8))
+			Expect(Request.NonBodyLength()).To(Equal(8))
+			Expect(Response.NonBodyLength()).To(Equal(8))
+			Expect(Publish.NonBodyLength()).To(Equal(40))
+			Expect(Gossip.NonBodyLength()).To(Equal(8))
+			Expect(IHave.NonBodyLength()).To(Equal(40))
+			Expect(Graft.NonBodyLength()).To(Equal(40))
+			Expect(Prune.NonBodyLength()).To(Equal(40))
+			Expect(Reliable.NonBodyLength()).To(Equal(40))
+			Expect(Have.NonBodyLength()).To(Equal(40))
+			Expect(Want.NonBodyLength()).To(Equal(40))
+			Expect(Ack.NonBodyLength()).To(Equal(8))
 		})
 	})
 
@@ -102,4 +129,36 @@ var _ = Describe("Protocol", func() {
 			Expect(func() { message.Hash() }).To(Panic())
 		})
 	})
+
+	Context("when reporting the results of sending messages", func() {
+		It("should not block", func() {
+			results := make(chan error, 1)
+			messageOtw := MessageOnTheWire{Result: results}
+			messageOtw.ReportResult(nil)
+			messageOtw.ReportResult(errors.New("dropped"))
+			Expect(<-results).Should(BeNil())
+			Consistently(results).ShouldNot(Receive())
+
+			MessageOnTheWire{}.ReportResult(nil)
+		})
+
+		It("should return the errors of the messages that were not delivered", func() {
+			results := make(chan error, 3)
+			results <- nil
+			results <- NewErrMessageNotDelivered(RandomPeerID(), errors.New("unreachable"))
+			results <- nil
+			errs := WaitForResults(context.Background(), results, 3)
+			Expect(errs).Should(HaveLen(1))
+			Expect(errs[0]).Should(BeAssignableToTypeOf(ErrMessageNotDelivered{}))
+		})
+
+		It("should return the error of the context for missing results", func() {
+			results := make(chan error, 3)
+			results <- nil
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			errs := WaitForResults(ctx, results, 3)
+			Expect(errs).Should(Equal([]error{context.DeadlineExceeded, context.DeadlineExceeded}))
+		})
+	})
 })
@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"context"
+	"fmt"
 	"io"
 
 	"github.com/renproject/phi"
@@ -20,6 +21,10 @@ type SignVerifier interface {
 type Session interface {
 	ReadMessageOnTheWire(io.Reader) (MessageOnTheWire, error)
 	WriteMessage(io.Writer, Message) error
+
+	// Negotiation returns the values that were negotiated by both Peers while
+	// establishing the Session.
+	Negotiation() Negotiation
 }
 
 // SessionManager is able to establish new Session with a Peer.
@@ -28,6 +33,71 @@ type SessionManager interface {
 	NewSessionKey() []byte
 }
 
+// AEADSessionManager is a SessionManager that knows the authenticated
+// encryption scheme used by its Sessions. Peers negotiate the AEAD during the
+// handshake, so two SessionManagers with the same AEAD must be interoperable.
+type AEADSessionManager interface {
+	SessionManager
+
+	AEAD() AEAD
+}
+
+// SessionManagerAEAD returns the AEAD of the SessionManager. SessionManagers
+// that do not implement AEADSessionManager are assumed to use AES256GCM, which
+// was the only AEAD before AEADs were negotiated.
+func SessionManagerAEAD(sessionManager SessionManager) AEAD {
+	if sessionManager, ok := sessionManager.(AEADSessionManager); ok {
+		return sessionManager.AEAD()
+	}
+	return AES256GCM
+}
+
+// AEAD identifies the authenticated encryption scheme, including the nonce
+// scheme and framing, that a Session uses to secure messages.
+type AEAD uint8
+
+const (
+	NoAEAD           = AEAD(0) // No encryption or authentication
+	AES256GCM        = AEAD(1) // AES-256-GCM with nonces from a seeded generator
+	ChaCha20Poly1305 = AEAD(2) // ChaCha20-Poly1305 with nonces from a seeded generator
+	AES256GCMCounter = AEAD(3) // AES-256-GCM with counter nonces and rekeying
+	NoiseChaChaPoly  = AEAD(4) // ChaCha20-Poly1305 with the cipher states of a noise handshake
+
+	ChaCha20Poly1305Counter = AEAD(5) // ChaCha20-Poly1305 with counter nonces and rekeying
+)
+
+func (aead AEAD) String() string {
+	switch aead {
+	case NoAEAD:
+		return "none"
+	case AES256GCM:
+		return "aes-256-gcm"
+	case ChaCha20Poly1305:
+		return "chacha20-poly1305"
+	case AES256GCMCounter:
+		return "aes-256-gcm-counter"
+	case NoiseChaChaPoly:
+		return "noise-chachapoly"
+	case ChaCha20Poly1305Counter:
+		return "chacha20-poly1305-counter"
+	default:
+		return fmt.Sprintf("aead(%d)", uint8(aead))
+	}
+}
+
+// IsDuplex returns true if Sessions that use the AEAD can be written by both
+// Peers at the same time, because each direction uses its own nonces. Other
+// Sessions derive their nonces in lockstep, and must only be written by the
+// Peer that initiated the handshake.
+func (aead AEAD) IsDuplex() bool {
+	switch aead {
+	case NoAEAD, AES256GCMCounter, NoiseChaChaPoly, ChaCha20Poly1305Counter:
+		return true
+	default:
+		return false
+	}
+}
+
 // Client reads message from the MessageReceiver and sends the message to the
 // target Peer.
 type Client interface {
@@ -54,3 +124,24 @@ func ParForAllAddresses(addrs PeerAddresses, numWorkers int, f func(PeerAddress)
 		}
 	})
 }
+
+// WaitForResults reads n outcomes from the results, and returns the errors of
+// the messages that were not delivered. Outcomes that are not read before the
+// context is done are returned as the error of the context.
+func WaitForResults(ctx context.Context, results <-chan error, n int) []error {
+	errs := []error{}
+	for i := 0; i < n; i++ {
+		select {
+		case <-ctx.Done():
+			for ; i < n; i++ {
+				errs = append(errs, ctx.Err())
+			}
+			return errs
+		case err := <-results:
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errs
+}
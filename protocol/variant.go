@@ -0,0 +1,107 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// A VariantDefinition describes how messages of a MessageVariant are framed.
+// Applications can define their own variants by registering a
+// VariantDefinition with RegisterMessageVariant.
+type VariantDefinition struct {
+	Variant MessageVariant
+	Name    string // Returned by MessageVariant.String
+
+	// HasGroupID is true if messages of the variant carry a GroupID after the
+	// variant in the header.
+	HasGroupID bool
+}
+
+// NonBodyLength returns the length of the V1 header of messages of the
+// variant: len(MessageLength) + len(MessageVersion) + len(MessageVariant) +
+// len(GroupID).
+func (definition VariantDefinition) NonBodyLength() int {
+	if definition.HasGroupID {
+		return 40 // 4(uint32) + 2(uint16) + 2(uint16) + 32([32]byte)
+	}
+	return 8 // 4(uint32) + 2(uint16) + 2(uint16) + 0
+}
+
+var (
+	variantsMu = new(sync.RWMutex)
+	variants   = map[MessageVariant]VariantDefinition{}
+)
+
+func init() {
+	for _, definition := range []VariantDefinition{
+		{Variant: Ping, Name: "ping"},
+		{Variant: Pong, Name: "pong"},
+		{Variant: Cast, Name: "cast"},
+		{Variant: Multicast, Name: "multicast", HasGroupID: true},
+		{Variant: Broadcast, Name: "broadcast", HasGroupID: true},
+		{Variant: Stream, Name: "stream"},
+		{Variant: Request, Name: "request"},
+		{Variant: Response, Name: "response"},
+		{Variant: Publish, Name: "publish", HasGroupID: true},
+		{Variant: Gossip, Name: "gossip"},
+		{Variant: IHave, Name: "ihave", HasGroupID: true},
+		{Variant: Graft, Name: "graft", HasGroupID: true},
+		{Variant: Prune, Name: "prune", HasGroupID: true},
+		{Variant: Reliable, Name: "reliable", HasGroupID: true},
+		{Variant: Have, Name: "have", HasGroupID: true},
+		{Variant: Want, Name: "want", HasGroupID: true},
+		{Variant: Ack, Name: "ack"},
+	} {
+		if err := RegisterMessageVariant(definition); err != nil {
+			panic(fmt.Errorf("invariant violation: cannot register built-in variant: %v", err))
+		}
+	}
+}
+
+// RegisterMessageVariant registers a MessageVariant, so that messages of the
+// variant can be marshaled, unmarshaled and negotiated. Variants should be
+// registered before any Peers are created (for example, in an init function),
+// because the registered variants are advertised during handshakes. Each
+// variant can only be registered once. It is safe for concurrent use.
+func RegisterMessageVariant(definition VariantDefinition) error {
+	if definition.Variant == 0 {
+		return fmt.Errorf("error registering message variant: variant=0 is reserved")
+	}
+	if definition.Name == "" {
+		return fmt.Errorf("error registering message variant=%d: empty name", definition.Variant)
+	}
+
+	variantsMu.Lock()
+	defer variantsMu.Unlock()
+
+	if existing, ok := variants[definition.Variant]; ok {
+		return NewErrMessageVariantIsAlreadyRegistered(definition.Variant, existing.Name)
+	}
+	variants[definition.Variant] = definition
+	return nil
+}
+
+// LookupMessageVariant returns the VariantDefinition of a registered variant.
+func LookupMessageVariant(variant MessageVariant) (VariantDefinition, bool) {
+	variantsMu.RLock()
+	defer variantsMu.RUnlock()
+
+	definition, ok := variants[variant]
+	return definition, ok
+}
+
+// MessageVariants returns all registered variants in ascending order.
+func MessageVariants() []MessageVariant {
+	variantsMu.RLock()
+	defer variantsMu.RUnlock()
+
+	registered := make([]MessageVariant, 0, len(variants))
+	for variant := range variants {
+		registered = append(registered, variant)
+	}
+	sort.Slice(registered, func(i, j int) bool {
+		return registered[i] < registered[j]
+	})
+	return registered
+}
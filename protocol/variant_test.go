@@ -0,0 +1,85 @@
+package protocol_test
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/protocol"
+	. "github.com/renproject/aw/testutil"
+)
+
+// Variants registered by these tests. They are registered once, because the
+// registry is global.
+const (
+	customVariant        = MessageVariant(0x7B01)
+	customGroupedVariant = MessageVariant(0x7B02)
+)
+
+func init() {
+	if err := RegisterMessageVariant(VariantDefinition{Variant: customVariant, Name: "custom"}); err != nil {
+		panic(err)
+	}
+	if err := RegisterMessageVariant(VariantDefinition{Variant: customGroupedVariant, Name: "custom-grouped", HasGroupID: true}); err != nil {
+		panic(err)
+	}
+}
+
+var _ = Describe("Variants", func() {
+	Context("when using the built-in variants", func() {
+		It("should have registered them", func() {
+			for _, variant := range []MessageVariant{Ping, Pong, Cast, Multicast, Broadcast, Stream, Request, Response, Publish, Gossip, IHave, Graft, Prune, Reliable, Have, Want, Ack} {
+				definition, ok := LookupMessageVariant(variant)
+				Expect(ok).Should(BeTrue())
+				Expect(definition.Name).Should(Equal(variant.String()))
+				Expect(definition.HasGroupID).Should(Equal(variant == Multicast || variant == Broadcast || variant == Publish || variant == IHave || variant == Graft || variant == Prune || variant == Reliable || variant == Have || variant == Want))
+			}
+		})
+	})
+
+	Context("when registering a variant", func() {
+		It("should be valid", func() {
+			Expect(ValidateMessageVariant(customVariant)).Should(Succeed())
+			Expect(customVariant.String()).Should(Equal("custom"))
+			Expect(customVariant.NonBodyLength()).Should(Equal(8))
+			Expect(customVariant.HasGroupID()).Should(BeFalse())
+			Expect(customGroupedVariant.NonBodyLength()).Should(Equal(40))
+			Expect(customGroupedVariant.HasGroupID()).Should(BeTrue())
+		})
+
+		It("should be advertised in the default capabilities", func() {
+			Expect(MessageVariants()).Should(ContainElement(customVariant))
+			Expect(DefaultCapabilities().Variants).Should(ContainElement(customVariant))
+			Expect(DefaultCapabilities().Variants).Should(ContainElement(customGroupedVariant))
+		})
+
+		It("should marshal and unmarshal messages of the variant", func() {
+			for _, version := range []MessageVersion{V1, V2} {
+				for _, variant := range []MessageVariant{customVariant, customGroupedVariant} {
+					message := RandomMessage(version, variant)
+					data, err := message.MarshalBinary()
+					Expect(err).ShouldNot(HaveOccurred())
+
+					unmarshaled := Message{}
+					Expect(unmarshaled.UnmarshalBinary(data)).Should(Succeed())
+					Expect(unmarshaled.Variant).Should(Equal(variant))
+					Expect(unmarshaled.GroupID).Should(Equal(message.GroupID))
+					Expect(bytes.Equal(unmarshaled.Body, message.Body)).Should(BeTrue())
+				}
+			}
+		})
+
+		It("should return an error if the variant is already registered", func() {
+			err := RegisterMessageVariant(VariantDefinition{Variant: Cast, Name: "other"})
+			Expect(err).Should(BeAssignableToTypeOf(ErrMessageVariantIsAlreadyRegistered{}))
+			Expect(err.(ErrMessageVariantIsAlreadyRegistered).Name).Should(Equal("cast"))
+			Expect(Cast.String()).Should(Equal("cast"))
+		})
+
+		It("should return an error if the variant is zero or has no name", func() {
+			Expect(RegisterMessageVariant(VariantDefinition{Variant: 0, Name: "zero"})).ShouldNot(Succeed())
+			Expect(RegisterMessageVariant(VariantDefinition{Variant: MessageVariant(0x7B03)})).ShouldNot(Succeed())
+			Expect(ValidateMessageVariant(MessageVariant(0x7B03))).ShouldNot(Succeed())
+		})
+	})
+})
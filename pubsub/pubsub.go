@@ -0,0 +1,644 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/broadcast"
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	frameData        = byte(1) // A message published to a topic
+	frameSubscribe   = byte(2) // The sender is interested in a topic
+	frameUnsubscribe = byte(3) // The sender is no longer interested in a topic
+
+	// MaxTopicLength is the maximum number of bytes in a topic.
+	MaxTopicLength = 255
+
+	// nonceLength is the length of the random nonce in data frames. The nonce
+	// stops the same body from being ignored when it is published more than
+	// once.
+	nonceLength = 8
+)
+
+// Options are used to parameterise the behaviour of a PubSub.
+type Options struct {
+	Logger     logrus.FieldLogger
+	NumWorkers int
+
+	// Capacity is the number of messages that can be buffered by each
+	// Subscription. Messages are dropped when the buffer of a Subscription is
+	// full. Defaults to 64.
+	Capacity int
+
+	// AdvertiseInterval is how often the topics of the local Subscriptions are
+	// advertised to all known peers. Defaults to 30 seconds.
+	AdvertiseInterval time.Duration
+
+	// InterestTTL is how long the interest of a peer in a topic is kept after
+	// its last advertisement. Defaults to 3 times the AdvertiseInterval.
+	InterestTTL time.Duration
+
+	// MaxTopics is the maximum number of topics that each peer can be
+	// interested in. Advertisements of other topics are dropped until the
+	// peer unsubscribes from some of its topics, or its interest in them
+	// expires. Defaults to 1024.
+	MaxTopics int
+
+	// MaxTopicLength is the maximum number of bytes in the topics that are
+	// advertised by other peers. Advertisements of longer topics are dropped.
+	// Defaults to, and cannot be more than, the MaxTopicLength constant.
+	MaxTopicLength int
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.Logger == nil {
+		options.Logger = logrus.New()
+	}
+	if options.NumWorkers <= 0 {
+		options.NumWorkers = 2 * runtime.NumCPU()
+	}
+	if options.Capacity <= 0 {
+		options.Capacity = 64
+	}
+	if options.AdvertiseInterval <= 0 {
+		options.AdvertiseInterval = 30 * time.Second
+	}
+	if options.InterestTTL <= 0 {
+		options.InterestTTL = 3 * options.AdvertiseInterval
+	}
+	if options.MaxTopics <= 0 {
+		options.MaxTopics = 1024
+	}
+	if options.MaxTopicLength <= 0 || options.MaxTopicLength > MaxTopicLength {
+		options.MaxTopicLength = MaxTopicLength
+	}
+}
+
+// A Message is a message that has been published to a topic.
+type Message struct {
+	Time  time.Time
+	Topic string
+	Body  protocol.MessageBody
+
+	// From is the peer that forwarded the message to this peer. It is not
+	// necessarily the peer that published the message.
+	From protocol.PeerID
+}
+
+// A Validator checks messages that are published to a topic. Messages that
+// fail validation are not delivered to Subscriptions and not forwarded to
+// other peers.
+type Validator func(from protocol.PeerID, topic string, body protocol.MessageBody) error
+
+// A PubSub publishes messages to topics, and delivers the messages of topics
+// that have been subscribed to. Subscriptions are advertised to all known
+// peers, and messages are only broadcast to the peers that are interested in
+// their topic.
+type PubSub interface {
+	// Run the PubSub until the context is done. Subscriptions do not receive
+	// messages from remote peers, and are not advertised, unless the PubSub is
+	// running.
+	Run(ctx context.Context)
+
+	// Subscribe to a topic. The topic is advertised to all known peers, if
+	// there are no other Subscriptions to it.
+	Subscribe(ctx context.Context, topic string) (*Subscription, error)
+
+	// Publish a message to all peers that are interested in the topic,
+	// including the Subscriptions of this peer. It returns an
+	// ErrMessageRejected if the Validator of the topic rejects the message.
+	Publish(ctx context.Context, topic string, body protocol.MessageBody) error
+
+	// Validate the messages of a topic using the Validator. It replaces the
+	// previous Validator of the topic. A nil Validator accepts all messages.
+	Validate(topic string, validator Validator) error
+
+	// AcceptPublish handles a Publish message from a remote peer.
+	AcceptPublish(ctx context.Context, from protocol.PeerID, message protocol.Message) error
+}
+
+// A Subscription receives the messages that are published to a topic.
+type Subscription struct {
+	topic    string
+	messages chan Message
+	pubsub   *pubsub
+	once     *sync.Once
+}
+
+// Topic returns the topic of the Subscription.
+func (subscription *Subscription) Topic() string {
+	return subscription.topic
+}
+
+// Messages returns the channel of messages that are published to the topic.
+// It is closed after the Subscription is cancelled.
+func (subscription *Subscription) Messages() <-chan Message {
+	return subscription.messages
+}
+
+// Unsubscribe cancels the Subscription. If it is the last Subscription to the
+// topic, then all known peers are told that this peer is no longer interested
+// in the topic. It is safe to call more than once.
+func (subscription *Subscription) Unsubscribe() {
+	subscription.once.Do(func() {
+		subscription.pubsub.unsubscribe(subscription)
+	})
+}
+
+type pubsub struct {
+	options     Options
+	messages    protocol.MessageSender
+	dht         dht.DHT
+	broadcaster broadcast.Broadcaster
+	events      chan protocol.Event
+
+	mu            *sync.RWMutex
+	subscriptions map[string]map[*Subscription]struct{}
+	validators    map[string]Validator
+	interests     map[string]map[string]interest
+	numTopics     map[string]int // Number of topics that each peer is interested in
+}
+
+// interest is the interest of a remote peer in a topic.
+type interest struct {
+	peerID protocol.PeerID
+	expiry time.Time
+}
+
+// NewPubSub returns a PubSub that sends messages through the
+// protocol.MessageSender, and stores the peers that are interested in each
+// topic as a group in the DHT.
+func NewPubSub(options Options, messages protocol.MessageSender, dht dht.DHT) PubSub {
+	options.setZerosToDefaults()
+	pubsub := &pubsub{
+		options:  options,
+		messages: messages,
+		dht:      dht,
+		events:   make(chan protocol.Event, options.Capacity),
+
+		mu:            new(sync.RWMutex),
+		subscriptions: map[string]map[*Subscription]struct{}{},
+		validators:    map[string]Validator{},
+		interests:     map[string]map[string]interest{},
+		numTopics:     map[string]int{},
+	}
+	pubsub.broadcaster = broadcast.NewBroadcasterWithOptions(broadcast.Options{
+		Logger:     options.Logger,
+		NumWorkers: options.NumWorkers,
+		Variant:    protocol.Publish,
+		Validate:   pubsub.validate,
+	}, messages, pubsub.events, dht)
+	return pubsub
+}
+
+// TopicGroupID returns the GroupID of the peers that are interested in a
+// topic.
+func TopicGroupID(topic string) protocol.GroupID {
+	return protocol.GroupID(sha256.Sum256([]byte("pubsub/" + topic)))
+}
+
+// ValidateTopic checks that a topic is not empty, and is not longer than the
+// MaxTopicLength.
+func ValidateTopic(topic string) error {
+	if len(topic) == 0 || len(topic) > MaxTopicLength {
+		return NewErrInvalidTopic(topic)
+	}
+	return nil
+}
+
+func (pubsub *pubsub) Run(ctx context.Context) {
+	go pubsub.broadcaster.Run(ctx)
+
+	ticker := time.NewTicker(pubsub.options.AdvertiseInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-pubsub.events:
+			if event, ok := event.(protocol.EventMessageReceived); ok {
+				pubsub.deliver(event.From, event.Message)
+			}
+		case <-ticker.C:
+			pubsub.expireInterests()
+			for _, topic := range pubsub.topics() {
+				pubsub.advertise(ctx, frameSubscribe, topic)
+			}
+		}
+	}
+}
+
+func (pubsub *pubsub) Subscribe(ctx context.Context, topic string) (*Subscription, error) {
+	if err := ValidateTopic(topic); err != nil {
+		return nil, err
+	}
+	subscription := &Subscription{
+		topic:    topic,
+		messages: make(chan Message, pubsub.options.Capacity),
+		pubsub:   pubsub,
+		once:     new(sync.Once),
+	}
+
+	pubsub.mu.Lock()
+	subscriptions, ok := pubsub.subscriptions[topic]
+	if !ok {
+		subscriptions = map[*Subscription]struct{}{}
+		pubsub.subscriptions[topic] = subscriptions
+	}
+	subscriptions[subscription] = struct{}{}
+	pubsub.mu.Unlock()
+
+	if !ok {
+		pubsub.advertise(ctx, frameSubscribe, topic)
+	}
+	return subscription, nil
+}
+
+func (pubsub *pubsub) unsubscribe(subscription *Subscription) {
+	pubsub.mu.Lock()
+	subscriptions := pubsub.subscriptions[subscription.topic]
+	delete(subscriptions, subscription)
+	last := len(subscriptions) == 0
+	if last {
+		delete(pubsub.subscriptions, subscription.topic)
+	}
+	close(subscription.messages)
+	pubsub.mu.Unlock()
+
+	if last {
+		// Unsubscribing does not block, so the advertisement is sent in the
+		// background. Peers that do not receive it will forget the interest of
+		// this peer after the InterestTTL.
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), pubsub.options.AdvertiseInterval)
+			defer cancel()
+			pubsub.advertise(ctx, frameUnsubscribe, subscription.topic)
+		}()
+	}
+}
+
+func (pubsub *pubsub) Publish(ctx context.Context, topic string, body protocol.MessageBody) error {
+	if err := ValidateTopic(topic); err != nil {
+		return err
+	}
+	me := pubsub.dht.Me().PeerID()
+	if err := pubsub.validator(topic)(me, topic, body); err != nil {
+		return NewErrMessageRejected(topic, err)
+	}
+
+	nonce := [nonceLength]byte{}
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return fmt.Errorf("error publishing to topic=%v: %v", topic, err)
+	}
+	frame := encodeFrame(frameData, topic, append(nonce[:], body...))
+	if err := pubsub.syncGroup(topic); err != nil {
+		return err
+	}
+	pubsub.deliver(me, frame)
+	return pubsub.broadcaster.Broadcast(ctx, TopicGroupID(topic), frame)
+}
+
+func (pubsub *pubsub) Validate(topic string, validator Validator) error {
+	if err := ValidateTopic(topic); err != nil {
+		return err
+	}
+
+	pubsub.mu.Lock()
+	defer pubsub.mu.Unlock()
+
+	if validator == nil {
+		delete(pubsub.validators, topic)
+		return nil
+	}
+	pubsub.validators[topic] = validator
+	return nil
+}
+
+func (pubsub *pubsub) AcceptPublish(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	// Pre-condition checks
+	if err := protocol.ValidateMessageVersion(message.Version); err != nil {
+		return err
+	}
+	if message.Variant != protocol.Publish {
+		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
+	}
+	frameType, topic, _, err := decodeFrame(message.Body)
+	if err != nil {
+		return err
+	}
+
+	switch frameType {
+	case frameData:
+		if !message.GroupID.Equal(TopicGroupID(topic)) {
+			return fmt.Errorf("error accepting publish: group id does not match topic=%v", topic)
+		}
+		// Messages are forwarded to the peers that are interested in the
+		// topic, so the group must exist even if there are none.
+		if err := pubsub.syncGroup(topic); err != nil {
+			return err
+		}
+		return pubsub.broadcaster.AcceptBroadcast(ctx, from, message)
+
+	case frameSubscribe:
+		isNew, err := pubsub.addInterest(topic, from)
+		if err != nil {
+			return err
+		}
+		// Tell new peers about our own interest in the topic, so that they do
+		// not need to wait for the next advertisement.
+		if isNew && pubsub.isSubscribed(topic) {
+			pubsub.advertiseTo(ctx, frameSubscribe, topic, from)
+		}
+		return nil
+
+	case frameUnsubscribe:
+		return pubsub.removeInterest(topic, from)
+
+	default:
+		return fmt.Errorf("error accepting publish: unexpected frame type=%d", frameType)
+	}
+}
+
+// validate is used by the Broadcaster to reject messages before they are
+// forwarded.
+func (pubsub *pubsub) validate(from protocol.PeerID, message protocol.Message) error {
+	frameType, topic, data, err := decodeFrame(message.Body)
+	if err != nil {
+		return err
+	}
+	if frameType != frameData || len(data) < nonceLength {
+		return fmt.Errorf("malformed data frame for topic=%v", topic)
+	}
+	return pubsub.validator(topic)(from, topic, data[nonceLength:])
+}
+
+func (pubsub *pubsub) validator(topic string) Validator {
+	pubsub.mu.RLock()
+	defer pubsub.mu.RUnlock()
+
+	if validator, ok := pubsub.validators[topic]; ok {
+		return validator
+	}
+	return func(protocol.PeerID, string, protocol.MessageBody) error { return nil }
+}
+
+// deliver a data frame to the Subscriptions of its topic. Messages are dropped
+// for Subscriptions that are not keeping up, so that they cannot block other
+// Subscriptions.
+func (pubsub *pubsub) deliver(from protocol.PeerID, body protocol.MessageBody) {
+	frameType, topic, data, err := decodeFrame(body)
+	if err != nil || frameType != frameData || len(data) < nonceLength {
+		return
+	}
+	message := Message{
+		Time:  time.Now(),
+		Topic: topic,
+		Body:  data[nonceLength:],
+		From:  from,
+	}
+
+	pubsub.mu.RLock()
+	defer pubsub.mu.RUnlock()
+
+	for subscription := range pubsub.subscriptions[topic] {
+		select {
+		case subscription.messages <- message:
+		default:
+			pubsub.options.Logger.Warnf("dropping message for topic=%v: subscription is full", topic)
+		}
+	}
+}
+
+func (pubsub *pubsub) isSubscribed(topic string) bool {
+	pubsub.mu.RLock()
+	defer pubsub.mu.RUnlock()
+
+	_, ok := pubsub.subscriptions[topic]
+	return ok
+}
+
+func (pubsub *pubsub) topics() []string {
+	pubsub.mu.RLock()
+	defer pubsub.mu.RUnlock()
+
+	topics := make([]string, 0, len(pubsub.subscriptions))
+	for topic := range pubsub.subscriptions {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// addInterest records that a peer is interested in a topic, and returns true
+// if it was not already interested. Topics that are longer than the
+// MaxTopicLength, and new topics of peers that are already interested in
+// MaxTopics topics, are dropped.
+func (pubsub *pubsub) addInterest(topic string, peerID protocol.PeerID) (bool, error) {
+	if len(topic) > pubsub.options.MaxTopicLength {
+		return false, newErrInvalidTopic(topic, pubsub.options.MaxTopicLength)
+	}
+
+	pubsub.mu.Lock()
+	defer pubsub.mu.Unlock()
+
+	interests := pubsub.interests[topic]
+	_, ok := interests[peerID.String()]
+	if !ok {
+		if pubsub.numTopics[peerID.String()] >= pubsub.options.MaxTopics {
+			return false, NewErrTooManyTopics(peerID, pubsub.options.MaxTopics)
+		}
+		pubsub.numTopics[peerID.String()]++
+	}
+	if interests == nil {
+		interests = map[string]interest{}
+		pubsub.interests[topic] = interests
+	}
+	interests[peerID.String()] = interest{
+		peerID: peerID,
+		expiry: time.Now().Add(pubsub.options.InterestTTL),
+	}
+	return !ok, pubsub.syncGroupWithoutLock(topic)
+}
+
+func (pubsub *pubsub) removeInterest(topic string, peerID protocol.PeerID) error {
+	pubsub.mu.Lock()
+	defer pubsub.mu.Unlock()
+
+	interests, ok := pubsub.interests[topic]
+	if !ok {
+		return nil
+	}
+	if _, ok := interests[peerID.String()]; !ok {
+		return nil
+	}
+	delete(interests, peerID.String())
+	pubsub.forgetTopicWithoutLock(peerID.String())
+	return pubsub.syncGroupWithoutLock(topic)
+}
+
+// forgetTopicWithoutLock decrements the number of topics that a peer is
+// interested in.
+func (pubsub *pubsub) forgetTopicWithoutLock(key string) {
+	pubsub.numTopics[key]--
+	if pubsub.numTopics[key] <= 0 {
+		delete(pubsub.numTopics, key)
+	}
+}
+
+// expireInterests forgets the peers that have not advertised their interest
+// in a topic within the InterestTTL.
+func (pubsub *pubsub) expireInterests() {
+	pubsub.mu.Lock()
+	defer pubsub.mu.Unlock()
+
+	now := time.Now()
+	for topic, interests := range pubsub.interests {
+		for key, interest := range interests {
+			if now.After(interest.expiry) {
+				delete(interests, key)
+				pubsub.forgetTopicWithoutLock(key)
+			}
+		}
+		if len(interests) == 0 {
+			delete(pubsub.interests, topic)
+			pubsub.dht.RemoveGroup(TopicGroupID(topic))
+			continue
+		}
+		if err := pubsub.syncGroupWithoutLock(topic); err != nil {
+			pubsub.options.Logger.Errorf("error updating interests in topic=%v: %v", topic, err)
+		}
+	}
+}
+
+func (pubsub *pubsub) syncGroup(topic string) error {
+	pubsub.mu.Lock()
+	defer pubsub.mu.Unlock()
+
+	return pubsub.syncGroupWithoutLock(topic)
+}
+
+// syncGroupWithoutLock writes the peers that are interested in a topic to the
+// group of the topic in the DHT.
+func (pubsub *pubsub) syncGroupWithoutLock(topic string) error {
+	interests := pubsub.interests[topic]
+	ids := make(protocol.PeerIDs, 0, len(interests))
+	for _, interest := range interests {
+		ids = append(ids, interest.peerID)
+	}
+	return pubsub.dht.AddGroup(TopicGroupID(topic), ids)
+}
+
+// advertise a subscribe or unsubscribe frame to all known peers.
+func (pubsub *pubsub) advertise(ctx context.Context, frameType byte, topic string) {
+	addrs, err := pubsub.dht.PeerAddresses()
+	if err != nil {
+		pubsub.options.Logger.Errorf("error advertising topic=%v: error loading peer addresses: %v", topic, err)
+		return
+	}
+	message := protocol.NewMessage(protocol.V1, protocol.Publish, protocol.NilGroupID, encodeFrame(frameType, topic, nil))
+	protocol.ParForAllAddresses(addrs, pubsub.options.NumWorkers, func(to protocol.PeerAddress) {
+		pubsub.send(ctx, to, message)
+	})
+}
+
+// advertiseTo sends a subscribe or unsubscribe frame to one peer.
+func (pubsub *pubsub) advertiseTo(ctx context.Context, frameType byte, topic string, peerID protocol.PeerID) {
+	to, err := pubsub.dht.PeerAddress(peerID)
+	if err != nil {
+		pubsub.options.Logger.Debugf("error advertising topic=%v to %v: %v", topic, peerID, err)
+		return
+	}
+	pubsub.send(ctx, to, protocol.NewMessage(protocol.V1, protocol.Publish, protocol.NilGroupID, encodeFrame(frameType, topic, nil)))
+}
+
+func (pubsub *pubsub) send(ctx context.Context, to protocol.PeerAddress, message protocol.Message) {
+	select {
+	case <-ctx.Done():
+		pubsub.options.Logger.Debugf("cannot send message to %v, %v", to.PeerID(), ctx.Err())
+	case pubsub.messages <- protocol.MessageOnTheWire{To: to, Message: message}:
+	}
+}
+
+// encodeFrame returns a frame with the type, the length of the topic, the
+// topic, and the data.
+func encodeFrame(frameType byte, topic string, data []byte) protocol.MessageBody {
+	frame := make(protocol.MessageBody, 0, 2+len(topic)+len(data))
+	frame = append(frame, frameType, byte(len(topic)))
+	frame = append(frame, topic...)
+	return append(frame, data...)
+}
+
+func decodeFrame(body protocol.MessageBody) (byte, string, []byte, error) {
+	if len(body) < 2 {
+		return 0, "", nil, fmt.Errorf("error decoding frame: expected len>=2, got len=%v", len(body))
+	}
+	topicLength := int(body[1])
+	if topicLength == 0 || len(body) < 2+topicLength {
+		return 0, "", nil, fmt.Errorf("error decoding frame: invalid topic length=%v", topicLength)
+	}
+	return body[0], string(body[2 : 2+topicLength]), body[2+topicLength:], nil
+}
+
+// ErrInvalidTopic is returned when a topic is empty, or is longer than the
+// MaxTopicLength.
+type ErrInvalidTopic struct {
+	error
+	Topic string
+}
+
+// NewErrInvalidTopic returns an error for an invalid topic.
+func NewErrInvalidTopic(topic string) error {
+	return newErrInvalidTopic(topic, MaxTopicLength)
+}
+
+func newErrInvalidTopic(topic string, max int) error {
+	return ErrInvalidTopic{
+		error: fmt.Errorf("invalid topic=%q: expected 0<len<=%v, got len=%v", topic, max, len(topic)),
+		Topic: topic,
+	}
+}
+
+// ErrTooManyTopics is returned when a peer advertises its interest in a new
+// topic, but is already interested in the maximum number of topics.
+type ErrTooManyTopics struct {
+	error
+	PeerID protocol.PeerID
+	Max    int
+}
+
+// NewErrTooManyTopics returns an error for a peer that is already interested
+// in the given maximum number of topics.
+func NewErrTooManyTopics(peerID protocol.PeerID, max int) error {
+	return ErrTooManyTopics{
+		error:  fmt.Errorf("too many topics from peer=%v: expected at most %v", peerID, max),
+		PeerID: peerID,
+		Max:    max,
+	}
+}
+
+// ErrMessageRejected is returned when a message is published to a topic, and
+// is rejected by the Validator of the topic.
+type ErrMessageRejected struct {
+	error
+	Topic  string
+	Reason error
+}
+
+// NewErrMessageRejected returns an error for a message that has been rejected
+// by the Validator of the topic for the given reason.
+func NewErrMessageRejected(topic string, reason error) error {
+	return ErrMessageRejected{
+		error:  fmt.Errorf("message rejected by validator of topic=%v: %v", topic, reason),
+		Topic:  topic,
+		Reason: reason,
+	}
+}
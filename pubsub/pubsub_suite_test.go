@@ -0,0 +1,13 @@
+package pubsub_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestPubSub(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "PubSub Suite")
+}
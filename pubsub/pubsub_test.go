@@ -0,0 +1,290 @@
+package pubsub_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/pubsub"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("PubSub", func() {
+
+	// network returns n PubSubs that know about, and are connected to, each
+	// other. It also returns the number of published messages that have been
+	// received by each PubSub.
+	network := func(ctx context.Context, n int, options Options) ([]PubSub, []protocol.PeerID, []*int64) {
+		addrs := make([]protocol.PeerAddress, n)
+		for i := range addrs {
+			addrs[i] = RandomAddress()
+		}
+		pubsubs := make([]PubSub, n)
+		ids := make([]protocol.PeerID, n)
+		received := make([]*int64, n)
+		messages := make([]chan protocol.MessageOnTheWire, n)
+		for i := range pubsubs {
+			dht := NewDHT(addrs[i], NewTable("dht"), nil)
+			for j := range addrs {
+				if i != j {
+					Expect(dht.AddPeerAddress(addrs[j])).NotTo(HaveOccurred())
+				}
+			}
+			messages[i] = make(chan protocol.MessageOnTheWire, 128)
+			pubsubs[i] = NewPubSub(options, messages[i], dht)
+			ids[i] = addrs[i].PeerID()
+			received[i] = new(int64)
+		}
+
+		forward := func(i int) {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case message := <-messages[i]:
+					for j := range ids {
+						if !ids[j].Equal(message.To.PeerID()) {
+							continue
+						}
+						if !message.Message.GroupID.Equal(protocol.NilGroupID) {
+							atomic.AddInt64(received[j], 1)
+						}
+						pubsubs[j].AcceptPublish(ctx, ids[i], message.Message)
+					}
+				}
+			}
+		}
+		for i := range pubsubs {
+			go pubsubs[i].Run(ctx)
+			go forward(i)
+		}
+		return pubsubs, ids, received
+	}
+
+	options := func() Options {
+		return Options{
+			Logger:            logrus.New(),
+			AdvertiseInterval: 100 * time.Millisecond,
+		}
+	}
+
+	receive := func(subscription *Subscription) Message {
+		var message Message
+		Eventually(subscription.Messages(), 5*time.Second).Should(Receive(&message))
+		return message
+	}
+
+	Context("when publishing to a topic", func() {
+		It("should deliver messages to the subscriptions of all peers", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			pubsubs, ids, _ := network(ctx, 4, options())
+
+			subscriptions := make([]*Subscription, len(pubsubs))
+			for i := range pubsubs {
+				var err error
+				subscriptions[i], err = pubsubs[i].Subscribe(ctx, "topic")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(subscriptions[i].Topic()).Should(Equal("topic"))
+			}
+			time.Sleep(200 * time.Millisecond)
+
+			body := RandomMessageBody()
+			Expect(pubsubs[0].Publish(ctx, "topic", body)).To(Succeed())
+			for i := range subscriptions {
+				message := receive(subscriptions[i])
+				Expect(message.Topic).Should(Equal("topic"))
+				Expect(bytes.Equal(message.Body, body)).Should(BeTrue())
+				if i == 0 {
+					Expect(message.From.Equal(ids[0])).Should(BeTrue())
+				}
+				Consistently(subscriptions[i].Messages(), 100*time.Millisecond).ShouldNot(Receive())
+			}
+		})
+
+		It("should deliver the same body more than once", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			pubsubs, _, _ := network(ctx, 2, options())
+
+			subscription, err := pubsubs[1].Subscribe(ctx, "topic")
+			Expect(err).NotTo(HaveOccurred())
+			time.Sleep(200 * time.Millisecond)
+
+			body := RandomMessageBody()
+			Expect(pubsubs[0].Publish(ctx, "topic", body)).To(Succeed())
+			Expect(pubsubs[0].Publish(ctx, "topic", body)).To(Succeed())
+			Expect(bytes.Equal(receive(subscription).Body, body)).Should(BeTrue())
+			Expect(bytes.Equal(receive(subscription).Body, body)).Should(BeTrue())
+		})
+
+		It("should only send messages to peers that are interested in the topic", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			pubsubs, _, received := network(ctx, 4, options())
+
+			subscription, err := pubsubs[1].Subscribe(ctx, "topic")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = pubsubs[2].Subscribe(ctx, "another topic")
+			Expect(err).NotTo(HaveOccurred())
+			time.Sleep(200 * time.Millisecond)
+
+			Expect(pubsubs[0].Publish(ctx, "topic", RandomMessageBody())).To(Succeed())
+			receive(subscription)
+			time.Sleep(100 * time.Millisecond)
+			Expect(atomic.LoadInt64(received[1])).Should(Equal(int64(1)))
+			Expect(atomic.LoadInt64(received[2])).Should(BeZero())
+			Expect(atomic.LoadInt64(received[3])).Should(BeZero())
+		})
+	})
+
+	Context("when unsubscribing", func() {
+		It("should close the subscription and stop receiving messages", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			pubsubs, _, received := network(ctx, 2, options())
+
+			subscription, err := pubsubs[1].Subscribe(ctx, "topic")
+			Expect(err).NotTo(HaveOccurred())
+			time.Sleep(200 * time.Millisecond)
+			subscription.Unsubscribe()
+			subscription.Unsubscribe()
+			Eventually(subscription.Messages()).Should(BeClosed())
+			time.Sleep(200 * time.Millisecond)
+
+			Expect(pubsubs[0].Publish(ctx, "topic", RandomMessageBody())).To(Succeed())
+			time.Sleep(100 * time.Millisecond)
+			Expect(atomic.LoadInt64(received[1])).Should(BeZero())
+		})
+	})
+
+	Context("when validating a topic", func() {
+		It("should reject local messages that fail validation", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			pubsubs, _, _ := network(ctx, 1, options())
+
+			Expect(pubsubs[0].Validate("topic", func(from protocol.PeerID, topic string, body protocol.MessageBody) error {
+				return errors.New("rejected")
+			})).To(Succeed())
+			err := pubsubs[0].Publish(ctx, "topic", RandomMessageBody())
+			Expect(err).To(HaveOccurred())
+			_, ok := err.(ErrMessageRejected)
+			Expect(ok).Should(BeTrue())
+
+			Expect(pubsubs[0].Validate("topic", nil)).To(Succeed())
+			Expect(pubsubs[0].Publish(ctx, "topic", RandomMessageBody())).To(Succeed())
+		})
+
+		It("should not deliver or forward remote messages that fail validation", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			pubsubs, _, received := network(ctx, 3, options())
+
+			subscriptions := make([]*Subscription, len(pubsubs))
+			for i := range pubsubs {
+				var err error
+				subscriptions[i], err = pubsubs[i].Subscribe(ctx, "topic")
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(pubsubs[1].Validate("topic", func(from protocol.PeerID, topic string, body protocol.MessageBody) error {
+				if bytes.HasPrefix(body, []byte("bad")) {
+					return errors.New("rejected")
+				}
+				return nil
+			})).To(Succeed())
+			time.Sleep(200 * time.Millisecond)
+
+			Expect(pubsubs[0].Publish(ctx, "topic", []byte("bad message"))).To(Succeed())
+			Expect(string(receive(subscriptions[2]).Body)).Should(Equal("bad message"))
+			Consistently(subscriptions[1].Messages(), 200*time.Millisecond).ShouldNot(Receive())
+
+			// Peer 2 forwards the message back to peer 0 and to peer 1, but
+			// peer 1 does not forward the message at all.
+			Expect(atomic.LoadInt64(received[0])).Should(Equal(int64(1)))
+		})
+	})
+
+	Context("when using invalid topics", func() {
+		It("should return an error", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			pubsubs, _, _ := network(ctx, 1, options())
+
+			for _, topic := range []string{"", strings.Repeat("x", MaxTopicLength+1)} {
+				_, err := pubsubs[0].Subscribe(ctx, topic)
+				Expect(err).To(HaveOccurred())
+				_, ok := err.(ErrInvalidTopic)
+				Expect(ok).Should(BeTrue())
+				Expect(pubsubs[0].Publish(ctx, topic, RandomMessageBody())).NotTo(Succeed())
+				Expect(pubsubs[0].Validate(topic, nil)).NotTo(Succeed())
+			}
+		})
+	})
+
+	Context("when a peer advertises too many topics", func() {
+		// frame returns a message with a subscribe or unsubscribe frame.
+		frame := func(frameType byte, topic string) protocol.Message {
+			body := append([]byte{frameType, byte(len(topic))}, topic...)
+			return protocol.NewMessage(protocol.V1, protocol.Publish, protocol.NilGroupID, body)
+		}
+
+		It("should drop the advertisements of new topics", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			opts := options()
+			opts.MaxTopics = 2
+			pubsubs, _, _ := network(ctx, 1, opts)
+
+			from := RandomPeerID()
+			Expect(pubsubs[0].AcceptPublish(ctx, from, frame(2, "a"))).To(Succeed())
+			Expect(pubsubs[0].AcceptPublish(ctx, from, frame(2, "b"))).To(Succeed())
+			err := pubsubs[0].AcceptPublish(ctx, from, frame(2, "c"))
+			Expect(err).Should(BeAssignableToTypeOf(ErrTooManyTopics{}))
+			Expect(err.(ErrTooManyTopics).PeerID.Equal(from)).Should(BeTrue())
+
+			// Other peers, and topics that the peer is already interested in,
+			// are not affected.
+			Expect(pubsubs[0].AcceptPublish(ctx, RandomPeerID(), frame(2, "c"))).To(Succeed())
+			Expect(pubsubs[0].AcceptPublish(ctx, from, frame(2, "a"))).To(Succeed())
+
+			// New topics are accepted once the peer has unsubscribed.
+			Expect(pubsubs[0].AcceptPublish(ctx, from, frame(3, "a"))).To(Succeed())
+			Expect(pubsubs[0].AcceptPublish(ctx, from, frame(2, "c"))).To(Succeed())
+		})
+
+		It("should drop the advertisements of long topics", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			opts := options()
+			opts.MaxTopicLength = 4
+			pubsubs, _, _ := network(ctx, 1, opts)
+
+			Expect(pubsubs[0].AcceptPublish(ctx, RandomPeerID(), frame(2, "abcd"))).To(Succeed())
+			Expect(pubsubs[0].AcceptPublish(ctx, RandomPeerID(), frame(2, "abcde"))).Should(BeAssignableToTypeOf(ErrInvalidTopic{}))
+		})
+	})
+
+	Context("when accepting invalid messages", func() {
+		It("should return an error", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			pubsubs, _, _ := network(ctx, 1, options())
+
+			message := protocol.NewMessage(protocol.V1, protocol.Broadcast, RandomGroupID(), RandomMessageBody())
+			Expect(pubsubs[0].AcceptPublish(ctx, RandomPeerID(), message)).NotTo(Succeed())
+			message = protocol.NewMessage(protocol.V1, protocol.Publish, RandomGroupID(), protocol.MessageBody{1})
+			Expect(pubsubs[0].AcceptPublish(ctx, RandomPeerID(), message)).NotTo(Succeed())
+			message = protocol.NewMessage(protocol.V1, protocol.Publish, RandomGroupID(), append([]byte{1, 5}, "topic12345678"...))
+			Expect(pubsubs[0].AcceptPublish(ctx, RandomPeerID(), message)).NotTo(Succeed())
+		})
+	})
+})
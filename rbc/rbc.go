@@ -0,0 +1,459 @@
+package rbc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/broadcast"
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/id"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	frameSend  = byte(1) // The origin sends its message to the group
+	frameEcho  = byte(2) // The sender has received the message from the origin
+	frameReady = byte(3) // The sender is ready to deliver the message
+)
+
+// Options are used to parameterise the behaviour of a ReliableBroadcaster.
+type Options struct {
+	Logger     logrus.FieldLogger
+	NumWorkers int
+
+	// Window bounds the number of messages waiting for delivery that are
+	// tracked for each origin. Frames of a message are dropped, unless its
+	// sequence is less than Window away from the highest sequence of the
+	// origin that has been delivered (or less than Window, before a message
+	// of the origin has been delivered). Origins should therefore use
+	// increasing sequences, starting from zero. Defaults to 1024.
+	Window uint64
+
+	// Timeout after which messages that have not been delivered are
+	// forgotten, so that messages that will never be delivered, such as
+	// messages that a faulty origin only sends to some peers, are not tracked
+	// forever. Defaults to 1 minute.
+	Timeout time.Duration
+
+	// Delivered remembers the messages that have been delivered, so that
+	// frames that arrive after delivery are ignored. It should not use
+	// broadcast.SeenCacheBloom mode, because false positives stop messages
+	// from being delivered. Defaults to a broadcast.SeenCache with the default
+	// options.
+	Delivered broadcast.SeenCache
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.Logger == nil {
+		options.Logger = logrus.New()
+	}
+	if options.NumWorkers <= 0 {
+		options.NumWorkers = 2 * runtime.NumCPU()
+	}
+	if options.Window == 0 {
+		options.Window = 1024
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = time.Minute
+	}
+	if options.Delivered == nil {
+		delivered, err := broadcast.NewSeenCache(broadcast.SeenCacheOptions{})
+		if err != nil {
+			panic(fmt.Errorf("invariant violation: cannot create delivered cache: %v", err))
+		}
+		options.Delivered = delivered
+	}
+}
+
+// A ReliableBroadcaster is used to send messages to all peers in a group, so
+// that either all honest peers in the group deliver the same message, or none
+// of them do. It implements Bracha's reliable broadcast. The origin sends its
+// message to the group, every peer echoes the first message that it receives
+// from the origin, and a peer is ready to deliver a message when enough peers
+// have echoed it, or when enough peers are ready to deliver it. A message is
+// delivered when enough peers are ready to deliver it.
+//
+// For a group of n peers, it tolerates f = (n-1)/3 faulty peers. A peer is
+// ready when ⌈(n+f+1)/2⌉ peers have echoed the message, or f+1 peers are
+// ready, and delivers the message when 2f+1 peers are ready. Messages are
+// delivered by emitting a protocol.EventReliableDelivered, at most once for
+// each origin and sequence, even if the origin sends different messages to
+// different peers.
+type ReliableBroadcaster interface {
+	// Broadcast a message to all peers in the group. The sequence must not
+	// have been used by this peer before, and should be one more than the
+	// previous sequence, starting from zero (see Options.Window). This peer
+	// must be in the group.
+	Broadcast(ctx context.Context, groupID protocol.GroupID, sequence uint64, body protocol.MessageBody) error
+
+	// AcceptReliable message from another peer in the group.
+	AcceptReliable(ctx context.Context, from protocol.PeerID, message protocol.Message) error
+}
+
+// instanceKey identifies a message by its origin and sequence.
+type instanceKey struct {
+	origin   string
+	sequence uint64
+}
+
+// hash of the key, by which it is remembered after it has been delivered.
+func (key instanceKey) hash() id.Hash {
+	return id.Hash(sha256.Sum256(encodeFrame(0, key, nil)))
+}
+
+// instance is the state of the reliable broadcast of a message to a group.
+// Peers can receive different values for the same instance from an origin
+// that is faulty, but each peer can only echo, and be ready for, one value.
+type instance struct {
+	groupID protocol.GroupID
+	created time.Time
+	values  map[id.Hash]protocol.MessageBody
+	echoes  map[string]id.Hash
+	readies map[string]id.Hash
+
+	echoed  bool
+	readied bool
+}
+
+type reliableBroadcaster struct {
+	options  Options
+	messages protocol.MessageSender
+	events   protocol.EventSender
+	dht      dht.DHT
+
+	mu         *sync.Mutex
+	sequences  map[uint64]struct{} // Sequences that have been used by this peer
+	instances  map[instanceKey]*instance
+	highest    map[string]uint64 // Highest sequence that has been delivered for each origin
+	lastExpiry time.Time
+}
+
+// NewReliableBroadcaster returns a ReliableBroadcaster that sends messages
+// through the protocol.MessageSender, and emits delivered messages to the
+// protocol.EventSender. The members of each group are read from the DHT.
+func NewReliableBroadcaster(options Options, messages protocol.MessageSender, events protocol.EventSender, dht dht.DHT) ReliableBroadcaster {
+	options.setZerosToDefaults()
+	return &reliableBroadcaster{
+		options:  options,
+		messages: messages,
+		events:   events,
+		dht:      dht,
+
+		mu:        new(sync.Mutex),
+		sequences: map[uint64]struct{}{},
+		instances: map[instanceKey]*instance{},
+		highest:   map[string]uint64{},
+	}
+}
+
+func (broadcaster *reliableBroadcaster) Broadcast(ctx context.Context, groupID protocol.GroupID, sequence uint64, body protocol.MessageBody) error {
+	me := broadcaster.dht.Me().PeerID()
+	if len(me.String()) > 255 {
+		return fmt.Errorf("error broadcasting: expected len(peer id)<=255, got len=%v", len(me.String()))
+	}
+	members, err := broadcaster.dht.GroupIDs(groupID)
+	if err != nil {
+		return err
+	}
+	if !contains(members, me) {
+		return fmt.Errorf("error broadcasting: %v is not in group=%v", me, groupID)
+	}
+	key := instanceKey{origin: me.String(), sequence: sequence}
+
+	broadcaster.mu.Lock()
+	if _, ok := broadcaster.sequences[sequence]; ok {
+		broadcaster.mu.Unlock()
+		return NewErrSequenceReused(sequence)
+	}
+	broadcaster.sequences[sequence] = struct{}{}
+	broadcaster.mu.Unlock()
+
+	send := protocol.NewMessage(protocol.V1, protocol.Reliable, groupID, encodeFrame(frameSend, key, body))
+	if err := broadcaster.sendToGroup(ctx, groupID, send); err != nil {
+		return err
+	}
+	return broadcaster.accept(ctx, me, frameSend, key, groupID, body)
+}
+
+func (broadcaster *reliableBroadcaster) AcceptReliable(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	// Pre-condition checks
+	if err := protocol.ValidateMessageVersion(message.Version); err != nil {
+		return err
+	}
+	if message.Variant != protocol.Reliable {
+		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
+	}
+	frameType, key, body, err := decodeFrame(message.Body)
+	if err != nil {
+		return err
+	}
+	if frameType == frameSend && key.origin != from.String() {
+		return fmt.Errorf("error accepting reliable broadcast: %v cannot send for origin=%v", from, key.origin)
+	}
+	return broadcaster.accept(ctx, from, frameType, key, message.GroupID, body)
+}
+
+// accept a frame from a member of the group, and send the echoes and readies,
+// and deliver the message, that it causes.
+func (broadcaster *reliableBroadcaster) accept(ctx context.Context, from protocol.PeerID, frameType byte, key instanceKey, groupID protocol.GroupID, body protocol.MessageBody) error {
+	members, err := broadcaster.dht.GroupIDs(groupID)
+	if err != nil {
+		return err
+	}
+	if !contains(members, from) {
+		return fmt.Errorf("error accepting reliable broadcast: %v is not in group=%v", from, groupID)
+	}
+	origin, ok := find(members, key.origin)
+	if !ok {
+		return fmt.Errorf("error accepting reliable broadcast: origin=%v is not in group=%v", key.origin, groupID)
+	}
+	me := broadcaster.dht.Me().PeerID()
+	isMember := contains(members, me)
+
+	broadcaster.mu.Lock()
+	seen, err := broadcaster.options.Delivered.Seen(key.hash())
+	if err != nil {
+		broadcaster.mu.Unlock()
+		return err
+	}
+	if seen {
+		broadcaster.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	broadcaster.expire(now)
+	inst, ok := broadcaster.instances[key]
+	if !ok {
+		// Any member can send echoes and readies for any origin, so the
+		// number of instances is bounded by the window of the origin. Frames
+		// for sequences that the origin has not used do not stop its messages
+		// from being delivered, because they are tracked by the same instance.
+		if !broadcaster.inWindow(key) {
+			broadcaster.mu.Unlock()
+			return fmt.Errorf("error accepting reliable broadcast: sequence=%v is outside the window of origin=%v", key.sequence, key.origin)
+		}
+		inst = &instance{
+			groupID: groupID,
+			created: now,
+			values:  map[id.Hash]protocol.MessageBody{},
+			echoes:  map[string]id.Hash{},
+			readies: map[string]id.Hash{},
+		}
+		broadcaster.instances[key] = inst
+	}
+	if !inst.groupID.Equal(groupID) {
+		broadcaster.mu.Unlock()
+		return fmt.Errorf("error accepting reliable broadcast: expected group=%v, got group=%v", inst.groupID, groupID)
+	}
+
+	// Record the frame, and the echo of this peer that it causes. Only the
+	// first frame of each type from each peer is recorded, so that faulty
+	// peers cannot vote more than once.
+	digest := id.Hash(sha256.Sum256(body))
+	recorded := false
+	outgoing := []protocol.Message{}
+	switch frameType {
+	case frameSend:
+		if !inst.echoed && isMember {
+			inst.echoed = true
+			inst.echoes[me.String()] = digest
+			outgoing = append(outgoing, protocol.NewMessage(protocol.V1, protocol.Reliable, groupID, encodeFrame(frameEcho, key, body)))
+			recorded = true
+		}
+	case frameEcho:
+		if _, ok := inst.echoes[from.String()]; !ok {
+			inst.echoes[from.String()] = digest
+			recorded = true
+		}
+	case frameReady:
+		if _, ok := inst.readies[from.String()]; !ok {
+			inst.readies[from.String()] = digest
+			recorded = true
+		}
+	}
+	if _, ok := inst.values[digest]; recorded && !ok {
+		inst.values[digest] = body
+	}
+
+	// Be ready for a value when enough peers have echoed it, or enough peers
+	// are ready for it, and deliver it when enough peers are ready for it.
+
+	n := len(members)
+	f := (n - 1) / 3
+	deliver := protocol.MessageBody(nil)
+	delivered := false
+	for digest, body := range inst.values {
+		if !inst.readied && isMember && (count(inst.echoes, digest) >= (n+f)/2+1 || count(inst.readies, digest) >= f+1) {
+			inst.readied = true
+			inst.readies[me.String()] = digest
+			outgoing = append(outgoing, protocol.NewMessage(protocol.V1, protocol.Reliable, groupID, encodeFrame(frameReady, key, body)))
+		}
+		if count(inst.readies, digest) >= 2*f+1 {
+			deliver, delivered = body, true
+			break
+		}
+	}
+	if delivered {
+		if err := broadcaster.options.Delivered.Insert(key.hash()); err != nil {
+			broadcaster.mu.Unlock()
+			return err
+		}
+		delete(broadcaster.instances, key)
+		if highest, ok := broadcaster.highest[key.origin]; !ok || key.sequence > highest {
+			broadcaster.highest[key.origin] = key.sequence
+		}
+	}
+	broadcaster.mu.Unlock()
+
+	for _, message := range outgoing {
+		if err := broadcaster.sendToGroup(ctx, groupID, message); err != nil {
+			return err
+		}
+	}
+	if !delivered {
+		return nil
+	}
+
+	event := protocol.EventReliableDelivered{
+		Time:     time.Now(),
+		GroupID:  groupID,
+		Origin:   origin,
+		Sequence: key.sequence,
+		Message:  deliver,
+	}
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("error delivering reliable broadcast: %v", ctx.Err())
+	case broadcaster.events <- event:
+		return nil
+	}
+}
+
+// inWindow returns true if the sequence of the key is less than the Window away
+// from the highest sequence of its origin that has been delivered. It must be
+// called while holding the mutex.
+func (broadcaster *reliableBroadcaster) inWindow(key instanceKey) bool {
+	highest, ok := broadcaster.highest[key.origin]
+	if !ok {
+		return key.sequence < broadcaster.options.Window
+	}
+	if key.sequence > highest {
+		return key.sequence-highest < broadcaster.options.Window
+	}
+	return highest-key.sequence < broadcaster.options.Window
+}
+
+// expire the instances that have not been delivered within the Timeout. To
+// avoid iterating over all instances for every frame, instances are only
+// expired once per Timeout. It must be called while holding the mutex.
+func (broadcaster *reliableBroadcaster) expire(now time.Time) {
+	if now.Sub(broadcaster.lastExpiry) < broadcaster.options.Timeout {
+		return
+	}
+	broadcaster.lastExpiry = now
+	for key, inst := range broadcaster.instances {
+		if now.Sub(inst.created) >= broadcaster.options.Timeout {
+			delete(broadcaster.instances, key)
+		}
+	}
+}
+
+// sendToGroup sends a message to all other members of the group.
+func (broadcaster *reliableBroadcaster) sendToGroup(ctx context.Context, groupID protocol.GroupID, message protocol.Message) error {
+	addrs, err := broadcaster.dht.GroupAddresses(groupID)
+	if err != nil {
+		return err
+	}
+	me := broadcaster.dht.Me().PeerID()
+	protocol.ParForAllAddresses(addrs, broadcaster.options.NumWorkers, func(to protocol.PeerAddress) {
+		if to == nil || to.PeerID().Equal(me) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			broadcaster.options.Logger.Debugf("cannot send message to %v, %v", to.PeerID(), ctx.Err())
+		case broadcaster.messages <- protocol.MessageOnTheWire{To: to, Message: message}:
+		}
+	})
+	return nil
+}
+
+// count returns the number of peers that voted for the digest.
+func count(votes map[string]id.Hash, digest id.Hash) int {
+	n := 0
+	for _, vote := range votes {
+		if vote == digest {
+			n++
+		}
+	}
+	return n
+}
+
+func contains(ids protocol.PeerIDs, peerID protocol.PeerID) bool {
+	for _, id := range ids {
+		if id.Equal(peerID) {
+			return true
+		}
+	}
+	return false
+}
+
+func find(ids protocol.PeerIDs, peerID string) (protocol.PeerID, bool) {
+	for _, id := range ids {
+		if id.String() == peerID {
+			return id, true
+		}
+	}
+	return nil, false
+}
+
+// encodeFrame returns a frame with the type, the sequence, the length of the
+// origin, the origin, and the body.
+func encodeFrame(frameType byte, key instanceKey, body protocol.MessageBody) protocol.MessageBody {
+	frame := make(protocol.MessageBody, 10, 11+len(key.origin)+len(body))
+	frame[0] = frameType
+	binary.BigEndian.PutUint64(frame[1:9], key.sequence)
+	frame[9] = byte(len(key.origin))
+	frame = append(frame, key.origin...)
+	return append(frame, body...)
+}
+
+func decodeFrame(body protocol.MessageBody) (byte, instanceKey, protocol.MessageBody, error) {
+	if len(body) < 10 {
+		return 0, instanceKey{}, nil, fmt.Errorf("error decoding frame: expected len>=10, got len=%v", len(body))
+	}
+	if body[0] != frameSend && body[0] != frameEcho && body[0] != frameReady {
+		return 0, instanceKey{}, nil, fmt.Errorf("error decoding frame: unexpected frame type=%d", body[0])
+	}
+	originLength := int(body[9])
+	if originLength == 0 || len(body) < 10+originLength {
+		return 0, instanceKey{}, nil, fmt.Errorf("error decoding frame: invalid origin length=%v", originLength)
+	}
+	key := instanceKey{
+		origin:   string(body[10 : 10+originLength]),
+		sequence: binary.BigEndian.Uint64(body[1:9]),
+	}
+	return body[0], key, body[10+originLength:], nil
+}
+
+// ErrSequenceReused is returned when a message is broadcast with a sequence
+// that has already been used by this peer.
+type ErrSequenceReused struct {
+	error
+	Sequence uint64
+}
+
+// NewErrSequenceReused returns an error for a sequence that has already been
+// used.
+func NewErrSequenceReused(sequence uint64) error {
+	return ErrSequenceReused{
+		error:    fmt.Errorf("sequence=%v has already been used", sequence),
+		Sequence: sequence,
+	}
+}
@@ -0,0 +1,385 @@
+package rbc_test
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/rbc"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Reliable broadcast", func() {
+
+	// network returns n ReliableBroadcasters in the same group that are
+	// connected to each other, followed by twins ReliableBroadcasters that use
+	// the same identity as the first one. Twins can be used to send different
+	// messages to different peers. Messages are dropped if the filter returns
+	// false.
+	network := func(ctx context.Context, n, twins int, filter func(from, to int, message protocol.Message) bool) ([]ReliableBroadcaster, []chan protocol.Event, protocol.PeerIDs, protocol.GroupID) {
+		addrs := make(protocol.PeerAddresses, n)
+		ids := make(protocol.PeerIDs, n)
+		for i := range addrs {
+			addrs[i] = RandomAddress()
+			ids[i] = addrs[i].PeerID()
+		}
+		identity := func(i int) int {
+			if i >= n {
+				return 0
+			}
+			return i
+		}
+		groupID := RandomGroupID()
+
+		broadcasters := make([]ReliableBroadcaster, n+twins)
+		events := make([]chan protocol.Event, n+twins)
+		messages := make([]chan protocol.MessageOnTheWire, n+twins)
+		for i := range broadcasters {
+			dht := NewDHT(addrs[identity(i)], NewTable("dht"), nil)
+			for j := range addrs {
+				if identity(i) != j {
+					Expect(dht.AddPeerAddress(addrs[j])).To(Succeed())
+				}
+			}
+			Expect(dht.AddGroup(groupID, ids)).To(Succeed())
+			messages[i] = make(chan protocol.MessageOnTheWire, 1024)
+			events[i] = make(chan protocol.Event, 1024)
+			broadcasters[i] = NewReliableBroadcaster(Options{Logger: logrus.New()}, messages[i], events[i], dht)
+		}
+
+		forward := func(i int) {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case message := <-messages[i]:
+					for j := range broadcasters {
+						if !ids[identity(j)].Equal(message.To.PeerID()) {
+							continue
+						}
+						if filter != nil && !filter(i, j, message.Message) {
+							continue
+						}
+						broadcasters[j].AcceptReliable(ctx, ids[identity(i)], message.Message)
+					}
+				}
+			}
+		}
+		for i := range broadcasters {
+			go forward(i)
+		}
+		return broadcasters, events, ids, groupID
+	}
+
+	delivered := func(events chan protocol.Event) protocol.EventReliableDelivered {
+		var event protocol.Event
+		Eventually(events, 5*time.Second).Should(Receive(&event))
+		Expect(event).Should(BeAssignableToTypeOf(protocol.EventReliableDelivered{}))
+		return event.(protocol.EventReliableDelivered)
+	}
+
+	Context("when the origin is honest", func() {
+		It("should deliver the message to every peer exactly once", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			broadcasters, events, ids, groupID := network(ctx, 4, 0, nil)
+
+			body := RandomMessageBody()
+			Expect(broadcasters[0].Broadcast(ctx, groupID, 1, body)).To(Succeed())
+			for i := range events {
+				event := delivered(events[i])
+				Expect(event.GroupID).Should(Equal(groupID))
+				Expect(event.Origin.Equal(ids[0])).Should(BeTrue())
+				Expect(event.Sequence).Should(Equal(uint64(1)))
+				Expect(event.Message).Should(Equal(body))
+				Consistently(events[i], 100*time.Millisecond).ShouldNot(Receive())
+			}
+		})
+
+		It("should deliver messages with the same sequence from different origins", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			broadcasters, events, ids, groupID := network(ctx, 4, 0, nil)
+
+			Expect(broadcasters[0].Broadcast(ctx, groupID, 1, RandomMessageBody())).To(Succeed())
+			Expect(broadcasters[1].Broadcast(ctx, groupID, 1, RandomMessageBody())).To(Succeed())
+			for i := range events {
+				origins := map[string]struct{}{}
+				for j := 0; j < 2; j++ {
+					origins[delivered(events[i]).Origin.String()] = struct{}{}
+				}
+				Expect(origins).Should(HaveKey(ids[0].String()))
+				Expect(origins).Should(HaveKey(ids[1].String()))
+			}
+		})
+
+		It("should not broadcast a sequence more than once", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			broadcasters, _, _, groupID := network(ctx, 4, 0, nil)
+
+			Expect(broadcasters[0].Broadcast(ctx, groupID, 1, RandomMessageBody())).To(Succeed())
+			err := broadcasters[0].Broadcast(ctx, groupID, 1, RandomMessageBody())
+			Expect(err).Should(BeAssignableToTypeOf(ErrSequenceReused{}))
+		})
+
+		It("should not broadcast to a group that it is not in", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			broadcasters, _, _, _ := network(ctx, 4, 0, nil)
+
+			Expect(broadcasters[0].Broadcast(ctx, RandomGroupID(), 1, RandomMessageBody())).NotTo(Succeed())
+		})
+	})
+
+	Context("when the origin equivocates", func() {
+		It("should deliver the same message to every honest peer", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Peer 0 sends one message to peers 1 and 2, and its twin sends
+			// another message to peer 3.
+			filter := func(from, to int, message protocol.Message) bool {
+				switch {
+				case to == 0 || to == 4:
+					return false
+				case from == 0:
+					return to == 1 || to == 2
+				case from == 4:
+					return to == 3
+				default:
+					return true
+				}
+			}
+			broadcasters, events, _, groupID := network(ctx, 4, 1, filter)
+
+			body := RandomMessageBody()
+			Expect(broadcasters[0].Broadcast(ctx, groupID, 1, body)).To(Succeed())
+			Expect(broadcasters[4].Broadcast(ctx, groupID, 1, RandomMessageBody())).To(Succeed())
+			for i := 1; i < 4; i++ {
+				Expect(delivered(events[i]).Message).Should(Equal(body))
+				Consistently(events[i], 100*time.Millisecond).ShouldNot(Receive())
+			}
+		})
+
+		It("should not deliver a message if no message is echoed by enough peers", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Peer 0 sends one message to peer 1, and its twin sends another
+			// message to peer 2.
+			filter := func(from, to int, message protocol.Message) bool {
+				switch {
+				case to == 0 || to == 4:
+					return false
+				case from == 0:
+					return to == 1
+				case from == 4:
+					return to == 2
+				default:
+					return true
+				}
+			}
+			broadcasters, events, _, groupID := network(ctx, 4, 1, filter)
+
+			Expect(broadcasters[0].Broadcast(ctx, groupID, 1, RandomMessageBody())).To(Succeed())
+			Expect(broadcasters[4].Broadcast(ctx, groupID, 1, RandomMessageBody())).To(Succeed())
+			for i := 1; i < 4; i++ {
+				Consistently(events[i], 300*time.Millisecond).ShouldNot(Receive())
+			}
+		})
+
+		It("should deliver at most one message when there are more peers", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Peer 0 sends one message to the even peers, and its twin sends
+			// another message to the odd peers.
+			n := 7
+			filter := func(from, to int, message protocol.Message) bool {
+				switch {
+				case to == 0 || to == n:
+					return false
+				case from == 0:
+					return to%2 == 0
+				case from == n:
+					return to%2 == 1
+				default:
+					return true
+				}
+			}
+			broadcasters, events, _, groupID := network(ctx, n, 1, filter)
+
+			Expect(broadcasters[0].Broadcast(ctx, groupID, 1, RandomMessageBody())).To(Succeed())
+			Expect(broadcasters[n].Broadcast(ctx, groupID, 1, RandomMessageBody())).To(Succeed())
+
+			bodies := []protocol.MessageBody{}
+			for i := 1; i < n; i++ {
+				select {
+				case event := <-events[i]:
+					bodies = append(bodies, event.(protocol.EventReliableDelivered).Message)
+				case <-time.After(time.Second):
+				}
+			}
+
+			// Either every honest peer delivers the same message, or none of
+			// them do.
+			if len(bodies) > 0 {
+				Expect(bodies).Should(HaveLen(n - 1))
+				for _, body := range bodies {
+					Expect(body).Should(Equal(bodies[0]))
+				}
+			}
+			for i := 1; i < n; i++ {
+				Consistently(events[i], 100*time.Millisecond).ShouldNot(Receive())
+			}
+		})
+	})
+
+	Context("when a member floods frames for another origin", func() {
+		It("should still deliver the messages of the origin", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			broadcasters, events, ids, groupID := network(ctx, 4, 0, nil)
+
+			// Peer 3 echoes made up messages from peer 0, until the window of
+			// peer 0 is full.
+			for sequence := uint64(0); sequence < 1024; sequence++ {
+				echo := protocol.NewMessage(protocol.V1, protocol.Reliable, groupID, echoFrame(ids[0], sequence, RandomMessageBody()))
+				Expect(broadcasters[1].AcceptReliable(ctx, ids[3], echo)).To(Succeed())
+			}
+			echo := protocol.NewMessage(protocol.V1, protocol.Reliable, groupID, echoFrame(ids[0], 1024, RandomMessageBody()))
+			Expect(broadcasters[1].AcceptReliable(ctx, ids[3], echo)).NotTo(Succeed())
+
+			body := RandomMessageBody()
+			Expect(broadcasters[0].Broadcast(ctx, groupID, 1, body)).To(Succeed())
+			for i := range events {
+				event := delivered(events[i])
+				Expect(event.Origin.Equal(ids[0])).Should(BeTrue())
+				Expect(event.Message).Should(Equal(body))
+			}
+		})
+	})
+
+	// firstMember returns a ReliableBroadcaster for the first of n peers in a
+	// group, and the channel of messages that it sends.
+	firstMember := func(n int, options Options) (ReliableBroadcaster, chan protocol.MessageOnTheWire, protocol.PeerIDs, protocol.GroupID) {
+		addrs := make(protocol.PeerAddresses, n)
+		ids := make(protocol.PeerIDs, n)
+		for i := range addrs {
+			addrs[i] = RandomAddress()
+			ids[i] = addrs[i].PeerID()
+		}
+		groupID := RandomGroupID()
+		dht := NewDHT(addrs[0], NewTable("dht"), nil)
+		for _, addr := range addrs[1:] {
+			Expect(dht.AddPeerAddress(addr)).To(Succeed())
+		}
+		Expect(dht.AddGroup(groupID, ids)).To(Succeed())
+		messages := make(chan protocol.MessageOnTheWire, 1024)
+		return NewReliableBroadcaster(options, messages, make(chan protocol.Event, 16), dht), messages, ids, groupID
+	}
+
+	Context("when a faulty origin floods one peer with messages", func() {
+		It("should still track the messages of other origins that the peer echoes", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			broadcaster, _, ids, groupID := firstMember(4, Options{})
+
+			// Peer 1 echoes the messages that faulty peer 2 only sent to it,
+			// until the window of peer 2 is full.
+			for sequence := uint64(0); sequence < 2048; sequence++ {
+				echo := protocol.NewMessage(protocol.V1, protocol.Reliable, groupID, echoFrame(ids[2], sequence, RandomMessageBody()))
+				err := broadcaster.AcceptReliable(ctx, ids[1], echo)
+				if sequence < 1024 {
+					Expect(err).NotTo(HaveOccurred())
+				} else {
+					Expect(err).To(HaveOccurred())
+				}
+			}
+
+			// Peer 1 can still echo the messages of peer 3.
+			echo := protocol.NewMessage(protocol.V1, protocol.Reliable, groupID, echoFrame(ids[3], 0, RandomMessageBody()))
+			Expect(broadcaster.AcceptReliable(ctx, ids[1], echo)).To(Succeed())
+		})
+	})
+
+	Context("when a message is not delivered before the timeout", func() {
+		It("should forget the frames of the message", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			broadcaster, messages, ids, groupID := firstMember(4, Options{Timeout: 100 * time.Millisecond})
+
+			// Two echoes are forgotten before the third one arrives, so this
+			// peer is not ready.
+			body := RandomMessageBody()
+			for _, from := range ids[1:3] {
+				echo := protocol.NewMessage(protocol.V1, protocol.Reliable, groupID, echoFrame(ids[3], 0, body))
+				Expect(broadcaster.AcceptReliable(ctx, from, echo)).To(Succeed())
+			}
+			time.Sleep(200 * time.Millisecond)
+			echo := protocol.NewMessage(protocol.V1, protocol.Reliable, groupID, echoFrame(ids[3], 0, body))
+			Expect(broadcaster.AcceptReliable(ctx, ids[3], echo)).To(Succeed())
+			Consistently(messages, 100*time.Millisecond).ShouldNot(Receive())
+
+			// Three echoes that arrive before the timeout make this peer ready.
+			for _, from := range ids[1:] {
+				echo := protocol.NewMessage(protocol.V1, protocol.Reliable, groupID, echoFrame(ids[3], 1, body))
+				Expect(broadcaster.AcceptReliable(ctx, from, echo)).To(Succeed())
+			}
+			Eventually(messages).Should(Receive())
+		})
+	})
+
+	Context("when accepting invalid messages", func() {
+		It("should return an error", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			origin, other := RandomAddress(), RandomAddress()
+			groupID := RandomGroupID()
+			newBroadcaster := func(me, peer protocol.PeerAddress) (ReliableBroadcaster, chan protocol.MessageOnTheWire) {
+				dht := NewDHT(me, NewTable("dht"), nil)
+				Expect(dht.AddPeerAddress(peer)).To(Succeed())
+				Expect(dht.AddGroup(groupID, protocol.PeerIDs{origin.PeerID(), other.PeerID()})).To(Succeed())
+				messages := make(chan protocol.MessageOnTheWire, 16)
+				return NewReliableBroadcaster(Options{}, messages, make(chan protocol.Event, 16), dht), messages
+			}
+			sender, messages := newBroadcaster(origin, other)
+			receiver, _ := newBroadcaster(other, origin)
+
+			Expect(sender.Broadcast(ctx, groupID, 1, RandomMessageBody())).To(Succeed())
+			var send protocol.MessageOnTheWire
+			Eventually(messages).Should(Receive(&send))
+
+			// Only the origin can send its messages, and only members of the
+			// group can send messages.
+			Expect(receiver.AcceptReliable(ctx, other.PeerID(), send.Message)).NotTo(Succeed())
+			Expect(receiver.AcceptReliable(ctx, RandomPeerID(), send.Message)).NotTo(Succeed())
+
+			for _, body := range [][]byte{{}, {1, 2, 3}, append([]byte{9}, send.Message.Body[1:]...), send.Message.Body[:10]} {
+				message := protocol.NewMessage(protocol.V1, protocol.Reliable, groupID, body)
+				Expect(receiver.AcceptReliable(ctx, origin.PeerID(), message)).NotTo(Succeed())
+			}
+			message := protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, send.Message.Body)
+			Expect(receiver.AcceptReliable(ctx, origin.PeerID(), message)).NotTo(Succeed())
+
+			Expect(receiver.AcceptReliable(ctx, origin.PeerID(), send.Message)).To(Succeed())
+		})
+	})
+})
+
+// echoFrame returns the body of an echo of a message from the origin.
+func echoFrame(origin protocol.PeerID, sequence uint64, body protocol.MessageBody) protocol.MessageBody {
+	frame := make(protocol.MessageBody, 10)
+	frame[0] = 2
+	binary.BigEndian.PutUint64(frame[1:9], sequence)
+	frame[9] = byte(len(origin.String()))
+	frame = append(frame, origin.String()...)
+	return append(frame, body...)
+}
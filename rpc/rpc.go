@@ -0,0 +1,429 @@
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	statusOK          = byte(0) // The handler returned a response
+	statusNoHandler   = byte(1) // The remote peer has no handler
+	statusRemoteError = byte(2) // The handler returned an error
+	statusTimedOut    = byte(3) // The handler did not return before the deadline
+	statusOverloaded  = byte(4) // The remote peer is handling too many requests
+
+	// requestHeaderLength is the length of the ID and the timeout of a
+	// request.
+	requestHeaderLength = 8 + 8
+
+	// responseHeaderLength is the length of the ID and the status of a
+	// response.
+	responseHeaderLength = 8 + 1
+
+	// responseTimeout is the longest time that is spent sending a response
+	// after the handler has returned.
+	responseTimeout = 5 * time.Second
+)
+
+// A Handler handles requests from remote peers, and returns the body of the
+// response. The context is done when the deadline of the requester has been
+// reached. Errors are returned to the requester as an ErrRemote.
+type Handler func(ctx context.Context, from protocol.PeerID, body protocol.MessageBody) (protocol.MessageBody, error)
+
+// Options are used to parameterise the behaviour of a Requester.
+type Options struct {
+	Logger logrus.FieldLogger
+
+	// Timeout is used for requests whose context has no deadline. Defaults to
+	// 10 seconds.
+	Timeout time.Duration
+
+	// MaxTimeout is the longest time that the handler is given to handle a
+	// request from a remote peer. Longer timeouts that are sent by remote
+	// peers are reduced to MaxTimeout. Defaults to 1 minute.
+	MaxTimeout time.Duration
+
+	// MaxHandlers is the maximum number of requests from remote peers that
+	// are handled at the same time. Requests that are received while
+	// MaxHandlers requests are being handled are not handled, and the
+	// requester returns an ErrOverloaded. Defaults to 256.
+	MaxHandlers int
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.Logger == nil {
+		options.Logger = logrus.New()
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 10 * time.Second
+	}
+	if options.MaxTimeout <= 0 {
+		options.MaxTimeout = time.Minute
+	}
+	if options.MaxHandlers <= 0 {
+		options.MaxHandlers = 256
+	}
+}
+
+// A Requester sends requests to remote peers and matches them with their
+// responses, and handles requests from remote peers. The deadline of a request
+// is sent with the request, so the handler of the remote peer gives up when
+// the requester does. Responses are written back through the session that the
+// request was read from, when the session allows it.
+type Requester interface {
+	// Request sends the body to a remote peer, and returns the body of its
+	// response. It returns an ErrRequestTimedOut if the context is done
+	// before the response is received, an ErrNoHandler if the remote peer
+	// does not handle requests, an ErrOverloaded if the remote peer is
+	// handling too many requests, and an ErrRemote if the handler of the
+	// remote peer returns an error.
+	Request(ctx context.Context, to protocol.PeerID, body protocol.MessageBody) (protocol.MessageBody, error)
+
+	// Handle requests from remote peers using the Handler. It replaces the
+	// previous Handler. A nil Handler stops requests from being handled.
+	Handle(handler Handler)
+
+	// AcceptRequest handles a Request message from a remote peer. The
+	// response is sent to the reply MessageSender, or to the remote peer
+	// through a new connection if it is nil.
+	AcceptRequest(ctx context.Context, from protocol.PeerID, message protocol.Message, reply protocol.MessageSender) error
+
+	// AcceptResponse handles a Response message from a remote peer.
+	AcceptResponse(ctx context.Context, from protocol.PeerID, message protocol.Message) error
+}
+
+type requester struct {
+	options  Options
+	messages protocol.MessageSender
+	dht      dht.DHT
+
+	mu      *sync.RWMutex
+	handler Handler
+	nextID  uint64
+	pending map[uint64]pending
+
+	// handlers has a slot for each request that is being handled.
+	handlers chan struct{}
+}
+
+// pending is a request that is waiting for its response.
+type pending struct {
+	to        protocol.PeerID
+	responses chan response
+}
+
+type response struct {
+	status byte
+	body   protocol.MessageBody
+}
+
+// NewRequester returns a Requester that sends messages through the
+// protocol.MessageSender. It does not handle requests until a Handler is
+// given to Handle.
+func NewRequester(options Options, messages protocol.MessageSender, dht dht.DHT) Requester {
+	options.setZerosToDefaults()
+
+	// Start from a random ID, so that responses to requests sent before a
+	// restart are not matched with new requests.
+	nextID := [8]byte{}
+	if _, err := rand.Read(nextID[:]); err != nil {
+		panic(fmt.Errorf("invariant violation: cannot generate request id: %v", err))
+	}
+	return &requester{
+		options:  options,
+		messages: messages,
+		dht:      dht,
+
+		mu:      new(sync.RWMutex),
+		nextID:  binary.LittleEndian.Uint64(nextID[:]),
+		pending: map[uint64]pending{},
+
+		handlers: make(chan struct{}, options.MaxHandlers),
+	}
+}
+
+func (requester *requester) Request(ctx context.Context, to protocol.PeerID, body protocol.MessageBody) (protocol.MessageBody, error) {
+	toAddr, err := requester.dht.PeerAddress(to)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, requester.options.Timeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+
+	requester.mu.Lock()
+	id := requester.nextID
+	requester.nextID++
+	responses := make(chan response, 1)
+	requester.pending[id] = pending{to: to, responses: responses}
+	requester.mu.Unlock()
+	defer func() {
+		requester.mu.Lock()
+		delete(requester.pending, id)
+		requester.mu.Unlock()
+	}()
+
+	// The remaining time is sent instead of the deadline, so that the clocks
+	// of the peers do not need to be synchronised.
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return nil, NewErrRequestTimedOut(to)
+	}
+	requestBody := make(protocol.MessageBody, requestHeaderLength, requestHeaderLength+len(body))
+	binary.LittleEndian.PutUint64(requestBody[:8], id)
+	binary.LittleEndian.PutUint64(requestBody[8:], uint64(timeout))
+	message := protocol.MessageOnTheWire{
+		To:      toAddr,
+		Message: protocol.NewMessage(protocol.V1, protocol.Request, protocol.NilGroupID, append(requestBody, body...)),
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, requester.contextError(ctx, to)
+	case requester.messages <- message:
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, requester.contextError(ctx, to)
+	case response := <-responses:
+		switch response.status {
+		case statusOK:
+			return response.body, nil
+		case statusNoHandler:
+			return nil, NewErrNoHandler(to)
+		case statusTimedOut:
+			return nil, NewErrRequestTimedOut(to)
+		case statusOverloaded:
+			return nil, NewErrOverloaded(to)
+		default:
+			return nil, NewErrRemote(to, string(response.body))
+		}
+	}
+}
+
+func (requester *requester) contextError(ctx context.Context, to protocol.PeerID) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return NewErrRequestTimedOut(to)
+	}
+	return fmt.Errorf("error requesting from %v: %v", to, ctx.Err())
+}
+
+func (requester *requester) Handle(handler Handler) {
+	requester.mu.Lock()
+	defer requester.mu.Unlock()
+
+	requester.handler = handler
+}
+
+func (requester *requester) AcceptRequest(ctx context.Context, from protocol.PeerID, message protocol.Message, reply protocol.MessageSender) error {
+	// Pre-condition checks
+	if err := protocol.ValidateMessageVersion(message.Version); err != nil {
+		return err
+	}
+	if message.Variant != protocol.Request {
+		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
+	}
+	if len(message.Body) < requestHeaderLength {
+		return fmt.Errorf("error accepting request: expected len>=%v, got len=%v", requestHeaderLength, len(message.Body))
+	}
+	id := binary.LittleEndian.Uint64(message.Body[:8])
+	timeout := time.Duration(binary.LittleEndian.Uint64(message.Body[8:16]))
+	if timeout < 0 || timeout > requester.options.MaxTimeout {
+		timeout = requester.options.MaxTimeout
+	}
+	body := message.Body[requestHeaderLength:]
+
+	requester.mu.RLock()
+	handler := requester.handler
+	requester.mu.RUnlock()
+
+	// Reject the request without blocking when too many requests are being
+	// handled, so that remote peers cannot block other messages.
+	select {
+	case requester.handlers <- struct{}{}:
+	default:
+		messages, response, err := requester.response(from, id, statusOverloaded, protocol.MessageBody("too many requests"), reply)
+		if err != nil {
+			return err
+		}
+		select {
+		case messages <- response:
+		default:
+		}
+		return fmt.Errorf("error accepting request from %v: %v requests are being handled", from, requester.options.MaxHandlers)
+	}
+
+	// Handle the request in the background, so that slow handlers do not block
+	// other messages.
+	go func() {
+		defer func() { <-requester.handlers }()
+
+		handlerCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		status, responseBody := statusNoHandler, protocol.MessageBody{}
+		if handler != nil {
+			var err error
+			responseBody, err = handler(handlerCtx, from, body)
+			switch {
+			case err == nil:
+				status = statusOK
+			case handlerCtx.Err() == context.DeadlineExceeded:
+				status, responseBody = statusTimedOut, protocol.MessageBody{}
+			default:
+				status, responseBody = statusRemoteError, protocol.MessageBody(err.Error())
+			}
+		}
+		// The response is sent with a context that is derived from the parent
+		// context, because the context of the handler is already done when the
+		// handler has timed out.
+		responseCtx, responseCancel := context.WithTimeout(ctx, responseTimeout)
+		defer responseCancel()
+		if err := requester.respond(responseCtx, from, id, status, responseBody, reply); err != nil {
+			requester.options.Logger.Debugf("error responding to %v: %v", from, err)
+		}
+	}()
+	return nil
+}
+
+// respond to a request through the reply MessageSender if it is not nil, and
+// through the MessageSender of the Requester otherwise.
+func (requester *requester) respond(ctx context.Context, to protocol.PeerID, id uint64, status byte, body protocol.MessageBody, reply protocol.MessageSender) error {
+	messages, message, err := requester.response(to, id, status, body, reply)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case messages <- message:
+		return nil
+	}
+}
+
+// response returns a response to a request, and the MessageSender through which
+// it must be sent.
+func (requester *requester) response(to protocol.PeerID, id uint64, status byte, body protocol.MessageBody, reply protocol.MessageSender) (protocol.MessageSender, protocol.MessageOnTheWire, error) {
+	responseBody := make(protocol.MessageBody, responseHeaderLength, responseHeaderLength+len(body))
+	binary.LittleEndian.PutUint64(responseBody[:8], id)
+	responseBody[8] = status
+	message := protocol.MessageOnTheWire{
+		Message: protocol.NewMessage(protocol.V1, protocol.Response, protocol.NilGroupID, append(responseBody, body...)),
+	}
+	if reply != nil {
+		return reply, message, nil
+	}
+
+	toAddr, err := requester.dht.PeerAddress(to)
+	if err != nil {
+		return nil, protocol.MessageOnTheWire{}, err
+	}
+	message.To = toAddr
+	return requester.messages, message, nil
+}
+
+func (requester *requester) AcceptResponse(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	// Pre-condition checks
+	if err := protocol.ValidateMessageVersion(message.Version); err != nil {
+		return err
+	}
+	if message.Variant != protocol.Response {
+		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
+	}
+	if len(message.Body) < responseHeaderLength {
+		return fmt.Errorf("error accepting response: expected len>=%v, got len=%v", responseHeaderLength, len(message.Body))
+	}
+	id := binary.LittleEndian.Uint64(message.Body[:8])
+
+	requester.mu.RLock()
+	p, ok := requester.pending[id]
+	requester.mu.RUnlock()
+
+	// Ignore responses to requests that have already returned, and responses
+	// from peers that did not receive the request.
+	if !ok || !p.to.Equal(from) {
+		return nil
+	}
+	select {
+	case p.responses <- response{status: message.Body[8], body: message.Body[responseHeaderLength:]}:
+	default:
+	}
+	return nil
+}
+
+// ErrRequestTimedOut is returned when a response is not received before the
+// deadline of the request.
+type ErrRequestTimedOut struct {
+	error
+	PeerID protocol.PeerID
+}
+
+// NewErrRequestTimedOut returns an error for a request to the peer that has
+// timed out.
+func NewErrRequestTimedOut(peerID protocol.PeerID) error {
+	return ErrRequestTimedOut{
+		error:  fmt.Errorf("request to %v timed out", peerID),
+		PeerID: peerID,
+	}
+}
+
+// ErrNoHandler is returned when the remote peer does not handle requests.
+type ErrNoHandler struct {
+	error
+	PeerID protocol.PeerID
+}
+
+// NewErrNoHandler returns an error for a request to a peer that does not
+// handle requests.
+func NewErrNoHandler(peerID protocol.PeerID) error {
+	return ErrNoHandler{
+		error:  fmt.Errorf("no request handler at %v", peerID),
+		PeerID: peerID,
+	}
+}
+
+// ErrOverloaded is returned when the remote peer is handling too many requests
+// to handle the request.
+type ErrOverloaded struct {
+	error
+	PeerID protocol.PeerID
+}
+
+// NewErrOverloaded returns an error for a request that was not handled by the
+// peer, because it was handling too many requests.
+func NewErrOverloaded(peerID protocol.PeerID) error {
+	return ErrOverloaded{
+		error:  fmt.Errorf("too many requests at %v", peerID),
+		PeerID: peerID,
+	}
+}
+
+// ErrRemote is returned when the handler of the remote peer returns an error.
+type ErrRemote struct {
+	error
+	PeerID protocol.PeerID
+	Reason string
+}
+
+// NewErrRemote returns an error for a request whose handler at the peer has
+// returned an error for the given reason.
+func NewErrRemote(peerID protocol.PeerID, reason string) error {
+	return ErrRemote{
+		error:  fmt.Errorf("error from request handler at %v: %v", peerID, reason),
+		PeerID: peerID,
+		Reason: reason,
+	}
+}
@@ -0,0 +1,287 @@
+package rpc_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/rpc"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Requester", func() {
+
+	// requestersWithOptions returns two Requesters that use the Options and
+	// are connected to each other. Requests are accepted with the given reply
+	// MessageSender.
+	requestersWithOptions := func(ctx context.Context, reply chan protocol.MessageOnTheWire, options Options) (Requester, Requester, protocol.PeerID, protocol.PeerID) {
+		fromAddr, toAddr := RandomAddress(), RandomAddress()
+		fromMessages := make(chan protocol.MessageOnTheWire, 16)
+		toMessages := make(chan protocol.MessageOnTheWire, 16)
+
+		fromDHT := NewDHT(fromAddr, NewTable("dht"), nil)
+		Expect(fromDHT.AddPeerAddress(toAddr)).NotTo(HaveOccurred())
+		toDHT := NewDHT(toAddr, NewTable("dht"), nil)
+		Expect(toDHT.AddPeerAddress(fromAddr)).NotTo(HaveOccurred())
+
+		from := NewRequester(options, fromMessages, fromDHT)
+		to := NewRequester(options, toMessages, toDHT)
+
+		forward := func(messages chan protocol.MessageOnTheWire, requester Requester, sender protocol.PeerID) {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case message := <-messages:
+					switch message.Message.Variant {
+					case protocol.Request:
+						var replies protocol.MessageSender
+						if reply != nil {
+							replies = reply
+						}
+						requester.AcceptRequest(ctx, sender, message.Message, replies)
+					case protocol.Response:
+						requester.AcceptResponse(ctx, sender, message.Message)
+					}
+				}
+			}
+		}
+		go forward(fromMessages, to, fromAddr.PeerID())
+		go forward(toMessages, from, toAddr.PeerID())
+
+		return from, to, fromAddr.PeerID(), toAddr.PeerID()
+	}
+
+	// requesters returns two Requesters that are connected to each other.
+	// Requests are accepted with the given reply MessageSender.
+	requesters := func(ctx context.Context, reply chan protocol.MessageOnTheWire) (Requester, Requester, protocol.PeerID, protocol.PeerID) {
+		return requestersWithOptions(ctx, reply, Options{Logger: logrus.New(), Timeout: time.Second})
+	}
+
+	Context("when the remote peer handles the request", func() {
+		It("should return the response", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			from, to, fromID, toID := requesters(ctx, nil)
+			to.Handle(func(ctx context.Context, sender protocol.PeerID, body protocol.MessageBody) (protocol.MessageBody, error) {
+				Expect(sender.Equal(fromID)).Should(BeTrue())
+				return append(body, body...), nil
+			})
+
+			for i := 0; i < 10; i++ {
+				body := RandomMessageBody()
+				response, err := from.Request(ctx, toID, body)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(bytes.Equal(response, append(body, body...))).Should(BeTrue())
+			}
+		})
+
+		It("should propagate the deadline to the handler", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			from, to, _, toID := requesters(ctx, nil)
+			deadlines := make(chan time.Time, 1)
+			to.Handle(func(ctx context.Context, _ protocol.PeerID, body protocol.MessageBody) (protocol.MessageBody, error) {
+				deadline, ok := ctx.Deadline()
+				Expect(ok).Should(BeTrue())
+				deadlines <- deadline
+				return body, nil
+			})
+
+			requestCtx, requestCancel := context.WithTimeout(ctx, 500*time.Millisecond)
+			defer requestCancel()
+			expected, _ := requestCtx.Deadline()
+			_, err := from.Request(requestCtx, toID, RandomMessageBody())
+			Expect(err).ShouldNot(HaveOccurred())
+			var deadline time.Time
+			Eventually(deadlines).Should(Receive(&deadline))
+			Expect(deadline).Should(BeTemporally("~", expected, 100*time.Millisecond))
+		})
+
+		It("should send the response through the reply sender", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			reply := make(chan protocol.MessageOnTheWire, 1)
+			from, to, _, toID := requesters(ctx, reply)
+			to.Handle(func(ctx context.Context, _ protocol.PeerID, body protocol.MessageBody) (protocol.MessageBody, error) {
+				return body, nil
+			})
+
+			go from.Request(ctx, toID, RandomMessageBody())
+			var message protocol.MessageOnTheWire
+			Eventually(reply).Should(Receive(&message))
+			Expect(message.Message.Variant).Should(Equal(protocol.Response))
+		})
+	})
+
+	Context("when the remote peer has no handler", func() {
+		It("should return ErrNoHandler", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			from, _, _, toID := requesters(ctx, nil)
+
+			_, err := from.Request(ctx, toID, RandomMessageBody())
+			Expect(err).Should(BeAssignableToTypeOf(ErrNoHandler{}))
+		})
+	})
+
+	Context("when the handler returns an error", func() {
+		It("should return ErrRemote", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			from, to, _, toID := requesters(ctx, nil)
+			to.Handle(func(ctx context.Context, _ protocol.PeerID, body protocol.MessageBody) (protocol.MessageBody, error) {
+				return nil, errors.New("bad request")
+			})
+
+			_, err := from.Request(ctx, toID, RandomMessageBody())
+			Expect(err).Should(BeAssignableToTypeOf(ErrRemote{}))
+			Expect(err.(ErrRemote).Reason).Should(Equal("bad request"))
+		})
+	})
+
+	Context("when the handler does not return before the deadline", func() {
+		It("should return ErrRequestTimedOut", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			from, to, _, toID := requesters(ctx, nil)
+			done := make(chan struct{})
+			to.Handle(func(ctx context.Context, _ protocol.PeerID, body protocol.MessageBody) (protocol.MessageBody, error) {
+				<-ctx.Done()
+				close(done)
+				return nil, ctx.Err()
+			})
+
+			requestCtx, requestCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+			defer requestCancel()
+			_, err := from.Request(requestCtx, toID, RandomMessageBody())
+			Expect(err).Should(BeAssignableToTypeOf(ErrRequestTimedOut{}))
+			Eventually(done).Should(BeClosed())
+		})
+	})
+
+	Context("when the handler does not return before the max timeout", func() {
+		It("should always respond with ErrRequestTimedOut", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			options := Options{Logger: logrus.New(), MaxTimeout: 50 * time.Millisecond}
+			from, to, _, toID := requestersWithOptions(ctx, nil, options)
+			to.Handle(func(ctx context.Context, _ protocol.PeerID, body protocol.MessageBody) (protocol.MessageBody, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			})
+
+			// The response must arrive long before the deadline of the
+			// requester, instead of being dropped with the handler context.
+			for i := 0; i < 10; i++ {
+				requestCtx, requestCancel := context.WithTimeout(ctx, time.Second)
+				start := time.Now()
+				_, err := from.Request(requestCtx, toID, RandomMessageBody())
+				requestCancel()
+				Expect(err).Should(BeAssignableToTypeOf(ErrRequestTimedOut{}))
+				Expect(time.Since(start)).Should(BeNumerically("<", 500*time.Millisecond))
+			}
+		})
+	})
+
+	Context("when the requester sends a timeout that is too long", func() {
+		It("should give the handler at most the max timeout", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			options := Options{Logger: logrus.New(), MaxTimeout: 200 * time.Millisecond}
+			from, to, _, toID := requestersWithOptions(ctx, nil, options)
+			deadlines := make(chan time.Time, 1)
+			to.Handle(func(ctx context.Context, _ protocol.PeerID, body protocol.MessageBody) (protocol.MessageBody, error) {
+				deadline, ok := ctx.Deadline()
+				Expect(ok).Should(BeTrue())
+				deadlines <- deadline
+				return body, nil
+			})
+
+			requestCtx, requestCancel := context.WithTimeout(ctx, time.Hour)
+			defer requestCancel()
+			_, err := from.Request(requestCtx, toID, RandomMessageBody())
+			Expect(err).ShouldNot(HaveOccurred())
+			var deadline time.Time
+			Eventually(deadlines).Should(Receive(&deadline))
+			Expect(deadline).Should(BeTemporally("~", time.Now().Add(200*time.Millisecond), 200*time.Millisecond))
+		})
+	})
+
+	Context("when the remote peer is handling too many requests", func() {
+		It("should return ErrOverloaded", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			options := Options{Logger: logrus.New(), Timeout: time.Second, MaxHandlers: 1}
+			from, to, _, toID := requestersWithOptions(ctx, nil, options)
+			requests := make(chan protocol.MessageBody, 1)
+			to.Handle(func(ctx context.Context, _ protocol.PeerID, body protocol.MessageBody) (protocol.MessageBody, error) {
+				requests <- body
+				<-ctx.Done()
+				return nil, ctx.Err()
+			})
+
+			go from.Request(ctx, toID, RandomMessageBody())
+			Eventually(requests).Should(Receive())
+
+			_, err := from.Request(ctx, toID, RandomMessageBody())
+			Expect(err).Should(BeAssignableToTypeOf(ErrOverloaded{}))
+		})
+	})
+
+	Context("when accepting a response from another peer", func() {
+		It("should ignore the response", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			from, to, _, toID := requesters(ctx, nil)
+			requests := make(chan protocol.MessageBody, 1)
+			to.Handle(func(ctx context.Context, _ protocol.PeerID, body protocol.MessageBody) (protocol.MessageBody, error) {
+				requests <- body
+				<-ctx.Done()
+				return nil, ctx.Err()
+			})
+
+			errs := make(chan error, 1)
+			go func() {
+				requestCtx, requestCancel := context.WithTimeout(ctx, 500*time.Millisecond)
+				defer requestCancel()
+				_, err := from.Request(requestCtx, toID, RandomMessageBody())
+				errs <- err
+			}()
+			Eventually(requests).Should(Receive())
+
+			// Responses are only matched with the peer that received the
+			// request, so guessing the ID is not enough.
+			for i := 0; i < 100; i++ {
+				body := append(RandomBytes(8), 0)
+				Expect(from.AcceptResponse(ctx, RandomPeerID(), protocol.NewMessage(protocol.V1, protocol.Response, protocol.NilGroupID, body))).Should(Succeed())
+			}
+			var err error
+			Eventually(errs, time.Second).Should(Receive(&err))
+			Expect(err).Should(BeAssignableToTypeOf(ErrRequestTimedOut{}))
+		})
+	})
+
+	Context("when accepting invalid messages", func() {
+		It("should return an error", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			from, _, _, toID := requesters(ctx, nil)
+
+			message := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, RandomBytes(32))
+			Expect(from.AcceptRequest(ctx, toID, message, nil)).Should(HaveOccurred())
+			Expect(from.AcceptResponse(ctx, toID, message)).Should(HaveOccurred())
+
+			message = protocol.NewMessage(protocol.V1, protocol.Request, protocol.NilGroupID, RandomBytes(15))
+			Expect(from.AcceptRequest(ctx, toID, message, nil)).Should(HaveOccurred())
+			message = protocol.NewMessage(protocol.V1, protocol.Response, protocol.NilGroupID, RandomBytes(8))
+			Expect(from.AcceptResponse(ctx, toID, message)).Should(HaveOccurred())
+		})
+	})
+})
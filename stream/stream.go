@@ -0,0 +1,680 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	frameData   = byte(1) // A chunk of the payload, starting at the offset
+	frameEnd    = byte(2) // The end of the payload: its length and hash
+	frameAck    = byte(3) // The number of bytes read by the receiver
+	frameDone   = byte(4) // The receiver has read and verified the payload
+	frameCancel = byte(5) // Either peer has cancelled the stream
+
+	// frameHeaderLength is the length of the type, the stream ID and the
+	// offset of a frame.
+	frameHeaderLength = 1 + 16 + 8
+
+	// maxSessionOverhead is an upper bound on the bytes added to a message body
+	// by a protocol.Session: nonces, counters, authentication tags and the
+	// compression flag.
+	maxSessionOverhead = 128
+)
+
+// Options are used to parameterise the behaviour of a Streamer.
+type Options struct {
+	Logger logrus.FieldLogger
+
+	// ChunkSize is the maximum number of payload bytes sent in one message.
+	// It is reduced to fit within the SizeLimits. Defaults to 256 KiB.
+	ChunkSize int
+
+	// Window is the maximum number of chunks that can be sent before they are
+	// acknowledged by the receiver. The receiver only acknowledges chunks once
+	// they have been read from its Reader, so a slow reader slows down the
+	// sender. Defaults to 16.
+	Window int
+
+	// AckTimeout is how long the sender waits for the receiver to
+	// acknowledge more of the payload, before it retransmits the chunks that
+	// have not been acknowledged. Defaults to 5 seconds.
+	AckTimeout time.Duration
+
+	// MaxRetransmissions is the number of consecutive retransmissions, without
+	// any progress, after which the sender gives up. Defaults to 6.
+	MaxRetransmissions int
+
+	// IdleTimeout is how long the receiver waits for the next chunk, before it
+	// gives up on the stream. Defaults to 1 minute.
+	IdleTimeout time.Duration
+
+	// MaxIncoming is the maximum number of streams that can be received from
+	// each peer at the same time. New streams from a peer that is already
+	// sending MaxIncoming streams are cancelled. Defaults to 16.
+	MaxIncoming int
+
+	// SizeLimits bound the length of the messages that carry chunks.
+	// Defaults to protocol.DefaultSizeLimits.
+	SizeLimits protocol.SizeLimits
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.Logger == nil {
+		options.Logger = logrus.New()
+	}
+	if options.ChunkSize <= 0 {
+		options.ChunkSize = 256 * 1024
+	}
+	if options.Window <= 0 {
+		options.Window = 16
+	}
+	if options.AckTimeout <= 0 {
+		options.AckTimeout = 5 * time.Second
+	}
+	if options.MaxRetransmissions <= 0 {
+		options.MaxRetransmissions = 6
+	}
+	if options.IdleTimeout <= 0 {
+		options.IdleTimeout = time.Minute
+	}
+	if options.MaxIncoming <= 0 {
+		options.MaxIncoming = 16
+	}
+	options.SizeLimits.SetZerosToDefaults()
+	maxChunkSize := int(options.SizeLimits.MaxLength(protocol.Stream)) - protocol.Stream.NonBodyLength() - frameHeaderLength - maxSessionOverhead
+	if options.ChunkSize > maxChunkSize {
+		options.ChunkSize = maxChunkSize
+	}
+	if options.ChunkSize <= 0 {
+		panic(fmt.Sprintf("invariant violation: size limit for stream messages is too low: %v", options.SizeLimits.MaxLength(protocol.Stream)))
+	}
+}
+
+// A Streamer sends payloads that are larger than the maximum message length,
+// by fragmenting them into chunks that are reassembled by the receiver. At
+// most a window of chunks are in flight at any time. Chunks that are not
+// acknowledged, because they have been lost or because the connection to the
+// receiver has been re-established, are retransmitted. The receiver verifies
+// the length and the SHA256 hash of the entire payload before it returns
+// io.EOF.
+type Streamer interface {
+	// SendStream reads the payload from the io.Reader, and sends it to the
+	// peer. It returns once the peer has read and verified the entire
+	// payload, or with an error if the stream is cancelled by the peer, the
+	// peer stops responding, or the context is done.
+	SendStream(ctx context.Context, to protocol.PeerID, r io.Reader) error
+
+	// AcceptStream handles a Stream message from a remote peer. A new
+	// protocol.EventStreamReceived is emitted when a peer starts a stream.
+	AcceptStream(ctx context.Context, from protocol.PeerID, message protocol.Message) error
+}
+
+type streamer struct {
+	options  Options
+	messages protocol.MessageSender
+	events   protocol.EventSender
+	dht      dht.DHT
+
+	mu       *sync.Mutex
+	outgoing map[protocol.StreamID]*outgoing
+	incoming map[string]*incoming
+	finished map[string]finished
+	streams  map[string]int // Number of incoming streams from each peer
+}
+
+// outgoing is the state of a stream that is being sent. Frames from the
+// receiver are delivered to the sender through the frames channel.
+type outgoing struct {
+	to     protocol.PeerID
+	frames chan frame
+}
+
+// incoming is the state of a stream that is being received. Chunks are queued
+// in order, and written to the Reader by a separate goroutine, so that a slow
+// Reader does not block the handling of other messages.
+type incoming struct {
+	read uint64 // Number of bytes read from the Reader (accessed atomically)
+
+	from protocol.PeerID
+	id   protocol.StreamID
+
+	// Guarded by the mutex of the streamer.
+	received uint64
+	ended    bool
+	finished bool
+
+	frames chan frame
+	done   chan struct{}
+	reader *io.PipeReader
+	writer *io.PipeWriter
+}
+
+// finished keeps the last frame sent by the receiver of a stream, so that it
+// can be sent again if it is lost.
+type finished struct {
+	frame frame
+	at    time.Time
+}
+
+// NewStreamer returns a Streamer that sends messages through the
+// protocol.MessageSender, and emits a protocol.EventStreamReceived through
+// the protocol.EventSender for every stream that it receives.
+func NewStreamer(options Options, messages protocol.MessageSender, events protocol.EventSender, dht dht.DHT) Streamer {
+	options.setZerosToDefaults()
+	return &streamer{
+		options:  options,
+		messages: messages,
+		events:   events,
+		dht:      dht,
+
+		mu:       new(sync.Mutex),
+		outgoing: map[protocol.StreamID]*outgoing{},
+		incoming: map[string]*incoming{},
+		finished: map[string]finished{},
+		streams:  map[string]int{},
+	}
+}
+
+func (streamer *streamer) SendStream(ctx context.Context, to protocol.PeerID, r io.Reader) error {
+	toAddr, err := streamer.dht.PeerAddress(to)
+	if err != nil {
+		return err
+	}
+	id := protocol.StreamID{}
+	if _, err := rand.Read(id[:]); err != nil {
+		return newErrStreaming(to, fmt.Errorf("error generating stream id: %v", err))
+	}
+
+	out := &outgoing{to: to, frames: make(chan frame, 2*streamer.options.Window)}
+	streamer.mu.Lock()
+	streamer.outgoing[id] = out
+	streamer.mu.Unlock()
+	defer func() {
+		streamer.mu.Lock()
+		delete(streamer.outgoing, id)
+		streamer.mu.Unlock()
+	}()
+
+	send := func(f frame) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case streamer.messages <- protocol.MessageOnTheWire{To: toAddr, Message: f.message()}:
+			return nil
+		}
+	}
+	cancel := func(reason error) error {
+		// Tell the receiver to give up, but do not wait for the message to be
+		// sent, because the context may already be done.
+		f := frame{frameType: frameCancel, streamID: id, payload: []byte(reason.Error())}
+		select {
+		case streamer.messages <- protocol.MessageOnTheWire{To: toAddr, Message: f.message()}:
+		default:
+		}
+		return reason
+	}
+
+	hash := sha256.New()
+	window := uint64(streamer.options.Window * streamer.options.ChunkSize)
+	unacked := []frame{} // Data frames that have been sent, but not acknowledged
+	acked, sent := uint64(0), uint64(0)
+	end := (*frame)(nil) // The end frame, once the payload has been read
+	eof := false
+	retransmissions := 0
+
+	timer := time.NewTimer(streamer.options.AckTimeout)
+	defer timer.Stop()
+
+	for {
+		// Send chunks until the window is full.
+		for !eof && sent-acked < window {
+			chunk := make([]byte, streamer.options.ChunkSize)
+			n, err := io.ReadFull(r, chunk)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return cancel(newErrStreaming(to, fmt.Errorf("error reading payload: %v", err)))
+			}
+			if n == 0 {
+				continue
+			}
+			hash.Write(chunk[:n])
+			f := frame{frameType: frameData, streamID: id, offset: sent, payload: chunk[:n]}
+			if err := send(f); err != nil {
+				return cancel(newErrStreaming(to, err))
+			}
+			unacked = append(unacked, f)
+			sent += uint64(n)
+		}
+		if eof && end == nil {
+			end = &frame{frameType: frameEnd, streamID: id, offset: sent, payload: hash.Sum(nil)}
+			if err := send(*end); err != nil {
+				return cancel(newErrStreaming(to, err))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return cancel(newErrStreaming(to, ctx.Err()))
+
+		case f := <-out.frames:
+			switch f.frameType {
+			case frameAck:
+				if f.offset > acked && f.offset <= sent {
+					acked = f.offset
+					for len(unacked) > 0 && unacked[0].offset+uint64(len(unacked[0].payload)) <= acked {
+						unacked = unacked[1:]
+					}
+					retransmissions = 0
+					resetTimer(timer, streamer.options.AckTimeout)
+				}
+			case frameDone:
+				if end != nil && f.offset == end.offset {
+					return nil
+				}
+			case frameCancel:
+				return NewErrStreamCancelled(id, string(f.payload))
+			}
+
+		case <-timer.C:
+			// Nothing has been acknowledged recently, so the chunks (or the
+			// acknowledgements) have been lost. Send everything that has not
+			// been acknowledged again.
+			retransmissions++
+			if retransmissions > streamer.options.MaxRetransmissions {
+				return cancel(NewErrStreamTimedOut(id))
+			}
+			streamer.options.Logger.Debugf("retransmitting %v bytes of stream=%v to %v", sent-acked, id, to)
+			for _, f := range unacked {
+				if err := send(f); err != nil {
+					return cancel(newErrStreaming(to, err))
+				}
+			}
+			if end != nil {
+				if err := send(*end); err != nil {
+					return cancel(newErrStreaming(to, err))
+				}
+			}
+			timer.Reset(streamer.options.AckTimeout)
+		}
+	}
+}
+
+func (streamer *streamer) AcceptStream(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	// Pre-condition checks
+	if err := protocol.ValidateMessageVersion(message.Version); err != nil {
+		return err
+	}
+	if message.Variant != protocol.Stream {
+		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
+	}
+	f, err := unmarshalFrame(message.Body)
+	if err != nil {
+		return err
+	}
+
+	switch f.frameType {
+	case frameAck, frameDone:
+		streamer.deliver(from, f)
+		return nil
+	case frameCancel:
+		if streamer.deliver(from, f) {
+			return nil
+		}
+		streamer.mu.Lock()
+		in, ok := streamer.incoming[key(from, f.streamID)]
+		streamer.mu.Unlock()
+		if ok && streamer.finish(in, f) {
+			in.writer.CloseWithError(NewErrStreamCancelled(f.streamID, string(f.payload)))
+		}
+		return nil
+	case frameData, frameEnd:
+		return streamer.receive(ctx, from, f)
+	default:
+		return fmt.Errorf("error accepting stream: unknown frame type=%v", f.frameType)
+	}
+}
+
+// deliver a frame from the receiver of a stream to its sender. It returns
+// false if this Streamer is not sending the stream to the peer.
+func (streamer *streamer) deliver(from protocol.PeerID, f frame) bool {
+	streamer.mu.Lock()
+	out, ok := streamer.outgoing[f.streamID]
+	streamer.mu.Unlock()
+	if !ok || !out.to.Equal(from) {
+		return false
+	}
+	// Acknowledgements are cumulative, so it is safe to drop them when the
+	// sender is busy. Other frames are sent again when the sender retransmits.
+	select {
+	case out.frames <- f:
+	default:
+	}
+	return true
+}
+
+// receive a chunk, or the end, of a stream. Chunks must be received in order,
+// so all other chunks are dropped and acknowledged with the number of bytes
+// read so far. This allows the sender to retransmit from the right offset.
+func (streamer *streamer) receive(ctx context.Context, from protocol.PeerID, f frame) error {
+	k := key(from, f.streamID)
+
+	streamer.mu.Lock()
+	if done, ok := streamer.finished[k]; ok {
+		streamer.mu.Unlock()
+		// The sender has not received the last frame, so send it again.
+		return streamer.send(ctx, from, done.frame)
+	}
+	in, ok := streamer.incoming[k]
+	if !ok {
+		if f.offset != 0 {
+			streamer.mu.Unlock()
+			return nil
+		}
+		if streamer.streams[from.String()] >= streamer.options.MaxIncoming {
+			streamer.mu.Unlock()
+			err := NewErrTooManyStreams(from, streamer.options.MaxIncoming)
+			if sendErr := streamer.send(ctx, from, frame{frameType: frameCancel, streamID: f.streamID, payload: []byte(err.Error())}); sendErr != nil {
+				streamer.options.Logger.Debugf("error sending cancel for stream=%v: %v", f.streamID, sendErr)
+			}
+			return err
+		}
+		in = streamer.newIncoming(ctx, from, f.streamID)
+		streamer.incoming[k] = in
+		streamer.streams[from.String()]++
+	}
+	inOrder := !in.ended && f.offset == in.received
+	if inOrder {
+		select {
+		case in.frames <- f:
+			in.received += uint64(len(f.payload))
+			in.ended = f.frameType == frameEnd
+		default:
+			inOrder = false
+		}
+	}
+	streamer.mu.Unlock()
+
+	if !ok {
+		event := protocol.EventStreamReceived{
+			Time:     time.Now(),
+			From:     from,
+			StreamID: f.streamID,
+			Reader:   in.reader,
+		}
+		select {
+		case <-ctx.Done():
+			in.writer.CloseWithError(ctx.Err())
+			return fmt.Errorf("error accepting stream: %v", ctx.Err())
+		case streamer.events <- event:
+		}
+	}
+	if !inOrder {
+		return streamer.send(ctx, from, frame{frameType: frameAck, streamID: f.streamID, offset: atomic.LoadUint64(&in.read)})
+	}
+	return nil
+}
+
+// newIncoming creates the state of a new stream, and starts writing its
+// chunks to a Reader. It must be called while holding the mutex.
+func (streamer *streamer) newIncoming(ctx context.Context, from protocol.PeerID, id protocol.StreamID) *incoming {
+	reader, writer := io.Pipe()
+	in := &incoming{
+		from:   from,
+		id:     id,
+		frames: make(chan frame, streamer.options.Window+1),
+		done:   make(chan struct{}),
+		reader: reader,
+		writer: writer,
+	}
+	go streamer.read(ctx, in)
+	return in
+}
+
+// read the queued chunks of an incoming stream into its Reader. Writing to the
+// Reader blocks until the chunk has been read, so the sender is only
+// acknowledged once the chunk has been read. Once the end of the stream is
+// read, its length and hash are verified.
+func (streamer *streamer) read(ctx context.Context, in *incoming) {
+	hash := sha256.New()
+	read := uint64(0)
+
+	timer := time.NewTimer(streamer.options.IdleTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-in.done:
+			return
+
+		case <-ctx.Done():
+			in.writer.CloseWithError(ctx.Err())
+			streamer.finish(in, frame{frameType: frameCancel, streamID: in.id, payload: []byte(ctx.Err().Error())})
+			return
+
+		case <-timer.C:
+			err := NewErrStreamTimedOut(in.id)
+			in.writer.CloseWithError(err)
+			streamer.cancel(ctx, in, err)
+			return
+
+		case f := <-in.frames:
+			resetTimer(timer, streamer.options.IdleTimeout)
+
+			if f.frameType == frameEnd {
+				if f.offset != read || !bytes.Equal(f.payload, hash.Sum(nil)) {
+					err := NewErrStreamCorrupted(in.id)
+					in.writer.CloseWithError(err)
+					streamer.cancel(ctx, in, err)
+					return
+				}
+				in.writer.Close()
+				done := frame{frameType: frameDone, streamID: in.id, offset: read}
+				if streamer.finish(in, done) {
+					if err := streamer.send(ctx, in.from, done); err != nil {
+						streamer.options.Logger.Debugf("error sending done for stream=%v: %v", in.id, err)
+					}
+				}
+				return
+			}
+
+			if _, err := in.writer.Write(f.payload); err != nil {
+				// The Reader has been closed by the application, or the
+				// stream has been cancelled by the sender.
+				streamer.cancel(ctx, in, fmt.Errorf("reader closed: %v", err))
+				return
+			}
+			hash.Write(f.payload)
+			read += uint64(len(f.payload))
+			atomic.StoreUint64(&in.read, read)
+			if err := streamer.send(ctx, in.from, frame{frameType: frameAck, streamID: in.id, offset: read}); err != nil {
+				streamer.options.Logger.Debugf("error sending ack for stream=%v: %v", in.id, err)
+			}
+		}
+	}
+}
+
+// cancel an incoming stream, and tell the sender, unless the stream has
+// already finished.
+func (streamer *streamer) cancel(ctx context.Context, in *incoming, reason error) {
+	f := frame{frameType: frameCancel, streamID: in.id, payload: []byte(reason.Error())}
+	if streamer.finish(in, f) {
+		if err := streamer.send(ctx, in.from, f); err != nil {
+			streamer.options.Logger.Debugf("error sending cancel for stream=%v: %v", in.id, err)
+		}
+	}
+}
+
+// finish an incoming stream, and keep the last frame sent to the sender so
+// that it can be sent again. It returns false if the stream had already
+// finished. Finished streams are forgotten after the idle timeout.
+func (streamer *streamer) finish(in *incoming, last frame) bool {
+	streamer.mu.Lock()
+	defer streamer.mu.Unlock()
+
+	if in.finished {
+		return false
+	}
+	in.finished = true
+	close(in.done)
+
+	now := time.Now()
+	for k, f := range streamer.finished {
+		if now.Sub(f.at) > streamer.options.IdleTimeout {
+			delete(streamer.finished, k)
+		}
+	}
+	k := key(in.from, in.id)
+	delete(streamer.incoming, k)
+	streamer.finished[k] = finished{frame: last, at: now}
+	streamer.streams[in.from.String()]--
+	if streamer.streams[in.from.String()] == 0 {
+		delete(streamer.streams, in.from.String())
+	}
+	return true
+}
+
+// send a frame to a peer.
+func (streamer *streamer) send(ctx context.Context, to protocol.PeerID, f frame) error {
+	toAddr, err := streamer.dht.PeerAddress(to)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case streamer.messages <- protocol.MessageOnTheWire{To: toAddr, Message: f.message()}:
+		return nil
+	}
+}
+
+func key(from protocol.PeerID, id protocol.StreamID) string {
+	return from.String() + "/" + id.String()
+}
+
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
+
+type frame struct {
+	frameType byte
+	streamID  protocol.StreamID
+	offset    uint64
+	payload   []byte
+}
+
+func (f frame) message() protocol.Message {
+	body := make([]byte, frameHeaderLength, frameHeaderLength+len(f.payload))
+	body[0] = f.frameType
+	copy(body[1:17], f.streamID[:])
+	binary.LittleEndian.PutUint64(body[17:], f.offset)
+	return protocol.NewMessage(protocol.V1, protocol.Stream, protocol.NilGroupID, append(body, f.payload...))
+}
+
+func unmarshalFrame(body []byte) (frame, error) {
+	if len(body) < frameHeaderLength {
+		return frame{}, fmt.Errorf("error unmarshaling stream frame: expected len>=%v, got len=%v", frameHeaderLength, len(body))
+	}
+	f := frame{frameType: body[0], offset: binary.LittleEndian.Uint64(body[17:]), payload: body[frameHeaderLength:]}
+	copy(f.streamID[:], body[1:17])
+	return f, nil
+}
+
+// ErrStreaming is returned when a stream cannot be sent to a peer.
+type ErrStreaming struct {
+	error
+	PeerID protocol.PeerID
+}
+
+func newErrStreaming(peerID protocol.PeerID, err error) error {
+	return ErrStreaming{
+		error:  fmt.Errorf("error streaming to %v: %v", peerID, err),
+		PeerID: peerID,
+	}
+}
+
+// ErrStreamCancelled is returned when a stream is cancelled by the remote
+// peer.
+type ErrStreamCancelled struct {
+	error
+	StreamID protocol.StreamID
+	Reason   string
+}
+
+// NewErrStreamCancelled returns an error for a stream that has been cancelled
+// by the remote peer for the given reason.
+func NewErrStreamCancelled(id protocol.StreamID, reason string) error {
+	return ErrStreamCancelled{
+		error:    fmt.Errorf("stream=%v cancelled by remote peer: %v", id, reason),
+		StreamID: id,
+		Reason:   reason,
+	}
+}
+
+// ErrStreamTimedOut is returned when the remote peer of a stream stops
+// responding.
+type ErrStreamTimedOut struct {
+	error
+	StreamID protocol.StreamID
+}
+
+// NewErrStreamTimedOut returns an error for a stream whose remote peer has
+// stopped responding.
+func NewErrStreamTimedOut(id protocol.StreamID) error {
+	return ErrStreamTimedOut{
+		error:    fmt.Errorf("stream=%v timed out", id),
+		StreamID: id,
+	}
+}
+
+// ErrTooManyStreams is returned when a peer starts a stream while it is already
+// sending the maximum number of streams.
+type ErrTooManyStreams struct {
+	error
+	PeerID protocol.PeerID
+}
+
+// NewErrTooManyStreams returns an error for a stream from a peer that is
+// already sending the maximum number of streams.
+func NewErrTooManyStreams(peerID protocol.PeerID, max int) error {
+	return ErrTooManyStreams{
+		error:  fmt.Errorf("peer=%v is already sending %v streams", peerID, max),
+		PeerID: peerID,
+	}
+}
+
+// ErrStreamCorrupted is returned by the Reader of a stream when the length or
+// the hash of the payload does not match the length and the hash sent by the
+// sender.
+type ErrStreamCorrupted struct {
+	error
+	StreamID protocol.StreamID
+}
+
+// NewErrStreamCorrupted returns an error for a stream that has failed its
+// integrity check.
+func NewErrStreamCorrupted(id protocol.StreamID) error {
+	return ErrStreamCorrupted{
+		error:    fmt.Errorf("stream=%v failed integrity check", id),
+		StreamID: id,
+	}
+}
@@ -0,0 +1,268 @@
+package stream_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/stream"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Streamer", func() {
+
+	// streamers returns two Streamers that are connected to each other. Every
+	// message is passed to the filter before it is accepted, and is dropped if
+	// the filter returns false.
+	streamers := func(ctx context.Context, options Options, filter func(*protocol.Message) bool) (Streamer, Streamer, protocol.PeerID, protocol.PeerID, chan protocol.Event) {
+		fromAddr, toAddr := RandomAddress(), RandomAddress()
+		fromMessages := make(chan protocol.MessageOnTheWire, 16)
+		toMessages := make(chan protocol.MessageOnTheWire, 16)
+		fromEvents := make(chan protocol.Event, 16)
+		toEvents := make(chan protocol.Event, 16)
+
+		fromDHT := NewDHT(fromAddr, NewTable("dht"), nil)
+		Expect(fromDHT.AddPeerAddress(toAddr)).NotTo(HaveOccurred())
+		toDHT := NewDHT(toAddr, NewTable("dht"), nil)
+		Expect(toDHT.AddPeerAddress(fromAddr)).NotTo(HaveOccurred())
+
+		from := NewStreamer(options, fromMessages, fromEvents, fromDHT)
+		to := NewStreamer(options, toMessages, toEvents, toDHT)
+
+		forward := func(messages chan protocol.MessageOnTheWire, streamer Streamer, sender protocol.PeerID) {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case message := <-messages:
+					if filter != nil && !filter(&message.Message) {
+						continue
+					}
+					streamer.AcceptStream(ctx, sender, message.Message)
+				}
+			}
+		}
+		go forward(fromMessages, to, fromAddr.PeerID())
+		go forward(toMessages, from, toAddr.PeerID())
+
+		return from, to, fromAddr.PeerID(), toAddr.PeerID(), toEvents
+	}
+
+	options := func() Options {
+		return Options{
+			Logger:             logrus.New(),
+			ChunkSize:          1024,
+			Window:             4,
+			AckTimeout:         50 * time.Millisecond,
+			MaxRetransmissions: 20,
+			IdleTimeout:        5 * time.Second,
+		}
+	}
+
+	receive := func(events chan protocol.Event) protocol.EventStreamReceived {
+		var event protocol.Event
+		Eventually(events, 5*time.Second).Should(Receive(&event))
+		Expect(event).Should(BeAssignableToTypeOf(protocol.EventStreamReceived{}))
+		return event.(protocol.EventStreamReceived)
+	}
+
+	Context("when streaming a payload", func() {
+		It("should be received in full by the remote peer", func() {
+			for _, length := range []int{0, 1, 1023, 1024, 1025, 10 * 1024, 1024 * 1024} {
+				ctx, cancel := context.WithCancel(context.Background())
+				from, _, fromID, toID, events := streamers(ctx, options(), nil)
+
+				payload := RandomBytes(length)
+				errs := make(chan error, 1)
+				go func() {
+					errs <- from.SendStream(ctx, toID, bytes.NewReader(payload))
+				}()
+
+				event := receive(events)
+				Expect(event.From.Equal(fromID)).Should(BeTrue())
+				data, err := ioutil.ReadAll(event.Reader)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(bytes.Equal(data, payload)).Should(BeTrue())
+				Eventually(errs, 5*time.Second).Should(Receive(BeNil()))
+				cancel()
+			}
+		})
+
+		It("should be received in full when messages are lost", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			from, _, _, toID, events := streamers(ctx, options(), func(*protocol.Message) bool {
+				return rand.Intn(5) != 0
+			})
+
+			payload := RandomBytes(64 * 1024)
+			errs := make(chan error, 1)
+			go func() {
+				errs <- from.SendStream(ctx, toID, bytes.NewReader(payload))
+			}()
+
+			data, err := ioutil.ReadAll(receive(events).Reader)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(bytes.Equal(data, payload)).Should(BeTrue())
+			Eventually(errs, 10*time.Second).Should(Receive(BeNil()))
+		})
+
+		It("should not send more than a window of chunks before they are read", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			opts := options()
+			opts.AckTimeout = time.Second
+			sent := make(chan struct{}, 64)
+			from, _, _, toID, events := streamers(ctx, opts, func(message *protocol.Message) bool {
+				if len(message.Body) > 25 && message.Body[0] == 1 {
+					sent <- struct{}{}
+				}
+				return true
+			})
+
+			go from.SendStream(ctx, toID, bytes.NewReader(RandomBytes(32*1024)))
+			event := receive(events)
+			Eventually(sent).Should(HaveLen(opts.Window))
+			Consistently(sent, 200*time.Millisecond).Should(HaveLen(opts.Window))
+
+			data := make([]byte, 1024)
+			_, err := event.Reader.Read(data)
+			Expect(err).ShouldNot(HaveOccurred())
+			Eventually(sent).Should(HaveLen(opts.Window + 1))
+		})
+	})
+
+	Context("when the payload is corrupted", func() {
+		It("should return an error from the reader and cancel the stream", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			from, _, _, toID, events := streamers(ctx, options(), func(message *protocol.Message) bool {
+				if len(message.Body) > 25 && message.Body[0] == 1 {
+					body := make(protocol.MessageBody, len(message.Body))
+					copy(body, message.Body)
+					body[25]++
+					message.Body = body
+				}
+				return true
+			})
+
+			errs := make(chan error, 1)
+			go func() {
+				errs <- from.SendStream(ctx, toID, bytes.NewReader(RandomBytes(4*1024)))
+			}()
+
+			_, err := ioutil.ReadAll(receive(events).Reader)
+			Expect(err).Should(BeAssignableToTypeOf(ErrStreamCorrupted{}))
+			var sendErr error
+			Eventually(errs, 5*time.Second).Should(Receive(&sendErr))
+			Expect(sendErr).Should(BeAssignableToTypeOf(ErrStreamCancelled{}))
+		})
+	})
+
+	Context("when the receiver closes the reader", func() {
+		It("should cancel the stream", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			from, _, _, toID, events := streamers(ctx, options(), nil)
+
+			errs := make(chan error, 1)
+			go func() {
+				errs <- from.SendStream(ctx, toID, bytes.NewReader(RandomBytes(64*1024)))
+			}()
+
+			Expect(receive(events).Reader.Close()).Should(Succeed())
+			var err error
+			Eventually(errs, 5*time.Second).Should(Receive(&err))
+			Expect(err).Should(BeAssignableToTypeOf(ErrStreamCancelled{}))
+		})
+	})
+
+	Context("when the context of the sender is cancelled", func() {
+		It("should cancel the stream", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			from, _, _, toID, events := streamers(ctx, options(), nil)
+
+			sendCtx, sendCancel := context.WithCancel(ctx)
+			errs := make(chan error, 1)
+			go func() {
+				errs <- from.SendStream(sendCtx, toID, bytes.NewReader(RandomBytes(64*1024)))
+			}()
+
+			event := receive(events)
+			sendCancel()
+			var err error
+			Eventually(errs, 5*time.Second).Should(Receive(&err))
+			Expect(err).Should(BeAssignableToTypeOf(ErrStreaming{}))
+
+			_, err = ioutil.ReadAll(event.Reader)
+			Expect(err).Should(BeAssignableToTypeOf(ErrStreamCancelled{}))
+		})
+	})
+
+	Context("when the receiver stops responding", func() {
+		It("should time out", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			opts := options()
+			opts.AckTimeout = 10 * time.Millisecond
+			opts.MaxRetransmissions = 3
+			from, _, _, toID, _ := streamers(ctx, opts, func(*protocol.Message) bool {
+				return false
+			})
+
+			err := from.SendStream(ctx, toID, bytes.NewReader(RandomBytes(4*1024)))
+			Expect(err).Should(BeAssignableToTypeOf(ErrStreamTimedOut{}))
+		})
+	})
+
+	Context("when a peer sends too many streams at the same time", func() {
+		It("should cancel the new streams", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			opts := options()
+			opts.MaxIncoming = 1
+			from, to, fromID, toID, events := streamers(ctx, opts, nil)
+
+			// The first stream is not read, so it is still being received.
+			go from.SendStream(ctx, toID, bytes.NewReader(RandomBytes(64*1024)))
+			event := receive(events)
+
+			err := from.SendStream(ctx, toID, bytes.NewReader(RandomBytes(1024)))
+			Expect(err).Should(BeAssignableToTypeOf(ErrStreamCancelled{}))
+
+			// Frames that start new streams are rejected.
+			body := make([]byte, 1+16+8, 1+16+8+32)
+			body[0] = 1
+			copy(body[1:17], RandomBytes(16))
+			message := protocol.NewMessage(protocol.V1, protocol.Stream, protocol.NilGroupID, append(body, RandomBytes(32)...))
+			Expect(to.AcceptStream(ctx, fromID, message)).Should(BeAssignableToTypeOf(ErrTooManyStreams{}))
+
+			// New streams are received once the first stream has finished.
+			Expect(event.Reader.Close()).Should(Succeed())
+			Eventually(func() error {
+				return to.AcceptStream(ctx, fromID, message)
+			}, 5*time.Second).Should(Succeed())
+		})
+	})
+
+	Context("when accepting invalid messages", func() {
+		It("should return an error", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			_, to, fromID, _, _ := streamers(ctx, options(), nil)
+
+			message := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, RandomBytes(32))
+			Expect(to.AcceptStream(ctx, fromID, message)).Should(HaveOccurred())
+			message = protocol.NewMessage(protocol.V1, protocol.Stream, protocol.NilGroupID, RandomBytes(24))
+			Expect(to.AcceptStream(ctx, fromID, message)).Should(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,157 @@
+package tcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// PeerAddress is the address of a Peer that accepts TCP connections. The Nonce
+// is increased by the Peer whenever its address changes, so that newer
+// addresses replace older addresses in the DHT.
+type PeerAddress struct {
+	ID    protocol.PeerID
+	Host  string
+	Port  uint16
+	Nonce uint64
+}
+
+// NewPeerAddress returns a PeerAddress with a zero Nonce.
+func NewPeerAddress(id protocol.PeerID, host string, port uint16) PeerAddress {
+	return PeerAddress{
+		ID:   id,
+		Host: host,
+		Port: port,
+	}
+}
+
+// String implements the `protocol.PeerAddress` interface.
+func (address PeerAddress) String() string {
+	return fmt.Sprintf("/tcp/%s/port/%d/id/%v/nonce/%d", address.Host, address.Port, address.ID, address.Nonce)
+}
+
+// Equal implements the `protocol.PeerAddress` interface.
+func (address PeerAddress) Equal(peerAddress protocol.PeerAddress) bool {
+	return address.String() == peerAddress.String()
+}
+
+// PeerID implements the `protocol.PeerAddress` interface.
+func (address PeerAddress) PeerID() protocol.PeerID {
+	return address.ID
+}
+
+// NetworkAddress implements the `protocol.PeerAddress` interface. It returns
+// nil if the host cannot be resolved.
+func (address PeerAddress) NetworkAddress() net.Addr {
+	netAddress, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(address.Host, strconv.Itoa(int(address.Port))))
+	if err != nil {
+		return nil
+	}
+	return netAddress
+}
+
+// IsNewer implements the `protocol.PeerAddress` interface.
+func (address PeerAddress) IsNewer(peerAddress protocol.PeerAddress) bool {
+	other, ok := peerAddress.(PeerAddress)
+	if !ok {
+		return false
+	}
+	return address.Nonce > other.Nonce
+}
+
+type peerAddressCodec struct {
+	peerIDCodec protocol.PeerIDCodec
+}
+
+// NewPeerAddressCodec returns a PeerAddressCodec for PeerAddresses. The PeerID
+// is encoded using the given PeerIDCodec, and is followed by the host, the
+// port and the nonce.
+func NewPeerAddressCodec(peerIDCodec protocol.PeerIDCodec) protocol.PeerAddressCodec {
+	if peerIDCodec == nil {
+		panic("invariant violation: peer id codec cannot be nil")
+	}
+	return peerAddressCodec{peerIDCodec: peerIDCodec}
+}
+
+// Encode implements the `protocol.PeerAddressCodec` interface.
+func (codec peerAddressCodec) Encode(peerAddress protocol.PeerAddress) ([]byte, error) {
+	address, ok := peerAddress.(PeerAddress)
+	if !ok {
+		return nil, fmt.Errorf("unsupported peer address of type: %T", peerAddress)
+	}
+	id, err := codec.peerIDCodec.Encode(address.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding peer id: %v", err)
+	}
+
+	buffer := new(bytes.Buffer)
+	if err := writeBytes(buffer, id); err != nil {
+		return nil, fmt.Errorf("error encoding peer id: %v", err)
+	}
+	if err := writeBytes(buffer, []byte(address.Host)); err != nil {
+		return nil, fmt.Errorf("error encoding host: %v", err)
+	}
+	if err := binary.Write(buffer, binary.LittleEndian, address.Port); err != nil {
+		return nil, fmt.Errorf("error encoding port: %v", err)
+	}
+	if err := binary.Write(buffer, binary.LittleEndian, address.Nonce); err != nil {
+		return nil, fmt.Errorf("error encoding nonce: %v", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+// Decode implements the `protocol.PeerAddressCodec` interface.
+func (codec peerAddressCodec) Decode(data []byte) (protocol.PeerAddress, error) {
+	reader := bytes.NewReader(data)
+	id, err := readBytes(reader)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding peer id: %v", err)
+	}
+	peerID, err := codec.peerIDCodec.Decode(id)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding peer id: %v", err)
+	}
+	host, err := readBytes(reader)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding host: %v", err)
+	}
+	address := PeerAddress{ID: peerID, Host: string(host)}
+	if err := binary.Read(reader, binary.LittleEndian, &address.Port); err != nil {
+		return nil, fmt.Errorf("error decoding port: %v", err)
+	}
+	if err := binary.Read(reader, binary.LittleEndian, &address.Nonce); err != nil {
+		return nil, fmt.Errorf("error decoding nonce: %v", err)
+	}
+	if reader.Len() != 0 {
+		return nil, fmt.Errorf("error decoding peer address: %v trailing bytes", reader.Len())
+	}
+	return address, nil
+}
+
+func writeBytes(w io.Writer, data []byte) error {
+	if len(data) > 0xFFFF {
+		return fmt.Errorf("length %v exceeds %v", len(data), 0xFFFF)
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint16(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readBytes(r io.Reader) ([]byte, error) {
+	var n uint16
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
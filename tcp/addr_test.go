@@ -0,0 +1,51 @@
+package tcp_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/tcp"
+	. "github.com/renproject/aw/testutil"
+)
+
+var _ = Describe("TCP peer address", func() {
+
+	Context("when encoding and decoding addresses", func() {
+		It("should return the same address", func() {
+			codec := NewPeerAddressCodec(SimplePeerIDCodec{})
+			address := NewPeerAddress(RandomPeerID(), "127.0.0.1", 18514)
+			address.Nonce = 42
+
+			data, err := codec.Encode(address)
+			Expect(err).NotTo(HaveOccurred())
+			decoded, err := codec.Decode(data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decoded.Equal(address)).Should(BeTrue())
+			Expect(decoded.PeerID().Equal(address.PeerID())).Should(BeTrue())
+		})
+
+		It("should return an error when encoding other addresses", func() {
+			codec := NewPeerAddressCodec(SimplePeerIDCodec{})
+			_, err := codec.Encode(RandomAddress())
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should return an error when decoding truncated data", func() {
+			codec := NewPeerAddressCodec(SimplePeerIDCodec{})
+			data, err := codec.Encode(NewPeerAddress(RandomPeerID(), "127.0.0.1", 18514))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = codec.Decode(data[:len(data)-1])
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when comparing addresses", func() {
+		It("should prefer the address with the larger nonce", func() {
+			address := NewPeerAddress(RandomPeerID(), "127.0.0.1", 18514)
+			newer := address
+			newer.Nonce++
+			Expect(newer.IsNewer(address)).Should(BeTrue())
+			Expect(address.IsNewer(newer)).Should(BeFalse())
+			Expect(newer.NetworkAddress().String()).Should(Equal("127.0.0.1:18514"))
+		})
+	})
+})
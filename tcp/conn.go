@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -19,10 +20,27 @@ var ErrTooManyConnections = errors.New("too many connections")
 // A ConnPool maintains multiple connections to different remote peers and
 // re-uses these connections when sending multiple message to the peer. If a
 // connection to a peer does not exist when a message is sent, then it is
-// established. When there are multiple Clients, they should all use a shared
-// ConnPool, and therefore all implementations must be safe for concurrent use.
+// established, and the remote peer must authenticate itself as the PeerID of
+// the PeerAddress. When there are multiple Clients, they should all use a
+// shared ConnPool, and therefore all implementations must be safe for
+// concurrent use.
 type ConnPool interface {
-	Send(net.Addr, protocol.Message) error
+	// Send a message to the peer. It returns an ErrConnecting if a connection
+	// to the peer cannot be established, which is the only error that is
+	// counted by the circuit breaker of a Client. It returns a
+	// handshake.ErrMessageRejected, without closing the connection, if the
+	// session rejects the message before writing it.
+	Send(protocol.PeerAddress, protocol.Message) error
+
+	// Register a connection that was accepted from the remote peer, so that
+	// messages sent to the peer re-use the connection instead of dialing a new
+	// one. The ConnPool writes to the session at the same time as its caller,
+	// so the session must be safe for concurrent writes.
+	Register(net.Conn, protocol.PeerID, protocol.Session)
+
+	// Deregister a connection that was accepted from the remote peer, once it
+	// has been closed.
+	Deregister(protocol.PeerID, net.Conn)
 }
 
 // ConnPoolOptions are used to parameterise the behaviour of a ConnPool.
@@ -30,6 +48,18 @@ type ConnPoolOptions struct {
 	Timeout        time.Duration // Timeout when dialing new connections.
 	TimeToLive     time.Duration // Time-to-live for connections.
 	MaxConnections int           // Max connections allowed.
+
+	// Replies receives the messages that remote peers write back through the
+	// sessions of connections in the pool. Messages are only read from
+	// sessions that can be written by both peers. If it is nil, messages are
+	// never read.
+	Replies protocol.MessageSender
+
+	// Me is the PeerID of the local peer. When the local and remote peers dial
+	// each other at the same time, both keep the connection that was dialed by
+	// the peer with the lesser PeerID, and close the other one. If it is nil,
+	// connections dialed by the local peer are always kept.
+	Me protocol.PeerID
 }
 
 func (options *ConnPoolOptions) setZerosToDefaults() {
@@ -55,7 +85,29 @@ type connPool struct {
 
 type conn struct {
 	conn    net.Conn
+	peerID  protocol.PeerID
 	session protocol.Session
+	addr    string // Network address that was dialed, or empty if the connection was accepted
+}
+
+// syncSession is a protocol.Session that can be written concurrently.
+type syncSession struct {
+	protocol.Session
+	mu *sync.Mutex
+}
+
+func newSyncSession(session protocol.Session) protocol.Session {
+	return syncSession{
+		Session: session,
+		mu:      new(sync.Mutex),
+	}
+}
+
+func (session syncSession) WriteMessage(w io.Writer, m protocol.Message) error {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	return session.Session.WriteMessage(w, m)
 }
 
 // NewConnPool returns a ConnPool with no existing connections. It is safe for
@@ -77,35 +129,106 @@ func NewConnPool(options ConnPoolOptions, logger logrus.FieldLogger, handshaker
 	}
 }
 
-func (pool *connPool) Send(to net.Addr, m protocol.Message) error {
+func (pool *connPool) Send(to protocol.PeerAddress, m protocol.Message) error {
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
 
-	toStr := to.String()
+	netAddr := to.NetworkAddress()
+	if netAddr == nil {
+		return fmt.Errorf("invalid network address for peer=%v", to.PeerID())
+	}
+	toStr := to.PeerID().String()
 	c, ok := pool.conns[toStr]
+	if ok && c.addr != "" && c.addr != netAddr.String() {
+		// The peer has moved to a different network address, so the existing
+		// connection must be replaced by a connection to the new address.
+		pool.closeConnImmediately(toStr)
+		ok = false
+	}
 	if !ok {
 		if len(pool.conns) >= pool.options.MaxConnections {
 			return ErrTooManyConnections
 		}
 
 		var err error
-		c, err = pool.connect(to)
+		c, err = pool.connect(netAddr, to.PeerID())
 		if err != nil {
-			return err
+			return NewErrConnecting(to.PeerID(), err)
 		}
 
 		pool.conns[toStr] = c
-		go pool.closeConn(toStr)
+		go pool.closeConn(toStr, c)
+		if pool.options.Replies != nil && c.session.Negotiation().AEAD.IsDuplex() {
+			go pool.read(toStr, c)
+		}
 	}
 
 	if err := c.session.WriteMessage(c.conn, m); err != nil {
+		if _, ok := err.(handshake.ErrMessageRejected); ok {
+			// Nothing has been written, so the connection can still be used.
+			return err
+		}
 		pool.logger.Errorf("error in session: %v, closing connection...", err)
 		pool.closeConnImmediately(toStr)
+		return err
 	}
 	return nil
 }
 
-func (pool *connPool) connect(to net.Addr) (conn, error) {
+func (pool *connPool) Register(netConn net.Conn, peerID protocol.PeerID, session protocol.Session) {
+	// Only the peer that initiated the handshake can write to sessions that are
+	// not duplex, so they cannot be used to send messages.
+	if !session.Negotiation().AEAD.IsDuplex() {
+		return
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	toStr := peerID.String()
+	existing, ok := pool.conns[toStr]
+	if ok && existing.addr != "" {
+		if pool.keepDialed(peerID) {
+			return
+		}
+		pool.closeConnImmediately(toStr)
+		ok = false
+	}
+	if !ok && len(pool.conns) >= pool.options.MaxConnections {
+		return
+	}
+
+	c := conn{
+		conn:    netConn,
+		peerID:  peerID,
+		session: session,
+	}
+	pool.conns[toStr] = c
+	go pool.closeConn(toStr, c)
+}
+
+func (pool *connPool) Deregister(peerID protocol.PeerID, netConn net.Conn) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	toStr := peerID.String()
+	if existing, ok := pool.conns[toStr]; ok && existing.conn == netConn {
+		delete(pool.conns, toStr)
+	}
+}
+
+// keepDialed returns true if the connection dialed to the remote peer must be
+// kept instead of a connection accepted from it. Both peers make the same
+// decision, so that they converge on one connection when they dial each other
+// at the same time.
+func (pool *connPool) keepDialed(remote protocol.PeerID) bool {
+	if pool.options.Me == nil {
+		return true
+	}
+	return pool.options.Me.String() < remote.String()
+}
+
+func (pool *connPool) connect(to net.Addr, expected protocol.PeerID) (conn, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), pool.options.Timeout)
 	defer cancel()
 
@@ -120,11 +243,13 @@ func (pool *connPool) connect(to net.Addr) (conn, error) {
 		return conn{}, err
 	}
 
-	session, err := pool.handshaker.Handshake(ctx, netConn)
+	session, err := pool.handshaker.Handshake(ctx, netConn, expected)
 	if err != nil {
+		netConn.Close()
 		return conn{}, err
 	}
 	if session == nil {
+		netConn.Close()
 		return conn{}, fmt.Errorf("nil session [addr = %v] returned by handshaker", to)
 	}
 
@@ -135,17 +260,39 @@ func (pool *connPool) connect(to net.Addr) (conn, error) {
 
 	return conn{
 		conn:    netConn,
+		peerID:  expected,
 		session: session,
+		addr:    to.String(),
 	}, nil
 }
 
-func (pool *connPool) closeConn(to string) {
+// read the messages written back by the remote peer of a connection, until the
+// connection is closed.
+func (pool *connPool) read(to string, c conn) {
+	for {
+		messageOtw, err := c.session.ReadMessageOnTheWire(c.conn)
+		if err != nil {
+			if err != io.EOF {
+				pool.logger.Debugf("error reading reply from %v: %v", to, err)
+			}
+			pool.mu.Lock()
+			defer pool.mu.Unlock()
+			if existing, ok := pool.conns[to]; ok && existing.conn == c.conn {
+				pool.closeConnImmediately(to)
+			}
+			return
+		}
+		pool.options.Replies <- messageOtw
+	}
+}
+
+func (pool *connPool) closeConn(to string, c conn) {
 	<-time.After(pool.options.TimeToLive)
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
 
-	c, ok := pool.conns[to]
-	if !ok {
+	// Do not close a connection that has replaced this one.
+	if existing, ok := pool.conns[to]; !ok || existing.conn != c.conn {
 		return
 	}
 	if err := c.conn.Close(); err != nil {
@@ -2,7 +2,9 @@ package tcp_test
 
 import (
 	"context"
-	"net"
+	"fmt"
+	"io"
+	"sync/atomic"
 	"testing/quick"
 	"time"
 
@@ -15,11 +17,28 @@ import (
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/renproject/aw/handshake"
 	"github.com/renproject/aw/protocol"
+	"github.com/renproject/phi"
 	"github.com/sirupsen/logrus"
 )
 
+// countingHandshaker counts the handshakes that it initiates.
+type countingHandshaker struct {
+	handshake.Handshaker
+	handshakes *int64
+}
+
+func (handshaker countingHandshaker) Handshake(ctx context.Context, rw io.ReadWriter, expected protocol.PeerID) (protocol.Session, error) {
+	atomic.AddInt64(handshaker.handshakes, 1)
+	return handshaker.Handshaker.Handshake(ctx, rw, expected)
+}
+
 var _ = Describe("Connection pool", func() {
 
+	BeforeEach(func() {
+		// Give enough time for server to clean up between tests
+		time.Sleep(500 * time.Millisecond)
+	})
+
 	Context("when initializing a ConnPool", func() {
 		It("should set the options to default if not provided", func() {
 			handshaker := handshake.New(NewMockSignVerifier(), handshake.NewGCMSessionManager())
@@ -49,14 +68,14 @@ var _ = Describe("Connection pool", func() {
 					pool := NewConnPool(ConnPoolOptions{}, logrus.New(), handshaker)
 
 					// Initialize a server
-					serverAddr, err := net.ResolveTCPAddr("tcp", ":8080")
-					Expect(err).NotTo(HaveOccurred())
-					options := ServerOptions{Host: serverAddr.String()}
-					messages := NewTCPServer(ctx, options, clientSignVerifier)
+					serverSignVerifier := NewMockSignVerifier()
+					serverAddr := NewSimpleTCPPeerAddress(serverSignVerifier.ID(), "", "8080")
+					options := ServerOptions{Host: serverAddr.NetworkAddress().String()}
+					messages := NewTCPServer(ctx, options, serverSignVerifier, clientSignVerifier)
 
 					// Send 20 messages through the connPool and expect the server receives all of them.
 					for i := 0; i < 20; i++ {
-						message := RandomMessage(protocol.V1, RandomMessageVariant())
+						message := RandomMessage(protocol.V2, RandomMessageVariant())
 						Expect(pool.Send(serverAddr, message)).NotTo(HaveOccurred())
 						var received protocol.MessageOnTheWire
 						Eventually(messages, 3*time.Second).Should(Receive(&received))
@@ -84,13 +103,12 @@ var _ = Describe("Connection pool", func() {
 					pool := NewConnPool(ConnPoolOptions{MaxConnections: 1}, logrus.New(), handshaker)
 
 					// Initialize two servers
-					serverAddr1, err := net.ResolveTCPAddr("tcp", ":8080")
-					Expect(err).NotTo(HaveOccurred())
-					serverAddr2, err := net.ResolveTCPAddr("tcp", ":9090")
-					Expect(err).NotTo(HaveOccurred())
+					serverSignVerifier1, serverSignVerifier2 := NewMockSignVerifier(), NewMockSignVerifier()
+					serverAddr1 := NewSimpleTCPPeerAddress(serverSignVerifier1.ID(), "", "8080")
+					serverAddr2 := NewSimpleTCPPeerAddress(serverSignVerifier2.ID(), "", "9090")
 
-					_ = NewTCPServer(ctx, ServerOptions{Host: serverAddr1.String()}, clientSignVerifier)
-					_ = NewTCPServer(ctx, ServerOptions{Host: serverAddr2.String()}, clientSignVerifier)
+					_ = NewTCPServer(ctx, ServerOptions{Host: serverAddr1.NetworkAddress().String(), RateLimit: -1}, serverSignVerifier1, clientSignVerifier)
+					_ = NewTCPServer(ctx, ServerOptions{Host: serverAddr2.NetworkAddress().String(), RateLimit: -1}, serverSignVerifier2, clientSignVerifier)
 
 					// Wait for servers to start
 					time.Sleep(1000 * time.Millisecond)
@@ -121,10 +139,10 @@ var _ = Describe("Connection pool", func() {
 					pool := NewConnPool(ConnPoolOptions{TimeToLive: 200 * time.Millisecond}, logrus.New(), handshaker)
 
 					// Initialize a server
-					serverAddr, err := net.ResolveTCPAddr("tcp", ":8080")
-					Expect(err).NotTo(HaveOccurred())
-					options := ServerOptions{Host: serverAddr.String(), RateLimit: -1} // no rate limiting on server
-					messages := NewTCPServer(ctx, options, clientSignVerifier)
+					serverSignVerifier := NewMockSignVerifier()
+					serverAddr := NewSimpleTCPPeerAddress(serverSignVerifier.ID(), "", "8080")
+					options := ServerOptions{Host: serverAddr.NetworkAddress().String(), RateLimit: -1} // no rate limiting on server
+					messages := NewTCPServer(ctx, options, serverSignVerifier, clientSignVerifier)
 
 					// Send a message through the connPool and expect the server receives it.
 					message1 := RandomMessage(protocol.V1, RandomMessageVariant())
@@ -150,6 +168,311 @@ var _ = Describe("Connection pool", func() {
 		})
 	})
 
+	Context("when the server is not the expected peer", func() {
+		It("should return an ErrUnexpectedPeer without delivering the message", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer func() {
+				cancel()
+				time.Sleep(200 * time.Millisecond)
+			}()
+
+			// Initialize a connPool
+			clientSignVerifier := NewMockSignVerifier()
+			handshaker := handshake.New(clientSignVerifier, handshake.NewGCMSessionManager())
+			pool := NewConnPool(ConnPoolOptions{}, logrus.New(), handshaker)
+
+			// Initialize a server, and an address that claims it is another peer
+			serverSignVerifier := NewMockSignVerifier()
+			serverAddr := NewSimpleTCPPeerAddress(serverSignVerifier.ID(), "", "8080")
+			options := ServerOptions{Host: serverAddr.NetworkAddress().String(), RateLimit: -1}
+			messages := NewTCPServer(ctx, options, serverSignVerifier, clientSignVerifier)
+			otherAddr := NewSimpleTCPPeerAddress(NewMockSignVerifier().ID(), "", "8080")
+
+			err := pool.Send(otherAddr, RandomMessage(protocol.V1, RandomMessageVariant()))
+			Expect(err).To(BeAssignableToTypeOf(ErrConnecting{}))
+			Expect(err.(ErrConnecting).Err).To(BeAssignableToTypeOf(handshake.ErrUnexpectedPeer{}))
+			Consistently(messages, time.Second).ShouldNot(Receive())
+		})
+
+		It("should not reuse a connection that was established with another peer", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer func() {
+				cancel()
+				time.Sleep(200 * time.Millisecond)
+			}()
+
+			// Initialize a connPool
+			clientSignVerifier := NewMockSignVerifier()
+			handshaker := handshake.New(clientSignVerifier, handshake.NewGCMSessionManager())
+			pool := NewConnPool(ConnPoolOptions{}, logrus.New(), handshaker)
+
+			// Initialize a server
+			serverSignVerifier := NewMockSignVerifier()
+			serverAddr := NewSimpleTCPPeerAddress(serverSignVerifier.ID(), "", "8080")
+			options := ServerOptions{Host: serverAddr.NetworkAddress().String(), RateLimit: -1}
+			messages := NewTCPServer(ctx, options, serverSignVerifier, clientSignVerifier)
+
+			// Establish a connection with the server
+			Expect(pool.Send(serverAddr, RandomMessage(protocol.V1, RandomMessageVariant()))).To(Succeed())
+			Eventually(messages, 3*time.Second).Should(Receive())
+
+			// Send to a stale address of another peer at the same network address
+			otherAddr := NewSimpleTCPPeerAddress(NewMockSignVerifier().ID(), "", "8080")
+			err := pool.Send(otherAddr, RandomMessage(protocol.V1, RandomMessageVariant()))
+			Expect(err).To(BeAssignableToTypeOf(ErrConnecting{}))
+			Expect(err.(ErrConnecting).Err).To(BeAssignableToTypeOf(handshake.ErrUnexpectedPeer{}))
+			Consistently(messages, time.Second).ShouldNot(Receive())
+		})
+	})
+
+	Context("when the session rejects a message", func() {
+		It("should return an ErrMessageRejected without closing the connection", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer func() {
+				cancel()
+				time.Sleep(200 * time.Millisecond)
+			}()
+
+			// Initialize a connPool that cannot write casts longer than 64 bytes
+			clientSignVerifier := NewMockSignVerifier()
+			limits := protocol.SizeLimits{
+				MaxVariantLengths: map[protocol.MessageVariant]protocol.MessageLength{protocol.Cast: 64},
+			}
+			handshakes := int64(0)
+			handshaker := countingHandshaker{
+				Handshaker: handshake.NewWithOptions(clientSignVerifier, handshake.Options{SizeLimits: limits}, handshake.NewGCMSessionManager()),
+				handshakes: &handshakes,
+			}
+			pool := NewConnPool(ConnPoolOptions{}, logrus.New(), handshaker)
+
+			// Initialize a server
+			serverSignVerifier := NewMockSignVerifier()
+			serverAddr := NewSimpleTCPPeerAddress(serverSignVerifier.ID(), "", "8080")
+			options := ServerOptions{Host: serverAddr.NetworkAddress().String(), RateLimit: -1}
+			messages := NewTCPServer(ctx, options, serverSignVerifier, clientSignVerifier)
+
+			// Establish a connection with the server
+			Expect(pool.Send(serverAddr, protocol.NewMessage(protocol.V2, protocol.Cast, protocol.NilGroupID, RandomBytes(8)))).To(Succeed())
+			Eventually(messages, 3*time.Second).Should(Receive())
+
+			// Send a message that exceeds the size limits
+			err := pool.Send(serverAddr, protocol.NewMessage(protocol.V2, protocol.Cast, protocol.NilGroupID, RandomBytes(128)))
+			Expect(err).To(BeAssignableToTypeOf(handshake.ErrMessageRejected{}))
+			Expect(err.(handshake.ErrMessageRejected).Err).To(BeAssignableToTypeOf(protocol.ErrMessageLengthIsTooHigh{}))
+			Consistently(messages, 200*time.Millisecond).ShouldNot(Receive())
+
+			// Expect the connection to be re-used
+			Expect(pool.Send(serverAddr, protocol.NewMessage(protocol.V2, protocol.Cast, protocol.NilGroupID, RandomBytes(8)))).To(Succeed())
+			Eventually(messages, 3*time.Second).Should(Receive())
+			Expect(atomic.LoadInt64(&handshakes)).Should(Equal(int64(1)))
+		})
+	})
+
+	Context("when using the noise handshaker", func() {
+		It("should establish sessions between the connPool and the server and deliver messages", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer func() {
+				cancel()
+				time.Sleep(200 * time.Millisecond)
+			}()
+
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+
+			// Initialize a connPool
+			pool := NewConnPool(ConnPoolOptions{}, logrus.New(), handshake.NewNoise(clientSignVerifier))
+
+			// Initialize a server
+			serverAddr := NewSimpleTCPPeerAddress(serverSignVerifier.ID(), "", "8080")
+			messages := NewTCPServerWithHandshaker(ctx, ServerOptions{Host: serverAddr.NetworkAddress().String()}, handshake.NewNoise(serverSignVerifier))
+
+			// Send 20 messages through the connPool and expect the server receives all of them.
+			for i := 0; i < 20; i++ {
+				message := RandomMessage(protocol.V2, RandomMessageVariant())
+				Expect(pool.Send(serverAddr, message)).NotTo(HaveOccurred())
+				var received protocol.MessageOnTheWire
+				Eventually(messages, 3*time.Second).Should(Receive(&received))
+				Expect(received.From.String()).Should(Equal(clientSignVerifier.ID()))
+				Expect(cmp.Equal(message, received.Message, cmpopts.EquateEmpty())).Should(BeTrue())
+			}
+		})
+
+		It("should deliver replies written back through the session of the server", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer func() {
+				cancel()
+				time.Sleep(200 * time.Millisecond)
+			}()
+
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+
+			// Initialize a connPool that reads replies
+			replies := make(chan protocol.MessageOnTheWire, 1)
+			pool := NewConnPool(ConnPoolOptions{Replies: replies}, logrus.New(), handshake.NewNoise(clientSignVerifier))
+
+			// Initialize a server
+			serverAddr := NewSimpleTCPPeerAddress(serverSignVerifier.ID(), "", "8080")
+			messages := NewTCPServerWithHandshaker(ctx, ServerOptions{Host: serverAddr.NetworkAddress().String()}, handshake.NewNoise(serverSignVerifier))
+
+			// Reply to every message through the session that it was read from.
+			for i := 0; i < 20; i++ {
+				Expect(pool.Send(serverAddr, RandomMessage(protocol.V1, RandomMessageVariant()))).NotTo(HaveOccurred())
+				var received protocol.MessageOnTheWire
+				Eventually(messages, 3*time.Second).Should(Receive(&received))
+				Expect(received.Reply).ShouldNot(BeNil())
+
+				reply := RandomMessage(protocol.V2, RandomMessageVariant())
+				received.Reply <- protocol.MessageOnTheWire{Message: reply}
+				var receivedReply protocol.MessageOnTheWire
+				Eventually(replies, 3*time.Second).Should(Receive(&receivedReply))
+				Expect(receivedReply.From.String()).Should(Equal(serverSignVerifier.ID()))
+				Expect(cmp.Equal(reply, receivedReply.Message, cmpopts.EquateEmpty())).Should(BeTrue())
+			}
+		})
+
+		It("should not deliver messages when the server does not trust the client", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer func() {
+				cancel()
+				time.Sleep(200 * time.Millisecond)
+			}()
+
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier()
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+
+			pool := NewConnPool(ConnPoolOptions{Timeout: 500 * time.Millisecond}, logrus.New(), handshake.NewNoise(clientSignVerifier))
+
+			serverAddr := NewSimpleTCPPeerAddress(serverSignVerifier.ID(), "", "8080")
+			messages := NewTCPServerWithHandshaker(ctx, ServerOptions{Host: serverAddr.NetworkAddress().String()}, handshake.NewNoise(serverSignVerifier))
+
+			message := RandomMessage(protocol.V1, RandomMessageVariant())
+			_ = pool.Send(serverAddr, message)
+			Consistently(messages, time.Second).ShouldNot(Receive())
+		})
+	})
+
+	Context("when the server registers accepted connections with a connPool", func() {
+		It("should send messages to the client through the accepted connection", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer func() {
+				cancel()
+				time.Sleep(200 * time.Millisecond)
+			}()
+
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+
+			// Initialize a connPool that reads replies
+			replies := make(chan protocol.MessageOnTheWire, 1)
+			clientPool := NewConnPool(ConnPoolOptions{Replies: replies}, logrus.New(), handshake.NewNoise(clientSignVerifier))
+
+			// Initialize a server that shares its connPool
+			serverHandshaker := handshake.NewNoise(serverSignVerifier)
+			serverPool := NewConnPool(ConnPoolOptions{Timeout: 200 * time.Millisecond}, logrus.New(), serverHandshaker)
+			serverAddr := NewSimpleTCPPeerAddress(serverSignVerifier.ID(), "", "8080")
+			server := NewServerWithConnPool(ServerOptions{Host: serverAddr.NetworkAddress().String()}, logrus.New(), serverHandshaker, nil, serverPool)
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			go server.Run(ctx, messages)
+			time.Sleep(50 * time.Millisecond)
+
+			// Establish a connection with the server
+			Expect(clientPool.Send(serverAddr, RandomMessage(protocol.V1, RandomMessageVariant()))).To(Succeed())
+			Eventually(messages, 3*time.Second).Should(Receive())
+
+			// The client cannot be dialed, so messages can only be sent through
+			// the connection that it has dialed.
+			clientAddr := NewSimpleTCPPeerAddress(clientSignVerifier.ID(), "", "8081")
+			for i := 0; i < 20; i++ {
+				message := RandomMessage(protocol.V2, RandomMessageVariant())
+				Expect(serverPool.Send(clientAddr, message)).To(Succeed())
+				var received protocol.MessageOnTheWire
+				Eventually(replies, 3*time.Second).Should(Receive(&received))
+				Expect(received.From.String()).Should(Equal(serverSignVerifier.ID()))
+				Expect(cmp.Equal(message, received.Message, cmpopts.EquateEmpty())).Should(BeTrue())
+			}
+		})
+
+		It("should keep one connection when both peers dial each other at the same time", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer func() {
+				cancel()
+				time.Sleep(200 * time.Millisecond)
+			}()
+
+			signVerifiers := []MockSignVerifier{NewMockSignVerifier(), NewMockSignVerifier()}
+			signVerifiers[0].Whitelist(signVerifiers[1].ID())
+			signVerifiers[1].Whitelist(signVerifiers[0].ID())
+
+			// Initialize both peers with a server that shares their connPool
+			addrs := make([]protocol.PeerAddress, 2)
+			pools := make([]ConnPool, 2)
+			servers := make([]*Server, 2)
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			for i := range signVerifiers {
+				addrs[i] = NewSimpleTCPPeerAddress(signVerifiers[i].ID(), "", fmt.Sprintf("%v", 8080+i))
+				handshaker := handshake.NewNoise(signVerifiers[i])
+				pools[i] = NewConnPool(ConnPoolOptions{Replies: messages, Me: addrs[i].PeerID()}, logrus.New(), handshaker)
+				servers[i] = NewServerWithConnPool(ServerOptions{Host: addrs[i].NetworkAddress().String()}, logrus.New(), handshaker, nil, pools[i])
+				go servers[i].Run(ctx, messages)
+			}
+			time.Sleep(50 * time.Millisecond)
+
+			// Send messages in both directions at the same time
+			phi.ParForAll(pools, func(i int) {
+				defer GinkgoRecover()
+				for j := 0; j < 10; j++ {
+					Expect(pools[i].Send(addrs[1-i], RandomMessage(protocol.V1, RandomMessageVariant()))).To(Succeed())
+				}
+			})
+			for i := 0; i < 20; i++ {
+				Eventually(messages, 3*time.Second).Should(Receive())
+			}
+
+			// The connection dialed by the peer with the greater PeerID is closed.
+			Eventually(func() int64 {
+				return servers[0].Stats().Connections + servers[1].Stats().Connections
+			}, 3*time.Second).Should(Equal(int64(1)))
+		})
+	})
+
+	Context("when using counter sessions", func() {
+		It("should deliver messages across rekeys", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer func() {
+				cancel()
+				time.Sleep(200 * time.Millisecond)
+			}()
+
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+			sessionOptions := handshake.CounterSessionOptions{MaxMessages: 3}
+
+			// Initialize a connPool
+			handshaker := handshake.New(clientSignVerifier, handshake.NewCounterSessionManager(sessionOptions))
+			pool := NewConnPool(ConnPoolOptions{}, logrus.New(), handshaker)
+
+			// Initialize a server
+			serverAddr := NewSimpleTCPPeerAddress(serverSignVerifier.ID(), "", "8080")
+			serverHandshaker := handshake.New(serverSignVerifier, handshake.NewCounterSessionManager(sessionOptions))
+			messages := NewTCPServerWithHandshaker(ctx, ServerOptions{Host: serverAddr.NetworkAddress().String()}, serverHandshaker)
+
+			// Send 20 messages through the connPool and expect the server receives all of them.
+			for i := 0; i < 20; i++ {
+				message := RandomMessage(protocol.V2, RandomMessageVariant())
+				Expect(pool.Send(serverAddr, message)).NotTo(HaveOccurred())
+				var received protocol.MessageOnTheWire
+				Eventually(messages, 3*time.Second).Should(Receive(&received))
+				Expect(cmp.Equal(message, received.Message, cmpopts.EquateEmpty())).Should(BeTrue())
+			}
+		})
+	})
+
 	Context("when trying to connect to a malicious server", func() {
 		Context("when server doesn't respond in time", func() {
 			It("should timeout the handshake process", func() {
@@ -166,9 +489,8 @@ var _ = Describe("Connection pool", func() {
 					pool := NewConnPool(ConnPoolOptions{Timeout: 200 * time.Millisecond}, logrus.New(), handshaker)
 
 					// Initialize a server
-					serverAddr, err := net.ResolveTCPAddr("tcp", ":8080")
-					Expect(err).NotTo(HaveOccurred())
-					options := ServerOptions{Host: serverAddr.String(), RateLimit: -1} // no rate limiting on server
+					serverAddr := NewSimpleTCPPeerAddress(RandomPeerID().String(), "", "8080")
+					options := ServerOptions{Host: serverAddr.NetworkAddress().String(), RateLimit: -1} // no rate limiting on server
 					NewMaliciousTCPServer(ctx, options, clientSignVerifier)
 
 					// Send a message through the connPool and expect the server receives it.
@@ -0,0 +1,239 @@
+package tcp
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/protocol"
+)
+
+// RetryPolicy is used to parameterise how a Client retries messages that
+// cannot be sent. The backoff before each retry doubles from the BaseBackoff
+// up to the MaxBackoff, and a random fraction (up to the Jitter) of it is
+// removed, so that peers do not retry in lockstep. A Client never waits past
+// the Deadline of a message.
+type RetryPolicy struct {
+	MaxAttempts int           `json:"maxAttempts"` // Defaults to 5
+	BaseBackoff time.Duration `json:"baseBackoff"` // Defaults to 250 milliseconds
+	MaxBackoff  time.Duration `json:"maxBackoff"`  // Defaults to 5 seconds
+	Jitter      float64       `json:"jitter"`      // Defaults to 0.2, and negative values disable it
+
+	// Retryable returns true if a message should be sent again after the
+	// error. Defaults to IsRetryable.
+	Retryable func(error) bool `json:"-"`
+}
+
+func (policy *RetryPolicy) setZerosToDefaults() {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = 5
+	}
+	if policy.BaseBackoff <= 0 {
+		policy.BaseBackoff = 250 * time.Millisecond
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = 5 * time.Second
+	}
+	if policy.MaxBackoff < policy.BaseBackoff {
+		policy.MaxBackoff = policy.BaseBackoff
+	}
+	if policy.Jitter == 0 {
+		policy.Jitter = 0.2
+	}
+	if policy.Jitter < 0 {
+		policy.Jitter = 0
+	}
+	if policy.Jitter > 1 {
+		policy.Jitter = 1
+	}
+	if policy.Retryable == nil {
+		policy.Retryable = IsRetryable
+	}
+}
+
+// backoff returns how long to wait before the given retry, starting from 1.
+func (policy RetryPolicy) backoff(retry int) time.Duration {
+	backoff := policy.BaseBackoff
+	for i := 1; i < retry && backoff < policy.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > policy.MaxBackoff {
+		backoff = policy.MaxBackoff
+	}
+	return backoff - time.Duration(policy.Jitter*rand.Float64()*float64(backoff))
+}
+
+// IsRetryable returns false for errors that will not go away by sending the
+// message again: when the address belongs to another peer (or is being
+// intercepted), when the peer is not authorized, when the circuit to the peer
+// is open, and when the message is rejected because its variant is not
+// supported or it exceeds the size limits.
+func IsRetryable(err error) bool {
+	switch err := err.(type) {
+	case ErrConnecting:
+		return IsRetryable(err.Err)
+	case handshake.ErrMessageRejected:
+		return IsRetryable(err.Err)
+	case handshake.ErrUnexpectedPeer, handshake.ErrUnauthorizedPeer, ErrCircuitOpen:
+		return false
+	case protocol.ErrMessageVariantIsNotSupported, protocol.ErrMessageLengthIsTooHigh, protocol.ErrDecompressedLengthIsTooHigh:
+		return false
+	default:
+		return true
+	}
+}
+
+// CircuitBreakerOptions are used to parameterise the per-peer circuit breaker
+// of a Client. After FailureThreshold consecutive failures to connect to a
+// peer (an ErrConnecting returned by the ConnPool), messages to the peer fail
+// fast with ErrCircuitOpen. Other errors, such as failures to write to an
+// established connection, are not counted. Once the ResetTimeout has passed,
+// one message is sent to probe the peer: if it is sent, the circuit is closed,
+// and otherwise it stays open for another ResetTimeout. Peers that have not
+// failed for longer than the ResetTimeout are forgotten.
+type CircuitBreakerOptions struct {
+	FailureThreshold int           `json:"failureThreshold"` // Defaults to 5, and negative values disable the circuit breaker
+	ResetTimeout     time.Duration `json:"resetTimeout"`     // Defaults to 30 seconds
+}
+
+func (options *CircuitBreakerOptions) setZerosToDefaults() {
+	if options.FailureThreshold == 0 {
+		options.FailureThreshold = 5
+	}
+	if options.ResetTimeout <= 0 {
+		options.ResetTimeout = 30 * time.Second
+	}
+}
+
+// circuit is the state of the circuit to a peer that has failed.
+type circuit struct {
+	failures    int       // Consecutive failures
+	lastFailure time.Time // When the last failure was recorded
+	openUntil   time.Time // When the circuit can be probed, if it is open
+	probing     bool      // True while a probe is being sent
+}
+
+type circuitBreaker struct {
+	options CircuitBreakerOptions
+
+	mu        *sync.Mutex
+	circuits  map[string]*circuit
+	lastPrune time.Time
+}
+
+func newCircuitBreaker(options CircuitBreakerOptions) *circuitBreaker {
+	return &circuitBreaker{
+		options: options,
+
+		mu:       new(sync.Mutex),
+		circuits: map[string]*circuit{},
+	}
+}
+
+// allow returns ErrCircuitOpen if messages to the peer must fail fast.
+// Otherwise, the outcome of sending the message must be recorded.
+func (breaker *circuitBreaker) allow(peerID protocol.PeerID, now time.Time) error {
+	if breaker.options.FailureThreshold < 0 {
+		return nil
+	}
+
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	c, ok := breaker.circuits[peerID.String()]
+	if !ok || c.failures < breaker.options.FailureThreshold {
+		return nil
+	}
+	if c.probing || now.Before(c.openUntil) {
+		return NewErrCircuitOpen(peerID)
+	}
+	c.probing = true
+	return nil
+}
+
+// record the outcome of sending a message to the peer. Only an ErrConnecting
+// counts as a failure.
+func (breaker *circuitBreaker) record(peerID protocol.PeerID, now time.Time, err error) {
+	if breaker.options.FailureThreshold < 0 {
+		return
+	}
+
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	if err == nil {
+		delete(breaker.circuits, peerID.String())
+		return
+	}
+	c, ok := breaker.circuits[peerID.String()]
+	if _, failed := err.(ErrConnecting); !failed {
+		// The outcome says nothing about whether the peer can be connected
+		// to, so the circuit is left as it is (and can be probed again).
+		if ok {
+			c.probing = false
+		}
+		return
+	}
+	if !ok {
+		breaker.prune(now)
+		c = new(circuit)
+		breaker.circuits[peerID.String()] = c
+	}
+	c.failures++
+	c.lastFailure = now
+	c.probing = false
+	if c.failures >= breaker.options.FailureThreshold {
+		c.openUntil = now.Add(breaker.options.ResetTimeout)
+	}
+}
+
+// prune the circuits of peers that have not failed for longer than the
+// ResetTimeout. It does nothing if it has already pruned within the last
+// ResetTimeout. The mutex must be held.
+func (breaker *circuitBreaker) prune(now time.Time) {
+	if now.Sub(breaker.lastPrune) < breaker.options.ResetTimeout {
+		return
+	}
+	breaker.lastPrune = now
+	for peerID, c := range breaker.circuits {
+		if !c.probing && now.Sub(c.lastFailure) > breaker.options.ResetTimeout {
+			delete(breaker.circuits, peerID)
+		}
+	}
+}
+
+// ErrConnecting is returned by a ConnPool when it cannot dial a peer, or cannot
+// complete the handshake with it. Err is the error that caused it.
+type ErrConnecting struct {
+	error
+	PeerID protocol.PeerID
+	Err    error
+}
+
+// NewErrConnecting creates a new error which is returned when a connection to
+// the given peer cannot be established.
+func NewErrConnecting(peerID protocol.PeerID, err error) error {
+	return ErrConnecting{
+		error:  fmt.Errorf("error connecting to %v: %v", peerID, err),
+		PeerID: peerID,
+		Err:    err,
+	}
+}
+
+// ErrCircuitOpen is returned when a message is not sent to a peer, because
+// sending messages to the peer has failed too many times.
+type ErrCircuitOpen struct {
+	error
+	PeerID protocol.PeerID
+}
+
+// NewErrCircuitOpen creates a new error which is returned when the circuit to
+// the given peer is open.
+func NewErrCircuitOpen(peerID protocol.PeerID) error {
+	return ErrCircuitOpen{
+		error:  fmt.Errorf("circuit to %v is open", peerID),
+		PeerID: peerID,
+	}
+}
@@ -0,0 +1,296 @@
+package tcp_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/tcp"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// failingPool is a ConnPool that fails to send the given number of messages
+// (or all of them, if it is negative), and records when it was used.
+type failingPool struct {
+	mu       *sync.Mutex
+	failures int
+	err      error
+	attempts []time.Time
+}
+
+func newFailingPool(failures int, err error) *failingPool {
+	return &failingPool{
+		mu:       new(sync.Mutex),
+		failures: failures,
+		err:      err,
+	}
+}
+
+func (pool *failingPool) Send(to protocol.PeerAddress, m protocol.Message) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.attempts = append(pool.attempts, time.Now())
+	if pool.failures == 0 {
+		return nil
+	}
+	if pool.failures > 0 {
+		pool.failures--
+	}
+	return pool.err
+}
+
+func (pool *failingPool) Register(conn net.Conn, peerID protocol.PeerID, session protocol.Session) {
+}
+
+func (pool *failingPool) Deregister(peerID protocol.PeerID, conn net.Conn) {
+}
+
+func (pool *failingPool) setFailures(failures int) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.failures = failures
+}
+
+func (pool *failingPool) numAttempts() int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	return len(pool.attempts)
+}
+
+var _ = Describe("Client", func() {
+
+	// send a message through the client, and return the outcome.
+	send := func(ctx context.Context, messages chan<- protocol.MessageOnTheWire, deadline time.Time) error {
+		results := make(chan error, 1)
+		messages <- protocol.MessageOnTheWire{
+			To:       RandomAddress(),
+			Message:  RandomMessage(protocol.V1, RandomMessageVariant()),
+			Result:   results,
+			Deadline: deadline,
+		}
+		var err error
+		Eventually(results, 5*time.Second).Should(Receive(&err))
+		return err
+	}
+
+	run := func(ctx context.Context, options ClientOptions, pool ConnPool) chan protocol.MessageOnTheWire {
+		messages := make(chan protocol.MessageOnTheWire, 16)
+		go NewClientWithOptions(options, logrus.New(), pool).Run(ctx, messages)
+		return messages
+	}
+
+	Context("when retrying messages", func() {
+		It("should retry until the message is sent", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			pool := newFailingPool(2, errors.New("unreachable"))
+			messages := run(ctx, ClientOptions{RetryPolicy: RetryPolicy{BaseBackoff: 10 * time.Millisecond}}, pool)
+
+			Expect(send(ctx, messages, time.Time{})).To(Succeed())
+			Expect(pool.numAttempts()).Should(Equal(3))
+		})
+
+		It("should give up after the max attempts", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			pool := newFailingPool(-1, errors.New("unreachable"))
+			options := ClientOptions{
+				RetryPolicy:    RetryPolicy{MaxAttempts: 3, BaseBackoff: 10 * time.Millisecond},
+				CircuitBreaker: CircuitBreakerOptions{FailureThreshold: -1},
+			}
+			messages := run(ctx, options, pool)
+
+			err := send(ctx, messages, time.Time{})
+			Expect(err).Should(BeAssignableToTypeOf(protocol.ErrMessageNotDelivered{}))
+			Expect(pool.numAttempts()).Should(Equal(3))
+		})
+
+		It("should back off exponentially up to the max backoff", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			pool := newFailingPool(-1, errors.New("unreachable"))
+			options := ClientOptions{
+				RetryPolicy:    RetryPolicy{MaxAttempts: 5, BaseBackoff: 50 * time.Millisecond, MaxBackoff: 100 * time.Millisecond, Jitter: -1},
+				CircuitBreaker: CircuitBreakerOptions{FailureThreshold: -1},
+			}
+			messages := run(ctx, options, pool)
+
+			Expect(send(ctx, messages, time.Time{})).NotTo(Succeed())
+			pool.mu.Lock()
+			defer pool.mu.Unlock()
+			Expect(pool.attempts).Should(HaveLen(5))
+			for i, min := range []time.Duration{50, 100, 100, 100} {
+				Expect(pool.attempts[i+1].Sub(pool.attempts[i])).Should(BeNumerically(">=", min*time.Millisecond))
+			}
+			Expect(pool.attempts[4].Sub(pool.attempts[0])).Should(BeNumerically("<", time.Second))
+		})
+
+		It("should not retry errors that are not retryable", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			fatal := errors.New("fatal")
+			pool := newFailingPool(-1, fatal)
+			options := ClientOptions{
+				RetryPolicy: RetryPolicy{
+					BaseBackoff: 10 * time.Millisecond,
+					Retryable:   func(err error) bool { return err != fatal },
+				},
+			}
+			messages := run(ctx, options, pool)
+
+			Expect(send(ctx, messages, time.Time{})).NotTo(Succeed())
+			Expect(pool.numAttempts()).Should(Equal(1))
+		})
+
+		nonRetryable := map[string]error{
+			"ErrUnexpectedPeer":               NewErrConnecting(RandomPeerID(), handshake.NewErrUnexpectedPeer(RandomPeerID(), RandomPeerID())),
+			"ErrUnauthorizedPeer":             NewErrConnecting(RandomPeerID(), handshake.NewErrUnauthorizedPeer(RandomPeerID(), errors.New("denied"))),
+			"ErrMessageVariantIsNotSupported": handshake.NewErrMessageRejected(protocol.NewErrMessageVariantIsNotSupported(protocol.Ping)),
+			"ErrMessageLengthIsTooHigh":       handshake.NewErrMessageRejected(protocol.NewErrMessageLengthIsTooHigh(128, 64, protocol.Cast)),
+			"ErrDecompressedLengthIsTooHigh":  protocol.NewErrDecompressedLengthIsTooHigh(protocol.Snappy, 128, 64),
+		}
+		for name, err := range nonRetryable {
+			name, err := name, err
+
+			It("should not retry an "+name, func() {
+				Expect(IsRetryable(err)).Should(BeFalse())
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				pool := newFailingPool(-1, err)
+				messages := run(ctx, ClientOptions{RetryPolicy: RetryPolicy{BaseBackoff: 10 * time.Millisecond}}, pool)
+
+				Expect(send(ctx, messages, time.Time{})).NotTo(Succeed())
+				Consistently(pool.numAttempts, 100*time.Millisecond).Should(Equal(1))
+			})
+		}
+
+		It("should not retry past the deadline of the message", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			pool := newFailingPool(-1, errors.New("unreachable"))
+			messages := run(ctx, ClientOptions{RetryPolicy: RetryPolicy{BaseBackoff: time.Second}}, pool)
+
+			start := time.Now()
+			Expect(send(ctx, messages, start.Add(200*time.Millisecond))).NotTo(Succeed())
+			Expect(time.Since(start)).Should(BeNumerically("<", 500*time.Millisecond))
+			Expect(pool.numAttempts()).Should(Equal(1))
+		})
+	})
+
+	Context("when a peer keeps failing", func() {
+		It("should fail fast until the circuit is probed", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			pool := newFailingPool(-1, NewErrConnecting(RandomPeerID(), errors.New("unreachable")))
+			options := ClientOptions{
+				RetryPolicy:    RetryPolicy{MaxAttempts: 1},
+				CircuitBreaker: CircuitBreakerOptions{FailureThreshold: 2, ResetTimeout: 300 * time.Millisecond},
+			}
+			messages := run(ctx, options, pool)
+			to := RandomAddress()
+			sendTo := func() error {
+				results := make(chan error, 1)
+				messages <- protocol.MessageOnTheWire{
+					To:      to,
+					Message: RandomMessage(protocol.V1, RandomMessageVariant()),
+					Result:  results,
+				}
+				var err error
+				Eventually(results).Should(Receive(&err))
+				return err
+			}
+
+			// The circuit opens after two failures.
+			Expect(sendTo()).NotTo(Succeed())
+			Expect(sendTo()).NotTo(Succeed())
+			Expect(sendTo()).NotTo(Succeed())
+			Expect(pool.numAttempts()).Should(Equal(2))
+
+			// Messages to other peers are still sent.
+			Expect(send(ctx, messages, time.Time{})).NotTo(Succeed())
+			Expect(pool.numAttempts()).Should(Equal(3))
+
+			// A failed probe opens the circuit again.
+			time.Sleep(300 * time.Millisecond)
+			Expect(sendTo()).NotTo(Succeed())
+			Expect(sendTo()).NotTo(Succeed())
+			Expect(pool.numAttempts()).Should(Equal(4))
+
+			// A successful probe closes the circuit.
+			pool.setFailures(0)
+			time.Sleep(300 * time.Millisecond)
+			Expect(sendTo()).To(Succeed())
+			Expect(sendTo()).To(Succeed())
+			Expect(pool.numAttempts()).Should(Equal(6))
+		})
+
+		It("should only count failures to connect", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			options := ClientOptions{
+				RetryPolicy:    RetryPolicy{MaxAttempts: 1},
+				CircuitBreaker: CircuitBreakerOptions{FailureThreshold: 2, ResetTimeout: time.Minute},
+			}
+			for _, err := range []error{ErrTooManyConnections, errors.New("error writing message")} {
+				pool := newFailingPool(-1, err)
+				messages := run(ctx, options, pool)
+				to := RandomAddress()
+				for i := 0; i < 4; i++ {
+					results := make(chan error, 1)
+					messages <- protocol.MessageOnTheWire{
+						To:      to,
+						Message: RandomMessage(protocol.V1, RandomMessageVariant()),
+						Result:  results,
+					}
+					Eventually(results).Should(Receive(HaveOccurred()))
+				}
+				Expect(pool.numAttempts()).Should(Equal(4))
+			}
+		})
+
+		It("should forget peers that have not failed for the reset timeout", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			pool := newFailingPool(-1, NewErrConnecting(RandomPeerID(), errors.New("unreachable")))
+			options := ClientOptions{
+				RetryPolicy:    RetryPolicy{MaxAttempts: 1},
+				CircuitBreaker: CircuitBreakerOptions{FailureThreshold: 2, ResetTimeout: 100 * time.Millisecond},
+			}
+			messages := run(ctx, options, pool)
+			to := RandomAddress()
+			sendTo := func(to protocol.PeerAddress) error {
+				results := make(chan error, 1)
+				messages <- protocol.MessageOnTheWire{
+					To:      to,
+					Message: RandomMessage(protocol.V1, RandomMessageVariant()),
+					Result:  results,
+				}
+				var err error
+				Eventually(results).Should(Receive(&err))
+				return err
+			}
+
+			// The first failure is forgotten once another peer fails after
+			// the reset timeout, so the circuit does not open after the
+			// second failure.
+			Expect(sendTo(to)).NotTo(Succeed())
+			time.Sleep(200 * time.Millisecond)
+			Expect(sendTo(RandomAddress())).NotTo(Succeed())
+			Expect(sendTo(to)).NotTo(Succeed())
+			Expect(sendTo(to)).NotTo(Succeed())
+			Expect(pool.numAttempts()).Should(Equal(4))
+		})
+	})
+})
@@ -14,15 +14,38 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// ClientOptions are used to parameterise the behaviour of a Client.
+type ClientOptions struct {
+	RetryPolicy    RetryPolicy           `json:"retryPolicy"`
+	CircuitBreaker CircuitBreakerOptions `json:"circuitBreaker"`
+}
+
+func (options *ClientOptions) setZerosToDefaults() {
+	options.RetryPolicy.setZerosToDefaults()
+	options.CircuitBreaker.setZerosToDefaults()
+}
+
 type Client struct {
-	logger logrus.FieldLogger
-	pool   ConnPool
+	logger  logrus.FieldLogger
+	pool    ConnPool
+	policy  RetryPolicy
+	breaker *circuitBreaker
 }
 
 func NewClient(logger logrus.FieldLogger, pool ConnPool) *Client {
+	return NewClientWithOptions(ClientOptions{}, logger, pool)
+}
+
+// NewClientWithOptions returns a Client that retries messages using the
+// RetryPolicy, and stops sending messages to peers that keep failing using
+// the CircuitBreaker.
+func NewClientWithOptions(options ClientOptions, logger logrus.FieldLogger, pool ConnPool) *Client {
+	options.setZerosToDefaults()
 	return &Client{
-		logger: logger,
-		pool:   pool,
+		logger:  logger,
+		pool:    pool,
+		policy:  options.RetryPolicy,
+		breaker: newCircuitBreaker(options.CircuitBreaker),
 	}
 }
 
@@ -32,20 +55,67 @@ func (client *Client) Run(ctx context.Context, messages protocol.MessageReceiver
 		case <-ctx.Done():
 			return
 		case messageOtw := <-messages:
-			go client.handleMessageOnTheWire(messageOtw)
+			go client.handleMessageOnTheWire(ctx, messageOtw)
 		}
 	}
 }
 
-func (client *Client) handleMessageOnTheWire(message protocol.MessageOnTheWire) {
-	for i := 0; i < 5; i++ {
-		err := client.pool.Send(message.To.NetworkAddress(), message.Message)
+// handleMessageOnTheWire sends the message, retrying it using the RetryPolicy,
+// and reports the outcome to the Result of the message.
+func (client *Client) handleMessageOnTheWire(ctx context.Context, message protocol.MessageOnTheWire) {
+	// Stop retrying at the deadline of the sender.
+	if !message.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, message.Deadline)
+		defer cancel()
+	}
+
+	peerID := message.To.PeerID()
+	err := client.send(ctx, message)
+	if err == nil {
+		message.ReportResult(nil)
+		return
+	}
+	message.ReportResult(protocol.NewErrMessageNotDelivered(peerID, err))
+}
+
+// send the message, and return the error of the last attempt.
+func (client *Client) send(ctx context.Context, message protocol.MessageOnTheWire) error {
+	peerID := message.To.PeerID()
+	var err error
+	for attempt := 1; attempt <= client.policy.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			// Give up if the message cannot be retried before the deadline.
+			backoff := client.policy.backoff(attempt - 1)
+			if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err = client.breaker.allow(peerID, time.Now()); err != nil {
+			client.logger.Debugf("error send %v message to %v: %v", message.Message.Variant, message.To.NetworkAddress(), err)
+			return err
+		}
+		err = client.pool.Send(message.To, message.Message)
+		client.breaker.record(peerID, time.Now(), err)
 		if err == nil {
-			return
+			return nil
+		}
+		if !client.policy.Retryable(err) {
+			client.logger.Warnf("error send %v message to %v: %v", message.Message.Variant, message.To.NetworkAddress(), err)
+			return err
 		}
 		client.logger.Debugf("error send %v message to %v: %v", message.Message.Variant, message.To.NetworkAddress(), err)
-		time.Sleep(time.Second)
 	}
+	return err
 }
 
 type ServerOptions struct {
@@ -53,6 +123,15 @@ type ServerOptions struct {
 	Timeout        time.Duration // Timeout when establish a connection
 	RateLimit      time.Duration // Minimum time interval before accepting connection from same peer.
 	MaxConnections int           // Max connections allowed.
+
+	// SizeLimits bound the length of incoming messages. They should be the
+	// same SizeLimits that are used by the Handshaker. Zero values default to
+	// the values of protocol.DefaultSizeLimits.
+	SizeLimits protocol.SizeLimits
+
+	// ReplyCapacity is the number of replies that can be buffered for each
+	// incoming connection. Defaults to 64.
+	ReplyCapacity int
 }
 
 func (options *ServerOptions) setZerosToDefaults() {
@@ -68,19 +147,48 @@ func (options *ServerOptions) setZerosToDefaults() {
 	if options.MaxConnections == 0 {
 		options.MaxConnections = 256
 	}
+	if options.ReplyCapacity == 0 {
+		options.ReplyCapacity = 64
+	}
+	options.SizeLimits.SetZerosToDefaults()
+}
+
+// ServerStats are statistics about the connections accepted by a Server.
+type ServerStats struct {
+	Connections   int64  // Number of open connections
+	RejectedPeers uint64 // Number of peers rejected by the Authorizer of the Handshaker
 }
 
 type Server struct {
 	logger      logrus.FieldLogger
 	options     ServerOptions
 	handshaker  handshake.Handshaker
+	events      protocol.EventSender
+	pool        ConnPool
 	connections int64
+	rejected    uint64
 
 	lastConnAttemptsMu *sync.RWMutex
 	lastConnAttempts   map[string]time.Time
 }
 
+// NewServer returns a Server that establishes sessions using the Handshaker.
 func NewServer(options ServerOptions, logger logrus.FieldLogger, handshaker handshake.Handshaker) *Server {
+	return NewServerWithConnPool(options, logger, handshaker, nil, nil)
+}
+
+// NewServerWithEvents returns a Server that establishes sessions using the
+// Handshaker. Peers that are rejected by the Authorizer of the Handshaker are
+// reported as a protocol.EventPeerRejected through the EventSender (if it is
+// not nil).
+func NewServerWithEvents(options ServerOptions, logger logrus.FieldLogger, handshaker handshake.Handshaker, events protocol.EventSender) *Server {
+	return NewServerWithConnPool(options, logger, handshaker, events, nil)
+}
+
+// NewServerWithConnPool returns a Server that registers the connections that
+// it accepts with the ConnPool (if it is not nil), so that messages sent to
+// remote peers re-use the connections that the peers have dialed.
+func NewServerWithConnPool(options ServerOptions, logger logrus.FieldLogger, handshaker handshake.Handshaker, events protocol.EventSender, pool ConnPool) *Server {
 	if logger == nil {
 		logger = logrus.New()
 	}
@@ -92,6 +200,8 @@ func NewServer(options ServerOptions, logger logrus.FieldLogger, handshaker hand
 		logger:      logger,
 		options:     options,
 		handshaker:  handshaker,
+		events:      events,
+		pool:        pool,
 		connections: 0,
 
 		lastConnAttemptsMu: new(sync.RWMutex),
@@ -99,6 +209,14 @@ func NewServer(options ServerOptions, logger logrus.FieldLogger, handshaker hand
 	}
 }
 
+// Stats returns the current ServerStats. It is safe for concurrent use.
+func (server *Server) Stats() ServerStats {
+	return ServerStats{
+		Connections:   atomic.LoadInt64(&server.connections),
+		RejectedPeers: atomic.LoadUint64(&server.rejected),
+	}
+}
+
 // Run the server until the context is done. The server will continuously listen
 // for new connections, spawning each one into a background goroutine so that it
 // can be handled concurrently.
@@ -168,8 +286,26 @@ func (server *Server) handle(ctx context.Context, conn net.Conn, messages protoc
 	}
 	server.logger.Debugf("new connection with %v takes %v", conn.RemoteAddr().String(), time.Now().Sub(now))
 
+	// Messages sent to the remote peer can also be written through this
+	// connection by the ConnPool.
+	if server.pool != nil {
+		session = newSyncSession(session)
+	}
+
+	// Messages can be written back through the session, if both peers can
+	// write to it.
+	var replies chan protocol.MessageOnTheWire
+	if session.Negotiation().AEAD.IsDuplex() {
+		replies = make(chan protocol.MessageOnTheWire, server.options.ReplyCapacity)
+		done := make(chan struct{})
+		defer close(done)
+		go server.reply(ctx, done, conn, session, replies)
+	}
+
+	registered := false
 	for {
-		sizeLimitedReader := io.LimitReader(conn, 10*1024*1024) // Limit incoming connection reads to 10 MB.
+		// Limit incoming connection reads to the largest message allowed.
+		sizeLimitedReader := io.LimitReader(conn, int64(server.options.SizeLimits.MaxReadLength()))
 		messageOtw, err := session.ReadMessageOnTheWire(sizeLimitedReader)
 
 		if err != nil {
@@ -180,6 +316,18 @@ func (server *Server) handle(ctx context.Context, conn net.Conn, messages protoc
 			return
 		}
 
+		// The session authenticates the sender of every message, so the first
+		// message identifies the remote peer of the connection.
+		if server.pool != nil && !registered && messageOtw.From != nil {
+			server.pool.Register(conn, messageOtw.From, session)
+			defer server.pool.Deregister(messageOtw.From, conn)
+			registered = true
+		}
+
+		if replies != nil {
+			messageOtw.Reply = replies
+		}
+
 		select {
 		case <-ctx.Done():
 			return
@@ -188,6 +336,43 @@ func (server *Server) handle(ctx context.Context, conn net.Conn, messages protoc
 	}
 }
 
+// reply writes messages back through the session of an incoming connection,
+// until the connection is closed.
+func (server *Server) reply(ctx context.Context, done <-chan struct{}, conn net.Conn, session protocol.Session, replies <-chan protocol.MessageOnTheWire) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case messageOtw := <-replies:
+			if err := session.WriteMessage(conn, messageOtw.Message); err != nil {
+				server.logger.Errorf("error writing reply to %v: %v", conn.RemoteAddr().String(), err)
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// reject records a peer that has been rejected by the Authorizer.
+func (server *Server) reject(ctx context.Context, err handshake.ErrUnauthorizedPeer) {
+	atomic.AddUint64(&server.rejected, 1)
+	server.logger.Warnf("rejected peer=%v: %v", err.PeerID, err.Reason)
+	if server.events == nil {
+		return
+	}
+	event := protocol.EventPeerRejected{
+		Time:   time.Now(),
+		PeerID: err.PeerID,
+		Reason: err.Reason,
+	}
+	select {
+	case <-ctx.Done():
+	case server.events <- event:
+	}
+}
+
 func (server *Server) allowRateLimit(conn net.Conn) bool {
 	server.lastConnAttemptsMu.Lock()
 	defer server.lastConnAttemptsMu.Unlock()
@@ -222,6 +407,9 @@ func (server *Server) establishSession(ctx context.Context, conn net.Conn) (prot
 
 	session, err := server.handshaker.AcceptHandshake(handshakeCtx, conn)
 	if err != nil {
+		if err, ok := err.(handshake.ErrUnauthorizedPeer); ok {
+			server.reject(ctx, err)
+		}
 		return nil, fmt.Errorf("bad handshake with %v: %v", conn.RemoteAddr().String(), err)
 	}
 
@@ -13,6 +13,7 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/renproject/aw/handshake"
 	"github.com/renproject/aw/protocol"
 	"github.com/sirupsen/logrus"
 )
@@ -20,7 +21,7 @@ import (
 var _ = Describe("TCP client and server", func() {
 
 	sendRandomMessage := func(messageSender protocol.MessageSender, to protocol.PeerAddress) protocol.Message {
-		message := RandomMessage(protocol.V1, RandomMessageVariant())
+		message := RandomMessage(protocol.V2, RandomMessageVariant())
 		messageOtw := protocol.MessageOnTheWire{
 			To:      to,
 			Message: message,
@@ -52,20 +53,74 @@ var _ = Describe("TCP client and server", func() {
 			messageSender := NewTCPClient(ctx, ConnPoolOptions{}, clientSignVerifier)
 
 			// Initialize a server
-			serverAddr := NewSimpleTCPPeerAddress(RandomPeerID().String(), "", "8080")
+			serverSignVerifier := NewMockSignVerifier()
+			serverAddr := NewSimpleTCPPeerAddress(serverSignVerifier.ID(), "", "8080")
 			options := ServerOptions{Host: serverAddr.NetworkAddress().String()}
-			messageReceiver := NewTCPServer(ctx, options, clientSignVerifier)
+			messageReceiver := NewTCPServer(ctx, options, serverSignVerifier, clientSignVerifier)
 
 			// Send a message through the messageSender and expect the server receives it.
 			test := func() bool {
 				message := sendRandomMessage(messageSender, serverAddr)
 				var received protocol.MessageOnTheWire
 				Eventually(messageReceiver, 3*time.Second).Should(Receive(&received))
+				// Sessions that use lockstep nonces cannot be written by the
+				// server.
+				Expect(received.Reply).Should(BeNil())
 				return cmp.Equal(message, received.Message, cmpopts.EquateEmpty())
 			}
 
 			Expect(quick.Check(test, nil)).NotTo(HaveOccurred())
 		})
+
+		It("should report the result of sending the message", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Initialize a client
+			clientSignVerifier := NewMockSignVerifier()
+			messageSender := NewTCPClient(ctx, ConnPoolOptions{}, clientSignVerifier)
+
+			// Initialize a server
+			serverSignVerifier := NewMockSignVerifier()
+			serverAddr := NewSimpleTCPPeerAddress(serverSignVerifier.ID(), "", "8080")
+			options := ServerOptions{Host: serverAddr.NetworkAddress().String()}
+			messageReceiver := NewTCPServer(ctx, options, serverSignVerifier, clientSignVerifier)
+
+			results := make(chan error, 1)
+			messageSender <- protocol.MessageOnTheWire{
+				To:      serverAddr,
+				Message: RandomMessage(protocol.V1, RandomMessageVariant()),
+				Result:  results,
+			}
+			Eventually(messageReceiver, 3*time.Second).Should(Receive())
+			var err error
+			Eventually(results, 3*time.Second).Should(Receive(&err))
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("should report an error if the message cannot be sent", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Initialize a client, and stop it while it is retrying.
+			clientSignVerifier := NewMockSignVerifier()
+			clientCtx, clientCancel := context.WithTimeout(ctx, 500*time.Millisecond)
+			defer clientCancel()
+			messageSender := NewTCPClient(clientCtx, ConnPoolOptions{}, clientSignVerifier)
+
+			// Nothing is listening on the address.
+			serverAddr := NewSimpleTCPPeerAddress(NewMockSignVerifier().ID(), "", "8081")
+			results := make(chan error, 1)
+			messageSender <- protocol.MessageOnTheWire{
+				To:      serverAddr,
+				Message: RandomMessage(protocol.V1, RandomMessageVariant()),
+				Result:  results,
+			}
+			var err error
+			Eventually(results, 3*time.Second).Should(Receive(&err))
+			Expect(err).Should(BeAssignableToTypeOf(protocol.ErrMessageNotDelivered{}))
+			Expect(err.(protocol.ErrMessageNotDelivered).PeerID.Equal(serverAddr.PeerID())).Should(BeTrue())
+		})
 	})
 
 	Context("when reach max number of connection allowed", func() {
@@ -74,9 +129,10 @@ var _ = Describe("TCP client and server", func() {
 			defer cancel()
 
 			// Initialize a server
-			serverAddr := NewSimpleTCPPeerAddress(RandomPeerID().String(), "", "8080")
+			serverSignVerifier := NewMockSignVerifier()
+			serverAddr := NewSimpleTCPPeerAddress(serverSignVerifier.ID(), "", "8080")
 			options := ServerOptions{Host: serverAddr.NetworkAddress().String(), MaxConnections: 1}
-			_ = NewTCPServer(ctx, options)
+			_ = NewTCPServer(ctx, options, serverSignVerifier)
 
 			addr1, err := net.ResolveTCPAddr("tcp", ":10000")
 			Expect(err).NotTo(HaveOccurred())
@@ -99,18 +155,22 @@ var _ = Describe("TCP client and server", func() {
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
 
-			// Initialize a client
+			// Initialize a client that does not retry rejected messages
+			// before the rate limit has expired, because each attempt resets
+			// the rate limit.
 			clientSignVerifier := NewMockSignVerifier()
 			clientCtx, clientCancel := context.WithCancel(ctx)
-			messageSender := NewTCPClient(clientCtx, ConnPoolOptions{}, clientSignVerifier)
+			clientOptions := ClientOptions{RetryPolicy: RetryPolicy{BaseBackoff: time.Second, Jitter: -1}}
+			messageSender := NewTCPClientWithOptions(clientCtx, clientOptions, ConnPoolOptions{}, clientSignVerifier)
 
 			// Initialize a server
-			serverAddr := NewSimpleTCPPeerAddress(RandomPeerID().String(), "", "8080")
+			serverSignVerifier := NewMockSignVerifier()
+			serverAddr := NewSimpleTCPPeerAddress(serverSignVerifier.ID(), "", "8080")
 			options := ServerOptions{
 				Host:      serverAddr.NetworkAddress().String(),
 				RateLimit: 500 * time.Millisecond,
 			}
-			messageReceiver := NewTCPServer(ctx, options, clientSignVerifier)
+			messageReceiver := NewTCPServer(ctx, options, serverSignVerifier, clientSignVerifier)
 
 			// Try to connect and send a message to server
 			_ = sendRandomMessage(messageSender, serverAddr)
@@ -120,7 +180,7 @@ var _ = Describe("TCP client and server", func() {
 			clientCancel()
 
 			// Create a new client and send a message and expect it to be rejected.
-			messageSender = NewTCPClient(ctx, ConnPoolOptions{}, clientSignVerifier)
+			messageSender = NewTCPClientWithOptions(ctx, clientOptions, ConnPoolOptions{}, clientSignVerifier)
 			_ = sendRandomMessage(messageSender, serverAddr)
 			Eventually(messageReceiver).ShouldNot(Receive())
 
@@ -135,6 +195,38 @@ var _ = Describe("TCP client and server", func() {
 		})
 	})
 
+	Context("when the server does not authorize the client", func() {
+		It("should reject the client and emit an event", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Initialize a client
+			clientSignVerifier := NewMockSignVerifier()
+			messageSender := NewTCPClient(ctx, ConnPoolOptions{}, clientSignVerifier)
+
+			// Initialize a server that denies the client
+			serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+			serverAddr := NewSimpleTCPPeerAddress(serverSignVerifier.ID(), "", "8080")
+			options := ServerOptions{Host: serverAddr.NetworkAddress().String(), RateLimit: -1}
+			authorizer := handshake.NewDenylist(SimplePeerID(clientSignVerifier.ID()))
+			handshaker := handshake.NewWithOptions(serverSignVerifier, handshake.Options{Authorizer: authorizer}, handshake.NewGCMSessionManager())
+			events := make(chan protocol.Event, 16)
+			server := NewServerWithEvents(options, logrus.New(), handshaker, events)
+			messageReceiver := make(chan protocol.MessageOnTheWire, 16)
+			go server.Run(ctx, messageReceiver)
+
+			// Send a message and expect the server to reject the client.
+			_ = sendRandomMessage(messageSender, serverAddr)
+			var event protocol.Event
+			Eventually(events, 3*time.Second).Should(Receive(&event))
+			Expect(event).To(BeAssignableToTypeOf(protocol.EventPeerRejected{}))
+			Expect(event.(protocol.EventPeerRejected).PeerID.String()).To(Equal(clientSignVerifier.ID()))
+			Expect(server.Stats().RejectedPeers).To(BeNumerically(">=", 1))
+			Consistently(messageReceiver).ShouldNot(Receive())
+		})
+	})
+
 	Context("when an honest server is dialed by a malicious client", func() {
 		Context("when client doesn't do anything in the handshake process", func() {
 			It("should timeout after sometime", func() {
@@ -146,9 +238,10 @@ var _ = Describe("TCP client and server", func() {
 				messageSender := NewMaliciousTCPClient(ctx, ConnPoolOptions{}, clientSignVerifier)
 
 				// Initialize a server
-				serverAddr := NewSimpleTCPPeerAddress(RandomPeerID().String(), "", "8080")
+				serverSignVerifier := NewMockSignVerifier()
+				serverAddr := NewSimpleTCPPeerAddress(serverSignVerifier.ID(), "", "8080")
 				options := ServerOptions{Host: serverAddr.NetworkAddress().String(), Timeout: 500 * time.Millisecond}
-				messageReceiver := NewTCPServer(ctx, options, clientSignVerifier)
+				messageReceiver := NewTCPServer(ctx, options, serverSignVerifier, clientSignVerifier)
 
 				// Send a message through the messageSender and expect the server reject the connection.
 				_ = sendRandomMessage(messageSender, serverAddr)
@@ -60,9 +60,13 @@ func NewConnection(port string) (io.ReadWriter, io.ReadWriter, func() error, err
 }
 
 func NewTCPClient(ctx context.Context, options tcp.ConnPoolOptions, verifier protocol.SignVerifier) protocol.MessageSender {
+	return NewTCPClientWithOptions(ctx, tcp.ClientOptions{}, options, verifier)
+}
+
+func NewTCPClientWithOptions(ctx context.Context, clientOptions tcp.ClientOptions, options tcp.ConnPoolOptions, verifier protocol.SignVerifier) protocol.MessageSender {
 	messages := make(chan protocol.MessageOnTheWire, 128)
 	handshaker := handshake.New(verifier, handshake.NewGCMSessionManager())
-	client := tcp.NewClient(logrus.New(), tcp.NewConnPool(options, logrus.New(), handshaker))
+	client := tcp.NewClientWithOptions(clientOptions, logrus.New(), tcp.NewConnPool(options, logrus.New(), handshaker))
 
 	go client.Run(ctx, messages)
 	return messages
@@ -77,14 +81,21 @@ func NewMaliciousTCPClient(ctx context.Context, options tcp.ConnPoolOptions, ver
 	return messages
 }
 
-func NewTCPServer(ctx context.Context, options tcp.ServerOptions, clientSignVerifiers ...MockSignVerifier) chan protocol.MessageOnTheWire {
-	signVerifier := NewMockSignVerifier()
+// NewTCPServer runs a server that authenticates itself using the given
+// MockSignVerifier, and trusts the given clients.
+func NewTCPServer(ctx context.Context, options tcp.ServerOptions, signVerifier MockSignVerifier, clientSignVerifiers ...MockSignVerifier) chan protocol.MessageOnTheWire {
 	for _, clientSignVerifier := range clientSignVerifiers {
 		signVerifier.Whitelist(clientSignVerifier.ID())
 		clientSignVerifier.Whitelist(signVerifier.ID())
 	}
 
 	handshaker := handshake.New(signVerifier, handshake.NewGCMSessionManager())
+	return NewTCPServerWithHandshaker(ctx, options, handshaker)
+}
+
+// NewTCPServerWithHandshaker runs a server that uses the given Handshaker, and
+// returns the channel through which it sends received messages.
+func NewTCPServerWithHandshaker(ctx context.Context, options tcp.ServerOptions, handshaker handshake.Handshaker) chan protocol.MessageOnTheWire {
 	server := tcp.NewServer(options, logrus.New(), handshaker)
 	messageSender := make(chan protocol.MessageOnTheWire, 128)
 	go server.Run(ctx, messageSender)
@@ -126,7 +137,7 @@ func NewMalHanshaker(signVerifier protocol.SignVerifier, sessionManager protocol
 	}
 }
 
-func (m *MalHanshaker) Handshake(ctx context.Context, rw io.ReadWriter) (protocol.Session, error) {
+func (m *MalHanshaker) Handshake(ctx context.Context, rw io.ReadWriter, expected protocol.PeerID) (protocol.Session, error) {
 	<-ctx.Done()
 	return nil, nil
 }
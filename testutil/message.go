@@ -9,7 +9,7 @@ import (
 
 func InvalidMessageVersion() protocol.MessageVersion {
 	version := protocol.V1
-	for version == protocol.V1 {
+	for protocol.ValidateMessageVersion(version) == nil {
 		version = protocol.MessageVersion(rand.Intn(math.MaxUint16))
 	}
 	return version
@@ -50,13 +50,7 @@ func RandomMessageBody() protocol.MessageBody {
 }
 
 func RandomMessageVariant() protocol.MessageVariant {
-	allVariants := []protocol.MessageVariant{
-		protocol.Ping,
-		protocol.Pong,
-		protocol.Cast,
-		protocol.Multicast,
-		protocol.Broadcast,
-	}
+	allVariants := protocol.MessageVariants()
 	return allVariants[rand.Intn(len(allVariants))]
 }
 
@@ -64,10 +58,13 @@ func RandomMessage(version protocol.MessageVersion, variant protocol.MessageVari
 	body := RandomMessageBody()
 	groupID := protocol.NilGroupID
 	length := 8
-	if variant == protocol.Multicast || variant == protocol.Broadcast {
+	if variant.HasGroupID() {
 		groupID = RandomGroupID()
 		length = 40
 	}
+	if version == protocol.V2 {
+		length += 2 // Empty extension area
+	}
 	return protocol.Message{
 		Length:  protocol.MessageLength(length + len(body)),
 		Version: version,
@@ -71,7 +71,7 @@ func ReadChannel(ctx context.Context, events chan protocol.Event) (protocol.Even
 		select {
 		case event := <-events:
 			switch e := event.(type) {
-			case protocol.EventPeerChanged:
+			case protocol.EventPeerChanged, protocol.EventPeerRejected:
 				continue
 			case protocol.EventMessageReceived:
 				return e, true
@@ -84,6 +84,42 @@ func ReadChannel(ctx context.Context, events chan protocol.Event) (protocol.Even
 	}
 }
 
+func ReadStream(ctx context.Context, events chan protocol.Event) (protocol.EventStreamReceived, bool) {
+	for {
+		select {
+		case event := <-events:
+			switch e := event.(type) {
+			case protocol.EventPeerChanged, protocol.EventPeerRejected, protocol.EventMessageReceived:
+				continue
+			case protocol.EventStreamReceived:
+				return e, true
+			default:
+				panic("unknown event type")
+			}
+		case <-ctx.Done():
+			return protocol.EventStreamReceived{}, false
+		}
+	}
+}
+
+func ReadReliable(ctx context.Context, events chan protocol.Event) (protocol.EventReliableDelivered, bool) {
+	for {
+		select {
+		case event := <-events:
+			switch e := event.(type) {
+			case protocol.EventPeerChanged, protocol.EventPeerRejected, protocol.EventMessageReceived:
+				continue
+			case protocol.EventReliableDelivered:
+				return e, true
+			default:
+				panic("unknown event type")
+			}
+		case <-ctx.Done():
+			return protocol.EventReliableDelivered{}, false
+		}
+	}
+}
+
 func EmptyChannel(events chan protocol.Event) {
 	for {
 		select {